@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/mikolajb/emailserv/internal/apikey"
+	"github.com/mikolajb/emailserv/internal/callbacks"
+	"github.com/mikolajb/emailserv/internal/requestid"
+	"go.uber.org/zap"
+)
+
+// CallbackRequest is a request registering a callback
+type CallbackRequest struct {
+	// URL receives events
+	URL string `json:"url"`
+
+	// MessageID limits a callback to a single message, optional
+	MessageID string `json:"message_id,omitempty"`
+}
+
+// CallbacksResponse is a list of callbacks of a key
+type CallbacksResponse struct {
+	Callbacks []*callbacks.Registration `json:"callbacks"`
+}
+
+// CallbackLogResponse is a list of delivery attempts of a key
+type CallbackLogResponse struct {
+	Log []*callbacks.LogEntry `json:"log"`
+}
+
+// DeadLettersResponse is a list of events which could not be delivered
+type DeadLettersResponse struct {
+	DeadLetters []*callbacks.Delivery `json:"dead_letters"`
+}
+
+// callbacksHandler manages callbacks of an API key
+// GET /callbacks lists callbacks
+// POST /callbacks registers a callback
+// DELETE /callbacks/{id} removes a callback
+// GET /callbacks/log lists delivery attempts
+// GET /callbacks/dead_letters lists events which could not be delivered
+type callbacksHandler struct {
+	logger    *zap.Logger
+	keys      apikey.Keys
+	callbacks *callbacks.Dispatcher
+}
+
+func (h callbacksHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	requestID := requestid.FromRequest(r)
+	logger := h.logger.With(zap.String("request_id", requestID))
+	w.Header().Set(requestid.Header, requestID)
+
+	key, ok := h.keys.Name(r.Header.Get("Authorization"))
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	logger = logger.With(zap.String("api_key", key))
+
+	jsonEncoder := json.NewEncoder(w)
+	w.Header().Set("Content-Type", "application/json")
+	path := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/callbacks"), "/")
+
+	internalError := func(msg string, err error) {
+		logger.Error(msg, zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		jsonEncoder.Encode(Response{
+			Message:   "Internal server error",
+			Error:     true,
+			RequestID: requestID,
+		})
+	}
+
+	switch {
+	case r.Method == "GET" && path == "":
+		registrations, err := h.callbacks.Registrations(key)
+		if err != nil {
+			internalError("cannot list callbacks", err)
+			return
+		}
+		jsonEncoder.Encode(CallbacksResponse{
+			Callbacks: registrations,
+		})
+	case r.Method == "GET" && path == "log":
+		entries, err := h.callbacks.Log(key)
+		if err != nil {
+			internalError("cannot list callback log", err)
+			return
+		}
+		jsonEncoder.Encode(CallbackLogResponse{
+			Log: entries,
+		})
+	case r.Method == "GET" && path == "dead_letters":
+		deadLetters, err := h.callbacks.DeadLetters(key)
+		if err != nil {
+			internalError("cannot list dead letters", err)
+			return
+		}
+		jsonEncoder.Encode(DeadLettersResponse{
+			DeadLetters: deadLetters,
+		})
+	case r.Method == "POST" && path == "":
+		var request CallbackRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			logger.Debug("error while decoding callback", zap.Error(err))
+			w.WriteHeader(http.StatusBadRequest)
+			jsonEncoder.Encode(Response{
+				Message:   "Invalid JSON format",
+				Error:     true,
+				RequestID: requestID,
+			})
+			return
+		}
+		if err := callbacks.ValidateURL(request.URL); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			jsonEncoder.Encode(Response{
+				Message: "Request not valid",
+				ValidationErrors: []*ValidationError{{
+					Field: "url",
+					Error: err.Error(),
+				}},
+				Error:     true,
+				RequestID: requestID,
+			})
+			return
+		}
+		registration, err := h.callbacks.Register(key, request.MessageID, request.URL)
+		if err != nil {
+			internalError("cannot register callback", err)
+			return
+		}
+		logger.Info("callback registered", zap.String("callback_id", registration.ID))
+		w.WriteHeader(http.StatusCreated)
+		jsonEncoder.Encode(registration)
+	case r.Method == "DELETE" && path != "":
+		found, err := h.callbacks.Unregister(key, path)
+		if err != nil {
+			internalError("cannot remove callback", err)
+			return
+		}
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			jsonEncoder.Encode(Response{
+				Message:   "Callback not found",
+				Error:     true,
+				RequestID: requestID,
+			})
+			return
+		}
+		logger.Info("callback removed", zap.String("callback_id", path))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mikolajb/emailserv/internal/apikey"
+	"github.com/mikolajb/emailserv/internal/callbacks"
+	"github.com/mikolajb/emailserv/internal/emailclient"
+	"github.com/mikolajb/emailserv/internal/emailmanager"
+	"github.com/mikolajb/emailserv/internal/events"
+	"github.com/mikolajb/emailserv/internal/messages"
+	"github.com/mikolajb/emailserv/internal/storage"
+	"github.com/mikolajb/emailserv/internal/suppression"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestCallbacksHandler(t *testing.T) {
+	keys := apikey.Keys{"abc": "billing", "def": "marketing"}
+	dispatcher := callbacks.NewDispatcher(zaptest.NewLogger(t), storage.NewMemoryStore(), http.DefaultClient)
+	h := callbacksHandler{
+		logger:    zaptest.NewLogger(t),
+		keys:      keys,
+		callbacks: dispatcher,
+	}
+
+	do := func(method, path, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", token)
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := do("GET", "/callbacks", "xyz", ""); rr.Code != http.StatusUnauthorized {
+		t.Errorf("wrong status code, expected: %d, got: %d", http.StatusUnauthorized, rr.Code)
+	}
+	if rr := do("POST", "/callbacks", "abc", `{"url": "ftp://example.com"}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("wrong status code, expected: %d, got: %d", http.StatusBadRequest, rr.Code)
+	}
+
+	rr := do("POST", "/callbacks", "abc", `{"url": "https://example.com/callback"}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("wrong status code, expected: %d, got: %d", http.StatusCreated, rr.Code)
+	}
+	var registration callbacks.Registration
+	if err := json.NewDecoder(rr.Body).Decode(&registration); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if registration.ID == "" || registration.Secret == "" || registration.Key != "billing" {
+		t.Errorf("wrong registration: %+v", registration)
+	}
+
+	for token, expected := range map[string]int{"abc": 1, "def": 0} {
+		rr := do("GET", "/callbacks", token, "")
+		var response CallbacksResponse
+		if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		if len(response.Callbacks) != expected {
+			t.Errorf("expected %d callbacks of %s, got: %+v", expected, keys[token], response.Callbacks)
+		}
+	}
+
+	if rr := do("DELETE", "/callbacks/"+registration.ID, "def", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("wrong status code, expected: %d, got: %d", http.StatusNotFound, rr.Code)
+	}
+	if rr := do("DELETE", "/callbacks/"+registration.ID, "abc", ""); rr.Code != http.StatusNoContent {
+		t.Errorf("wrong status code, expected: %d, got: %d", http.StatusNoContent, rr.Code)
+	}
+	if rr := do("GET", "/callbacks/log", "abc", ""); rr.Code != http.StatusOK {
+		t.Errorf("wrong status code, expected: %d, got: %d", http.StatusOK, rr.Code)
+	}
+}
+
+func TestEmailControllerHandler_callbacks(t *testing.T) {
+	var mu sync.Mutex
+	var received []callbacks.Event
+	var signatures []string
+	var bodies [][]byte
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		body, _ := ioutil.ReadAll(r.Body)
+		var e callbacks.Event
+		json.Unmarshal(body, &e)
+		received = append(received, e)
+		signatures = append(signatures, r.Header.Get(callbacks.SignatureHeader))
+		bodies = append(bodies, body)
+	}))
+	defer receiver.Close()
+
+	logger := zaptest.NewLogger(t)
+	store := storage.NewMemoryStore()
+	messageStore := messages.NewStore(store)
+	dispatcher := callbacks.NewDispatcher(logger, store, http.DefaultClient)
+
+	handler := httpHandler{
+		logger: logger,
+		emailManager: &emailmanager.EmailManager{
+			Logger:        logger,
+			EmailClients:  []emailclient.EmailClient{emailclient.NewNopClient(logger)},
+			ClientTimeout: 100 * time.Millisecond,
+		},
+		keys:      apikey.Keys{"abc": "billing"},
+		messages:  messageStore,
+		callbacks: dispatcher,
+	}
+
+	message := &bytes.Buffer{}
+	json.NewEncoder(message).Encode(&Message{
+		Sender:      "sender@example.com",
+		Recipients:  []string{"recipient@example.com"},
+		CallbackURL: receiver.URL,
+	})
+	req := httptest.NewRequest("POST", "/email", message)
+	req.Header.Add("Authorization", "abc")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("wrong status code, expected: %d, got: %d", http.StatusCreated, rr.Code)
+	}
+	var response Response
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if response.Callback == nil || response.Callback.MessageID != response.MessageID {
+		t.Fatalf("callback should be registered for a message: %+v", response.Callback)
+	}
+
+	// a delivery reported by a provider is passed to the same callback
+	processor := &eventProcessor{
+		logger:       logger,
+		messages:     messageStore,
+		suppressions: suppression.NewList(store),
+		callbacks:    dispatcher,
+	}
+	err := processor.process([]events.Event{{
+		Type:      events.TypeDelivered,
+		Provider:  "nop",
+		MessageID: response.MessageID,
+		Recipient: "recipient@example.com",
+	}})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	if _, err := dispatcher.DeliverDue(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 2 {
+		t.Fatalf("expected 2 events, got: %+v", received)
+	}
+	for i, expected := range []string{callbacks.EventSent, callbacks.EventDelivered} {
+		if received[i].Type != expected || received[i].MessageID != response.MessageID {
+			t.Errorf("expected %s event of %s, got: %+v", expected, response.MessageID, received[i])
+		}
+		err := callbacks.Verify(response.Callback.Secret, signatures[i], bodies[i], time.Minute, time.Now())
+		if err != nil {
+			t.Errorf("signature not verified: %s", err.Error())
+		}
+	}
+}
@@ -1,19 +1,114 @@
 package main
 
-import "flag"
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mikolajb/emailserv/internal/emailclient"
+	"github.com/mikolajb/emailserv/internal/redact"
+)
+
+// memoryDB is a value of -db keeping state in memory
+const memoryDB = ":memory:"
 
 type configuration struct {
 	port          string
 	clientTimeout int
 	amazon        struct {
-		key    string
-		secret string
+		key              string
+		secret           string
+		maxSendRate      float64
+		region           string
+		endpoint         string
+		configurationSet string
+		tags             string
+		sourceArn        string
+		roleArn          string
+		externalID       string
+		roleSessionName  string
+		stsEndpoint      string
 	}
 	sendgrid struct {
-		key string
+		key         string
+		baseURL     string
+		webhookKey  string
+		maxSendRate float64
+	}
+	mailgun struct {
+		domain      string
+		key         string
+		region      string
+		baseURL     string
+		tags        string
+		variables   string
+		maxSendRate float64
+	}
+	postmark struct {
+		serverToken   string
+		messageStream string
+		tag           string
+		metadata      string
+		baseURL       string
+		maxSendRate   float64
+	}
+	tracing struct {
+		exporter string
+		endpoint string
+		insecure bool
+	}
+	log struct {
+		development bool
+		level       string
+		redact      string
+	}
+	idempotency struct {
+		ttl time.Duration
+	}
+	suppression struct {
+		policy string
+	}
+	admin struct {
+		token string
+	}
+	schedule struct {
+		lead time.Duration
+	}
+	pacing struct {
+		def     string
+		domains string
+		maxWait time.Duration
+	}
+	rateLimit struct {
+		rate  float64
+		burst int
+	}
+	callbacks struct {
+		allowInternal bool
 	}
-	token string
-	nop   bool
+	sns struct {
+		certificate string
+		topicArns   string
+	}
+	dkim struct {
+		keys string
+	}
+	webhook struct {
+		config string
+	}
+	sendmail struct {
+		command string
+	}
+	quotas  string
+	pricing string
+	routing string
+	db      string
+	token   string
+	keys    string
+	nop     bool
+	maildir string
+	mbox    string
 }
 
 func (c *configuration) init() {
@@ -21,13 +116,67 @@ func (c *configuration) init() {
 		*c = configuration{}
 	}
 
-	flag.StringVar(&c.amazon.key, "amazon.key", "", "Amazon access key id.")
+	flag.StringVar(&c.amazon.key, "amazon.key", "", "Amazon access key id, the default credential chain (environment, shared config, web identity, instance metadata) is used when it and -amazon.secret are empty.")
 	flag.StringVar(&c.amazon.secret, "amazon.secret", "", "Amazon secret access key.")
+	flag.StringVar(&c.amazon.roleArn, "amazon.role_arn", "", "ARN of a role assumed with STS to send messages, optional.")
+	flag.StringVar(&c.amazon.externalID, "amazon.external_id", "", "External ID passed to STS when -amazon.role_arn is assumed.")
+	flag.StringVar(&c.amazon.roleSessionName, "amazon.role_session_name", emailclient.DefaultRoleSessionName, "Session name of an assumed role.")
+	flag.StringVar(&c.amazon.stsEndpoint, "amazon.sts_endpoint", "", "STS endpoint URL, e.g. a VPC endpoint, a global endpoint is used when empty.")
+	flag.Float64Var(&c.amazon.maxSendRate, "amazon.max_send_rate", 0, "SES maximum send rate in recipients per second, 0 disables the limit.")
+	flag.StringVar(&c.amazon.region, "amazon.region", emailclient.DefaultAmazonRegion, "SES region.")
+	flag.StringVar(&c.amazon.endpoint, "amazon.endpoint", "", "SES endpoint URL, a regional endpoint is used when empty.")
+	flag.StringVar(&c.amazon.configurationSet, "amazon.configuration_set", "", "SES configuration set of messages, optional.")
+	flag.StringVar(&c.amazon.tags, "amazon.tags", "", "Comma separated SES tags of messages, e.g. app=emailserv,env=prod.")
+	flag.StringVar(&c.amazon.sourceArn, "amazon.source_arn", "", "ARN of an SES identity authorizing senders, optional.")
+	flag.StringVar(&c.dkim.keys, "dkim.keys", "", "JSON file with DKIM selectors and keys of sender domains, messages sent with SES and sendmail are signed with them.")
 	flag.StringVar(&c.sendgrid.key, "sendgrid.key", "", "Sendgrid key.")
+	flag.StringVar(&c.sendgrid.baseURL, "sendgrid.base_url", emailclient.DefaultSendgridURL, "SendGrid API base URL.")
+	flag.Float64Var(&c.sendgrid.maxSendRate, "sendgrid.max_send_rate", 0, "SendGrid plan limit in recipients per second, 0 disables the limit.")
+	flag.StringVar(&c.sendgrid.webhookKey, "sendgrid.webhook_key", "", "Base64 public key verifying SendGrid Event Webhook, the webhook is disabled when empty.")
+	flag.StringVar(&c.mailgun.domain, "mailgun.domain", "", "Mailgun sending domain, Mailgun is used when it and -mailgun.key are set.")
+	flag.StringVar(&c.mailgun.key, "mailgun.key", "", "Mailgun private API key.")
+	flag.StringVar(&c.mailgun.region, "mailgun.region", emailclient.MailgunRegionUS, "Mailgun region of a domain: us or eu.")
+	flag.StringVar(&c.mailgun.baseURL, "mailgun.base_url", "", "Mailgun API base URL, a URL of a region is used when empty.")
+	flag.StringVar(&c.mailgun.tags, "mailgun.tags", "", "Comma separated Mailgun tags of messages.")
+	flag.StringVar(&c.mailgun.variables, "mailgun.variables", "", "Comma separated Mailgun variables of messages, e.g. app=emailserv,env=prod.")
+	flag.Float64Var(&c.mailgun.maxSendRate, "mailgun.max_send_rate", 0, "Mailgun limit in recipients per second, 0 disables the limit.")
+	flag.StringVar(&c.postmark.serverToken, "postmark.server_token", "", "Postmark server API token, Postmark is used when it is set.")
+	flag.StringVar(&c.postmark.messageStream, "postmark.message_stream", emailclient.DefaultPostmarkStream, "Postmark message stream.")
+	flag.StringVar(&c.postmark.tag, "postmark.tag", "", "Postmark tag of messages, optional.")
+	flag.StringVar(&c.postmark.metadata, "postmark.metadata", "", "Comma separated Postmark metadata of messages, e.g. app=emailserv,env=prod.")
+	flag.StringVar(&c.postmark.baseURL, "postmark.base_url", emailclient.DefaultPostmarkURL, "Postmark API base URL.")
+	flag.Float64Var(&c.postmark.maxSendRate, "postmark.max_send_rate", 0, "Postmark limit in recipients per second, 0 disables the limit.")
+	flag.StringVar(&c.sendmail.command, "sendmail.command", "", "Command of a local MTA messages are piped to, e.g. \"/usr/sbin/sendmail -t -i\", optional.")
+	flag.StringVar(&c.webhook.config, "webhook.config", "", "JSON file configuring a client posting messages to an HTTP service, optional.")
 	flag.IntVar(&c.clientTimeout, "client_timeout", 5000, "Acceptable client work time in milliseconds.")
 	flag.StringVar(&c.port, "port", "8080", "Port.")
-	flag.StringVar(&c.token, "token", "", "Access token.")
+	flag.StringVar(&c.token, "token", "", "Access token of the \"default\" API key.")
+	flag.StringVar(&c.keys, "keys", "", "JSON file mapping names of API keys to their tokens, used with or instead of -token.")
 	flag.BoolVar(&c.nop, "nop", false, "Do not use any real client, just log messages.")
+	flag.StringVar(&c.maildir, "maildir", "", "Do not use any real client, write messages to a Maildir directory instead.")
+	flag.StringVar(&c.mbox, "mbox", "", "Do not use any real client, append messages to an mbox file instead.")
+	flag.StringVar(&c.quotas, "quotas", "", "JSON file with daily and monthly quotas of API keys, \"*\" applies to other keys, usage is only reported when empty.")
+	flag.StringVar(&c.pricing, "pricing", "", "JSON file with prices of providers used by usage reports, costs are 0 when empty.")
+	flag.StringVar(&c.routing, "routing", "priority", "Order of clients: priority (as configured) or cost (the cheapest first, using -pricing).")
+	flag.StringVar(&c.db, "db", "emailserv.db", "Database file, "+memoryDB+" keeps state in memory, it is lost on restart then.")
+	flag.StringVar(&c.admin.token, "admin.token", "", "Access token of admin endpoints, they are disabled when empty.")
+	flag.StringVar(&c.suppression.policy, "suppression.policy", "drop", "What to do with suppressed recipients: drop (skip them) or reject (reject a message).")
+	flag.BoolVar(&c.callbacks.allowInternal, "callbacks.allow_internal", false, "Allow callback URLs with loopback, link-local and private addresses, e.g. when callers run in the same private network.")
+	flag.StringVar(&c.sns.certificate, "sns.certificate", "", "PEM file with a certificate verifying SNS messages, it is downloaded from SNS when empty.")
+	flag.StringVar(&c.sns.topicArns, "sns.topic_arns", "", "Comma separated SNS topics accepted by the webhook, the webhook is disabled when empty.")
+	flag.DurationVar(&c.schedule.lead, "schedule.lead", 10*time.Minute, "How long before their time scheduled messages are passed to providers which can schedule them (SendGrid), 0 disables it.")
+	flag.Float64Var(&c.rateLimit.rate, "ratelimit.rate", 0, "Requests per second of a single API key, 0 disables the limit.")
+	flag.IntVar(&c.rateLimit.burst, "ratelimit.burst", 10, "Requests an API key can make at once above -ratelimit.rate.")
+	flag.StringVar(&c.pacing.def, "pacing.default", "", "Limit of recipient domains as concurrency/per_minute, e.g. 10/600, 0 disables a part of it, pacing is disabled when it and -pacing.domains are empty.")
+	flag.StringVar(&c.pacing.domains, "pacing.domains", "", "Comma separated limits of recipient domains, e.g. gmail.com=5/300,yahoo.com=2/120.")
+	flag.DurationVar(&c.pacing.maxWait, "pacing.max_wait", 30*time.Second, "How long a request waits for recipient domains before it gets 503 status, 0 waits until a client times out, scheduled messages always wait.")
+	flag.DurationVar(&c.idempotency.ttl, "idempotency.ttl", 24*time.Hour, "How long responses to requests with Idempotency-Key are remembered.")
+	flag.BoolVar(&c.log.development, "log.development", true, "Use human readable development logging instead of JSON production logging.")
+	flag.StringVar(&c.log.level, "log.level", "debug", "Log level: debug, info, warn or error.")
+	flag.StringVar(&c.log.redact, "log.redact", redact.DefaultPolicy, "Redaction of personal data in logs as field=mode pairs, modes: none, hash, mask, drop.")
+	flag.StringVar(&c.tracing.exporter, "tracing.exporter", "nop", "Trace exporter: nop or otlp.")
+	flag.StringVar(&c.tracing.endpoint, "tracing.endpoint", "", "OTLP/HTTP collector address (host:port), OTEL_EXPORTER_OTLP_ENDPOINT is used when empty.")
+	flag.BoolVar(&c.tracing.insecure, "tracing.insecure", false, "Use plain HTTP when talking to the OTLP collector.")
 }
 
 func (c *configuration) parse() {
@@ -35,3 +184,33 @@ func (c *configuration) parse() {
 		flag.Parse()
 	}
 }
+
+// parseTags parses comma separated name=value pairs
+func parseTags(s string) (map[string]string, error) {
+	tags := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid tag %q, expected name=value", pair)
+		}
+		tags[parts[0]] = parts[1]
+	}
+
+	return tags, nil
+}
+
+// parseList parses a comma separated list
+func parseList(s string) []string {
+	var result []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+
+	return result
+}
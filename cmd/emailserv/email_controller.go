@@ -5,9 +5,23 @@ import (
 	"fmt"
 	"net/http"
 	"regexp"
+	"time"
 
+	"github.com/mikolajb/emailserv/internal/apikey"
+	"github.com/mikolajb/emailserv/internal/callbacks"
 	"github.com/mikolajb/emailserv/internal/emailclient"
 	"github.com/mikolajb/emailserv/internal/emailmanager"
+	"github.com/mikolajb/emailserv/internal/idempotency"
+	"github.com/mikolajb/emailserv/internal/messages"
+	"github.com/mikolajb/emailserv/internal/pacing"
+	"github.com/mikolajb/emailserv/internal/quota"
+	"github.com/mikolajb/emailserv/internal/ratelimit"
+	"github.com/mikolajb/emailserv/internal/requestid"
+	"github.com/mikolajb/emailserv/internal/scheduler"
+	"github.com/mikolajb/emailserv/internal/suppression"
+	"github.com/mikolajb/emailserv/internal/tracing"
+	"github.com/mikolajb/emailserv/internal/usage"
+	"go.opentelemetry.io/otel/attribute"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
@@ -16,6 +30,8 @@ const (
 	emailRegexp = "^[a-zA-Z0-9.!#$%&'*+/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$"
 )
 
+var emailRe = regexp.MustCompile(emailRegexp)
+
 // Message is an incoming message.
 type Message struct {
 	// Sender is email's "from" attribute.
@@ -35,6 +51,49 @@ type Message struct {
 
 	// Body is email's content
 	Body string `json:"body"`
+
+	// CallbackURL receives status events of this message, optional
+	CallbackURL string `json:"callback_url,omitempty"`
+
+	// SendAt is an RFC 3339 time a message should be sent at, optional
+	SendAt *time.Time `json:"send_at,omitempty"`
+
+	// Timezone is an IANA time zone of recipients, e.g. "Europe/Warsaw",
+	// quiet hours are in this time zone, UTC when empty
+	Timezone string `json:"timezone,omitempty"`
+
+	// QuietHours is a period of recipients' local time
+	// a message is not sent during, it is deferred until their end
+	QuietHours *QuietHours `json:"quiet_hours,omitempty"`
+
+	// Sendgrid are SendGrid specific options, a message with a template,
+	// sandbox mode or an unsubscribe group is only sent by SendGrid,
+	// they are rejected when SendGrid is not configured, optional
+	Sendgrid *emailclient.SendgridOptions `json:"sendgrid,omitempty"`
+}
+
+// QuietHours is a daily period, e.g. from "22:00" to "08:00"
+type QuietHours struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// recipientCount returns a number of all recipients of a message
+func (m *Message) recipientCount() int {
+	return len(m.Recipients) + len(m.CCRecipients) + len(m.BCCRecipients)
+}
+
+// quietHours returns quiet hours of a message in its time zone or nil
+func (m *Message) quietHours() *scheduler.QuietHours {
+	if m.QuietHours == nil {
+		return nil
+	}
+
+	return &scheduler.QuietHours{
+		Start:    m.QuietHours.Start,
+		End:      m.QuietHours.End,
+		Timezone: m.Timezone,
+	}
 }
 
 // Response holds service's response message.
@@ -47,6 +106,24 @@ type Response struct {
 
 	// Error specifies if error occured.
 	Error bool `json:"error,omitempty"`
+
+	// RequestID identifies a request in logs,
+	// it is also sent in X-Request-ID header.
+	RequestID string `json:"request_id,omitempty"`
+
+	// MessageID identifies a message, it can be used to check its status.
+	MessageID string `json:"message_id,omitempty"`
+
+	// SuppressedRecipients are recipients found on a suppression list,
+	// depending on a policy they were skipped or caused a rejection.
+	SuppressedRecipients []string `json:"suppressed_recipients,omitempty"`
+
+	// Callback is a callback registered for a message with callback_url,
+	// its secret verifies signatures of events.
+	Callback *callbacks.Registration `json:"callback,omitempty"`
+
+	// Quota is a quota of an API key exceeded by a message.
+	Quota *quota.ExceededError `json:"quota,omitempty"`
 }
 
 // ValidationErrors holds an error of a particular field from the request
@@ -66,87 +143,464 @@ func (ve *ValidationError) String() string {
 }
 
 type httpHandler struct {
-	logger             *zap.Logger
-	emailManager       *emailmanager.EmailManager
-	authorizationToken string
+	logger            *zap.Logger
+	emailManager      *emailmanager.EmailManager
+	keys              apikey.Keys
+	idempotency       *idempotency.Keeper
+	suppressions      *suppression.List
+	suppressionPolicy string
+	messages          *messages.Store
+	callbacks         *callbacks.Dispatcher
+	scheduler         *scheduler.Scheduler
+	limiter           *ratelimit.Limiter
+	pacingMaxWait     time.Duration
+	quotas            *quota.Quotas
+	usage             *usage.Recorder
+}
+
+// statusRecorder remembers a status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	sr.status = status
+	sr.ResponseWriter.WriteHeader(status)
 }
 
 // ServeHTTP is a main controller function
-// it could be separated into two
-// - one holding technical aspects of it
-// - one holding application logic
+// it starts a span for a request, continuing a trace
+// from incoming headers, assigns a request ID
+// and passes control to serve
 func (h httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := requestid.FromRequest(r)
+	w.Header().Set(requestid.Header, id)
+
+	ctx, span := tracing.Start(
+		tracing.Extract(requestid.NewContext(r.Context(), id), r.Header),
+		"ServeHTTP",
+		attribute.String("http.method", r.Method),
+		attribute.String("http.target", r.URL.Path),
+		attribute.String("request_id", id),
+	)
+	defer span.End()
+
+	recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	h.serve(recorder, r.WithContext(ctx))
+
+	span.SetAttributes(attribute.Int("http.status_code", recorder.status))
+	if recorder.status >= http.StatusInternalServerError {
+		tracing.RecordError(span, fmt.Errorf("request failed with status %d", recorder.status))
+	}
+}
+
+// serve holds application logic of a controller
+func (h httpHandler) serve(w http.ResponseWriter, r *http.Request) {
+	logger := h.logger.With(requestid.Field(r.Context()))
+
 	if r.Method != "POST" {
-		h.logger.Debug("received request with a wrong method", zap.String("method", r.Method))
+		logger.Debug("received request with a wrong method", zap.String("method", r.Method))
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
 
-	if r.Header.Get("Authorization") != h.authorizationToken {
+	key, ok := h.keys.Name(r.Header.Get("Authorization"))
+	if !ok {
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
+	logger = logger.With(zap.String("api_key", key))
+	r = r.WithContext(apikey.NewContext(r.Context(), key))
 
+	if h.limiter != nil {
+		if ok, wait := h.limiter.Allow(key); !ok {
+			logger.Debug("rate limit exceeded", zap.Duration("retry_after", wait))
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Retry-After", ratelimit.RetryAfter(wait))
+			w.WriteHeader(http.StatusTooManyRequests)
+			json.NewEncoder(w).Encode(Response{
+				Message:   "Rate limit exceeded",
+				Error:     true,
+				RequestID: requestid.FromContext(r.Context()),
+			})
+			return
+		}
+	}
+
+	if key := r.Header.Get(idempotencyKeyHeader); key != "" && h.idempotency != nil {
+		h.serveIdempotent(w, r, key, logger)
+		return
+	}
+
+	h.sendEmail(w, r, logger)
+}
+
+// sendEmail decodes, validates and sends a message
+func (h httpHandler) sendEmail(w http.ResponseWriter, r *http.Request, logger *zap.Logger) {
 	ctx := r.Context()
+	requestID := requestid.FromContext(ctx)
 
 	jsonEncoder := json.NewEncoder(w)
 	w.Header().Set("Content-Type", "application/json")
 	var message Message
 
+	_, decodeSpan := tracing.Start(ctx, "decode")
 	err := json.NewDecoder(r.Body).Decode(&message)
+	decodeSpan.End()
 	if err != nil {
-		h.logger.Debug("error while decoding message", zap.Error(err))
+		logger.Debug("error while decoding message", zap.Error(err))
 		w.WriteHeader(http.StatusBadRequest)
 		jsonEncoder.Encode(Response{
-			Message: "Invalid JSON format",
-			Error:   true,
+			Message:   "Invalid JSON format",
+			Error:     true,
+			RequestID: requestID,
 		})
 		return
 	}
 
+	_, validateSpan := tracing.Start(ctx, "validate")
 	validationErrors := validate(&message)
+	if message.Sendgrid != nil && !h.emailManager.HasClient(emailclient.SendgridProvider) {
+		// other clients would drop these options without notice
+		validationErrors = append(validationErrors, &ValidationError{
+			Field: "sendgrid",
+			Error: "sendgrid client is not configured",
+		})
+	}
+	validateSpan.SetAttributes(attribute.Int("validation.errors", len(validationErrors)))
+	validateSpan.End()
 	if len(validationErrors) > 0 {
 		var validationFields []zapcore.Field
 		for _, ve := range validationErrors {
 			validationFields = append(validationFields, zap.Stringer("validation_error", ve))
 		}
-		h.logger.Debug("invalid message", validationFields...)
+		logger.Debug("invalid message", validationFields...)
 		w.WriteHeader(http.StatusBadRequest)
 		jsonEncoder.Encode(Response{
 			Message:          "Request not valid",
 			ValidationErrors: validationErrors,
 			Error:            true,
+			RequestID:        requestID,
 		})
 		return
 	}
 
-	err = h.emailManager.Send(
+	var suppressed []string
+	if h.suppressions != nil {
+		suppressed, err = suppress(h.suppressions, h.suppressionPolicy, &message)
+		if err != nil {
+			logger.Error("suppression list error", zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			jsonEncoder.Encode(Response{
+				Message:   "Internal server error",
+				Error:     true,
+				RequestID: requestID,
+			})
+			return
+		}
+	}
+	if len(suppressed) > 0 {
+		logger.Debug("suppressed recipients", zap.Strings("recipients", suppressed))
+		// a message is not sent to Cc and Bcc recipients alone
+		if h.suppressionPolicy == suppressionReject || len(message.Recipients) == 0 {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			jsonEncoder.Encode(Response{
+				Message:              "Recipients are suppressed",
+				Error:                true,
+				RequestID:            requestID,
+				SuppressedRecipients: suppressed,
+			})
+			return
+		}
+	}
+
+	key := apikey.FromContext(ctx)
+	if h.quotas != nil {
+		_, err := h.quotas.Reserve(key, message.recipientCount())
+		if exceeded, ok := err.(*quota.ExceededError); ok {
+			logger.Debug("quota exceeded", zap.Error(err))
+			w.Header().Set("Retry-After", ratelimit.RetryAfter(time.Until(exceeded.ResetsAt)))
+			w.WriteHeader(http.StatusTooManyRequests)
+			jsonEncoder.Encode(Response{
+				Message:   "Quota exceeded: " + exceeded.Error(),
+				Error:     true,
+				RequestID: requestID,
+				Quota:     exceeded,
+			})
+			return
+		}
+		if err != nil {
+			logger.Error("quota error", zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			jsonEncoder.Encode(Response{
+				Message:   "Internal server error",
+				Error:     true,
+				RequestID: requestID,
+			})
+			return
+		}
+	}
+
+	messageID := messages.NewID()
+	logger = logger.With(zap.String("message_id", messageID))
+
+	var callback *callbacks.Registration
+	if message.CallbackURL != "" && h.callbacks != nil {
+		callback, err = h.callbacks.Register(key, messageID, message.CallbackURL)
+		if err != nil {
+			logger.Error("cannot register callback", zap.Error(err))
+			h.releaseQuota(logger, key, &message)
+			w.WriteHeader(http.StatusInternalServerError)
+			jsonEncoder.Encode(Response{
+				Message:   "Internal server error",
+				Error:     true,
+				RequestID: requestID,
+			})
+			return
+		}
+	}
+
+	now := time.Now()
+	sendAt := now
+	if message.SendAt != nil && message.SendAt.After(now) {
+		sendAt = *message.SendAt
+	}
+	var deferReason string
+	if quietHours := message.quietHours(); quietHours != nil {
+		next, err := quietHours.Next(sendAt)
+		if err == nil && next.After(sendAt) {
+			sendAt = next
+			deferReason = "quiet hours " + quietHours.String()
+		}
+	}
+	if sendAt.After(now) {
+		h.schedule(w, r, logger, &message, messageID, sendAt, deferReason, suppressed, callback)
+		return
+	}
+
+	opts := []emailclient.EmailOption{
+		emailclient.WithBody(message.Body),
+		emailclient.WithCCRecipients(message.CCRecipients),
+		emailclient.WithBCCRecipients(message.BCCRecipients),
+		emailclient.WithMessageID(messageID),
+	}
+	if message.Sendgrid != nil {
+		opts = append(opts, emailclient.WithSendgrid(*message.Sendgrid))
+	}
+	if h.pacingMaxWait > 0 {
+		// a request is not held open for long, a caller retries instead
+		ctx = pacing.WithMaxWait(ctx, h.pacingMaxWait)
+	}
+	result, err := h.emailManager.Send(
 		ctx,
 		message.Sender,
 		message.Recipients,
 		message.Subject,
-		emailclient.WithBody(message.Body),
-		emailclient.WithCCRecipients(message.CCRecipients),
-		emailclient.WithBCCRecipients(message.BCCRecipients),
+		opts...,
 	)
 	if err != nil {
-		h.logger.Error("send error", zap.Error(err))
+		logger.Error("send error", zap.Error(err))
+		h.releaseQuota(logger, key, &message)
+		h.saveStatus(logger, &messages.Record{
+			ID:        messageID,
+			RequestID: requestID,
+			Key:       key,
+			Status:    messages.StatusFailed,
+		}, err.Error())
+		if rateLimitErr, ok := err.(*emailmanager.RateLimitError); ok {
+			// providers are only temporarily unavailable
+			w.Header().Set("Retry-After", ratelimit.RetryAfter(rateLimitErr.RetryAfter))
+			w.WriteHeader(http.StatusServiceUnavailable)
+			jsonEncoder.Encode(Response{
+				Message:   "Providers are at their rate limits",
+				Error:     true,
+				RequestID: requestID,
+				MessageID: messageID,
+				Callback:  callback,
+			})
+			return
+		}
+		if timeoutErr, ok := err.(*pacing.TimeoutError); ok {
+			w.Header().Set("Retry-After", ratelimit.RetryAfter(timeoutErr.RetryAfter))
+			w.WriteHeader(http.StatusServiceUnavailable)
+			jsonEncoder.Encode(Response{
+				Message:   "Recipient domains are busy",
+				Error:     true,
+				RequestID: requestID,
+				MessageID: messageID,
+				Callback:  callback,
+			})
+			return
+		}
+		if _, ok := err.(*emailmanager.ProviderRequiredError); ok {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			jsonEncoder.Encode(Response{
+				Message:   "Email cannot be sent: " + err.Error(),
+				Error:     true,
+				RequestID: requestID,
+				MessageID: messageID,
+				Callback:  callback,
+			})
+			return
+		}
 		w.WriteHeader(http.StatusInternalServerError)
 		jsonEncoder.Encode(Response{
-			Message: "Internal server error",
-			Error:   true,
+			Message:   "Internal server error",
+			Error:     true,
+			RequestID: requestID,
+			MessageID: messageID,
+			Callback:  callback,
 		})
 		return
 	}
+	h.saveStatus(logger, &messages.Record{
+		ID:                messageID,
+		RequestID:         requestID,
+		Key:               key,
+		Provider:          result.Provider,
+		ProviderMessageID: result.ProviderMessageID,
+		Status:            messages.StatusSent,
+	}, "")
+	recordUsage(logger, h.usage, &usage.Record{
+		Key:        key,
+		Provider:   result.Provider,
+		MessageID:  messageID,
+		Recipients: message.recipientCount(),
+		Size:       len(message.Subject) + len(message.Body),
+	})
 	w.WriteHeader(http.StatusCreated)
+	jsonEncoder.Encode(Response{
+		Message:              "Email sent",
+		RequestID:            requestID,
+		MessageID:            messageID,
+		SuppressedRecipients: suppressed,
+		Callback:             callback,
+	})
+}
+
+// releaseQuota gives back a quota reserved by a message which was not sent
+func (h httpHandler) releaseQuota(logger *zap.Logger, key string, message *Message) {
+	if h.quotas == nil {
+		return
+	}
+	if err := h.quotas.Release(key, message.recipientCount()); err != nil {
+		logger.Error("cannot release quota", zap.Error(err))
+	}
+}
+
+// schedule stores a message which will be sent later,
+// deferReason explains why a message is deferred after its time
+func (h httpHandler) schedule(w http.ResponseWriter, r *http.Request, logger *zap.Logger, message *Message, messageID string, sendAt time.Time, deferReason string, suppressed []string, callback *callbacks.Registration) {
+	ctx := r.Context()
+	requestID := requestid.FromContext(ctx)
+	jsonEncoder := json.NewEncoder(w)
+	logger = logger.With(zap.Time("send_at", sendAt))
+
+	key := apikey.FromContext(ctx)
+	if h.scheduler == nil || h.messages == nil {
+		h.releaseQuota(logger, key, message)
+		w.WriteHeader(http.StatusBadRequest)
+		jsonEncoder.Encode(Response{
+			Message:   "Scheduling is not supported",
+			Error:     true,
+			RequestID: requestID,
+		})
+		return
+	}
+
+	sendAt = sendAt.UTC()
+	status := messages.StatusScheduled
+	responseMessage := "Email scheduled"
+	if deferReason != "" {
+		status = messages.StatusDeferred
+		responseMessage = "Email deferred"
+		logger = logger.With(zap.String("reason", deferReason))
+	}
+	err := h.messages.Create(&messages.Record{
+		ID:             messageID,
+		RequestID:      requestID,
+		Key:            key,
+		Status:         status,
+		SendAt:         &sendAt,
+		DeferredReason: deferReason,
+	})
+	if err == nil {
+		err = h.scheduler.Schedule(&scheduler.Job{
+			ID:        messageID,
+			Key:       key,
+			RequestID: requestID,
+			Email: scheduler.Email{
+				Sender:        message.Sender,
+				Recipients:    message.Recipients,
+				CCRecipients:  message.CCRecipients,
+				BCCRecipients: message.BCCRecipients,
+				Subject:       message.Subject,
+				Body:          message.Body,
+				Sendgrid:      message.Sendgrid,
+			},
+			SendAt:     sendAt,
+			QuietHours: message.quietHours(),
+		})
+	}
+	if err != nil {
+		logger.Error("cannot schedule message", zap.Error(err))
+		h.releaseQuota(logger, key, message)
+		w.WriteHeader(http.StatusInternalServerError)
+		jsonEncoder.Encode(Response{
+			Message:   "Internal server error",
+			Error:     true,
+			RequestID: requestID,
+		})
+		return
+	}
+
+	logger.Debug("message scheduled")
+	w.WriteHeader(http.StatusAccepted)
+	jsonEncoder.Encode(Response{
+		Message:              responseMessage,
+		RequestID:            requestID,
+		MessageID:            messageID,
+		SuppressedRecipients: suppressed,
+		Callback:             callback,
+	})
+}
+
+// saveStatus stores a status of a message and notifies callbacks,
+// an error is only logged because a message was already processed
+func (h httpHandler) saveStatus(logger *zap.Logger, record *messages.Record, reason string) {
+	if h.messages != nil {
+		if err := h.messages.Create(record); err != nil {
+			logger.Error("cannot save message status", zap.Error(err))
+		}
+	}
+	if h.callbacks != nil {
+		err := h.callbacks.Notify(record.Key, callbacks.Event{
+			Type:      string(record.Status),
+			MessageID: record.ID,
+			RequestID: record.RequestID,
+			Reason:    reason,
+		})
+		if err != nil {
+			logger.Error("cannot notify callbacks", zap.Error(err))
+		}
+	}
+}
+
+// recordUsage records a sent message when usage is recorded
+func recordUsage(logger *zap.Logger, recorder *usage.Recorder, record *usage.Record) {
+	if recorder == nil {
+		return
+	}
+	if err := recorder.Record(record); err != nil {
+		logger.Error("cannot record usage", zap.Error(err))
+	}
 }
 
 func validate(message *Message) []*ValidationError {
 	errors := []*ValidationError{}
 
-	re := regexp.MustCompile(emailRegexp)
-
-	if !re.MatchString(message.Sender) {
+	if !emailRe.MatchString(message.Sender) {
 		errors = append(errors, &ValidationError{
 			Field: "sender",
 			Error: "not a valid email",
@@ -162,6 +616,55 @@ func validate(message *Message) []*ValidationError {
 		})
 	}
 
+	if message.CallbackURL != "" {
+		if err := callbacks.ValidateURL(message.CallbackURL); err != nil {
+			errors = append(errors, &ValidationError{
+				Field: "callback_url",
+				Error: err.Error(),
+			})
+		}
+	}
+
+	if message.Timezone != "" {
+		if _, err := time.LoadLocation(message.Timezone); err != nil {
+			errors = append(errors, &ValidationError{
+				Field: "timezone",
+				Error: "unknown time zone",
+			})
+		}
+	}
+	if message.QuietHours != nil {
+		// a time zone is validated above
+		quietHours := scheduler.QuietHours{Start: message.QuietHours.Start, End: message.QuietHours.End}
+		if err := quietHours.Validate(); err != nil {
+			errors = append(errors, &ValidationError{
+				Field: "quiet_hours",
+				Error: err.Error(),
+			})
+		}
+	}
+
+	if o := message.Sendgrid; o != nil {
+		if len(o.TemplateData) > 0 && o.TemplateID == "" {
+			errors = append(errors, &ValidationError{
+				Field: "sendgrid.dynamic_template_data",
+				Error: "requires template_id",
+			})
+		}
+		if o.ASMGroupID < 0 {
+			errors = append(errors, &ValidationError{
+				Field: "sendgrid.asm_group_id",
+				Error: "has to be positive",
+			})
+		}
+		if len(o.ASMGroupsToDisplay) > 0 && o.ASMGroupID == 0 {
+			errors = append(errors, &ValidationError{
+				Field: "sendgrid.asm_groups_to_display",
+				Error: "requires asm_group_id",
+			})
+		}
+	}
+
 	addresses := map[string][]string{
 		"recipient":     message.Recipients,
 		"cc_recipient":  message.CCRecipients,
@@ -170,7 +673,7 @@ func validate(message *Message) []*ValidationError {
 
 	for addrType, addresses := range addresses {
 		for i, r := range addresses {
-			if !re.MatchString(r) {
+			if !emailRe.MatchString(r) {
 				errors = append(errors, &ValidationError{
 					Field: fmt.Sprintf(
 						"%s[%d]",
@@ -12,8 +12,17 @@ import (
 	"time"
 
 	"github.com/golang/mock/gomock"
+	"github.com/mikolajb/emailserv/internal/apikey"
 	"github.com/mikolajb/emailserv/internal/emailclient"
 	"github.com/mikolajb/emailserv/internal/emailmanager"
+	"github.com/mikolajb/emailserv/internal/idempotency"
+	"github.com/mikolajb/emailserv/internal/ratelimit"
+	"github.com/mikolajb/emailserv/internal/requestid"
+	"github.com/mikolajb/emailserv/internal/storage"
+	"github.com/mikolajb/emailserv/internal/tracing"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace/noop"
 	"go.uber.org/zap/zaptest"
 )
 
@@ -88,7 +97,7 @@ func TestEmailControllerHandler(t *testing.T) {
 				client1.EXPECT().ProviderName().Return("mock_client1").Times(1)
 				client1.EXPECT().
 					Send(gomock.Any(), sender, recipients, subject, gomock.Any()).
-					DoAndReturn(func(ctx context.Context, senderX string, recipientsX []string, subjectX string, opts ...emailclient.EmailOption) error {
+					DoAndReturn(func(ctx context.Context, senderX string, recipientsX []string, subjectX string, opts ...emailclient.EmailOption) (string, error) {
 						if sender != senderX {
 							t.Errorf("expected '%s' sender but got '%s'", sender, senderX)
 						}
@@ -100,12 +109,12 @@ func TestEmailControllerHandler(t *testing.T) {
 						}
 						select {
 						case <-time.After(c.clientDelay):
-							return c.clientError
+							return "", c.clientError
 						case <-ctx.Done():
 							// sometime context is too fast
 							<-time.After(10 * time.Millisecond)
 						}
-						return nil
+						return "", nil
 					}).Times(1)
 			}
 
@@ -115,9 +124,9 @@ func TestEmailControllerHandler(t *testing.T) {
 				ClientTimeout: 100 * time.Millisecond,
 			}
 			handler := httpHandler{
-				logger:             zaptest.NewLogger(t),
-				emailManager:       em,
-				authorizationToken: token,
+				logger:       zaptest.NewLogger(t),
+				emailManager: em,
+				keys:         apikey.Keys{token: apikey.DefaultName},
 			}
 
 			method := "POST"
@@ -231,6 +240,31 @@ func Test_validate(t *testing.T) {
 				"bcc_recipient[1]": "invalid email address",
 			},
 		},
+		"OK-sendgrid-template": {
+			message: &Message{
+				Sender:     "abc@abc.com",
+				Recipients: []string{"def@abc.com"},
+				Sendgrid: &emailclient.SendgridOptions{
+					TemplateID:   "d-123",
+					TemplateData: map[string]interface{}{"name": "abc"},
+					ASMGroupID:   1,
+				},
+			},
+		},
+		"sendgrid-invalid": {
+			message: &Message{
+				Sender:     "abc@abc.com",
+				Recipients: []string{"def@abc.com"},
+				Sendgrid: &emailclient.SendgridOptions{
+					TemplateData:       map[string]interface{}{"name": "abc"},
+					ASMGroupsToDisplay: []int{1},
+				},
+			},
+			errors: map[string]string{
+				"sendgrid.dynamic_template_data": "requires template_id",
+				"sendgrid.asm_groups_to_display": "requires asm_group_id",
+			},
+		},
 	}
 
 	for hint, c := range cases {
@@ -254,3 +288,359 @@ func Test_validate(t *testing.T) {
 		})
 	}
 }
+
+func TestEmailControllerHandler_tracing(t *testing.T) {
+	exporter := tracing.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	otel.SetTracerProvider(tp)
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+
+	em := &emailmanager.EmailManager{
+		Logger:        zaptest.NewLogger(t),
+		EmailClients:  []emailclient.EmailClient{emailclient.NewNopClient(zaptest.NewLogger(t))},
+		ClientTimeout: 100 * time.Millisecond,
+	}
+	handler := httpHandler{
+		logger:       zaptest.NewLogger(t),
+		emailManager: em,
+		keys:         apikey.Keys{"abc": apikey.DefaultName},
+	}
+
+	message := &bytes.Buffer{}
+	json.NewEncoder(message).Encode(&Message{
+		Sender:     "sender@example.com",
+		Recipients: []string{"recipient@example.com"},
+	})
+	req, err := http.NewRequest("POST", "/email", message)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	req.Header.Add("Authorization", "abc")
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	req.Header.Add("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := map[string]bool{}
+	for _, s := range exporter.GetSpans() {
+		spans[s.Name] = true
+		if s.SpanContext.TraceID().String() != traceID {
+			t.Errorf("span %s is not a part of trace %s", s.Name, traceID)
+		}
+	}
+	for _, name := range []string{"ServeHTTP", "decode", "validate", "EmailManager.Send", "EmailClient.Send"} {
+		if !spans[name] {
+			t.Errorf("expected span %s", name)
+		}
+	}
+}
+
+func TestEmailControllerHandler_sendgrid(t *testing.T) {
+	cases := map[string]struct {
+		sendgrid   bool
+		options    emailclient.SendgridOptions
+		returnCode int
+		provider   string
+	}{
+		"sandbox": {
+			sendgrid:   true,
+			options:    emailclient.SendgridOptions{SandboxMode: true},
+			returnCode: http.StatusCreated,
+			provider:   "sendgrid",
+		},
+		"asm group": {
+			sendgrid:   true,
+			options:    emailclient.SendgridOptions{ASMGroupID: 42},
+			returnCode: http.StatusCreated,
+			provider:   "sendgrid",
+		},
+		"categories": {
+			sendgrid:   true,
+			options:    emailclient.SendgridOptions{Categories: []string{"welcome"}},
+			returnCode: http.StatusCreated,
+			provider:   "aws",
+		},
+		"not configured": {
+			options:    emailclient.SendgridOptions{Categories: []string{"welcome"}},
+			returnCode: http.StatusBadRequest,
+		},
+	}
+
+	for hint, c := range cases {
+		t.Run(hint, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+
+			aws := emailclient.NewMockEmailClient(mockCtrl)
+			aws.EXPECT().ProviderName().Return("aws").AnyTimes()
+			clients := []emailclient.EmailClient{aws}
+			if c.provider == "aws" {
+				aws.EXPECT().Send(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return("aws-id", nil).Times(1)
+			}
+			if c.sendgrid {
+				sendgrid := emailclient.NewMockEmailClient(mockCtrl)
+				sendgrid.EXPECT().ProviderName().Return("sendgrid").AnyTimes()
+				if c.provider == "sendgrid" {
+					sendgrid.EXPECT().Send(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return("sendgrid-id", nil).Times(1)
+				}
+				clients = append(clients, sendgrid)
+			}
+
+			handler := httpHandler{
+				logger: zaptest.NewLogger(t),
+				emailManager: &emailmanager.EmailManager{
+					Logger:        zaptest.NewLogger(t),
+					EmailClients:  clients,
+					ClientTimeout: 100 * time.Millisecond,
+				},
+				keys: apikey.Keys{"abc": apikey.DefaultName},
+			}
+
+			message := &bytes.Buffer{}
+			json.NewEncoder(message).Encode(&Message{
+				Sender:     "sender@example.com",
+				Recipients: []string{"recipient@example.com"},
+				Sendgrid:   &c.options,
+			})
+			req := httptest.NewRequest("POST", "/email", message)
+			req.Header.Add("Authorization", "abc")
+			w := httptest.NewRecorder()
+
+			handler.ServeHTTP(w, req)
+
+			if w.Code != c.returnCode {
+				t.Errorf("expected status %d, got %d: %s", c.returnCode, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestEmailControllerHandler_requestID(t *testing.T) {
+	cases := map[string]struct {
+		requestID string
+		expected  string
+	}{
+		"generated": {},
+		"provided": {
+			requestID: "abc-123",
+			expected:  "abc-123",
+		},
+		"invalid": {
+			requestID: "abc 123; DROP",
+		},
+	}
+
+	for hint, c := range cases {
+		t.Run(hint, func(t *testing.T) {
+			em := &emailmanager.EmailManager{
+				Logger:        zaptest.NewLogger(t),
+				EmailClients:  []emailclient.EmailClient{emailclient.NewNopClient(zaptest.NewLogger(t))},
+				ClientTimeout: 100 * time.Millisecond,
+			}
+			handler := httpHandler{
+				logger:       zaptest.NewLogger(t),
+				emailManager: em,
+				keys:         apikey.Keys{"abc": apikey.DefaultName},
+			}
+
+			message := &bytes.Buffer{}
+			json.NewEncoder(message).Encode(&Message{
+				Sender:     "sender@example.com",
+				Recipients: []string{"recipient@example.com"},
+			})
+			req, err := http.NewRequest("POST", "/email", message)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			req.Header.Add("Authorization", "abc")
+			if c.requestID != "" {
+				req.Header.Add(requestid.Header, c.requestID)
+			}
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+
+			header := recorder.Header().Get(requestid.Header)
+			if c.expected != "" && header != c.expected {
+				t.Errorf("expected request id '%s' but got '%s'", c.expected, header)
+			}
+			if c.expected == "" && (!requestid.Valid(header) || header == c.requestID) {
+				t.Errorf("expected a new request id but got '%s'", header)
+			}
+
+			var response Response
+			if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil {
+				t.Fatalf("cannot decode response body")
+			}
+			if response.RequestID != header {
+				t.Errorf("expected request id '%s' in a response but got '%s'", header, response.RequestID)
+			}
+		})
+	}
+}
+
+func TestEmailControllerHandler_idempotency(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	client1 := emailclient.NewMockEmailClient(mockCtrl)
+	client1.EXPECT().ProviderName().Return("mock_client1").Times(1)
+	client1.EXPECT().Send(gomock.Any(), "sender@example.com", []string{"recipient@example.com"}, "", gomock.Any()).Return("", nil).Times(1)
+
+	em := &emailmanager.EmailManager{
+		Logger:        zaptest.NewLogger(t),
+		EmailClients:  []emailclient.EmailClient{client1},
+		ClientTimeout: 100 * time.Millisecond,
+	}
+	handler := httpHandler{
+		logger:       zaptest.NewLogger(t),
+		emailManager: em,
+		keys:         apikey.Keys{"abc": apikey.DefaultName},
+		idempotency:  idempotency.NewKeeper(storage.NewMemoryStore(), time.Hour),
+	}
+
+	message := &bytes.Buffer{}
+	json.NewEncoder(message).Encode(&Message{
+		Sender:     "sender@example.com",
+		Recipients: []string{"recipient@example.com"},
+	})
+	otherMessage := &bytes.Buffer{}
+	json.NewEncoder(otherMessage).Encode(&Message{
+		Sender:     "sender@example.com",
+		Recipients: []string{"other@example.com"},
+	})
+
+	steps := []struct {
+		message    string
+		returnCode int
+		replayed   bool
+	}{
+		{message: message.String(), returnCode: http.StatusCreated},
+		{message: message.String(), returnCode: http.StatusCreated, replayed: true},
+		{message: otherMessage.String(), returnCode: http.StatusUnprocessableEntity},
+	}
+
+	var firstBody string
+	for i, step := range steps {
+		req, err := http.NewRequest("POST", "/email", bytes.NewBufferString(step.message))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		req.Header.Add("Authorization", "abc")
+		req.Header.Add(idempotencyKeyHeader, "key-1")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+
+		if recorder.Code != step.returnCode {
+			t.Errorf("step %d: expected return code %d but got %d", i, step.returnCode, recorder.Code)
+		}
+		if replayed := recorder.Header().Get(idempotentReplayedHeader) == "true"; replayed != step.replayed {
+			t.Errorf("step %d: expected replayed %t but got %t", i, step.replayed, replayed)
+		}
+		if i == 0 {
+			firstBody = recorder.Body.String()
+		} else if step.replayed && recorder.Body.String() != firstBody {
+			t.Errorf("step %d: expected original body '%s' but got '%s'", i, firstBody, recorder.Body.String())
+		}
+	}
+}
+
+func TestEmailControllerHandler_idempotencyAPIKeys(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	client1 := emailclient.NewMockEmailClient(mockCtrl)
+	client1.EXPECT().ProviderName().Return("mock_client1").AnyTimes()
+	client1.EXPECT().Send(gomock.Any(), "sender@example.com", gomock.Any(), "", gomock.Any()).Return("", nil).Times(2)
+
+	handler := httpHandler{
+		logger: zaptest.NewLogger(t),
+		emailManager: &emailmanager.EmailManager{
+			Logger:        zaptest.NewLogger(t),
+			EmailClients:  []emailclient.EmailClient{client1},
+			ClientTimeout: 100 * time.Millisecond,
+		},
+		keys:        apikey.Keys{"abc": "team-a", "def": "team-b"},
+		idempotency: idempotency.NewKeeper(storage.NewMemoryStore(), time.Hour),
+	}
+
+	var messageIDs []string
+	for _, step := range []struct {
+		token     string
+		recipient string
+	}{
+		{token: "abc", recipient: "a@example.com"},
+		{token: "def", recipient: "b@example.com"},
+	} {
+		message := &bytes.Buffer{}
+		json.NewEncoder(message).Encode(&Message{
+			Sender:     "sender@example.com",
+			Recipients: []string{step.recipient},
+		})
+		req := httptest.NewRequest("POST", "/email", message)
+		req.Header.Add("Authorization", step.token)
+		req.Header.Add(idempotencyKeyHeader, "order-123")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+
+		if recorder.Code != http.StatusCreated {
+			t.Errorf("%s: expected return code %d but got %d", step.token, http.StatusCreated, recorder.Code)
+		}
+		if recorder.Header().Get(idempotentReplayedHeader) != "" {
+			t.Errorf("%s: a response of another API key should not be replayed", step.token)
+		}
+		var response Response
+		json.NewDecoder(recorder.Body).Decode(&response)
+		messageIDs = append(messageIDs, response.MessageID)
+	}
+	if messageIDs[0] == messageIDs[1] {
+		t.Errorf("expected different messages, got: %v", messageIDs)
+	}
+}
+
+func TestEmailControllerHandler_rateLimit(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	em := &emailmanager.EmailManager{
+		Logger:        logger,
+		EmailClients:  []emailclient.EmailClient{emailclient.NewNopClient(logger)},
+		ClientTimeout: 100 * time.Millisecond,
+		RateLimits: map[string]*ratelimit.Bucket{
+			"nop": ratelimit.NewBucket(0.01, 2),
+		},
+	}
+	handler := httpHandler{
+		logger:       logger,
+		emailManager: em,
+		keys:         apikey.Keys{"abc": "billing", "def": "marketing"},
+		limiter:      ratelimit.NewLimiter(0.01, 2),
+	}
+
+	steps := []struct {
+		token      string
+		returnCode int
+	}{
+		{token: "abc", returnCode: http.StatusCreated},
+		{token: "abc", returnCode: http.StatusCreated},
+		{token: "abc", returnCode: http.StatusTooManyRequests},
+		// the provider is at its limit
+		{token: "def", returnCode: http.StatusServiceUnavailable},
+	}
+	for i, step := range steps {
+		message := &bytes.Buffer{}
+		json.NewEncoder(message).Encode(&Message{
+			Sender:     "sender@example.com",
+			Recipients: []string{"recipient@example.com"},
+		})
+		req := httptest.NewRequest("POST", "/email", message)
+		req.Header.Add("Authorization", step.token)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+
+		if recorder.Code != step.returnCode {
+			t.Errorf("step %d: expected return code %d but got %d", i, step.returnCode, recorder.Code)
+		}
+		retryAfter := recorder.Header().Get("Retry-After")
+		if step.returnCode != http.StatusCreated && retryAfter == "" {
+			t.Errorf("step %d: expected Retry-After header", i)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"github.com/mikolajb/emailserv/internal/callbacks"
+	"github.com/mikolajb/emailserv/internal/events"
+	"github.com/mikolajb/emailserv/internal/messages"
+	"github.com/mikolajb/emailserv/internal/suppression"
+	"go.uber.org/zap"
+)
+
+// callbackEvents are event types API callers are notified about
+var callbackEvents = map[events.Type]bool{
+	events.TypeDelivered:  true,
+	events.TypeBounced:    true,
+	events.TypeComplained: true,
+}
+
+// eventProcessor applies events reported by providers
+// to message statuses and a suppression list
+// and notifies callbacks of API callers
+type eventProcessor struct {
+	logger       *zap.Logger
+	messages     *messages.Store
+	suppressions *suppression.List
+	callbacks    *callbacks.Dispatcher
+}
+
+// process handles events, it stops on the first error
+// so a provider can deliver them again
+func (p *eventProcessor) process(evs []events.Event) error {
+	for _, e := range evs {
+		logger := p.logger.With(
+			zap.String("event", string(e.Type)),
+			zap.String("email_provider", e.Provider),
+			zap.String("provider_message_id", e.ProviderMessageID),
+			zap.String("message_id", e.MessageID),
+			zap.String("recipient", e.Recipient),
+		)
+
+		record, err := p.messages.ApplyEvent(e)
+		if err != nil {
+			logger.Error("cannot update message status", zap.Error(err))
+			return err
+		}
+		if record == nil {
+			logger.Debug("event of an unknown message")
+		} else {
+			logger.Debug("message status updated", zap.String("message_id", record.ID))
+			if p.callbacks != nil && callbackEvents[e.Type] {
+				err := p.callbacks.Notify(record.Key, callbacks.Event{
+					Type:      string(e.Type),
+					MessageID: record.ID,
+					RequestID: record.RequestID,
+					Recipient: e.Recipient,
+					Reason:    e.Reason,
+					Timestamp: e.Timestamp,
+				})
+				if err != nil {
+					logger.Error("cannot notify callbacks", zap.Error(err))
+					return err
+				}
+			}
+		}
+
+		var reason string
+		switch {
+		case e.Type == events.TypeBounced && e.Permanent:
+			reason = suppression.ReasonBounce
+		case e.Type == events.TypeComplained:
+			reason = suppression.ReasonComplaint
+		case e.Type == events.TypeUnsubscribed:
+			reason = suppression.ReasonUnsubscribe
+		}
+		if reason == "" || e.Recipient == "" {
+			continue
+		}
+		if _, err := p.suppressions.Add(e.Recipient, reason, e.Provider); err != nil {
+			logger.Error("cannot suppress an address", zap.Error(err))
+			return err
+		}
+		logger.Info("address suppressed", zap.String("reason", reason))
+	}
+
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/mikolajb/emailserv/internal/apikey"
+	"github.com/mikolajb/emailserv/internal/idempotency"
+	"github.com/mikolajb/emailserv/internal/requestid"
+	"go.uber.org/zap"
+)
+
+const (
+	idempotencyKeyHeader      = "Idempotency-Key"
+	idempotentReplayedHeader  = "Idempotent-Replayed"
+	maxIdempotencyKeyLength   = 255
+	maxIdempotentRequestBytes = 10 << 20
+)
+
+// bodyRecorder remembers a status code and a body written by a handler
+type bodyRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (br *bodyRecorder) WriteHeader(status int) {
+	br.status = status
+	br.ResponseWriter.WriteHeader(status)
+}
+
+func (br *bodyRecorder) Write(b []byte) (int, error) {
+	br.body.Write(b)
+	return br.ResponseWriter.Write(b)
+}
+
+// serveIdempotent sends a message once per idempotency key,
+// a retried request gets an original response
+func (h httpHandler) serveIdempotent(w http.ResponseWriter, r *http.Request, key string, logger *zap.Logger) {
+	requestID := requestid.FromContext(r.Context())
+	// keys of different API keys do not collide
+	apiKey := apikey.FromContext(r.Context())
+	logger = logger.With(zap.String("idempotency_key", key))
+	w.Header().Set("Content-Type", "application/json")
+	jsonEncoder := json.NewEncoder(w)
+
+	if len(key) > maxIdempotencyKeyLength {
+		w.WriteHeader(http.StatusBadRequest)
+		jsonEncoder.Encode(Response{
+			Message:   "Idempotency key too long",
+			Error:     true,
+			RequestID: requestID,
+		})
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxIdempotentRequestBytes))
+	if err != nil {
+		logger.Debug("cannot read request body", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		jsonEncoder.Encode(Response{
+			Message:   "Cannot read request body",
+			Error:     true,
+			RequestID: requestID,
+		})
+		return
+	}
+
+	record, err := h.idempotency.Begin(apiKey, key, idempotency.Hash(body))
+	switch err {
+	case nil:
+	case idempotency.ErrMismatch:
+		logger.Debug("idempotency key reused with a different request")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		jsonEncoder.Encode(Response{
+			Message:   "Idempotency key was used with a different request",
+			Error:     true,
+			RequestID: requestID,
+		})
+		return
+	case idempotency.ErrInFlight:
+		logger.Debug("request with the same idempotency key is in progress")
+		w.WriteHeader(http.StatusConflict)
+		jsonEncoder.Encode(Response{
+			Message:   "Request with the same idempotency key is in progress",
+			Error:     true,
+			RequestID: requestID,
+		})
+		return
+	default:
+		logger.Error("idempotency store error", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		jsonEncoder.Encode(Response{
+			Message:   "Internal server error",
+			Error:     true,
+			RequestID: requestID,
+		})
+		return
+	}
+
+	if record != nil {
+		logger.Debug("replaying a response", zap.Int("status", record.Status))
+		w.Header().Set(idempotentReplayedHeader, "true")
+		w.WriteHeader(record.Status)
+		w.Write(record.Body)
+		return
+	}
+
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	recorder := &bodyRecorder{ResponseWriter: w, status: http.StatusOK}
+	h.sendEmail(recorder, r, logger)
+
+	if !finalStatus(recorder.status, w.Header()) {
+		h.idempotency.Release(apiKey, key)
+		return
+	}
+	if err := h.idempotency.Complete(apiKey, key, recorder.status, recorder.body.Bytes()); err != nil {
+		logger.Error("cannot store an idempotent response", zap.Error(err))
+	}
+}
+
+// finalStatus checks if a response is a final result of a request,
+// server errors and refusals a client should retry later,
+// e.g. an exceeded quota, are not remembered
+func finalStatus(status int, header http.Header) bool {
+	if status >= http.StatusInternalServerError || status == http.StatusTooManyRequests {
+		return false
+	}
+	return header.Get("Retry-After") == ""
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"github.com/mikolajb/emailserv/internal/redact"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// newLogger builds a logger which redacts personal data
+// according to a given policy
+func newLogger(development bool, level, redactPolicy string) (*zap.Logger, error) {
+	policy, err := redact.ParsePolicy(redactPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	var zapLevel zapcore.Level
+	if err := zapLevel.Set(level); err != nil {
+		return nil, err
+	}
+
+	config := zap.NewProductionConfig()
+	if development {
+		config = zap.NewDevelopmentConfig()
+	}
+	config.Level = zap.NewAtomicLevelAt(zapLevel)
+
+	return config.Build(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return redact.NewCore(core, policy)
+	}))
+}
@@ -1,20 +1,46 @@
 package main
 
 import (
+	"context"
+	"io/ioutil"
+	"math"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/mikolajb/emailserv/internal/apikey"
+	"github.com/mikolajb/emailserv/internal/callbacks"
+	"github.com/mikolajb/emailserv/internal/dkim"
 	"github.com/mikolajb/emailserv/internal/emailclient"
 	"github.com/mikolajb/emailserv/internal/emailmanager"
+	"github.com/mikolajb/emailserv/internal/eventwebhook"
+	"github.com/mikolajb/emailserv/internal/idempotency"
+	"github.com/mikolajb/emailserv/internal/messages"
+	"github.com/mikolajb/emailserv/internal/pacing"
+	"github.com/mikolajb/emailserv/internal/quota"
+	"github.com/mikolajb/emailserv/internal/ratelimit"
+	"github.com/mikolajb/emailserv/internal/scheduler"
+	"github.com/mikolajb/emailserv/internal/sns"
+	"github.com/mikolajb/emailserv/internal/storage"
+	"github.com/mikolajb/emailserv/internal/suppression"
+	"github.com/mikolajb/emailserv/internal/tracing"
+	"github.com/mikolajb/emailserv/internal/usage"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
+// version is set during a build
+var version = "dev"
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "usage" {
+		os.Exit(usageCommand(os.Args[2:], os.Stdout, os.Stderr))
+	}
+
 	var config configuration
 	config.init()
 	config.parse()
@@ -23,54 +49,436 @@ func main() {
 	done := make(chan bool)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 
-	logger, err := zap.NewDevelopment()
+	logger, err := newLogger(config.log.development, config.log.level, config.log.redact)
 	if err != nil {
 		panic(err)
 	}
 	defer logger.Sync()
 
-	logger.Info("starting")
+	logger.Info("starting", zap.String("version", version))
+
+	exporter, err := tracing.NewExporter(
+		context.Background(),
+		config.tracing.exporter,
+		config.tracing.endpoint,
+		config.tracing.insecure,
+	)
+	if err != nil {
+		logger.Fatal("cannot create trace exporter", zap.Error(err))
+	}
+	tracerProvider := tracing.Setup(exporter, "emailserv", version)
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := tracerProvider.Shutdown(ctx); err != nil {
+			logger.Error("cannot flush traces", zap.Error(err))
+		}
+	}()
 	go func() {
 		sig := <-sigs
 		logger.Info("signal received, closing service", zap.Stringer("signal", sig))
 		done <- true
 	}()
 
+	var store storage.Store
+	if config.db == memoryDB {
+		logger.Warn("state is kept in memory, it is lost on restart")
+		store = storage.NewMemoryStore()
+	} else {
+		store, err = storage.NewBoltStore(config.db)
+		if err != nil {
+			logger.Fatal("cannot open database", zap.String("db", config.db), zap.Error(err))
+		}
+	}
+	defer store.Close()
+
+	if config.suppression.policy != suppressionDrop && config.suppression.policy != suppressionReject {
+		logger.Fatal("unknown suppression policy", zap.String("policy", config.suppression.policy))
+	}
+	suppressions := suppression.NewList(store)
+	messageStore := messages.NewStore(store)
+
+	keys := apikey.Keys{}
+	if config.keys != "" {
+		keys, err = apikey.Load(config.keys)
+		if err != nil {
+			logger.Fatal("cannot load api keys", zap.Error(err))
+		}
+	}
+	// without a keys file an empty -token keeps the service open as before
+	if config.token != "" || config.keys == "" {
+		if name, ok := keys[config.token]; ok {
+			logger.Fatal("token is already used by a key", zap.String("api_key", name))
+		}
+		keys[config.token] = apikey.DefaultName
+	}
+
+	webhookClient := &http.Client{Timeout: 10 * time.Second}
+	callbackClient := callbacks.NewClient(10 * time.Second)
+	if config.callbacks.allowInternal {
+		callbackClient = webhookClient
+	}
+	dispatcher := callbacks.NewDispatcher(logger.Named("callbacks"), store, callbackClient)
+	go dispatcher.Run(context.Background(), 5*time.Second)
+
+	keeper := idempotency.NewKeeper(store, config.idempotency.ttl)
+	go func() {
+		for range time.Tick(time.Hour) {
+			// purges are independent, one failing does not skip the others
+			if n, err := keeper.Purge(); err != nil {
+				logger.Error("cannot purge idempotency keys", zap.Error(err))
+			} else {
+				logger.Debug("idempotency keys purged", zap.Int("count", n))
+			}
+
+			if n, err := dispatcher.PurgeLog(7 * 24 * time.Hour); err != nil {
+				logger.Error("cannot purge callback log", zap.Error(err))
+			} else {
+				logger.Debug("callback log purged", zap.Int("count", n))
+			}
+
+			if n, err := dispatcher.PurgeRegistrations(7 * 24 * time.Hour); err != nil {
+				logger.Error("cannot purge message callbacks", zap.Error(err))
+			} else {
+				logger.Debug("message callbacks purged", zap.Int("count", n))
+			}
+		}
+	}()
+
+	var dkimSigner *dkim.Signer
+	if config.dkim.keys != "" {
+		keys, err := dkim.LoadKeys(config.dkim.keys)
+		if err != nil {
+			logger.Fatal("cannot load dkim keys", zap.Error(err))
+		}
+		dkimSigner = dkim.NewSigner(keys)
+	}
+
+	sinks := 0
+	for _, sink := range []bool{config.nop, config.maildir != "", config.mbox != ""} {
+		if sink {
+			sinks++
+		}
+	}
+	if sinks > 1 {
+		logger.Fatal("only one of -nop, -maildir and -mbox can be used")
+	}
+
 	var clients []emailclient.EmailClient
 	if config.nop {
 		clients = append(clients, emailclient.NewNopClient(logger.Named("nop")))
+	} else if config.maildir != "" || config.mbox != "" {
+		fileConfig := emailclient.FileConfig{
+			Format: emailclient.FormatMaildir,
+			Path:   config.maildir,
+			DKIM:   dkimSigner,
+		}
+		if config.mbox != "" {
+			fileConfig.Format = emailclient.FormatMbox
+			fileConfig.Path = config.mbox
+		}
+		fc, err := emailclient.NewFileClient(logger.Named("file"), fileConfig)
+		if err != nil {
+			logger.Fatal("cannot create file client", zap.Error(err))
+		}
+		clients = append(clients, fc)
 	} else {
-		ac, err := emailclient.NewAmazonClient(
-			logger.Named("aws"),
-			config.amazon.key,
-			config.amazon.secret,
-		)
+		tags, err := parseTags(config.amazon.tags)
+		if err != nil {
+			logger.Fatal("invalid amazon tags", zap.Error(err))
+		}
+		amazonConfig := emailclient.AmazonConfig{
+			KeyID:            config.amazon.key,
+			SecretKey:        config.amazon.secret,
+			Region:           config.amazon.region,
+			Endpoint:         config.amazon.endpoint,
+			ConfigurationSet: config.amazon.configurationSet,
+			Tags:             tags,
+			SourceArn:        config.amazon.sourceArn,
+			RoleArn:          config.amazon.roleArn,
+			ExternalID:       config.amazon.externalID,
+			RoleSessionName:  config.amazon.roleSessionName,
+			STSEndpoint:      config.amazon.stsEndpoint,
+			DKIM:             dkimSigner,
+		}
+		ac, err := emailclient.NewAmazonClient(logger.Named("aws"), amazonConfig)
 		if err != nil {
 			logger.Fatal("cannot create amazon sns client", zap.Error(err))
 		}
+		// credentials can be unavailable for a moment, e.g. instance metadata,
+		// so sending is not blocked by it
+		source, keyID, err := ac.CredentialSource()
+		if err != nil {
+			logger.Warn("cannot retrieve aws credentials", zap.String("role_arn", config.amazon.roleArn), zap.Error(err))
+		} else {
+			logger.Info("aws credentials",
+				zap.String("source", source),
+				zap.String("key_id", keyID),
+				zap.String("role_arn", config.amazon.roleArn),
+			)
+		}
 		sc, err := emailclient.NewSendgridClient(
 			logger.Named("sendgrid"),
 			config.sendgrid.key,
+			config.sendgrid.baseURL,
 		)
 		if err != nil {
 			logger.Fatal("cannot create sendgrid client", zap.Error(err))
 		}
 		clients = append(clients, ac, sc)
+
+		if config.mailgun.domain != "" && config.mailgun.key != "" {
+			variables, err := parseTags(config.mailgun.variables)
+			if err != nil {
+				logger.Fatal("invalid mailgun variables", zap.Error(err))
+			}
+			mc, err := emailclient.NewMailgunClient(logger.Named("mailgun"), emailclient.MailgunConfig{
+				Domain:    config.mailgun.domain,
+				Key:       config.mailgun.key,
+				Region:    config.mailgun.region,
+				BaseURL:   config.mailgun.baseURL,
+				Tags:      parseList(config.mailgun.tags),
+				Variables: variables,
+			})
+			if err != nil {
+				logger.Fatal("cannot create mailgun client", zap.Error(err))
+			}
+			clients = append(clients, mc)
+		}
+
+		if config.postmark.serverToken != "" {
+			metadata, err := parseTags(config.postmark.metadata)
+			if err != nil {
+				logger.Fatal("invalid postmark metadata", zap.Error(err))
+			}
+			pc, err := emailclient.NewPostmarkClient(logger.Named("postmark"), emailclient.PostmarkConfig{
+				ServerToken:   config.postmark.serverToken,
+				MessageStream: config.postmark.messageStream,
+				Tag:           config.postmark.tag,
+				Metadata:      metadata,
+				BaseURL:       config.postmark.baseURL,
+			})
+			if err != nil {
+				logger.Fatal("cannot create postmark client", zap.Error(err))
+			}
+			clients = append(clients, pc)
+		}
+
+		if config.sendmail.command != "" {
+			sm, err := emailclient.NewSendmailClient(logger.Named("sendmail"), emailclient.SendmailConfig{
+				Command: strings.Fields(config.sendmail.command),
+				DKIM:    dkimSigner,
+			})
+			if err != nil {
+				logger.Fatal("cannot create sendmail client", zap.Error(err))
+			}
+			clients = append(clients, sm)
+		}
+
+		if config.webhook.config != "" {
+			webhookConfig, err := emailclient.LoadWebhookConfig(config.webhook.config)
+			if err != nil {
+				logger.Fatal("cannot load webhook client config", zap.Error(err))
+			}
+			wc, err := emailclient.NewWebhookClient(logger.Named("webhook"), *webhookConfig)
+			if err != nil {
+				logger.Fatal("cannot create webhook client", zap.Error(err))
+			}
+			clients = append(clients, wc)
+		}
 	}
 
 	em := &emailmanager.EmailManager{
 		Logger:        logger.Named("email-manager"),
 		EmailClients:  clients,
 		ClientTimeout: time.Duration(config.clientTimeout) * time.Millisecond,
+		RateLimits:    map[string]*ratelimit.Bucket{},
+	}
+	if config.pacing.def != "" || config.pacing.domains != "" {
+		var def pacing.Limit
+		if config.pacing.def != "" {
+			def, err = pacing.ParseLimit(config.pacing.def)
+			if err != nil {
+				logger.Fatal("invalid pacing limit", zap.Error(err))
+			}
+		}
+		domains, err := pacing.ParseDomains(config.pacing.domains)
+		if err != nil {
+			logger.Fatal("invalid pacing limits", zap.Error(err))
+		}
+		em.Pacer = pacing.New(def, domains)
+	}
+	for provider, rate := range map[string]float64{
+		"aws":      config.amazon.maxSendRate,
+		"sendgrid": config.sendgrid.maxSendRate,
+		"mailgun":  config.mailgun.maxSendRate,
+		"postmark": config.postmark.maxSendRate,
+	} {
+		if rate > 0 {
+			// a burst of a single second of sending
+			em.RateLimits[provider] = ratelimit.NewBucket(rate, int(math.Ceil(rate)))
+		}
+	}
+
+	usageRecorder := usage.NewRecorder(store)
+	var pricing usage.Pricing
+	if config.pricing != "" {
+		pricing, err = usage.LoadPricing(config.pricing)
+		if err != nil {
+			logger.Fatal("cannot load pricing", zap.Error(err))
+		}
+	}
+	if config.routing != emailmanager.RoutingPriority && config.routing != emailmanager.RoutingCost {
+		logger.Fatal("unknown routing", zap.String("routing", config.routing))
+	}
+	em.Routing = config.routing
+	em.Pricing = pricing
+	if em.Routing == emailmanager.RoutingCost {
+		// volumes included in plans are used up by messages sent this month
+		now := time.Now().UTC()
+		monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		rows, err := usageRecorder.Report(monthStart, now.Add(time.Hour), nil)
+		if err != nil {
+			logger.Fatal("cannot read usage", zap.Error(err))
+		}
+		for _, row := range rows {
+			em.AddVolume(row.Provider, row.Recipients)
+		}
 	}
 
+	var quotaLimits map[string]quota.Limits
+	if config.quotas != "" {
+		quotaLimits, err = quota.Load(config.quotas)
+		if err != nil {
+			logger.Fatal("cannot load quotas", zap.Error(err))
+		}
+	}
+	quotas := quota.New(store, quotaLimits)
+
+	sender := &scheduledSender{
+		logger:       logger.Named("scheduled-sender"),
+		emailManager: em,
+		messages:     messageStore,
+		callbacks:    dispatcher,
+		usage:        usageRecorder,
+		quotas:       quotas,
+	}
+	messageScheduler := scheduler.New(logger.Named("scheduler"), store, sender.send)
+	messageScheduler.Lead = config.schedule.lead
+	messageScheduler.Deferred = sender.deferred
+	go messageScheduler.Run(context.Background(), 5*time.Second)
+
 	handler := httpHandler{
-		logger:             logger.Named("http-handler"),
-		emailManager:       em,
-		authorizationToken: config.token,
+		logger:            logger.Named("http-handler"),
+		emailManager:      em,
+		keys:              keys,
+		idempotency:       keeper,
+		suppressions:      suppressions,
+		suppressionPolicy: config.suppression.policy,
+		messages:          messageStore,
+		callbacks:         dispatcher,
+		scheduler:         messageScheduler,
+		usage:             usageRecorder,
+	}
+	handler.quotas = quotas
+	if em.Pacer != nil {
+		handler.pacingMaxWait = config.pacing.maxWait
+	}
+	if config.rateLimit.rate > 0 {
+		handler.limiter = ratelimit.NewLimiter(config.rateLimit.rate, config.rateLimit.burst)
 	}
 
 	http.Handle("/email", handler)
+	http.Handle("/email/", statusHandler{
+		logger:    logger.Named("status-handler"),
+		messages:  messageStore,
+		keys:      keys,
+		scheduler: messageScheduler,
+		quotas:    quotas,
+	})
+
+	callbackHandler := callbacksHandler{
+		logger:    logger.Named("callbacks-handler"),
+		keys:      keys,
+		callbacks: dispatcher,
+	}
+	http.Handle("/callbacks", callbackHandler)
+	http.Handle("/callbacks/", callbackHandler)
+
+	processor := &eventProcessor{
+		logger:       logger.Named("event-processor"),
+		messages:     messageStore,
+		suppressions: suppressions,
+		callbacks:    dispatcher,
+	}
+
+	topicArns := map[string]bool{}
+	for _, arn := range strings.Split(config.sns.topicArns, ",") {
+		if arn = strings.TrimSpace(arn); arn != "" {
+			topicArns[arn] = true
+		}
+	}
+	// signed messages of any topic could change statuses and suppressions
+	if len(topicArns) > 0 {
+		var certificates sns.CertificateSource
+		if config.sns.certificate == "" {
+			certificates = sns.NewHTTPCertificateSource(webhookClient)
+		} else {
+			pemData, err := ioutil.ReadFile(config.sns.certificate)
+			if err != nil {
+				logger.Fatal("cannot read sns certificate", zap.Error(err))
+			}
+			certificates, err = sns.NewStaticCertificateSource(pemData)
+			if err != nil {
+				logger.Fatal("invalid sns certificate", zap.Error(err))
+			}
+		}
+		http.Handle("/webhooks/sns", snsHandler{
+			logger:     logger.Named("sns-handler"),
+			verifier:   sns.NewVerifier(certificates),
+			httpClient: webhookClient,
+			topicArns:  topicArns,
+			processor:  processor,
+		})
+	}
+
+	if config.sendgrid.webhookKey != "" {
+		verifier, err := eventwebhook.NewVerifier(config.sendgrid.webhookKey, eventwebhook.DefaultTolerance)
+		if err != nil {
+			logger.Fatal("invalid sendgrid webhook key", zap.Error(err))
+		}
+		http.Handle("/webhooks/sendgrid", sendgridHandler{
+			logger:    logger.Named("sendgrid-handler"),
+			verifier:  verifier,
+			processor: processor,
+		})
+	}
+
+	adminSuppressionHandler := suppressionHandler{
+		logger:       logger.Named("suppression-handler"),
+		suppressions: suppressions,
+		adminToken:   config.admin.token,
+	}
+	http.Handle("/admin/suppressions", adminSuppressionHandler)
+	http.Handle("/admin/suppressions/", adminSuppressionHandler)
+	adminQuotaHandler := quotaHandler{
+		logger:     logger.Named("quota-handler"),
+		quotas:     quotas,
+		adminToken: config.admin.token,
+	}
+	http.Handle("/admin/quotas", adminQuotaHandler)
+	http.Handle("/admin/quotas/", adminQuotaHandler)
+	http.Handle("/admin/usage", usageHandler{
+		logger:     logger.Named("usage-handler"),
+		usage:      usageRecorder,
+		pricing:    pricing,
+		adminToken: config.admin.token,
+	})
+	http.Handle("/admin/pacing", pacingHandler{
+		logger:     logger.Named("pacing-handler"),
+		pacer:      em.Pacer,
+		adminToken: config.admin.token,
+	})
 
 	listener, err := net.Listen("tcp", ":"+config.port)
 	if err != nil {
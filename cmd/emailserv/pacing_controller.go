@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/mikolajb/emailserv/internal/pacing"
+	"github.com/mikolajb/emailserv/internal/requestid"
+	"go.uber.org/zap"
+)
+
+// PacingResponse describes messages waiting for recipient domains
+type PacingResponse struct {
+	// Backlog is a number of messages waiting for any domain
+	Backlog int `json:"backlog"`
+
+	Domains map[string]pacing.Stats `json:"domains"`
+}
+
+// pacingHandler is an admin controller reporting a backlog per domain
+// GET /admin/pacing returns stats of domains
+type pacingHandler struct {
+	logger     *zap.Logger
+	pacer      *pacing.Pacer
+	adminToken string
+}
+
+func (h pacingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	requestID := requestid.FromRequest(r)
+	logger := h.logger.With(zap.String("request_id", requestID))
+	w.Header().Set(requestid.Header, requestID)
+
+	if !requireAdmin(h.adminToken, r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if r.Method != "GET" {
+		logger.Debug("received request with a wrong method", zap.String("method", r.Method))
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	response := PacingResponse{Domains: map[string]pacing.Stats{}}
+	if h.pacer != nil {
+		response.Domains = h.pacer.Stats()
+	}
+	for _, stats := range response.Domains {
+		response.Backlog += stats.Backlog
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mikolajb/emailserv/internal/apikey"
+	"github.com/mikolajb/emailserv/internal/emailclient"
+	"github.com/mikolajb/emailserv/internal/emailmanager"
+	"github.com/mikolajb/emailserv/internal/pacing"
+	"github.com/mikolajb/emailserv/internal/requestid"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestPacingHandler(t *testing.T) {
+	pacer := pacing.New(pacing.Limit{}, map[string]pacing.Limit{"gmail.com": {Concurrency: 1}})
+	release, err := pacer.Acquire(context.Background(), []string{"a@gmail.com"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	defer release()
+
+	handler := pacingHandler{
+		logger:     zaptest.NewLogger(t),
+		pacer:      pacer,
+		adminToken: "admin",
+	}
+
+	cases := map[string]struct {
+		token      string
+		method     string
+		returnCode int
+	}{
+		"ok": {
+			token:      "admin",
+			method:     "GET",
+			returnCode: http.StatusOK,
+		},
+		"unauthorized": {
+			token:      "abc",
+			method:     "GET",
+			returnCode: http.StatusUnauthorized,
+		},
+		"bad-method": {
+			token:      "admin",
+			method:     "POST",
+			returnCode: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for hint, c := range cases {
+		t.Run(hint, func(t *testing.T) {
+			req := httptest.NewRequest(c.method, "/admin/pacing", nil)
+			req.Header.Add("Authorization", c.token)
+			req.Header.Add(requestid.Header, "admin-request")
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != c.returnCode {
+				t.Fatalf("wrong status code, expected: %d, got: %d", c.returnCode, rr.Code)
+			}
+			if id := rr.Header().Get(requestid.Header); id != "admin-request" {
+				t.Errorf("expected a request ID of a caller, got: %q", id)
+			}
+			if rr.Code != http.StatusOK {
+				return
+			}
+			var response PacingResponse
+			if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if response.Domains["gmail.com"].InFlight != 1 {
+				t.Errorf("wrong stats: %+v", response)
+			}
+		})
+	}
+}
+
+func TestEmailControllerHandler_pacingMaxWait(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	pacer := pacing.New(pacing.Limit{}, map[string]pacing.Limit{"gmail.com": {Concurrency: 1}})
+	release, err := pacer.Acquire(context.Background(), []string{"a@gmail.com"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	defer release()
+
+	handler := httpHandler{
+		logger: logger,
+		emailManager: &emailmanager.EmailManager{
+			Logger:        logger,
+			EmailClients:  []emailclient.EmailClient{emailclient.NewNopClient(logger)},
+			ClientTimeout: time.Second,
+			Pacer:         pacer,
+		},
+		keys:          apikey.Keys{"abc": "default"},
+		pacingMaxWait: 10 * time.Millisecond,
+	}
+
+	cases := map[string]struct {
+		recipient  string
+		returnCode int
+	}{
+		"busy": {
+			recipient:  "b@gmail.com",
+			returnCode: http.StatusServiceUnavailable,
+		},
+		"free": {
+			recipient:  "b@example.com",
+			returnCode: http.StatusCreated,
+		},
+	}
+
+	for hint, c := range cases {
+		t.Run(hint, func(t *testing.T) {
+			message := &bytes.Buffer{}
+			json.NewEncoder(message).Encode(&Message{
+				Sender:     "sender@example.com",
+				Recipients: []string{c.recipient},
+			})
+			req := httptest.NewRequest("POST", "/email", message)
+			req.Header.Add("Authorization", "abc")
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != c.returnCode {
+				t.Fatalf("wrong status code, expected: %d, got: %d", c.returnCode, rr.Code)
+			}
+			retryAfter := rr.Header().Get("Retry-After")
+			if c.returnCode == http.StatusServiceUnavailable && retryAfter == "" {
+				t.Errorf("expected Retry-After header")
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/mikolajb/emailserv/internal/quota"
+	"github.com/mikolajb/emailserv/internal/requestid"
+	"go.uber.org/zap"
+)
+
+// QuotaUsage is usage of an API key with its limits
+type QuotaUsage struct {
+	*quota.Usage
+	Limits quota.Limits `json:"limits"`
+}
+
+// QuotasResponse is usage of all API keys
+type QuotasResponse struct {
+	Quotas []QuotaUsage `json:"quotas"`
+}
+
+// quotaHandler is an admin controller of quotas of API keys
+// GET /admin/quotas lists usage of all keys
+// GET /admin/quotas/{key} returns usage of a key
+// DELETE /admin/quotas/{key}?period=day|month resets usage of a key,
+// both periods are reset without a period
+type quotaHandler struct {
+	logger     *zap.Logger
+	quotas     *quota.Quotas
+	adminToken string
+}
+
+func (h quotaHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	requestID := requestid.FromRequest(r)
+	logger := h.logger.With(zap.String("request_id", requestID))
+	w.Header().Set(requestid.Header, requestID)
+
+	if !requireAdmin(h.adminToken, r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	jsonEncoder := json.NewEncoder(w)
+	w.Header().Set("Content-Type", "application/json")
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/admin/quotas"), "/")
+	internalError := func(msg string, err error) {
+		logger.Error(msg, zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		jsonEncoder.Encode(Response{
+			Message:   "Internal server error",
+			Error:     true,
+			RequestID: requestID,
+		})
+	}
+
+	switch {
+	case r.Method == "GET" && key == "":
+		usage, err := h.quotas.All()
+		if err != nil {
+			internalError("cannot list quotas", err)
+			return
+		}
+		response := QuotasResponse{Quotas: []QuotaUsage{}}
+		for _, u := range usage {
+			response.Quotas = append(response.Quotas, QuotaUsage{Usage: u, Limits: h.quotas.Limits(u.Key)})
+		}
+		jsonEncoder.Encode(response)
+	case r.Method == "GET":
+		u, err := h.quotas.Usage(key)
+		if err != nil {
+			internalError("cannot get quota", err)
+			return
+		}
+		jsonEncoder.Encode(QuotaUsage{Usage: u, Limits: h.quotas.Limits(key)})
+	case r.Method == "DELETE" && key != "":
+		period := r.URL.Query().Get("period")
+		u, err := h.quotas.Reset(key, period)
+		if err == quota.ErrInvalidPeriod {
+			w.WriteHeader(http.StatusBadRequest)
+			jsonEncoder.Encode(Response{
+				Message: "Request not valid",
+				ValidationErrors: []*ValidationError{{
+					Field: "period",
+					Error: err.Error(),
+				}},
+				Error:     true,
+				RequestID: requestID,
+			})
+			return
+		}
+		if err != nil {
+			internalError("cannot reset quota", err)
+			return
+		}
+		logger.Info("quota reset", zap.String("api_key", key), zap.String("period", period))
+		jsonEncoder.Encode(QuotaUsage{Usage: u, Limits: h.quotas.Limits(key)})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mikolajb/emailserv/internal/apikey"
+	"github.com/mikolajb/emailserv/internal/emailclient"
+	"github.com/mikolajb/emailserv/internal/emailmanager"
+	"github.com/mikolajb/emailserv/internal/idempotency"
+	"github.com/mikolajb/emailserv/internal/quota"
+	"github.com/mikolajb/emailserv/internal/storage"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestEmailControllerHandler_quota(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	quotas := quota.New(storage.NewMemoryStore(), map[string]quota.Limits{
+		"billing": {MessagesPerDay: 1},
+	})
+	handler := httpHandler{
+		logger: logger,
+		emailManager: &emailmanager.EmailManager{
+			Logger:        logger,
+			EmailClients:  []emailclient.EmailClient{emailclient.NewNopClient(logger)},
+			ClientTimeout: 100 * time.Millisecond,
+		},
+		keys:   apikey.Keys{"abc": "billing"},
+		quotas: quotas,
+	}
+	admin := quotaHandler{
+		logger:     logger,
+		quotas:     quotas,
+		adminToken: "admin",
+	}
+
+	send := func() *httptest.ResponseRecorder {
+		message := &bytes.Buffer{}
+		json.NewEncoder(message).Encode(&Message{
+			Sender:     "sender@example.com",
+			Recipients: []string{"recipient@example.com"},
+		})
+		req := httptest.NewRequest("POST", "/email", message)
+		req.Header.Add("Authorization", "abc")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+	adminRequest := func(method, path string) (int, QuotaUsage) {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Add("Authorization", "admin")
+		rr := httptest.NewRecorder()
+		admin.ServeHTTP(rr, req)
+		var usage QuotaUsage
+		json.NewDecoder(rr.Body).Decode(&usage)
+		return rr.Code, usage
+	}
+
+	if rr := send(); rr.Code != http.StatusCreated {
+		t.Fatalf("wrong status code, expected: %d, got: %d", http.StatusCreated, rr.Code)
+	}
+	rr := send()
+	if rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") == "" {
+		t.Fatalf("wrong status code, expected: %d, got: %d", http.StatusTooManyRequests, rr.Code)
+	}
+	var response Response
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if response.Quota == nil || response.Quota.Period != quota.Day || response.Quota.Resource != "messages" {
+		t.Errorf("wrong quota in a response: %+v", response.Quota)
+	}
+
+	code, usage := adminRequest("GET", "/admin/quotas/billing")
+	if code != http.StatusOK || usage.Usage == nil || usage.Daily.Messages != 1 || usage.Limits.MessagesPerDay != 1 {
+		t.Errorf("wrong usage: %d %+v", code, usage)
+	}
+	if code, _ := adminRequest("DELETE", "/admin/quotas/billing?period=week"); code != http.StatusBadRequest {
+		t.Errorf("wrong status code, expected: %d, got: %d", http.StatusBadRequest, code)
+	}
+	code, usage = adminRequest("DELETE", "/admin/quotas/billing?period=day")
+	if code != http.StatusOK || usage.Usage == nil || usage.Daily.Messages != 0 || usage.Monthly.Messages != 1 {
+		t.Errorf("wrong usage after reset: %d %+v", code, usage)
+	}
+	if rr := send(); rr.Code != http.StatusCreated {
+		t.Errorf("a message should be sent after reset, got: %d", rr.Code)
+	}
+
+	req := httptest.NewRequest("GET", "/admin/quotas", nil)
+	req.Header.Add("Authorization", "admin")
+	rr = httptest.NewRecorder()
+	admin.ServeHTTP(rr, req)
+	var all QuotasResponse
+	if err := json.NewDecoder(rr.Body).Decode(&all); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if len(all.Quotas) != 1 || all.Quotas[0].Key != "billing" {
+		t.Errorf("wrong quotas: %+v", all)
+	}
+}
+
+func TestEmailControllerHandler_quotaIdempotency(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	quotas := quota.New(storage.NewMemoryStore(), map[string]quota.Limits{
+		"billing": {MessagesPerDay: 1},
+	})
+	handler := httpHandler{
+		logger: logger,
+		emailManager: &emailmanager.EmailManager{
+			Logger:        logger,
+			EmailClients:  []emailclient.EmailClient{emailclient.NewNopClient(logger)},
+			ClientTimeout: 100 * time.Millisecond,
+		},
+		keys:        apikey.Keys{"abc": "billing"},
+		idempotency: idempotency.NewKeeper(storage.NewMemoryStore(), time.Hour),
+		quotas:      quotas,
+	}
+
+	send := func(key string) *httptest.ResponseRecorder {
+		message := &bytes.Buffer{}
+		json.NewEncoder(message).Encode(&Message{
+			Sender:     "sender@example.com",
+			Recipients: []string{"recipient@example.com"},
+		})
+		req := httptest.NewRequest("POST", "/email", message)
+		req.Header.Add("Authorization", "abc")
+		req.Header.Add(idempotencyKeyHeader, key)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := send("key-1"); rr.Code != http.StatusCreated {
+		t.Fatalf("wrong status code, expected: %d, got: %d", http.StatusCreated, rr.Code)
+	}
+	if rr := send("key-2"); rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("wrong status code, expected: %d, got: %d", http.StatusTooManyRequests, rr.Code)
+	}
+
+	if _, err := quotas.Reset("billing", quota.Day); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	rr := send("key-2")
+	if rr.Code != http.StatusCreated {
+		t.Errorf("a retried request should be sent after reset, got: %d", rr.Code)
+	}
+	if rr.Header().Get(idempotentReplayedHeader) != "" {
+		t.Errorf("an exceeded quota should not be replayed")
+	}
+}
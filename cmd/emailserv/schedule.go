@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+
+	"github.com/mikolajb/emailserv/internal/apikey"
+	"github.com/mikolajb/emailserv/internal/callbacks"
+	"github.com/mikolajb/emailserv/internal/emailclient"
+	"github.com/mikolajb/emailserv/internal/emailmanager"
+	"github.com/mikolajb/emailserv/internal/messages"
+	"github.com/mikolajb/emailserv/internal/quota"
+	"github.com/mikolajb/emailserv/internal/requestid"
+	"github.com/mikolajb/emailserv/internal/scheduler"
+	"github.com/mikolajb/emailserv/internal/usage"
+	"go.uber.org/zap"
+)
+
+// scheduledSender sends messages released by a scheduler
+type scheduledSender struct {
+	logger       *zap.Logger
+	emailManager *emailmanager.EmailManager
+	messages     *messages.Store
+	callbacks    *callbacks.Dispatcher
+	usage        *usage.Recorder
+	quotas       *quota.Quotas
+}
+
+// send is a scheduler.SendFunc, an early job is only passed
+// to clients which can schedule it, a failure of such a job is not final
+func (s *scheduledSender) send(ctx context.Context, job *scheduler.Job, early bool) error {
+	ctx = apikey.NewContext(requestid.NewContext(ctx, job.RequestID), job.Key)
+	logger := s.logger.With(
+		requestid.Field(ctx),
+		zap.String("api_key", job.Key),
+		zap.String("message_id", job.ID),
+	)
+
+	opts := []emailclient.EmailOption{
+		emailclient.WithBody(job.Email.Body),
+		emailclient.WithCCRecipients(job.Email.CCRecipients),
+		emailclient.WithBCCRecipients(job.Email.BCCRecipients),
+		emailclient.WithMessageID(job.ID),
+	}
+	if job.Email.Sendgrid != nil {
+		opts = append(opts, emailclient.WithSendgrid(*job.Email.Sendgrid))
+	}
+	if early {
+		opts = append(opts, emailclient.WithSendAt(job.SendAt))
+	}
+
+	result, err := s.emailManager.Send(
+		ctx,
+		job.Email.Sender,
+		job.Email.Recipients,
+		job.Email.Subject,
+		opts...,
+	)
+	if err != nil && early {
+		return err
+	}
+	if err != nil {
+		logger.Error("send error", zap.Error(err))
+		releaseJobQuota(logger, s.quotas, job)
+		s.setStatus(logger, job, messages.StatusFailed, err.Error(), nil)
+		return err
+	}
+
+	s.setStatus(logger, job, messages.StatusSent, "", result)
+	email := job.Email
+	recordUsage(logger, s.usage, &usage.Record{
+		Key:        job.Key,
+		Provider:   result.Provider,
+		MessageID:  job.ID,
+		Recipients: email.RecipientCount(),
+		Size:       len(email.Subject) + len(email.Body),
+	})
+	return nil
+}
+
+// releaseJobQuota gives back a quota reserved by a scheduled message
+// which was not sent, in a period it was reserved in
+func releaseJobQuota(logger *zap.Logger, quotas *quota.Quotas, job *scheduler.Job) {
+	if quotas == nil {
+		return
+	}
+	if err := quotas.ReleaseAt(job.Key, job.Email.RecipientCount(), job.CreatedAt); err != nil {
+		logger.Error("cannot release quota", zap.Error(err))
+	}
+}
+
+// deferred records that a message is moved out of quiet hours,
+// it is a scheduler.Scheduler.Deferred function
+func (s *scheduledSender) deferred(job *scheduler.Job, reason string) {
+	sendAt := job.SendAt
+	_, err := s.messages.SetStatus(job.ID, messages.StatusDeferred, reason, func(r *messages.Record) {
+		r.SendAt = &sendAt
+		r.DeferredReason = reason
+	})
+	if err != nil {
+		s.logger.Error("cannot save message status", zap.String("message_id", job.ID), zap.Error(err))
+	}
+}
+
+// setStatus updates a status of a scheduled message and notifies callbacks
+func (s *scheduledSender) setStatus(logger *zap.Logger, job *scheduler.Job, status messages.Status, reason string, result *emailmanager.SendResult) {
+	_, err := s.messages.SetStatus(job.ID, status, reason, func(r *messages.Record) {
+		r.DeferredReason = ""
+		if result != nil {
+			r.Provider = result.Provider
+			r.ProviderMessageID = result.ProviderMessageID
+		}
+	})
+	if err != nil {
+		logger.Error("cannot save message status", zap.Error(err))
+	}
+
+	if s.callbacks == nil {
+		return
+	}
+	err = s.callbacks.Notify(job.Key, callbacks.Event{
+		Type:      string(status),
+		MessageID: job.ID,
+		RequestID: job.RequestID,
+		Reason:    reason,
+	})
+	if err != nil {
+		logger.Error("cannot notify callbacks", zap.Error(err))
+	}
+}
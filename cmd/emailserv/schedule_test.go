@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/mikolajb/emailserv/internal/apikey"
+	"github.com/mikolajb/emailserv/internal/emailclient"
+	"github.com/mikolajb/emailserv/internal/emailmanager"
+	"github.com/mikolajb/emailserv/internal/messages"
+	"github.com/mikolajb/emailserv/internal/quota"
+	"github.com/mikolajb/emailserv/internal/scheduler"
+	"github.com/mikolajb/emailserv/internal/storage"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestEmailControllerHandler_schedule(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	store := storage.NewMemoryStore()
+	messageStore := messages.NewStore(store)
+	em := &emailmanager.EmailManager{
+		Logger:        logger,
+		EmailClients:  []emailclient.EmailClient{emailclient.NewNopClient(logger)},
+		ClientTimeout: 100 * time.Millisecond,
+	}
+	sender := &scheduledSender{
+		logger:       logger,
+		emailManager: em,
+		messages:     messageStore,
+	}
+	messageScheduler := scheduler.New(logger, store, sender.send)
+	keys := apikey.Keys{"abc": apikey.DefaultName}
+
+	handler := httpHandler{
+		logger:       logger,
+		emailManager: em,
+		keys:         keys,
+		messages:     messageStore,
+		scheduler:    messageScheduler,
+	}
+	status := statusHandler{
+		logger:    logger,
+		messages:  messageStore,
+		keys:      keys,
+		scheduler: messageScheduler,
+	}
+
+	schedule := func(sendAt time.Time) Response {
+		message := &bytes.Buffer{}
+		json.NewEncoder(message).Encode(&Message{
+			Sender:     "sender@example.com",
+			Recipients: []string{"recipient@example.com"},
+			SendAt:     &sendAt,
+		})
+		req := httptest.NewRequest("POST", "/email", message)
+		req.Header.Add("Authorization", "abc")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusAccepted {
+			t.Fatalf("wrong status code, expected: %d, got: %d", http.StatusAccepted, rr.Code)
+		}
+		var response Response
+		if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		return response
+	}
+	cancel := func(id string) int {
+		req := httptest.NewRequest("DELETE", "/email/"+id, nil)
+		req.Header.Add("Authorization", "abc")
+		rr := httptest.NewRecorder()
+		status.ServeHTTP(rr, req)
+		return rr.Code
+	}
+	checkStatus := func(id string, expected messages.Status) {
+		record, err := messageStore.Get(id)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		if record.Status != expected {
+			t.Errorf("wrong status of %s, expected: %s, got: %s", id, expected, record.Status)
+		}
+	}
+
+	canceled := schedule(time.Now().Add(time.Hour))
+	released := schedule(time.Now().Add(100 * time.Millisecond))
+	checkStatus(canceled.MessageID, messages.StatusScheduled)
+	checkStatus(released.MessageID, messages.StatusScheduled)
+
+	if code := cancel(canceled.MessageID); code != http.StatusOK {
+		t.Errorf("wrong status code, expected: %d, got: %d", http.StatusOK, code)
+	}
+	checkStatus(canceled.MessageID, messages.StatusCanceled)
+	if code := cancel(canceled.MessageID); code != http.StatusConflict {
+		t.Errorf("wrong status code, expected: %d, got: %d", http.StatusConflict, code)
+	}
+
+	if n, _ := messageScheduler.DispatchDue(context.Background()); n != 0 {
+		t.Errorf("no message should be due, got: %d", n)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n, _ := messageScheduler.DispatchDue(context.Background()); n != 1 {
+		t.Errorf("a single message should be due, got: %d", n)
+	}
+	checkStatus(released.MessageID, messages.StatusSent)
+	if code := cancel(released.MessageID); code != http.StatusConflict {
+		t.Errorf("wrong status code, expected: %d, got: %d", http.StatusConflict, code)
+	}
+}
+
+func TestEmailControllerHandler_quietHours(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	store := storage.NewMemoryStore()
+	messageStore := messages.NewStore(store)
+	em := &emailmanager.EmailManager{
+		Logger:        logger,
+		EmailClients:  []emailclient.EmailClient{emailclient.NewNopClient(logger)},
+		ClientTimeout: 100 * time.Millisecond,
+	}
+	handler := httpHandler{
+		logger:       logger,
+		emailManager: em,
+		keys:         apikey.Keys{"abc": apikey.DefaultName},
+		messages:     messageStore,
+		scheduler:    scheduler.New(logger, store, nil),
+	}
+
+	now := time.Now().In(time.FixedZone("", 0))
+	cases := map[string]struct {
+		timezone   string
+		quietHours *QuietHours
+		code       int
+		status     messages.Status
+	}{
+		"outside-quiet-hours": {
+			quietHours: &QuietHours{Start: now.Add(2 * time.Hour).Format("15:04"), End: now.Add(3 * time.Hour).Format("15:04")},
+			code:       http.StatusCreated,
+			status:     messages.StatusSent,
+		},
+		"during-quiet-hours": {
+			timezone:   "Etc/GMT-3",
+			quietHours: &QuietHours{Start: now.Add(2 * time.Hour).Format("15:04"), End: now.Add(4 * time.Hour).Format("15:04")},
+			code:       http.StatusAccepted,
+			status:     messages.StatusDeferred,
+		},
+		"unknown-timezone": {
+			timezone:   "Mars/Olympus_Mons",
+			quietHours: &QuietHours{Start: "22:00", End: "08:00"},
+			code:       http.StatusBadRequest,
+		},
+		"invalid-quiet-hours": {
+			quietHours: &QuietHours{Start: "22:00", End: "22:00"},
+			code:       http.StatusBadRequest,
+		},
+	}
+
+	for hint, c := range cases {
+		t.Run(hint, func(t *testing.T) {
+			message := &bytes.Buffer{}
+			json.NewEncoder(message).Encode(&Message{
+				Sender:     "sender@example.com",
+				Recipients: []string{"recipient@example.com"},
+				Timezone:   c.timezone,
+				QuietHours: c.quietHours,
+			})
+			req := httptest.NewRequest("POST", "/email", message)
+			req.Header.Add("Authorization", "abc")
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != c.code {
+				t.Fatalf("wrong status code, expected: %d, got: %d", c.code, rr.Code)
+			}
+			if c.status == "" {
+				return
+			}
+			var response Response
+			if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			record, err := messageStore.Get(response.MessageID)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if record.Status != c.status {
+				t.Errorf("wrong status, expected: %s, got: %s", c.status, record.Status)
+			}
+			if c.status != messages.StatusDeferred {
+				return
+			}
+			if record.DeferredReason == "" || record.SendAt == nil {
+				t.Fatalf("a deferred message should have a reason and a time, got: %+v", record)
+			}
+			expected := now.Add(time.Hour).Truncate(time.Minute)
+			if !record.SendAt.Equal(expected) {
+				t.Errorf("wrong send time, expected: %s, got: %s", expected, record.SendAt)
+			}
+		})
+	}
+}
+
+func TestEmailControllerHandler_scheduleQuota(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	client := emailclient.NewMockEmailClient(mockCtrl)
+	client.EXPECT().ProviderName().Return("mock_client").AnyTimes()
+	client.EXPECT().Send(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		Return("", &emailclient.Error{Class: emailclient.ClassPermanent, Err: errors.New("rejected")}).Times(1)
+
+	logger := zaptest.NewLogger(t)
+	store := storage.NewMemoryStore()
+	messageStore := messages.NewStore(store)
+	quotas := quota.New(store, map[string]quota.Limits{
+		apikey.DefaultName: {MessagesPerDay: 2},
+	})
+	em := &emailmanager.EmailManager{
+		Logger:        logger,
+		EmailClients:  []emailclient.EmailClient{client},
+		ClientTimeout: 100 * time.Millisecond,
+	}
+	sender := &scheduledSender{
+		logger:       logger,
+		emailManager: em,
+		messages:     messageStore,
+		quotas:       quotas,
+	}
+	messageScheduler := scheduler.New(logger, store, sender.send)
+	keys := apikey.Keys{"abc": apikey.DefaultName}
+
+	handler := httpHandler{
+		logger:       logger,
+		emailManager: em,
+		keys:         keys,
+		messages:     messageStore,
+		scheduler:    messageScheduler,
+		quotas:       quotas,
+	}
+	status := statusHandler{
+		logger:    logger,
+		messages:  messageStore,
+		keys:      keys,
+		scheduler: messageScheduler,
+		quotas:    quotas,
+	}
+
+	schedule := func(sendAt time.Time) Response {
+		message := &bytes.Buffer{}
+		json.NewEncoder(message).Encode(&Message{
+			Sender:       "sender@example.com",
+			Recipients:   []string{"recipient@example.com"},
+			CCRecipients: []string{"cc@example.com"},
+			SendAt:       &sendAt,
+		})
+		req := httptest.NewRequest("POST", "/email", message)
+		req.Header.Add("Authorization", "abc")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusAccepted {
+			t.Fatalf("wrong status code, expected: %d, got: %d", http.StatusAccepted, rr.Code)
+		}
+		var response Response
+		if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		return response
+	}
+	checkUsage := func(expected quota.Counter) {
+		u, err := quotas.Usage(apikey.DefaultName)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		if u.Daily != expected || u.Monthly != expected {
+			t.Errorf("wrong usage, expected: %+v, got: %+v", expected, u)
+		}
+	}
+
+	canceled := schedule(time.Now().Add(time.Hour))
+	schedule(time.Now().Add(50 * time.Millisecond))
+	checkUsage(quota.Counter{Messages: 2, Recipients: 4})
+
+	req := httptest.NewRequest("DELETE", "/email/"+canceled.MessageID, nil)
+	req.Header.Add("Authorization", "abc")
+	rr := httptest.NewRecorder()
+	status.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("wrong status code, expected: %d, got: %d", http.StatusOK, rr.Code)
+	}
+	checkUsage(quota.Counter{Messages: 1, Recipients: 2})
+
+	time.Sleep(50 * time.Millisecond)
+	if n, _ := messageScheduler.DispatchDue(context.Background()); n != 1 {
+		t.Errorf("a single message should be due, got: %d", n)
+	}
+	checkUsage(quota.Counter{})
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+
+	"github.com/mikolajb/emailserv/internal/events"
+	"github.com/mikolajb/emailserv/internal/eventwebhook"
+	"github.com/mikolajb/emailserv/internal/requestid"
+	"go.uber.org/zap"
+)
+
+const maxSendgridEventsBytes = 5 << 20
+
+// sendgridHandler receives events from SendGrid Event Webhook
+// Requests are authenticated with their ECDSA signatures.
+type sendgridHandler struct {
+	logger    *zap.Logger
+	verifier  *eventwebhook.Verifier
+	processor *eventProcessor
+}
+
+func (h sendgridHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	requestID := requestid.FromRequest(r)
+	w.Header().Set(requestid.Header, requestID)
+	logger := h.logger.With(zap.String("request_id", requestID))
+
+	if r.Method != "POST" {
+		logger.Debug("received request with a wrong method", zap.String("method", r.Method))
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxSendgridEventsBytes))
+	if err != nil {
+		logger.Debug("cannot read request body", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = h.verifier.Verify(
+		body,
+		r.Header.Get(eventwebhook.SignatureHeader),
+		r.Header.Get(eventwebhook.TimestampHeader),
+	)
+	if err != nil {
+		logger.Warn("sendgrid events not verified", zap.Error(err))
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	evs, err := events.ParseSendGrid(body)
+	if err != nil {
+		logger.Warn("invalid sendgrid events", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := h.processor.process(evs); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	logger.Debug("sendgrid events processed", zap.Int("events", len(evs)))
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mikolajb/emailserv/internal/eventwebhook"
+	"github.com/mikolajb/emailserv/internal/messages"
+	"github.com/mikolajb/emailserv/internal/storage"
+	"github.com/mikolajb/emailserv/internal/suppression"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestSendgridHandler(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate key: %s", err.Error())
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("cannot marshal key: %s", err.Error())
+	}
+	sign := func(timestamp string, payload []byte) string {
+		h := sha256.Sum256(append([]byte(timestamp), payload...))
+		r, s, err := ecdsa.Sign(rand.Reader, key, h[:])
+		if err != nil {
+			t.Fatalf("cannot sign: %s", err.Error())
+		}
+		signature, err := asn1.Marshal(struct{ R, S *big.Int }{r, s})
+		if err != nil {
+			t.Fatalf("cannot encode signature: %s", err.Error())
+		}
+		return base64.StdEncoding.EncodeToString(signature)
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	bounce := []byte(`[
+		{"event": "processed", "email": "bounced@example.com", "timestamp": 1525953602, "sg_message_id": "14c5d75ce93.filter0001.0"},
+		{"event": "bounce", "type": "bounce", "email": "bounced@example.com", "timestamp": 1525953604, "reason": "550 5.1.1 user unknown", "sg_message_id": "14c5d75ce93.filter0001.0", "message_id": "message-1"}
+	]`)
+	spamreport := []byte(`[
+		{"event": "spamreport", "email": "complained@example.com", "timestamp": 1525953608, "sg_message_id": "14c5d75ce93.filter0001.1"}
+	]`)
+
+	cases := map[string]struct {
+		method     string
+		body       []byte
+		signature  string
+		returnCode int
+		status     messages.Status
+		suppressed string
+	}{
+		"bounce-by-custom-args": {
+			body:       bounce,
+			signature:  sign(timestamp, bounce),
+			returnCode: http.StatusOK,
+			status:     messages.StatusBounced,
+			suppressed: "bounced@example.com",
+		},
+		"spamreport-by-provider-message-id": {
+			body:       spamreport,
+			signature:  sign(timestamp, spamreport),
+			returnCode: http.StatusOK,
+			status:     messages.StatusComplained,
+			suppressed: "complained@example.com",
+		},
+		"tampered": {
+			body:       spamreport,
+			signature:  sign(timestamp, bounce),
+			returnCode: http.StatusForbidden,
+			status:     messages.StatusSent,
+		},
+		"unsigned": {
+			body:       bounce,
+			returnCode: http.StatusForbidden,
+			status:     messages.StatusSent,
+		},
+		"invalid-json": {
+			body:       []byte("{"),
+			signature:  sign(timestamp, []byte("{")),
+			returnCode: http.StatusBadRequest,
+			status:     messages.StatusSent,
+		},
+		"wrong-method": {
+			method:     "GET",
+			returnCode: http.StatusMethodNotAllowed,
+			status:     messages.StatusSent,
+		},
+	}
+
+	for hint, c := range cases {
+		t.Run(hint, func(t *testing.T) {
+			logger := zaptest.NewLogger(t)
+
+			verifier, err := eventwebhook.NewVerifier(base64.StdEncoding.EncodeToString(der), eventwebhook.DefaultTolerance)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+
+			store := storage.NewMemoryStore()
+			messageStore := messages.NewStore(store)
+			suppressions := suppression.NewList(store)
+			err = messageStore.Create(&messages.Record{
+				ID:                "message-1",
+				Provider:          "sendgrid",
+				ProviderMessageID: "14c5d75ce93",
+				Status:            messages.StatusSent,
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+
+			h := sendgridHandler{
+				logger:   logger,
+				verifier: verifier,
+				processor: &eventProcessor{
+					logger:       logger,
+					messages:     messageStore,
+					suppressions: suppressions,
+				},
+			}
+
+			method := c.method
+			if method == "" {
+				method = "POST"
+			}
+			req := httptest.NewRequest(method, "/webhooks/sendgrid", bytes.NewReader(c.body))
+			req.Header.Set(eventwebhook.SignatureHeader, c.signature)
+			req.Header.Set(eventwebhook.TimestampHeader, timestamp)
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+
+			if rr.Code != c.returnCode {
+				t.Errorf("wrong status code, expected: %d, got: %d", c.returnCode, rr.Code)
+			}
+
+			record, err := messageStore.Get("message-1")
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if record.Status != c.status {
+				t.Errorf("wrong status, expected: %s, got: %s", c.status, record.Status)
+			}
+
+			all, err := suppressions.All()
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if c.suppressed == "" {
+				if len(all) != 0 {
+					t.Errorf("no address should be suppressed, got: %+v", all)
+				}
+				return
+			}
+			entry, err := suppressions.Get(c.suppressed)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if entry == nil || entry.Source != "sendgrid" {
+				t.Errorf("address should be suppressed by sendgrid, got: %+v", entry)
+			}
+		})
+	}
+}
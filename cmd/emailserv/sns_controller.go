@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+
+	"github.com/mikolajb/emailserv/internal/events"
+	"github.com/mikolajb/emailserv/internal/requestid"
+	"github.com/mikolajb/emailserv/internal/sns"
+	"go.uber.org/zap"
+)
+
+const maxSNSMessageBytes = 256 << 10
+
+// snsHandler receives SES notifications delivered by SNS over HTTP
+// Messages are authenticated with their signatures.
+type snsHandler struct {
+	logger     *zap.Logger
+	verifier   *sns.Verifier
+	httpClient *http.Client
+	// topicArns are topics messages are accepted from, no topic when empty
+	topicArns map[string]bool
+	processor *eventProcessor
+}
+
+func (h snsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	requestID := requestid.FromRequest(r)
+	w.Header().Set(requestid.Header, requestID)
+	logger := h.logger.With(zap.String("request_id", requestID))
+
+	if r.Method != "POST" {
+		logger.Debug("received request with a wrong method", zap.String("method", r.Method))
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxSNSMessageBytes))
+	if err != nil {
+		logger.Debug("cannot read request body", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	message, err := sns.Parse(body)
+	if err != nil {
+		logger.Debug("invalid sns message", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	logger = logger.With(
+		zap.String("sns_message_id", message.MessageID),
+		zap.String("sns_type", message.Type),
+		zap.String("topic_arn", message.TopicArn),
+	)
+
+	// any AWS account can publish signed messages to its own topic,
+	// so a topic is checked before a certificate or a subscription is fetched
+	if !h.topicArns[message.TopicArn] {
+		logger.Warn("sns message from an unexpected topic")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if err := h.verifier.Verify(r.Context(), message); err != nil {
+		logger.Warn("sns message not verified", zap.Error(err))
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	switch message.Type {
+	case sns.TypeSubscriptionConfirmation:
+		if err := sns.ConfirmSubscription(r.Context(), h.httpClient, message); err != nil {
+			logger.Error("cannot confirm subscription", zap.Error(err))
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		logger.Info("subscription confirmed")
+	case sns.TypeUnsubscribeConfirmation:
+		logger.Info("unsubscribed")
+	case sns.TypeNotification:
+		evs, err := events.ParseSES([]byte(message.Message))
+		if err != nil {
+			logger.Warn("invalid ses notification", zap.Error(err))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err := h.processor.process(evs); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		logger.Debug("ses notification processed", zap.Int("events", len(evs)))
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
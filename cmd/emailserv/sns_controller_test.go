@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"github.com/mikolajb/emailserv/internal/messages"
+	"github.com/mikolajb/emailserv/internal/sns"
+	"github.com/mikolajb/emailserv/internal/storage"
+	"github.com/mikolajb/emailserv/internal/suppression"
+	"go.uber.org/zap/zaptest"
+)
+
+// rewriteTransport sends all requests to a test server
+type rewriteTransport struct {
+	target *url.URL
+}
+
+func (rt rewriteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req.URL.Scheme = rt.target.Scheme
+	req.URL.Host = rt.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+
+	data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatalf("cannot read fixture: %s", err.Error())
+	}
+
+	return data
+}
+
+func TestSNSHandler(t *testing.T) {
+	const topic = "arn:aws:sns:eu-west-1:123456789012:ses-notifications"
+
+	cases := map[string]struct {
+		fixture     string
+		body        []byte
+		method      string
+		topicArns   map[string]bool
+		returnCode  int
+		status      messages.Status
+		recipients  map[string]messages.Status
+		suppressed  string
+		confirmed   bool
+		notModified bool
+	}{
+		"bounce": {
+			fixture:    "sns_bounce.json",
+			returnCode: http.StatusOK,
+			status:     messages.StatusBounced,
+			recipients: map[string]messages.Status{"bounced@example.com": messages.StatusBounced},
+			suppressed: "bounced@example.com",
+		},
+		"complaint-by-provider-message-id": {
+			fixture:    "sns_complaint.json",
+			returnCode: http.StatusOK,
+			status:     messages.StatusComplained,
+			recipients: map[string]messages.Status{"complained@example.com": messages.StatusComplained},
+			suppressed: "complained@example.com",
+		},
+		"delivery": {
+			fixture:    "sns_delivery.json",
+			returnCode: http.StatusOK,
+			status:     messages.StatusDelivered,
+			recipients: map[string]messages.Status{
+				"a@example.com": messages.StatusDelivered,
+				"b@example.com": messages.StatusDelivered,
+			},
+		},
+		"subscription": {
+			fixture:     "sns_subscription.json",
+			returnCode:  http.StatusOK,
+			confirmed:   true,
+			notModified: true,
+		},
+		"unknown-topic": {
+			fixture:     "sns_bounce.json",
+			topicArns:   map[string]bool{"arn:aws:sns:eu-west-1:123456789012:other": true},
+			returnCode:  http.StatusForbidden,
+			notModified: true,
+		},
+		"no-topics": {
+			fixture:     "sns_bounce.json",
+			topicArns:   map[string]bool{},
+			returnCode:  http.StatusForbidden,
+			notModified: true,
+		},
+		"subscription-unknown-topic": {
+			fixture:     "sns_subscription.json",
+			topicArns:   map[string]bool{"arn:aws:sns:eu-west-1:123456789012:other": true},
+			returnCode:  http.StatusForbidden,
+			notModified: true,
+		},
+		"tampered": {
+			body: bytes.Replace(
+				readFixture(t, "sns_bounce.json"),
+				[]byte("bounced@example.com"),
+				[]byte("victim@example.com"),
+				-1,
+			),
+			returnCode:  http.StatusForbidden,
+			notModified: true,
+		},
+		"invalid-json": {
+			body:        []byte("{"),
+			returnCode:  http.StatusBadRequest,
+			notModified: true,
+		},
+		"wrong-method": {
+			method:      "GET",
+			returnCode:  http.StatusMethodNotAllowed,
+			notModified: true,
+		},
+	}
+
+	for hint, c := range cases {
+		t.Run(hint, func(t *testing.T) {
+			logger := zaptest.NewLogger(t)
+
+			var confirmed bool
+			snsServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Query().Get("Action") == "ConfirmSubscription" {
+					confirmed = true
+				}
+			}))
+			defer snsServer.Close()
+			target, _ := url.Parse(snsServer.URL)
+
+			certificates, err := sns.NewStaticCertificateSource(readFixture(t, "sns_cert.pem"))
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+
+			store := storage.NewMemoryStore()
+			messageStore := messages.NewStore(store)
+			suppressions := suppression.NewList(store)
+			err = messageStore.Create(&messages.Record{
+				ID:                "message-1",
+				Provider:          "aws",
+				ProviderMessageID: "0102015a23e1b5c4-ses-message-id",
+				Status:            messages.StatusSent,
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+
+			topicArns := c.topicArns
+			if topicArns == nil {
+				topicArns = map[string]bool{topic: true}
+			}
+			h := snsHandler{
+				logger:     logger,
+				verifier:   sns.NewVerifier(certificates),
+				httpClient: &http.Client{Transport: rewriteTransport{target: target}},
+				topicArns:  topicArns,
+				processor: &eventProcessor{
+					logger:       logger,
+					messages:     messageStore,
+					suppressions: suppressions,
+				},
+			}
+
+			body := c.body
+			if c.fixture != "" {
+				body = readFixture(t, c.fixture)
+			}
+			method := c.method
+			if method == "" {
+				method = "POST"
+			}
+
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, httptest.NewRequest(method, "/webhooks/sns", bytes.NewReader(body)))
+
+			if rr.Code != c.returnCode {
+				t.Errorf("wrong status code, expected: %d, got: %d", c.returnCode, rr.Code)
+			}
+			if confirmed != c.confirmed {
+				t.Errorf("wrong subscription confirmation, expected: %t, got: %t", c.confirmed, confirmed)
+			}
+
+			record, err := messageStore.Get("message-1")
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if c.notModified {
+				if record.Status != messages.StatusSent || len(record.History) != 1 {
+					t.Errorf("message should not be modified, got: %+v", record)
+				}
+			} else {
+				if record.Status != c.status {
+					t.Errorf("wrong status, expected: %s, got: %s", c.status, record.Status)
+				}
+				for address, status := range c.recipients {
+					if record.Recipients[address] != status {
+						t.Errorf("wrong status of %s, expected: %s, got: %s", address, status, record.Recipients[address])
+					}
+				}
+			}
+
+			all, err := suppressions.All()
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if c.suppressed == "" {
+				if len(all) != 0 {
+					t.Errorf("no address should be suppressed, got: %+v", all)
+				}
+				return
+			}
+			entry, err := suppressions.Get(c.suppressed)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if entry == nil || entry.Source != "aws" {
+				t.Errorf("address should be suppressed by aws, got: %+v", entry)
+			}
+		})
+	}
+}
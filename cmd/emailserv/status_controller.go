@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/mikolajb/emailserv/internal/apikey"
+	"github.com/mikolajb/emailserv/internal/messages"
+	"github.com/mikolajb/emailserv/internal/quota"
+	"github.com/mikolajb/emailserv/internal/requestid"
+	"github.com/mikolajb/emailserv/internal/scheduler"
+	"go.uber.org/zap"
+)
+
+// statusHandler returns a status of a message
+// GET /email/{id} returns a status
+// DELETE /email/{id} cancels a scheduled message
+type statusHandler struct {
+	logger    *zap.Logger
+	messages  *messages.Store
+	keys      apikey.Keys
+	scheduler *scheduler.Scheduler
+	quotas    *quota.Quotas
+}
+
+func (h statusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	requestID := requestid.FromRequest(r)
+	logger := h.logger.With(zap.String("request_id", requestID))
+	w.Header().Set(requestid.Header, requestID)
+
+	if r.Method != "GET" && r.Method != "DELETE" {
+		logger.Debug("received request with a wrong method", zap.String("method", r.Method))
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	key, ok := h.keys.Name(r.Header.Get("Authorization"))
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	jsonEncoder := json.NewEncoder(w)
+	w.Header().Set("Content-Type", "application/json")
+	id := strings.TrimPrefix(r.URL.Path, "/email/")
+
+	record, err := h.messages.Get(id)
+	if err != nil {
+		logger.Error("cannot get message status", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		jsonEncoder.Encode(Response{
+			Message:   "Internal server error",
+			Error:     true,
+			RequestID: requestID,
+		})
+		return
+	}
+	// messages of other keys are not revealed
+	if record == nil || record.Key != key {
+		w.WriteHeader(http.StatusNotFound)
+		jsonEncoder.Encode(Response{
+			Message:   "Message not found",
+			Error:     true,
+			RequestID: requestID,
+		})
+		return
+	}
+
+	if r.Method == "DELETE" {
+		h.cancel(w, logger, jsonEncoder, requestID, record)
+		return
+	}
+
+	jsonEncoder.Encode(record)
+}
+
+// cancel removes a scheduled message before it is dispatched
+func (h statusHandler) cancel(w http.ResponseWriter, logger *zap.Logger, jsonEncoder *json.Encoder, requestID string, record *messages.Record) {
+	var job *scheduler.Job
+	var err error
+	if h.scheduler != nil {
+		job, err = h.scheduler.Cancel(record.Key, record.ID)
+	}
+	canceled := job != nil
+	if canceled {
+		releaseJobQuota(logger, h.quotas, job)
+	}
+	if err == nil && canceled {
+		record, err = h.messages.SetStatus(record.ID, messages.StatusCanceled, "", nil)
+	}
+	if err != nil {
+		logger.Error("cannot cancel message", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		jsonEncoder.Encode(Response{
+			Message:   "Internal server error",
+			Error:     true,
+			RequestID: requestID,
+		})
+		return
+	}
+	if !canceled {
+		w.WriteHeader(http.StatusConflict)
+		jsonEncoder.Encode(Response{
+			Message:   "Message is already dispatched",
+			Error:     true,
+			RequestID: requestID,
+			MessageID: record.ID,
+		})
+		return
+	}
+
+	logger.Info("scheduled message canceled", zap.String("message_id", record.ID))
+	jsonEncoder.Encode(record)
+}
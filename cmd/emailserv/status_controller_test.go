@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mikolajb/emailserv/internal/apikey"
+	"github.com/mikolajb/emailserv/internal/messages"
+	"github.com/mikolajb/emailserv/internal/storage"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestStatusHandler(t *testing.T) {
+	cases := map[string]struct {
+		method     string
+		path       string
+		token      string
+		returnCode int
+	}{
+		"found": {
+			method:     "GET",
+			path:       "/email/message-1",
+			token:      "token",
+			returnCode: http.StatusOK,
+		},
+		"not-found": {
+			method:     "GET",
+			path:       "/email/message-2",
+			token:      "token",
+			returnCode: http.StatusNotFound,
+		},
+		"other-key": {
+			method:     "GET",
+			path:       "/email/message-3",
+			token:      "token",
+			returnCode: http.StatusNotFound,
+		},
+		"unauthorized": {
+			method:     "GET",
+			path:       "/email/message-1",
+			returnCode: http.StatusUnauthorized,
+		},
+		"wrong-method": {
+			method:     "POST",
+			path:       "/email/message-1",
+			token:      "token",
+			returnCode: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for hint, c := range cases {
+		t.Run(hint, func(t *testing.T) {
+			messageStore := messages.NewStore(storage.NewMemoryStore())
+			err := messageStore.Create(&messages.Record{
+				ID:                "message-1",
+				Key:               apikey.DefaultName,
+				Provider:          "aws",
+				ProviderMessageID: "provider-id",
+				Status:            messages.StatusSent,
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			err = messageStore.Create(&messages.Record{
+				ID:     "message-3",
+				Key:    "marketing",
+				Status: messages.StatusSent,
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+
+			h := statusHandler{
+				logger:   zaptest.NewLogger(t),
+				messages: messageStore,
+				keys:     apikey.Keys{"token": apikey.DefaultName},
+			}
+
+			req := httptest.NewRequest(c.method, c.path, nil)
+			req.Header.Set("Authorization", c.token)
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+
+			if rr.Code != c.returnCode {
+				t.Fatalf("wrong status code, expected: %d, got: %d", c.returnCode, rr.Code)
+			}
+			if rr.Code != http.StatusOK {
+				return
+			}
+
+			var record messages.Record
+			if err := json.NewDecoder(rr.Body).Decode(&record); err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if record.ID != "message-1" || record.Status != messages.StatusSent || record.Provider != "aws" {
+				t.Errorf("wrong record: %+v", record)
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/mikolajb/emailserv/internal/requestid"
+	"github.com/mikolajb/emailserv/internal/suppression"
+	"go.uber.org/zap"
+)
+
+// Suppression policies
+const (
+	// suppressionDrop removes suppressed recipients and sends to the rest
+	suppressionDrop = "drop"
+
+	// suppressionReject rejects a message with any suppressed recipient
+	suppressionReject = "reject"
+)
+
+// suppress finds suppressed recipients of a message,
+// when a policy is "drop" they are removed from a message
+func suppress(list *suppression.List, policy string, message *Message) ([]string, error) {
+	var suppressed []string
+	for _, addresses := range []*[]string{
+		&message.Recipients,
+		&message.CCRecipients,
+		&message.BCCRecipients,
+	} {
+		allowed, s, err := list.Filter(*addresses)
+		if err != nil {
+			return nil, err
+		}
+		if policy == suppressionDrop && len(s) > 0 {
+			*addresses = allowed
+		}
+		suppressed = append(suppressed, s...)
+	}
+
+	return suppressed, nil
+}
+
+// SuppressionRequest is a request adding an address to a suppression list
+type SuppressionRequest struct {
+	// Address is an address to suppress
+	Address string `json:"address"`
+
+	// Reason is a reason of suppressing, "manual" when empty
+	Reason string `json:"reason"`
+}
+
+// SuppressionsResponse is a list of suppressed addresses
+type SuppressionsResponse struct {
+	Suppressions []*suppression.Entry `json:"suppressions"`
+}
+
+// requireAdmin checks if a request has an admin token,
+// admin endpoints are disabled when a token is empty
+func requireAdmin(token string, r *http.Request) bool {
+	if token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(token)) == 1
+}
+
+// suppressionHandler is an admin controller of a suppression list
+// GET /admin/suppressions lists entries
+// POST /admin/suppressions adds an entry
+// DELETE /admin/suppressions/{address} removes an entry
+type suppressionHandler struct {
+	logger       *zap.Logger
+	suppressions *suppression.List
+	adminToken   string
+}
+
+func (h suppressionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	requestID := requestid.FromRequest(r)
+	logger := h.logger.With(zap.String("request_id", requestID))
+	w.Header().Set(requestid.Header, requestID)
+
+	if !requireAdmin(h.adminToken, r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	jsonEncoder := json.NewEncoder(w)
+	w.Header().Set("Content-Type", "application/json")
+	address := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/admin/suppressions"), "/")
+
+	switch {
+	case r.Method == "GET" && address == "":
+		entries, err := h.suppressions.All()
+		if err != nil {
+			logger.Error("cannot list suppressions", zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			jsonEncoder.Encode(Response{
+				Message:   "Internal server error",
+				Error:     true,
+				RequestID: requestID,
+			})
+			return
+		}
+		jsonEncoder.Encode(SuppressionsResponse{
+			Suppressions: entries,
+		})
+	case r.Method == "POST" && address == "":
+		var request SuppressionRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			logger.Debug("error while decoding suppression", zap.Error(err))
+			w.WriteHeader(http.StatusBadRequest)
+			jsonEncoder.Encode(Response{
+				Message:   "Invalid JSON format",
+				Error:     true,
+				RequestID: requestID,
+			})
+			return
+		}
+		if !emailRe.MatchString(request.Address) {
+			w.WriteHeader(http.StatusBadRequest)
+			jsonEncoder.Encode(Response{
+				Message: "Request not valid",
+				ValidationErrors: []*ValidationError{{
+					Field: "address",
+					Error: "not a valid email",
+				}},
+				Error:     true,
+				RequestID: requestID,
+			})
+			return
+		}
+		if request.Reason == "" {
+			request.Reason = suppression.ReasonManual
+		}
+		entry, err := h.suppressions.Add(request.Address, request.Reason, "admin")
+		if err != nil {
+			logger.Error("cannot add suppression", zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			jsonEncoder.Encode(Response{
+				Message:   "Internal server error",
+				Error:     true,
+				RequestID: requestID,
+			})
+			return
+		}
+		logger.Info("address suppressed", zap.String("email_address", entry.Address), zap.String("reason", entry.Reason))
+		w.WriteHeader(http.StatusCreated)
+		jsonEncoder.Encode(entry)
+	case r.Method == "DELETE" && address != "":
+		if err := h.suppressions.Remove(address); err != nil {
+			logger.Error("cannot remove suppression", zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			jsonEncoder.Encode(Response{
+				Message:   "Internal server error",
+				Error:     true,
+				RequestID: requestID,
+			})
+			return
+		}
+		logger.Info("address unsuppressed", zap.String("email_address", address))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
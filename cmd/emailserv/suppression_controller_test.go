@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/mikolajb/emailserv/internal/apikey"
+	"github.com/mikolajb/emailserv/internal/emailclient"
+	"github.com/mikolajb/emailserv/internal/emailmanager"
+	"github.com/mikolajb/emailserv/internal/storage"
+	"github.com/mikolajb/emailserv/internal/suppression"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestEmailControllerHandler_suppression(t *testing.T) {
+	cases := map[string]struct {
+		policy     string
+		recipients []string
+		cc         []string
+		returnCode int
+		sentTo     []string
+		suppressed []string
+	}{
+		"drop": {
+			policy:     suppressionDrop,
+			recipients: []string{"ok@example.com", "bounced@example.com"},
+			returnCode: http.StatusCreated,
+			sentTo:     []string{"ok@example.com"},
+			suppressed: []string{"bounced@example.com"},
+		},
+		"drop-all": {
+			policy:     suppressionDrop,
+			recipients: []string{"bounced@example.com"},
+			returnCode: http.StatusUnprocessableEntity,
+			suppressed: []string{"bounced@example.com"},
+		},
+		"drop-all-to": {
+			policy:     suppressionDrop,
+			recipients: []string{"bounced@example.com"},
+			cc:         []string{"ok@example.com"},
+			returnCode: http.StatusUnprocessableEntity,
+			suppressed: []string{"bounced@example.com"},
+		},
+		"reject": {
+			policy:     suppressionReject,
+			recipients: []string{"ok@example.com", "bounced@example.com"},
+			returnCode: http.StatusUnprocessableEntity,
+			suppressed: []string{"bounced@example.com"},
+		},
+		"nothing-suppressed": {
+			policy:     suppressionReject,
+			recipients: []string{"ok@example.com"},
+			returnCode: http.StatusCreated,
+			sentTo:     []string{"ok@example.com"},
+		},
+	}
+
+	for hint, c := range cases {
+		t.Run(hint, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+
+			client1 := emailclient.NewMockEmailClient(mockCtrl)
+			if c.sentTo != nil {
+				client1.EXPECT().ProviderName().Return("mock_client1").Times(1)
+				client1.EXPECT().Send(gomock.Any(), "sender@example.com", c.sentTo, "", gomock.Any()).Return("", nil).Times(1)
+			}
+
+			list := suppression.NewList(storage.NewMemoryStore())
+			list.Add("bounced@example.com", suppression.ReasonBounce, "aws")
+
+			handler := httpHandler{
+				logger: zaptest.NewLogger(t),
+				emailManager: &emailmanager.EmailManager{
+					Logger:        zaptest.NewLogger(t),
+					EmailClients:  []emailclient.EmailClient{client1},
+					ClientTimeout: 100 * time.Millisecond,
+				},
+				keys:              apikey.Keys{"abc": apikey.DefaultName},
+				suppressions:      list,
+				suppressionPolicy: c.policy,
+			}
+
+			message := &bytes.Buffer{}
+			json.NewEncoder(message).Encode(&Message{
+				Sender:       "sender@example.com",
+				Recipients:   c.recipients,
+				CCRecipients: c.cc,
+			})
+			req, err := http.NewRequest("POST", "/email", message)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			req.Header.Add("Authorization", "abc")
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+
+			if recorder.Code != c.returnCode {
+				t.Errorf("expected return code %d but got %d", c.returnCode, recorder.Code)
+			}
+			var response Response
+			if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil {
+				t.Fatalf("cannot decode response body")
+			}
+			if !reflect.DeepEqual(c.suppressed, response.SuppressedRecipients) {
+				t.Errorf("expected suppressed recipients %v but got %v", c.suppressed, response.SuppressedRecipients)
+			}
+		})
+	}
+}
+
+func TestSuppressionHandler(t *testing.T) {
+	list := suppression.NewList(storage.NewMemoryStore())
+	handler := suppressionHandler{
+		logger:       zaptest.NewLogger(t),
+		suppressions: list,
+		adminToken:   "admin",
+	}
+
+	steps := []struct {
+		method     string
+		path       string
+		body       string
+		token      string
+		returnCode int
+		addresses  []string
+	}{
+		{method: "GET", path: "/admin/suppressions", token: "abc", returnCode: http.StatusUnauthorized},
+		{method: "POST", path: "/admin/suppressions", body: `{"address": "abc"}`, returnCode: http.StatusBadRequest},
+		{method: "POST", path: "/admin/suppressions", body: `{"address": "a@example.com"}`, returnCode: http.StatusCreated},
+		{method: "POST", path: "/admin/suppressions", body: `{"address": "b@example.com", "reason": "bounce"}`, returnCode: http.StatusCreated},
+		{method: "GET", path: "/admin/suppressions", returnCode: http.StatusOK, addresses: []string{"a@example.com", "b@example.com"}},
+		{method: "DELETE", path: "/admin/suppressions/a@example.com", returnCode: http.StatusNoContent},
+		{method: "GET", path: "/admin/suppressions", returnCode: http.StatusOK, addresses: []string{"b@example.com"}},
+		{method: "PUT", path: "/admin/suppressions", returnCode: http.StatusMethodNotAllowed},
+	}
+
+	for i, step := range steps {
+		req, err := http.NewRequest(step.method, step.path, bytes.NewBufferString(step.body))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		token := "admin"
+		if step.token != "" {
+			token = step.token
+		}
+		req.Header.Add("Authorization", token)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+
+		if recorder.Code != step.returnCode {
+			t.Errorf("step %d: expected return code %d but got %d", i, step.returnCode, recorder.Code)
+		}
+		if step.addresses != nil {
+			var response SuppressionsResponse
+			if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil {
+				t.Fatalf("step %d: cannot decode response body", i)
+			}
+			var addresses []string
+			for _, e := range response.Suppressions {
+				addresses = append(addresses, e.Address)
+			}
+			if !reflect.DeepEqual(step.addresses, addresses) {
+				t.Errorf("step %d: expected addresses %v but got %v", i, step.addresses, addresses)
+			}
+		}
+	}
+}
+
+func TestRequireAdmin(t *testing.T) {
+	cases := map[string]struct {
+		token    string
+		header   string
+		expected bool
+	}{
+		"ok": {
+			token:    "admin",
+			header:   "admin",
+			expected: true,
+		},
+		"wrong": {
+			token:  "admin",
+			header: "admi",
+		},
+		"missing": {
+			token: "admin",
+		},
+		"disabled": {
+			token:  "",
+			header: "",
+		},
+	}
+
+	for hint, c := range cases {
+		t.Run(hint, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/admin/suppressions", nil)
+			if c.header != "" {
+				req.Header.Add("Authorization", c.header)
+			}
+			if ok := requireAdmin(c.token, req); ok != c.expected {
+				t.Errorf("expected %t but got %t", c.expected, ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/mikolajb/emailserv/internal/storage"
+	"github.com/mikolajb/emailserv/internal/usage"
+)
+
+// usageCommand prints a usage report of a database,
+// e.g. emailserv usage -db emailserv.db -from 2018-05-01 -format csv
+// A database of a running server is locked, GET /admin/usage
+// reports its usage then.
+func usageCommand(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("usage", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	db := flags.String("db", "emailserv.db", "Database file.")
+	pricingPath := flags.String("pricing", "", "JSON file with prices of providers, costs are 0 when empty.")
+	from := flags.String("from", "", "First day of a report (YYYY-MM-DD), the first day of a current month when empty.")
+	to := flags.String("to", "", "Last day of a report (YYYY-MM-DD), today when empty.")
+	format := flags.String("format", usage.FormatJSON, "Format of a report: json or csv.")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if *format != usage.FormatJSON && *format != usage.FormatCSV {
+		fmt.Fprintf(stderr, "unknown format %q, expected json or csv\n", *format)
+		return 2
+	}
+	start, end, err := reportPeriod(*from, *to, time.Now())
+	if err != nil {
+		fmt.Fprintln(stderr, err.Error())
+		return 2
+	}
+	var pricing usage.Pricing
+	if *pricingPath != "" {
+		pricing, err = usage.LoadPricing(*pricingPath)
+		if err != nil {
+			fmt.Fprintln(stderr, err.Error())
+			return 1
+		}
+	}
+
+	store, err := storage.NewBoltStore(*db)
+	if err != nil {
+		fmt.Fprintf(stderr, "cannot open database: %s\n", err.Error())
+		return 1
+	}
+	defer store.Close()
+
+	rows, err := usage.NewRecorder(store).Report(start, end, pricing)
+	if err != nil {
+		fmt.Fprintf(stderr, "cannot report usage: %s\n", err.Error())
+		return 1
+	}
+	if err := usage.Write(stdout, *format, rows); err != nil {
+		fmt.Fprintln(stderr, err.Error())
+		return 1
+	}
+
+	return 0
+}
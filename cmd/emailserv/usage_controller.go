@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/mikolajb/emailserv/internal/requestid"
+	"github.com/mikolajb/emailserv/internal/usage"
+	"go.uber.org/zap"
+)
+
+// reportPeriod returns a period of a report from "2006-01-02" days,
+// both days are included, by default it is a current month
+func reportPeriod(from, to string, now time.Time) (time.Time, time.Time, error) {
+	now = now.UTC()
+	start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+
+	if from != "" {
+		t, err := time.Parse("2006-01-02", from)
+		if err != nil {
+			return start, end, fmt.Errorf("invalid day %q, expected YYYY-MM-DD", from)
+		}
+		start = t
+	}
+	if to != "" {
+		t, err := time.Parse("2006-01-02", to)
+		if err != nil {
+			return start, end, fmt.Errorf("invalid day %q, expected YYYY-MM-DD", to)
+		}
+		end = t.AddDate(0, 0, 1)
+	}
+	if !start.Before(end) {
+		return start, end, fmt.Errorf("a report cannot end before it starts")
+	}
+
+	return start, end, nil
+}
+
+// usageHandler is an admin controller reporting usage and costs
+// GET /admin/usage?from=2018-05-01&to=2018-05-31&format=json|csv
+// aggregates sent messages by day, key and provider
+type usageHandler struct {
+	logger     *zap.Logger
+	usage      *usage.Recorder
+	pricing    usage.Pricing
+	adminToken string
+}
+
+func (h usageHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	requestID := requestid.FromRequest(r)
+	logger := h.logger.With(zap.String("request_id", requestID))
+	w.Header().Set(requestid.Header, requestID)
+
+	if !requireAdmin(h.adminToken, r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if r.Method != "GET" {
+		logger.Debug("received request with a wrong method", zap.String("method", r.Method))
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	format := query.Get("format")
+	if format == "" {
+		format = usage.FormatJSON
+	}
+	var validationErrors []*ValidationError
+	if format != usage.FormatJSON && format != usage.FormatCSV {
+		validationErrors = append(validationErrors, &ValidationError{
+			Field: "format",
+			Error: "has to be json or csv",
+		})
+	}
+	from, to, err := reportPeriod(query.Get("from"), query.Get("to"), time.Now())
+	if err != nil {
+		validationErrors = append(validationErrors, &ValidationError{
+			Field: "from, to",
+			Error: err.Error(),
+		})
+	}
+	if len(validationErrors) > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(Response{
+			Message:          "Request not valid",
+			ValidationErrors: validationErrors,
+			Error:            true,
+			RequestID:        requestID,
+		})
+		return
+	}
+
+	rows, err := h.usage.Report(from, to, h.pricing)
+	if err != nil {
+		logger.Error("cannot report usage", zap.Error(err))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(Response{
+			Message:   "Internal server error",
+			Error:     true,
+			RequestID: requestID,
+		})
+		return
+	}
+
+	if format == usage.FormatCSV {
+		w.Header().Set("Content-Type", "text/csv")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	if err := usage.Write(w, format, rows); err != nil {
+		logger.Error("cannot write usage report", zap.Error(err))
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mikolajb/emailserv/internal/apikey"
+	"github.com/mikolajb/emailserv/internal/emailclient"
+	"github.com/mikolajb/emailserv/internal/emailmanager"
+	"github.com/mikolajb/emailserv/internal/storage"
+	"github.com/mikolajb/emailserv/internal/usage"
+	"go.uber.org/zap/zaptest"
+)
+
+func Test_reportPeriod(t *testing.T) {
+	now := time.Date(2018, 5, 10, 12, 0, 0, 0, time.UTC)
+	cases := map[string]struct {
+		from  string
+		to    string
+		start time.Time
+		end   time.Time
+		err   bool
+	}{
+		"current-month": {
+			start: time.Date(2018, 5, 1, 0, 0, 0, 0, time.UTC),
+			end:   time.Date(2018, 5, 11, 0, 0, 0, 0, time.UTC),
+		},
+		"days": {
+			from:  "2018-04-01",
+			to:    "2018-04-30",
+			start: time.Date(2018, 4, 1, 0, 0, 0, 0, time.UTC),
+			end:   time.Date(2018, 5, 1, 0, 0, 0, 0, time.UTC),
+		},
+		"invalid": {
+			from: "April",
+			err:  true,
+		},
+		"reversed": {
+			from: "2018-04-30",
+			to:   "2018-04-01",
+			err:  true,
+		},
+	}
+
+	for hint, c := range cases {
+		t.Run(hint, func(t *testing.T) {
+			start, end, err := reportPeriod(c.from, c.to, now)
+			if c.err {
+				if err == nil {
+					t.Errorf("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if !start.Equal(c.start) || !end.Equal(c.end) {
+				t.Errorf("expected %s - %s, got: %s - %s", c.start, c.end, start, end)
+			}
+		})
+	}
+}
+
+func TestUsageHandler(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	recorder := usage.NewRecorder(storage.NewMemoryStore())
+	handler := httpHandler{
+		logger: logger,
+		emailManager: &emailmanager.EmailManager{
+			Logger:        logger,
+			EmailClients:  []emailclient.EmailClient{emailclient.NewNopClient(logger)},
+			ClientTimeout: 100 * time.Millisecond,
+		},
+		keys:  apikey.Keys{"abc": "billing"},
+		usage: recorder,
+	}
+	admin := usageHandler{
+		logger:     logger,
+		usage:      recorder,
+		pricing:    usage.Pricing{"nop": {PerRecipient: 0.5}},
+		adminToken: "admin",
+	}
+
+	message := &bytes.Buffer{}
+	json.NewEncoder(message).Encode(&Message{
+		Sender:       "sender@example.com",
+		Recipients:   []string{"recipient@example.com"},
+		CCRecipients: []string{"cc@example.com"},
+		Subject:      "subject",
+		Body:         "body",
+	})
+	req := httptest.NewRequest("POST", "/email", message)
+	req.Header.Add("Authorization", "abc")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("wrong status code, expected: %d, got: %d", http.StatusCreated, rr.Code)
+	}
+
+	today := time.Now().UTC().Format("2006-01-02")
+	cases := map[string]struct {
+		query       string
+		returnCode  int
+		contentType string
+		body        string
+	}{
+		"json": {
+			returnCode:  http.StatusOK,
+			contentType: "application/json",
+			body:        `{"rows":[{"day":"` + today + `","key":"billing","provider":"nop","messages":1,"recipients":2,"size":11,"cost":1}]}`,
+		},
+		"csv": {
+			query:       "?format=csv&from=" + today + "&to=" + today,
+			returnCode:  http.StatusOK,
+			contentType: "text/csv",
+			body:        "day,key,provider,messages,recipients,size,cost\n" + today + ",billing,nop,1,2,11,1.000000",
+		},
+		"invalid": {
+			query:      "?format=xml&from=yesterday",
+			returnCode: http.StatusBadRequest,
+		},
+	}
+
+	for hint, c := range cases {
+		t.Run(hint, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/admin/usage"+c.query, nil)
+			req.Header.Add("Authorization", "admin")
+			rr := httptest.NewRecorder()
+			admin.ServeHTTP(rr, req)
+
+			if rr.Code != c.returnCode {
+				t.Fatalf("wrong status code, expected: %d, got: %d", c.returnCode, rr.Code)
+			}
+			if c.body == "" {
+				return
+			}
+			if contentType := rr.Header().Get("Content-Type"); contentType != c.contentType {
+				t.Errorf("wrong content type, expected: %s, got: %s", c.contentType, contentType)
+			}
+			if body := strings.TrimSpace(rr.Body.String()); body != c.body {
+				t.Errorf("wrong body, expected:\n%s\ngot:\n%s", c.body, body)
+			}
+		})
+	}
+}
+
+func Test_usageCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "emailserv")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	db := filepath.Join(dir, "emailserv.db")
+	store, err := storage.NewBoltStore(db)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	err = usage.NewRecorder(store).Record(&usage.Record{
+		Time:       time.Date(2018, 5, 10, 12, 0, 0, 0, time.UTC),
+		Key:        "billing",
+		Provider:   "aws",
+		Recipients: 2,
+		Size:       100,
+	})
+	store.Close()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	var stdout, stderr bytes.Buffer
+	code := usageCommand([]string{"-db", db, "-from", "2018-05-01", "-to", "2018-05-31", "-format", "csv"}, &stdout, &stderr)
+	if code != 0 {
+		t.Fatalf("wrong exit code: %d, %s", code, stderr.String())
+	}
+	expected := "day,key,provider,messages,recipients,size,cost\n2018-05-10,billing,aws,1,2,100,0.000000\n"
+	if stdout.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, stdout.String())
+	}
+
+	if code := usageCommand([]string{"-db", db, "-format", "xml"}, &stdout, &stderr); code == 0 {
+		t.Errorf("an unknown format should fail")
+	}
+}
@@ -0,0 +1,72 @@
+// Package apikey identifies API callers by tokens they send
+// in Authorization header, every token belongs to a named key.
+package apikey
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// DefaultName is a name of a key given with -token flag
+const DefaultName = "default"
+
+type contextKey struct{}
+
+// Keys maps tokens to names of keys
+type Keys map[string]string
+
+// Load reads a JSON file mapping names of keys to tokens,
+// e.g. {"billing": "secret-token"}
+func Load(path string) (Keys, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read keys: %s", err.Error())
+	}
+
+	var tokens map[string]string
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, fmt.Errorf("invalid keys file: %s", err.Error())
+	}
+
+	keys := Keys{}
+	for name, token := range tokens {
+		if token == "" {
+			return nil, fmt.Errorf("empty token of key %s", name)
+		}
+		if _, ok := keys[token]; ok {
+			return nil, fmt.Errorf("token of key %s is not unique", name)
+		}
+		keys[token] = name
+	}
+
+	return keys, nil
+}
+
+// Name returns a name of a key a token belongs to,
+// all tokens are compared in constant time
+func (k Keys) Name(token string) (string, bool) {
+	var name string
+	found := false
+	for t, n := range k {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			name = n
+			found = true
+		}
+	}
+
+	return name, found
+}
+
+// NewContext returns a context holding a name of a key
+func NewContext(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, contextKey{}, name)
+}
+
+// FromContext returns a name of a key held by a context or an empty string
+func FromContext(ctx context.Context) string {
+	name, _ := ctx.Value(contextKey{}).(string)
+	return name
+}
@@ -0,0 +1,87 @@
+package apikey
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoad(t *testing.T) {
+	cases := map[string]struct {
+		content  string
+		expected Keys
+		err      bool
+	}{
+		"valid": {
+			content:  `{"billing": "token-1", "marketing": "token-2"}`,
+			expected: Keys{"token-1": "billing", "token-2": "marketing"},
+		},
+		"empty-token": {
+			content: `{"billing": ""}`,
+			err:     true,
+		},
+		"duplicated-token": {
+			content: `{"billing": "token-1", "marketing": "token-1"}`,
+			err:     true,
+		},
+		"invalid-json": {
+			content: `{`,
+			err:     true,
+		},
+	}
+
+	dir, err := ioutil.TempDir("", "apikey")
+	if err != nil {
+		t.Fatalf("cannot create directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	for hint, c := range cases {
+		t.Run(hint, func(t *testing.T) {
+			path := filepath.Join(dir, hint+".json")
+			if err := ioutil.WriteFile(path, []byte(c.content), 0600); err != nil {
+				t.Fatalf("cannot write keys: %s", err.Error())
+			}
+
+			keys, err := Load(path)
+			if c.err {
+				if err == nil {
+					t.Errorf("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if !reflect.DeepEqual(c.expected, keys) {
+				t.Errorf("expected keys %v but got %v", c.expected, keys)
+			}
+		})
+	}
+}
+
+func TestKeys_Name(t *testing.T) {
+	keys := Keys{"token-1": "billing", "": DefaultName}
+
+	cases := map[string]struct {
+		token string
+		name  string
+		found bool
+	}{
+		"known":   {token: "token-1", name: "billing", found: true},
+		"empty":   {token: "", name: DefaultName, found: true},
+		"unknown": {token: "token-2"},
+		"prefix":  {token: "token-", found: false},
+	}
+
+	for hint, c := range cases {
+		t.Run(hint, func(t *testing.T) {
+			name, found := keys.Name(c.token)
+			if name != c.name || found != c.found {
+				t.Errorf("expected (%q, %t), got (%q, %t)", c.name, c.found, name, found)
+			}
+		})
+	}
+}
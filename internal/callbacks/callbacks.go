@@ -0,0 +1,722 @@
+// Package callbacks notifies API callers about statuses of their messages,
+// events are POSTed as signed JSON to registered URLs and retried
+// with an exponential backoff.
+package callbacks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mikolajb/emailserv/internal/storage"
+	"go.uber.org/zap"
+)
+
+const (
+	registrationsBucket = "callbacks"
+	// messageCallbacksBucket holds callbacks of single messages
+	// by message IDs, so they are found without listing all of them
+	messageCallbacksBucket = "message_callbacks"
+	deliveriesBucket       = "callback_deliveries"
+	deadLettersBucket      = "callback_dead_letters"
+	logBucket              = "callback_log"
+
+	// SignatureHeader holds a signature of a request body,
+	// in a form "t=<unix timestamp>,v1=<hex HMAC-SHA256>"
+	SignatureHeader = "X-Emailserv-Signature"
+
+	// EventIDHeader holds an ID of an event, it is the same for all attempts
+	EventIDHeader = "X-Emailserv-Event-ID"
+)
+
+// Event types sent to callbacks
+const (
+	EventSent       = "sent"
+	EventDelivered  = "delivered"
+	EventBounced    = "bounced"
+	EventComplained = "complained"
+	EventFailed     = "failed"
+)
+
+// Event is a body of a callback request
+type Event struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	MessageID string    `json:"message_id"`
+	RequestID string    `json:"request_id,omitempty"`
+	Recipient string    `json:"recipient,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Registration is a URL events are sent to
+type Registration struct {
+	ID string `json:"id"`
+
+	// Key is a name of an API key which registered a callback
+	Key string `json:"key"`
+
+	// MessageID limits a callback to a single message,
+	// all messages sent with a key are reported when empty
+	MessageID string `json:"message_id,omitempty"`
+
+	URL string `json:"url"`
+
+	// Secret signs requests, see Sign
+	Secret string `json:"secret"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Delivery is an event waiting to be sent to a registered URL
+type Delivery struct {
+	ID             string    `json:"id"`
+	RegistrationID string    `json:"registration_id"`
+	Key            string    `json:"key"`
+	URL            string    `json:"url"`
+	Event          Event     `json:"event"`
+	Attempts       int       `json:"attempts"`
+	NextAttemptAt  time.Time `json:"next_attempt_at"`
+	LastError      string    `json:"last_error,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// LogEntry is a result of a single delivery attempt
+type LogEntry struct {
+	DeliveryID     string    `json:"delivery_id"`
+	RegistrationID string    `json:"registration_id"`
+	Key            string    `json:"key"`
+	EventID        string    `json:"event_id"`
+	EventType      string    `json:"event_type"`
+	MessageID      string    `json:"message_id"`
+	URL            string    `json:"url"`
+	Attempt        int       `json:"attempt"`
+	StatusCode     int       `json:"status_code,omitempty"`
+	Error          string    `json:"error,omitempty"`
+	Timestamp      time.Time `json:"timestamp"`
+}
+
+// Dispatcher keeps registrations and delivers events to them
+type Dispatcher struct {
+	logger *zap.Logger
+	store  storage.Store
+	client *http.Client
+	now    func() time.Time
+
+	// MaxAttempts is a number of attempts after which
+	// a delivery is moved to dead letters
+	MaxAttempts int
+
+	// BaseDelay is a delay after the first failed attempt,
+	// it doubles after each next one up to MaxDelay
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+
+	// Workers is a number of URLs deliveries are made to at once
+	Workers int
+
+	// MaxPerURL limits attempts to a single URL in one run,
+	// so a slow receiver does not delay callbacks of others
+	MaxPerURL int
+}
+
+// NewDispatcher returns a dispatcher keeping its state in a given store
+func NewDispatcher(logger *zap.Logger, store storage.Store, client *http.Client) *Dispatcher {
+	return &Dispatcher{
+		logger:      logger,
+		store:       store,
+		client:      client,
+		now:         time.Now,
+		MaxAttempts: 8,
+		BaseDelay:   10 * time.Second,
+		MaxDelay:    time.Hour,
+		Workers:     10,
+		MaxPerURL:   10,
+	}
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// ValidateURL checks if a URL can be registered
+func ValidateURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid url: %s", err.Error())
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url has to be an absolute http or https url")
+	}
+
+	return nil
+}
+
+// Register adds a callback of a key, messageID is optional
+func (d *Dispatcher) Register(key, messageID, rawURL string) (*Registration, error) {
+	if err := ValidateURL(rawURL); err != nil {
+		return nil, err
+	}
+
+	r := &Registration{
+		ID:        newID(),
+		Key:       key,
+		MessageID: messageID,
+		URL:       rawURL,
+		Secret:    newID(),
+		CreatedAt: d.now().UTC(),
+	}
+	if messageID == "" {
+		if err := d.store.Put(registrationsBucket, r.ID, r); err != nil {
+			return nil, err
+		}
+		return r, nil
+	}
+
+	var registrations []Registration
+	err := d.store.Update(messageCallbacksBucket, messageID, &registrations, func(bool) error {
+		registrations = append(registrations, *r)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Registrations returns all callbacks of a key
+func (d *Dispatcher) Registrations(key string) ([]*Registration, error) {
+	result := []*Registration{}
+	err := d.store.List(registrationsBucket, func(_ string, decode func(v interface{}) error) error {
+		var r Registration
+		if err := decode(&r); err != nil {
+			return err
+		}
+		if r.Key == key {
+			result = append(result, &r)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = d.store.List(messageCallbacksBucket, func(_ string, decode func(v interface{}) error) error {
+		var registrations []Registration
+		if err := decode(&registrations); err != nil {
+			return err
+		}
+		for i := range registrations {
+			if registrations[i].Key == key {
+				result = append(result, &registrations[i])
+			}
+		}
+		return nil
+	})
+
+	return result, err
+}
+
+// Unregister removes a callback of a key,
+// it returns false when a key has no such callback
+func (d *Dispatcher) Unregister(key, id string) (bool, error) {
+	var r Registration
+	err := d.store.Get(registrationsBucket, id, &r)
+	if err == nil {
+		if r.Key != key {
+			return false, nil
+		}
+		return true, d.store.Delete(registrationsBucket, id)
+	}
+	if err != storage.ErrNotFound {
+		return false, err
+	}
+
+	// callbacks of messages are only listed when they are removed
+	var messageID string
+	err = d.store.List(messageCallbacksBucket, func(k string, decode func(v interface{}) error) error {
+		var registrations []Registration
+		if err := decode(&registrations); err != nil {
+			return err
+		}
+		for _, r := range registrations {
+			if r.ID == id && r.Key == key {
+				messageID = k
+			}
+		}
+		return nil
+	})
+	if err != nil || messageID == "" {
+		return false, err
+	}
+
+	var registrations []Registration
+	err = d.store.Update(messageCallbacksBucket, messageID, &registrations, func(bool) error {
+		kept := registrations[:0]
+		for _, r := range registrations {
+			if r.ID != id {
+				kept = append(kept, r)
+			}
+		}
+		registrations = kept
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	if len(registrations) == 0 {
+		return true, d.store.Delete(messageCallbacksBucket, messageID)
+	}
+
+	return true, nil
+}
+
+// registration returns a callback of a delivery,
+// storage.ErrNotFound is returned when it was removed
+func (d *Dispatcher) registration(delivery *Delivery) (*Registration, error) {
+	var r Registration
+	err := d.store.Get(registrationsBucket, delivery.RegistrationID, &r)
+	if err != storage.ErrNotFound {
+		if err != nil {
+			return nil, err
+		}
+		return &r, nil
+	}
+	if delivery.Event.MessageID == "" {
+		return nil, storage.ErrNotFound
+	}
+
+	var registrations []Registration
+	if err := d.store.Get(messageCallbacksBucket, delivery.Event.MessageID, &registrations); err != nil {
+		return nil, err
+	}
+	for i := range registrations {
+		if registrations[i].ID == delivery.RegistrationID {
+			return &registrations[i], nil
+		}
+	}
+
+	return nil, storage.ErrNotFound
+}
+
+// Notify queues an event for all callbacks of a key
+// registered for all messages or for a message an event is about
+func (d *Dispatcher) Notify(key string, e Event) error {
+	if e.ID == "" {
+		e.ID = newID()
+	}
+	if e.Timestamp.IsZero() {
+		e.Timestamp = d.now().UTC()
+	}
+
+	var registrations []Registration
+	err := d.store.List(registrationsBucket, func(_ string, decode func(v interface{}) error) error {
+		var r Registration
+		if err := decode(&r); err != nil {
+			return err
+		}
+		if r.Key == key && (r.MessageID == "" || r.MessageID == e.MessageID) {
+			registrations = append(registrations, r)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if e.MessageID != "" {
+		var messageRegistrations []Registration
+		err := d.store.Get(messageCallbacksBucket, e.MessageID, &messageRegistrations)
+		if err != nil && err != storage.ErrNotFound {
+			return err
+		}
+		for _, r := range messageRegistrations {
+			if r.Key == key {
+				registrations = append(registrations, r)
+			}
+		}
+	}
+
+	now := d.now().UTC()
+	for _, r := range registrations {
+		delivery := &Delivery{
+			// IDs start with a time, so deliveries are attempted in order
+			ID:             fmt.Sprintf("%016x-%s", now.UnixNano(), newID()),
+			RegistrationID: r.ID,
+			Key:            r.Key,
+			URL:            r.URL,
+			Event:          e,
+			NextAttemptAt:  now,
+			CreatedAt:      now,
+		}
+		if err := d.store.Put(deliveriesBucket, delivery.ID, delivery); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Run delivers due events every interval until a context is done
+func (d *Dispatcher) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := d.DeliverDue(ctx); err != nil {
+			d.logger.Error("cannot deliver callbacks", zap.Error(err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// DeliverDue makes an attempt of every delivery which is due,
+// it returns a number of attempts
+func (d *Dispatcher) DeliverDue(ctx context.Context) (int, error) {
+	now := d.now()
+	var due []*Delivery
+	err := d.store.List(deliveriesBucket, func(_ string, decode func(v interface{}) error) error {
+		var delivery Delivery
+		if err := decode(&delivery); err != nil {
+			return err
+		}
+		if !delivery.NextAttemptAt.After(now) {
+			due = append(due, &delivery)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// deliveries to a URL are attempted in order, URLs are served
+	// by a pool of workers, a URL is left for the next run
+	// after a failed attempt, so a receiver which hangs only delays itself
+	var urls []string
+	byURL := map[string][]*Delivery{}
+	for _, delivery := range due {
+		if _, ok := byURL[delivery.URL]; !ok {
+			urls = append(urls, delivery.URL)
+		}
+		byURL[delivery.URL] = append(byURL[delivery.URL], delivery)
+	}
+
+	workers := d.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		attempts int
+		firstErr error
+	)
+	slots := make(chan struct{}, workers)
+	for _, url := range urls {
+		deliveries := byURL[url]
+		if d.MaxPerURL > 0 && len(deliveries) > d.MaxPerURL {
+			deliveries = deliveries[:d.MaxPerURL]
+		}
+
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(deliveries []*Delivery) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			for _, delivery := range deliveries {
+				if ctx.Err() != nil {
+					return
+				}
+				delivered, err := d.attempt(ctx, delivery)
+				mu.Lock()
+				attempts++
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+				if err != nil || !delivered {
+					return
+				}
+			}
+		}(deliveries)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return 0, firstErr
+	}
+	return attempts, nil
+}
+
+// attempt sends a single delivery and records a result, it reports
+// if a receiver did not fail, an error is only returned
+// when a state cannot be stored
+func (d *Dispatcher) attempt(ctx context.Context, delivery *Delivery) (bool, error) {
+	logger := d.logger.With(
+		zap.String("delivery_id", delivery.ID),
+		zap.String("registration_id", delivery.RegistrationID),
+		zap.String("event", delivery.Event.Type),
+		zap.String("message_id", delivery.Event.MessageID),
+	)
+
+	r, err := d.registration(delivery)
+	if err == storage.ErrNotFound {
+		logger.Debug("callback unregistered, delivery dropped")
+		return true, d.store.Delete(deliveriesBucket, delivery.ID)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	delivery.Attempts++
+	statusCode, sendErr := d.send(ctx, r, &delivery.Event)
+
+	entry := LogEntry{
+		DeliveryID:     delivery.ID,
+		RegistrationID: delivery.RegistrationID,
+		Key:            delivery.Key,
+		EventID:        delivery.Event.ID,
+		EventType:      delivery.Event.Type,
+		MessageID:      delivery.Event.MessageID,
+		URL:            delivery.URL,
+		Attempt:        delivery.Attempts,
+		StatusCode:     statusCode,
+		Timestamp:      d.now().UTC(),
+	}
+	if sendErr != nil {
+		entry.Error = sendErr.Error()
+	}
+	logKey := fmt.Sprintf("%020d-%s-%d", entry.Timestamp.UnixNano(), delivery.ID, delivery.Attempts)
+	if err := d.store.Put(logBucket, logKey, &entry); err != nil {
+		return false, err
+	}
+
+	if sendErr == nil {
+		logger.Debug("callback delivered", zap.Int("attempt", delivery.Attempts))
+		return true, d.store.Delete(deliveriesBucket, delivery.ID)
+	}
+
+	delivery.LastError = sendErr.Error()
+	if delivery.Attempts >= d.MaxAttempts {
+		logger.Warn("callback not delivered, moved to dead letters", zap.Int("attempt", delivery.Attempts), zap.Error(sendErr))
+		if err := d.store.Put(deadLettersBucket, delivery.ID, delivery); err != nil {
+			return false, err
+		}
+		return false, d.store.Delete(deliveriesBucket, delivery.ID)
+	}
+
+	delivery.NextAttemptAt = d.now().UTC().Add(d.backoff(delivery.Attempts))
+	logger.Debug(
+		"callback not delivered, retrying",
+		zap.Int("attempt", delivery.Attempts),
+		zap.Time("next_attempt_at", delivery.NextAttemptAt),
+		zap.Error(sendErr),
+	)
+	return false, d.store.Put(deliveriesBucket, delivery.ID, delivery)
+}
+
+// backoff returns a delay after a given number of failed attempts
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	delay := d.BaseDelay
+	for i := 1; i < attempts && delay < d.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > d.MaxDelay {
+		delay = d.MaxDelay
+	}
+
+	return delay
+}
+
+// send POSTs an event, any status other than 2xx is an error
+func (d *Dispatcher) send(ctx context.Context, r *Registration, e *Event) (int, error) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequest("POST", r.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventIDHeader, e.ID)
+	req.Header.Set(SignatureHeader, Sign(r.Secret, d.now().Unix(), body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	return resp.StatusCode, nil
+}
+
+// Log returns delivery attempts of a key, oldest first
+func (d *Dispatcher) Log(key string) ([]*LogEntry, error) {
+	result := []*LogEntry{}
+	err := d.store.List(logBucket, func(_ string, decode func(v interface{}) error) error {
+		var entry LogEntry
+		if err := decode(&entry); err != nil {
+			return err
+		}
+		if entry.Key == key {
+			result = append(result, &entry)
+		}
+		return nil
+	})
+
+	return result, err
+}
+
+// DeadLetters returns deliveries of a key which failed all attempts
+func (d *Dispatcher) DeadLetters(key string) ([]*Delivery, error) {
+	result := []*Delivery{}
+	err := d.store.List(deadLettersBucket, func(_ string, decode func(v interface{}) error) error {
+		var delivery Delivery
+		if err := decode(&delivery); err != nil {
+			return err
+		}
+		if delivery.Key == key {
+			result = append(result, &delivery)
+		}
+		return nil
+	})
+
+	return result, err
+}
+
+// PurgeLog removes log entries older than a given age,
+// it returns a number of removed entries
+func (d *Dispatcher) PurgeLog(age time.Duration) (int, error) {
+	before := fmt.Sprintf("%020d", d.now().Add(-age).UnixNano())
+	var old []string
+	err := d.store.List(logBucket, func(key string, _ func(v interface{}) error) error {
+		if key < before {
+			old = append(old, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, key := range old {
+		if err := d.store.Delete(logBucket, key); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(old), nil
+}
+
+// PurgeRegistrations removes callbacks of messages registered
+// before a given age, late events of such messages are not sent,
+// it returns a number of messages which callbacks were removed
+func (d *Dispatcher) PurgeRegistrations(age time.Duration) (int, error) {
+	before := d.now().Add(-age)
+	var old []string
+	err := d.store.List(messageCallbacksBucket, func(key string, decode func(v interface{}) error) error {
+		var registrations []Registration
+		if err := decode(&registrations); err != nil {
+			return err
+		}
+		for _, r := range registrations {
+			if !r.CreatedAt.Before(before) {
+				return nil
+			}
+		}
+		old = append(old, key)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, key := range old {
+		if err := d.store.Delete(messageCallbacksBucket, key); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(old), nil
+}
+
+// Sign returns a value of SignatureHeader,
+// the signature is HMAC-SHA256 of a timestamp, "." and a body
+func Sign(secret string, timestamp int64, body []byte) string {
+	t := strconv.FormatInt(timestamp, 10)
+	return "t=" + t + ",v1=" + signature(secret, t, body)
+}
+
+func signature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks a value of SignatureHeader,
+// a timestamp cannot be older than tolerance
+func Verify(secret, header string, body []byte, tolerance time.Duration, now time.Time) error {
+	var timestamp, sig string
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			timestamp = kv[1]
+		case "v1":
+			sig = kv[1]
+		}
+	}
+	if timestamp == "" || sig == "" {
+		return fmt.Errorf("invalid signature header")
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp: %s", timestamp)
+	}
+	if age := now.Sub(time.Unix(seconds, 0)); age > tolerance || age < -tolerance {
+		return fmt.Errorf("timestamp outside of tolerance: %s", timestamp)
+	}
+
+	if !hmac.Equal([]byte(sig), []byte(signature(secret, timestamp, body))) {
+		return fmt.Errorf("invalid signature")
+	}
+
+	return nil
+}
@@ -0,0 +1,443 @@
+package callbacks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mikolajb/emailserv/internal/storage"
+	"go.uber.org/zap/zaptest"
+)
+
+// receiver is a test callback endpoint answering with given status codes
+type receiver struct {
+	mu       sync.Mutex
+	statuses []int
+	events   []Event
+	headers  []http.Header
+	bodies   [][]byte
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	body, _ := ioutil.ReadAll(r.Body)
+	var e Event
+	json.Unmarshal(body, &e)
+	rc.events = append(rc.events, e)
+	rc.headers = append(rc.headers, r.Header)
+	rc.bodies = append(rc.bodies, body)
+
+	status := http.StatusOK
+	if len(rc.statuses) > 0 {
+		status = rc.statuses[0]
+		rc.statuses = rc.statuses[1:]
+	}
+	w.WriteHeader(status)
+}
+
+type clock struct {
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	return c.now
+}
+
+func newTestDispatcher(t *testing.T) (*Dispatcher, *clock) {
+	c := &clock{now: time.Date(2018, 5, 10, 12, 0, 0, 0, time.UTC)}
+	d := NewDispatcher(zaptest.NewLogger(t), storage.NewMemoryStore(), http.DefaultClient)
+	d.now = c.Now
+	d.MaxAttempts = 3
+	return d, c
+}
+
+func TestDispatcher_delivered(t *testing.T) {
+	rc := &receiver{}
+	server := httptest.NewServer(rc)
+	defer server.Close()
+
+	d, c := newTestDispatcher(t)
+	all, err := d.Register("billing", "", server.URL+"/all")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if _, err := d.Register("billing", "message-2", server.URL+"/other-message"); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if _, err := d.Register("marketing", "", server.URL+"/other-key"); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	err = d.Notify("billing", Event{Type: EventDelivered, MessageID: "message-1", Recipient: "a@example.com"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	n, err := d.DeliverDue(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if n != 1 || len(rc.events) != 1 {
+		t.Fatalf("expected a single delivery, got: %d attempts, %d requests", n, len(rc.events))
+	}
+
+	e := rc.events[0]
+	if e.Type != EventDelivered || e.MessageID != "message-1" || e.Recipient != "a@example.com" || e.ID == "" {
+		t.Errorf("wrong event: %+v", e)
+	}
+	if rc.headers[0].Get(EventIDHeader) != e.ID {
+		t.Errorf("wrong event id header: %s", rc.headers[0].Get(EventIDHeader))
+	}
+	err = Verify(all.Secret, rc.headers[0].Get(SignatureHeader), rc.bodies[0], 5*time.Minute, c.now)
+	if err != nil {
+		t.Errorf("signature not verified: %s", err.Error())
+	}
+	if err := Verify("wrong", rc.headers[0].Get(SignatureHeader), rc.bodies[0], 5*time.Minute, c.now); err == nil {
+		t.Errorf("signature verified with a wrong secret")
+	}
+
+	entries, err := d.Log("billing")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if len(entries) != 1 || entries[0].StatusCode != http.StatusOK || entries[0].Error != "" || entries[0].RegistrationID != all.ID {
+		t.Errorf("wrong log: %+v", entries)
+	}
+
+	if n, _ := d.DeliverDue(context.Background()); n != 0 {
+		t.Errorf("delivered event should not be sent again, got %d attempts", n)
+	}
+}
+
+func TestDispatcher_retries(t *testing.T) {
+	rc := &receiver{statuses: []int{http.StatusInternalServerError, http.StatusServiceUnavailable}}
+	server := httptest.NewServer(rc)
+	defer server.Close()
+
+	d, c := newTestDispatcher(t)
+	if _, err := d.Register("billing", "message-1", server.URL); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if err := d.Notify("billing", Event{Type: EventBounced, MessageID: "message-1"}); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	// the first retry is due after BaseDelay, the second one after 2*BaseDelay
+	steps := []struct {
+		advance  time.Duration
+		attempts int
+	}{
+		{0, 1},
+		{d.BaseDelay - time.Second, 0},
+		{time.Second, 1},
+		{2*d.BaseDelay - time.Second, 0},
+		{time.Second, 1},
+		{time.Hour, 0},
+	}
+	for i, s := range steps {
+		c.now = c.now.Add(s.advance)
+		n, err := d.DeliverDue(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		if n != s.attempts {
+			t.Errorf("step %d: expected %d attempts, got %d", i, s.attempts, n)
+		}
+	}
+
+	if len(rc.events) != 3 || rc.events[0].ID != rc.events[2].ID {
+		t.Errorf("expected the same event sent 3 times, got: %+v", rc.events)
+	}
+	entries, _ := d.Log("billing")
+	if len(entries) != 3 || entries[0].StatusCode != http.StatusInternalServerError || entries[2].Attempt != 3 {
+		t.Errorf("wrong log: %+v", entries)
+	}
+	deadLetters, _ := d.DeadLetters("billing")
+	if len(deadLetters) != 0 {
+		t.Errorf("unexpected dead letters: %+v", deadLetters)
+	}
+}
+
+func TestDispatcher_deadLetter(t *testing.T) {
+	rc := &receiver{statuses: []int{http.StatusBadRequest, http.StatusBadRequest, http.StatusBadRequest}}
+	server := httptest.NewServer(rc)
+	defer server.Close()
+
+	d, c := newTestDispatcher(t)
+	if _, err := d.Register("billing", "", server.URL); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if err := d.Notify("billing", Event{Type: EventFailed, MessageID: "message-1"}); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	for i := 0; i < 5; i++ {
+		if _, err := d.DeliverDue(context.Background()); err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		c.now = c.now.Add(d.MaxDelay)
+	}
+
+	if len(rc.events) != d.MaxAttempts {
+		t.Errorf("expected %d attempts, got %d", d.MaxAttempts, len(rc.events))
+	}
+	deadLetters, err := d.DeadLetters("billing")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if len(deadLetters) != 1 || deadLetters[0].Attempts != d.MaxAttempts || deadLetters[0].LastError == "" {
+		t.Errorf("wrong dead letters: %+v", deadLetters)
+	}
+	if deadLetters, _ := d.DeadLetters("marketing"); len(deadLetters) != 0 {
+		t.Errorf("dead letters of other keys should not be returned: %+v", deadLetters)
+	}
+}
+
+func TestDispatcher_unregister(t *testing.T) {
+	rc := &receiver{}
+	server := httptest.NewServer(rc)
+	defer server.Close()
+
+	d, _ := newTestDispatcher(t)
+	r, err := d.Register("billing", "", server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if err := d.Notify("billing", Event{Type: EventSent, MessageID: "message-1"}); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	if found, err := d.Unregister("marketing", r.ID); found || err != nil {
+		t.Errorf("a callback of other key should not be removed: %t, %v", found, err)
+	}
+	if found, err := d.Unregister("billing", r.ID); !found || err != nil {
+		t.Errorf("a callback should be removed: %t, %v", found, err)
+	}
+	if _, err := d.DeliverDue(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if len(rc.events) != 0 {
+		t.Errorf("events should not be sent to removed callbacks: %+v", rc.events)
+	}
+	registrations, _ := d.Registrations("billing")
+	if len(registrations) != 0 {
+		t.Errorf("unexpected registrations: %+v", registrations)
+	}
+}
+
+func TestDispatcher_backoff(t *testing.T) {
+	d := &Dispatcher{BaseDelay: 10 * time.Second, MaxDelay: time.Minute}
+
+	cases := map[int]time.Duration{
+		1: 10 * time.Second,
+		2: 20 * time.Second,
+		3: 40 * time.Second,
+		4: time.Minute,
+		9: time.Minute,
+	}
+
+	for attempts, expected := range cases {
+		if got := d.backoff(attempts); got != expected {
+			t.Errorf("expected %s after %d attempts, got %s", expected, attempts, got)
+		}
+	}
+}
+
+func TestValidateURL(t *testing.T) {
+	cases := map[string]bool{
+		"https://example.com/callback": true,
+		"http://localhost:8080":        true,
+		"ftp://example.com":            false,
+		"/callback":                    false,
+		"":                             false,
+	}
+
+	for u, valid := range cases {
+		if err := ValidateURL(u); (err == nil) != valid {
+			t.Errorf("wrong validation of %q: %v", u, err)
+		}
+	}
+}
+
+func TestDispatcher_messageRegistrations(t *testing.T) {
+	rc := &receiver{}
+	server := httptest.NewServer(rc)
+	defer server.Close()
+
+	d, c := newTestDispatcher(t)
+	r, err := d.Register("billing", "message-1", server.URL+"/message-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if _, err := d.Register("billing", "message-1", server.URL+"/again"); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if _, err := d.Register("marketing", "message-2", server.URL+"/message-2"); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	registrations, err := d.Registrations("billing")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if len(registrations) != 2 {
+		t.Errorf("expected callbacks of a message, got: %+v", registrations)
+	}
+
+	if found, err := d.Unregister("billing", r.ID); !found || err != nil {
+		t.Errorf("a callback should be removed: %t, %v", found, err)
+	}
+	if err := d.Notify("billing", Event{Type: EventSent, MessageID: "message-1"}); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if n, err := d.DeliverDue(context.Background()); n != 1 || err != nil {
+		t.Errorf("expected an event sent to the remaining callback, got: %d, %v", n, err)
+	}
+
+	c.now = c.now.Add(2 * time.Hour)
+	if _, err := d.Register("marketing", "message-3", server.URL+"/message-3"); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	n, err := d.PurgeRegistrations(time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if n != 2 {
+		t.Errorf("expected callbacks of 2 messages purged, got: %d", n)
+	}
+	registrations, _ = d.Registrations("marketing")
+	if len(registrations) != 1 || registrations[0].MessageID != "message-3" {
+		t.Errorf("only recent callbacks should be kept, got: %+v", registrations)
+	}
+}
+
+func TestCheckIP(t *testing.T) {
+	cases := map[string]bool{
+		"93.184.216.34":    true,
+		"2606:4700::1111":  true,
+		"127.0.0.1":        false,
+		"10.1.2.3":         false,
+		"172.20.0.1":       false,
+		"192.168.1.1":      false,
+		"169.254.169.254":  false,
+		"0.0.0.0":          false,
+		"::1":              false,
+		"fd00::1":          false,
+		"fe80::1":          false,
+		"::ffff:127.0.0.1": false,
+	}
+
+	for address, allowed := range cases {
+		if err := checkIP(net.ParseIP(address)); (err == nil) != allowed {
+			t.Errorf("wrong check of %s: %v", address, err)
+		}
+	}
+}
+
+func TestNewClient(t *testing.T) {
+	server := httptest.NewServer(&receiver{})
+	defer server.Close()
+
+	_, err := NewClient(time.Second).Get(server.URL)
+	if !errors.Is(err, ErrAddressNotAllowed) {
+		t.Errorf("expected %v, got: %v", ErrAddressNotAllowed, err)
+	}
+}
+
+func TestDispatcher_slowReceiver(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer slow.Close()
+	defer close(release)
+	rc := &receiver{}
+	fast := httptest.NewServer(rc)
+	defer fast.Close()
+
+	d, _ := newTestDispatcher(t)
+	d.client = &http.Client{Timeout: 500 * time.Millisecond}
+	if _, err := d.Register("billing", "", slow.URL); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if _, err := d.Register("marketing", "", fast.URL); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	for i := 0; i < 3; i++ {
+		if err := d.Notify("billing", Event{Type: EventSent}); err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+	}
+	if err := d.Notify("marketing", Event{Type: EventSent}); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	start := time.Now()
+	n, err := d.DeliverDue(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	// a receiver which failed is not tried again until the next run
+	if n != 2 {
+		t.Errorf("expected 2 attempts, got %d", n)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("deliveries to a slow receiver should not add up, took %s", elapsed)
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if len(rc.events) != 1 {
+		t.Errorf("expected an event delivered to a fast receiver, got %d", len(rc.events))
+	}
+}
+
+func TestDispatcher_workers(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		current int
+		max     int
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		current++
+		if current > max {
+			max = current
+		}
+		mu.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		mu.Lock()
+		current--
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	d, _ := newTestDispatcher(t)
+	d.Workers = 2
+	for _, key := range []string{"a", "b", "c", "d"} {
+		if _, err := d.Register(key, "", server.URL+"/"+key); err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		if err := d.Notify(key, Event{Type: EventSent}); err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+	}
+
+	if n, err := d.DeliverDue(context.Background()); n != 4 || err != nil {
+		t.Fatalf("expected 4 attempts, got: %d, %v", n, err)
+	}
+	if max < 2 || max > d.Workers {
+		t.Errorf("expected up to %d URLs at once, got %d", d.Workers, max)
+	}
+}
@@ -0,0 +1,99 @@
+package callbacks
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// ErrAddressNotAllowed is returned when a callback URL points to a loopback,
+// link-local, private or other internal address
+var ErrAddressNotAllowed = errors.New("address is not allowed")
+
+// internalNetworks are networks callbacks cannot connect to,
+// e.g. 169.254.169.254 is an address of cloud instance metadata
+var internalNetworks = parseNetworks(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+)
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks[i] = network
+	}
+	return networks
+}
+
+// checkIP returns ErrAddressNotAllowed when an IP is internal
+func checkIP(ip net.IP) error {
+	// IPv4-mapped IPv6 addresses are checked as IPv4
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, network := range internalNetworks {
+		if network.Contains(ip) {
+			return ErrAddressNotAllowed
+		}
+	}
+
+	return nil
+}
+
+// checkAddress is a net.Dialer.Control function, it is called with
+// a resolved address, so a public name cannot point to an internal one
+func checkAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return ErrAddressNotAllowed
+	}
+
+	return checkIP(ip)
+}
+
+// NewClient returns an HTTP client of callbacks, URLs are given by
+// API callers, so it refuses to connect to internal addresses,
+// including redirects
+func NewClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   10 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   checkAddress,
+	}
+
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			// a proxy would connect to any address
+			Proxy:               nil,
+			DialContext:         dialer.DialContext,
+			MaxIdleConns:        100,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+	}
+}
@@ -0,0 +1,467 @@
+// Package dkim signs raw messages with DKIM signatures (RFC 6376)
+// using relaxed/relaxed canonicalization and rsa-sha256
+// or ed25519-sha256 (RFC 8463) algorithms.
+package dkim
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// HeaderName is a name of a signature header
+const HeaderName = "DKIM-Signature"
+
+// DefaultHeaders are headers signed when a message has them
+var DefaultHeaders = []string{
+	"From",
+	"Reply-To",
+	"To",
+	"Cc",
+	"Subject",
+	"Date",
+	"Message-ID",
+	"MIME-Version",
+	"Content-Type",
+	"Content-Transfer-Encoding",
+}
+
+var (
+	// ErrNoSignature is returned when a message is not signed
+	ErrNoSignature = errors.New("message has no DKIM signature")
+
+	// ErrInvalidSignature is returned when a signature does not match
+	ErrInvalidSignature = errors.New("invalid DKIM signature")
+)
+
+// Key is a signing key of a domain
+type Key struct {
+	Domain   string
+	Selector string
+
+	// Signer is *rsa.PrivateKey or ed25519.PrivateKey
+	Signer crypto.Signer
+}
+
+// algorithm returns a name of a signing algorithm of a key
+func (k *Key) algorithm() (string, error) {
+	switch k.Signer.(type) {
+	case *rsa.PrivateKey:
+		return "rsa-sha256", nil
+	case ed25519.PrivateKey:
+		return "ed25519-sha256", nil
+	default:
+		return "", fmt.Errorf("unsupported key type %T", k.Signer)
+	}
+}
+
+// ParsePrivateKey parses a PEM encoded RSA (PKCS #1 or #8)
+// or Ed25519 (PKCS #8) private key
+func ParsePrivateKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse private key: %s", err.Error())
+	}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return key, nil
+	case ed25519.PrivateKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+}
+
+// LoadKeys reads a JSON file mapping domains to selectors and PEM files
+// of their keys, e.g. {"example.com": {"selector": "s1", "key": "s1.pem"}}
+func LoadKeys(path string) ([]*Key, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read DKIM keys: %s", err.Error())
+	}
+
+	var config map[string]struct {
+		Selector string `json:"selector"`
+		Key      string `json:"key"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("invalid DKIM keys file: %s", err.Error())
+	}
+
+	var keys []*Key
+	for domain, c := range config {
+		if c.Selector == "" {
+			return nil, fmt.Errorf("empty selector of domain %s", domain)
+		}
+		pemData, err := ioutil.ReadFile(c.Key)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read key of domain %s: %s", domain, err.Error())
+		}
+		signer, err := ParsePrivateKey(pemData)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key of domain %s: %s", domain, err.Error())
+		}
+		keys = append(keys, &Key{Domain: domain, Selector: c.Selector, Signer: signer})
+	}
+
+	return keys, nil
+}
+
+// Signer signs messages with keys of sender domains
+type Signer struct {
+	keys map[string]*Key
+
+	// Headers are headers signed when a message has them
+	Headers []string
+
+	now func() time.Time
+}
+
+// NewSigner returns a signer with keys of domains
+func NewSigner(keys []*Key) *Signer {
+	m := make(map[string]*Key, len(keys))
+	for _, k := range keys {
+		m[strings.ToLower(k.Domain)] = k
+	}
+
+	return &Signer{
+		keys:    m,
+		Headers: DefaultHeaders,
+		now:     time.Now,
+	}
+}
+
+// Sign adds a DKIM-Signature header to a message with a key
+// of a domain of its From address, a message of a domain
+// without a key is returned as it is
+func (s *Signer) Sign(message []byte) ([]byte, error) {
+	message = toCRLF(message)
+	headers, body := split(message)
+
+	from := lastHeader(headers, "From")
+	if from == nil {
+		return nil, errors.New("message has no From header")
+	}
+	address, err := mail.ParseAddress(strings.TrimSpace(from.value()))
+	if err != nil {
+		return nil, fmt.Errorf("invalid From header: %s", err.Error())
+	}
+	domain := strings.ToLower(address.Address[strings.LastIndex(address.Address, "@")+1:])
+	key, ok := s.keys[domain]
+	if !ok {
+		return message, nil
+	}
+	algorithm, err := key.algorithm()
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	var signed []*header
+	for _, name := range s.Headers {
+		if h := lastHeader(headers, name); h != nil {
+			names = append(names, strings.ToLower(name))
+			signed = append(signed, h)
+		}
+	}
+
+	bodyHash := sha256.Sum256(relaxedBody(body))
+	value := fmt.Sprintf(
+		" v=1; a=%s; c=relaxed/relaxed; d=%s; s=%s; t=%d; h=%s; bh=%s; b=",
+		algorithm,
+		key.Domain,
+		key.Selector,
+		s.now().Unix(),
+		strings.Join(names, ":"),
+		base64.StdEncoding.EncodeToString(bodyHash[:]),
+	)
+	signature, err := sign(key.Signer, headerHash(signed, HeaderName+":"+value))
+	if err != nil {
+		return nil, fmt.Errorf("cannot sign message: %s", err.Error())
+	}
+
+	var b bytes.Buffer
+	b.WriteString(HeaderName + ":" + value + base64.StdEncoding.EncodeToString(signature) + "\r\n")
+	b.Write(message)
+
+	return b.Bytes(), nil
+}
+
+// sign signs a SHA-256 hash, Ed25519 signs the hash itself (RFC 8463)
+func sign(signer crypto.Signer, hash []byte) ([]byte, error) {
+	if key, ok := signer.(ed25519.PrivateKey); ok {
+		return ed25519.Sign(key, hash), nil
+	}
+
+	return signer.Sign(rand.Reader, hash, crypto.SHA256)
+}
+
+// headerHash returns a hash of signed headers and a signature header
+// with an empty b= tag, without its trailing CRLF
+func headerHash(signed []*header, signatureHeader string) []byte {
+	h := sha256.New()
+	for _, header := range signed {
+		h.Write([]byte(relaxedHeader(header.raw)))
+		h.Write([]byte("\r\n"))
+	}
+	h.Write([]byte(relaxedHeader(signatureHeader)))
+
+	return h.Sum(nil)
+}
+
+// header is a raw header field with its continuation lines
+type header struct {
+	name string
+	raw  string
+}
+
+// value returns an unfolded value of a header
+func (h *header) value() string {
+	v := h.raw[strings.Index(h.raw, ":")+1:]
+	return strings.NewReplacer("\r\n", "").Replace(v)
+}
+
+// toCRLF converts bare LF line endings to CRLF
+func toCRLF(message []byte) []byte {
+	if !bytes.Contains(message, []byte("\n")) {
+		return message
+	}
+	message = bytes.Replace(message, []byte("\r\n"), []byte("\n"), -1)
+	return bytes.Replace(message, []byte("\n"), []byte("\r\n"), -1)
+}
+
+// split returns header fields and a body of a message
+func split(message []byte) ([]*header, []byte) {
+	var body []byte
+	headerPart := message
+	if i := bytes.Index(message, []byte("\r\n\r\n")); i >= 0 {
+		headerPart = message[:i+2]
+		body = message[i+4:]
+	}
+
+	var headers []*header
+	for _, line := range strings.SplitAfter(string(headerPart), "\r\n") {
+		if line == "" {
+			continue
+		}
+		line = strings.TrimSuffix(line, "\r\n")
+		if (line[0] == ' ' || line[0] == '\t') && len(headers) > 0 {
+			headers[len(headers)-1].raw += "\r\n" + line
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+		headers = append(headers, &header{name: strings.TrimSpace(line[:i]), raw: line})
+	}
+
+	return headers, body
+}
+
+// lastHeader returns the last instance of a header or nil
+func lastHeader(headers []*header, name string) *header {
+	for i := len(headers) - 1; i >= 0; i-- {
+		if strings.EqualFold(headers[i].name, name) {
+			return headers[i]
+		}
+	}
+
+	return nil
+}
+
+// relaxedHeader canonicalizes a header field, it returns it without CRLF
+func relaxedHeader(raw string) string {
+	i := strings.Index(raw, ":")
+	name := strings.ToLower(strings.TrimSpace(raw[:i]))
+	value := strings.NewReplacer("\r\n", "").Replace(raw[i+1:])
+	value = strings.Join(strings.FieldsFunc(value, isWSP), " ")
+
+	return name + ":" + value
+}
+
+func isWSP(r rune) bool {
+	return r == ' ' || r == '\t'
+}
+
+// relaxedBody canonicalizes a body
+func relaxedBody(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	for i, line := range lines {
+		// reduce whitespace, removing it at the end of a line
+		fields := strings.FieldsFunc(line, isWSP)
+		prefix := ""
+		if len(line) > 0 && isWSP(rune(line[0])) {
+			prefix = " "
+		}
+		lines[i] = prefix + strings.Join(fields, " ")
+		if len(fields) == 0 {
+			lines[i] = ""
+		}
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+// tags parses a tag list, e.g. "v=1; a=rsa-sha256"
+func tags(value string) map[string]string {
+	result := map[string]string{}
+	for _, tag := range strings.Split(value, ";") {
+		i := strings.Index(tag, "=")
+		if i < 0 {
+			continue
+		}
+		name := strings.TrimSpace(tag[:i])
+		v := strings.Join(strings.Fields(tag[i+1:]), "")
+		result[name] = v
+	}
+
+	return result
+}
+
+// withoutSignature returns a raw header with an empty b= tag
+func withoutSignature(raw string) string {
+	i := strings.Index(raw, ":")
+	parts := strings.Split(raw[i+1:], ";")
+	for j, part := range parts {
+		k := strings.Index(part, "=")
+		if k >= 0 && strings.TrimSpace(part[:k]) == "b" {
+			parts[j] = part[:k+1]
+		}
+	}
+
+	return raw[:i+1] + strings.Join(parts, ";")
+}
+
+// LookupTXTFunc returns TXT records of a name, e.g. net.LookupTXT
+type LookupTXTFunc func(name string) ([]string, error)
+
+// Verify verifies the first DKIM signature of a message with a public key
+// found in DNS, it returns a signing domain
+func Verify(message []byte, lookupTXT LookupTXTFunc) (string, error) {
+	message = toCRLF(message)
+	headers, body := split(message)
+
+	var signature *header
+	for _, h := range headers {
+		if strings.EqualFold(h.name, HeaderName) {
+			signature = h
+			break
+		}
+	}
+	if signature == nil {
+		return "", ErrNoSignature
+	}
+
+	t := tags(signature.value())
+	if t["v"] != "1" || t["c"] != "relaxed/relaxed" {
+		return "", fmt.Errorf("unsupported DKIM signature version %q or canonicalization %q", t["v"], t["c"])
+	}
+
+	bodyHash := sha256.Sum256(relaxedBody(body))
+	if base64.StdEncoding.EncodeToString(bodyHash[:]) != t["bh"] {
+		return "", fmt.Errorf("%s: body hash does not match", ErrInvalidSignature.Error())
+	}
+
+	// headers are signed from the bottom, so each instance is used once
+	used := map[*header]bool{}
+	var signed []*header
+	for _, name := range strings.Split(t["h"], ":") {
+		for i := len(headers) - 1; i >= 0; i-- {
+			h := headers[i]
+			if h != signature && !used[h] && strings.EqualFold(h.name, strings.TrimSpace(name)) {
+				used[h] = true
+				signed = append(signed, h)
+				break
+			}
+		}
+	}
+	hash := headerHash(signed, withoutSignature(signature.raw))
+
+	sig, err := base64.StdEncoding.DecodeString(t["b"])
+	if err != nil {
+		return "", fmt.Errorf("invalid signature encoding: %s", err.Error())
+	}
+
+	records, err := lookupTXT(t["s"] + "._domainkey." + t["d"])
+	if err != nil {
+		return "", fmt.Errorf("cannot find DKIM key: %s", err.Error())
+	}
+	key := tags(strings.Join(records, ""))
+	publicKey, err := base64.StdEncoding.DecodeString(key["p"])
+	if err != nil || len(publicKey) == 0 {
+		return "", errors.New("invalid DKIM key record")
+	}
+
+	switch t["a"] {
+	case "rsa-sha256":
+		if k := key["k"]; k != "" && k != "rsa" {
+			return "", fmt.Errorf("key type %q does not match algorithm %s", k, t["a"])
+		}
+		parsed, err := x509.ParsePKIXPublicKey(publicKey)
+		if err != nil {
+			return "", fmt.Errorf("invalid RSA key: %s", err.Error())
+		}
+		rsaKey, ok := parsed.(*rsa.PublicKey)
+		if !ok {
+			return "", errors.New("DKIM key is not an RSA key")
+		}
+		if err := rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, hash, sig); err != nil {
+			return "", ErrInvalidSignature
+		}
+	case "ed25519-sha256":
+		if key["k"] != "ed25519" || len(publicKey) != ed25519.PublicKeySize {
+			return "", fmt.Errorf("key type %q does not match algorithm %s", key["k"], t["a"])
+		}
+		if !ed25519.Verify(ed25519.PublicKey(publicKey), hash, sig) {
+			return "", ErrInvalidSignature
+		}
+	default:
+		return "", fmt.Errorf("unsupported algorithm %q", t["a"])
+	}
+
+	return t["d"], nil
+}
+
+// Record returns a DNS TXT record publishing a public key of a key
+func (k *Key) Record() (string, error) {
+	switch signer := k.Signer.(type) {
+	case *rsa.PrivateKey:
+		der, err := x509.MarshalPKIXPublicKey(&signer.PublicKey)
+		if err != nil {
+			return "", err
+		}
+		return "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der), nil
+	case ed25519.PrivateKey:
+		public := signer.Public().(ed25519.PublicKey)
+		return "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(public), nil
+	default:
+		return "", fmt.Errorf("unsupported key type %T", k.Signer)
+	}
+}
@@ -0,0 +1,184 @@
+package dkim
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dnsStub is a local DNS with TXT records
+type dnsStub map[string]string
+
+func (d dnsStub) LookupTXT(name string) ([]string, error) {
+	record, ok := d[name]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	// long records are split into strings of 255 bytes
+	var result []string
+	for len(record) > 255 {
+		result = append(result, record[:255])
+		record = record[255:]
+	}
+
+	return append(result, record), nil
+}
+
+const message = "From: Sender <sender@example.com>\r\n" +
+	"To: recipient@example.net\r\n" +
+	"Subject: Is dinner ready?\r\n" +
+	"Date: Thu, 10 May 2018 12:00:00 +0000\r\n" +
+	"Message-ID: <1@example.com>\r\n" +
+	"\r\n" +
+	"Hi.\r\n" +
+	"\r\n" +
+	"We lost the game.  Are you hungry yet?\r\n"
+
+func TestVerify_rfc8463(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/rfc8463.eml")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	dns := dnsStub{
+		"brisbane._domainkey.football.example.com": "v=DKIM1; k=ed25519; p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo=",
+	}
+
+	domain, err := Verify(data, dns.LookupTXT)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if domain != "football.example.com" {
+		t.Errorf("wrong domain: %s", domain)
+	}
+}
+
+func TestSigner_Sign(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	cases := map[string]struct {
+		signer    crypto.Signer
+		algorithm string
+	}{
+		"rsa-sha256": {
+			signer:    rsaKey,
+			algorithm: "a=rsa-sha256",
+		},
+		"ed25519-sha256": {
+			signer:    edKey,
+			algorithm: "a=ed25519-sha256",
+		},
+	}
+
+	for hint, c := range cases {
+		t.Run(hint, func(t *testing.T) {
+			key := &Key{Domain: "example.com", Selector: "s1", Signer: c.signer}
+			record, err := key.Record()
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			dns := dnsStub{"s1._domainkey.example.com": record}
+
+			signer := NewSigner([]*Key{key})
+			signer.now = func() time.Time { return time.Unix(1525953600, 0) }
+			signed, err := signer.Sign([]byte(message))
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if !bytes.HasPrefix(signed, []byte(HeaderName+": v=1; "+c.algorithm+"; c=relaxed/relaxed; d=example.com; s=s1; t=1525953600; h=from:to:subject:date:message-id; ")) {
+				t.Errorf("wrong signature header: %s", signed)
+			}
+
+			if _, err := Verify(signed, dns.LookupTXT); err != nil {
+				t.Errorf("unexpected error: %s", err.Error())
+			}
+
+			// relaxed canonicalization ignores whitespace changes
+			refolded := strings.Replace(string(signed), "Subject: Is dinner ready?", "subject:  Is dinner\r\n\tready? ", 1)
+			refolded = strings.Replace(refolded, "Are you hungry yet?\r\n", "Are you   hungry yet?  \r\n\r\n\r\n", 1)
+			if _, err := Verify([]byte(refolded), dns.LookupTXT); err != nil {
+				t.Errorf("unexpected error of a refolded message: %s", err.Error())
+			}
+
+			tampered := map[string]string{
+				"subject": strings.Replace(string(signed), "dinner", "lunch", 1),
+				"body":    strings.Replace(string(signed), "lost", "won", 1),
+			}
+			for part, m := range tampered {
+				if _, err := Verify([]byte(m), dns.LookupTXT); err == nil {
+					t.Errorf("a message with a changed %s should not be verified", part)
+				}
+			}
+		})
+	}
+}
+
+func TestSigner_Sign_otherDomain(t *testing.T) {
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	signer := NewSigner([]*Key{{Domain: "example.org", Selector: "s1", Signer: edKey}})
+
+	signed, err := signer.Sign([]byte(message))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if string(signed) != message {
+		t.Errorf("a message of a domain without a key should not be signed")
+	}
+	if _, err := Verify(signed, dnsStub{}.LookupTXT); err != ErrNoSignature {
+		t.Errorf("expected no signature, got: %v", err)
+	}
+}
+
+func TestLoadKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dkim")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	edDER, _ := x509.MarshalPKCS8PrivateKey(edKey)
+	files := map[string][]byte{
+		"rsa.pem":     pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}),
+		"ed25519.pem": pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: edDER}),
+		"keys.json": []byte(`{
+			"example.com": {"selector": "s1", "key": "` + filepath.Join(dir, "rsa.pem") + `"},
+			"example.org": {"selector": "s2", "key": "` + filepath.Join(dir, "ed25519.pem") + `"}
+		}`),
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+	}
+
+	keys, err := LoadKeys(filepath.Join(dir, "keys.json"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if len(keys) != 2 {
+		t.Fatalf("expected 2 keys, got: %d", len(keys))
+	}
+	for _, k := range keys {
+		if _, err := k.algorithm(); err != nil {
+			t.Errorf("unexpected error of %s: %s", k.Domain, err.Error())
+		}
+	}
+}
@@ -3,102 +3,309 @@ package emailclient
 import (
 	"context"
 	"fmt"
+	"sort"
+	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ses"
+	"github.com/mikolajb/emailserv/internal/dkim"
+	"github.com/mikolajb/emailserv/internal/mime"
+	"github.com/mikolajb/emailserv/internal/requestid"
+	"github.com/mikolajb/emailserv/internal/tracing"
 	"go.uber.org/zap"
 )
 
+const (
+	// DefaultAmazonRegion is a region of SES used when none is configured
+	DefaultAmazonRegion = "eu-west-1"
+
+	// DefaultRoleSessionName names sessions of assumed roles
+	DefaultRoleSessionName = "emailserv"
+)
+
+// AmazonConfig configures AmazonClient
+type AmazonConfig struct {
+	// KeyID and SecretKey are static credentials, the default credential
+	// chain (environment, shared config, web identity, instance metadata)
+	// is used when they are empty
+	KeyID     string
+	SecretKey string
+
+	// RoleArn is a role assumed with STS using credentials above, optional
+	RoleArn string
+
+	// ExternalID is passed to STS when a role is assumed, optional
+	ExternalID string
+
+	// RoleSessionName names sessions of an assumed role,
+	// DefaultRoleSessionName when empty
+	RoleSessionName string
+
+	// STSEndpoint overrides an endpoint of STS
+	STSEndpoint string
+
+	// Region is a region of SES, DefaultAmazonRegion when empty
+	Region string
+
+	// Endpoint overrides an endpoint of SES, e.g. a local fake server
+	Endpoint string
+
+	// ConfigurationSet is a name of a configuration set of messages, optional
+	ConfigurationSet string
+
+	// Tags are added to every message
+	Tags map[string]string
+
+	// SourceArn is an ARN of an identity authorizing a sender, optional
+	SourceArn string
+
+	// DKIM signs messages, optional
+	DKIM *dkim.Signer
+}
+
 // AmazonClient holds a state of a client
 type AmazonClient struct {
-	logger    *zap.Logger
-	sesClient *ses.SES
+	logger      *zap.Logger
+	sesClient   *ses.SES
+	credentials *credentials.Credentials
+	config      AmazonConfig
 }
 
-// NewAmazonClient returns a new amazon SNS client for given credentials
-func NewAmazonClient(logger *zap.Logger, keyID, secretKey string) (*AmazonClient, error) {
+// NewAmazonClient returns a new amazon SES client for a given configuration
+func NewAmazonClient(logger *zap.Logger, config AmazonConfig) (*AmazonClient, error) {
+	if config.Region == "" {
+		config.Region = DefaultAmazonRegion
+	}
+	awsConfig := aws.Config{
+		Logger: aws.LoggerFunc(func(args ...interface{}) {
+			logger.Debug("aws sdk", zap.Any("aws_sdk", args))
+		}),
+		Region: aws.String(config.Region),
+	}
+	if config.KeyID != "" || config.SecretKey != "" {
+		awsConfig.Credentials = credentials.NewStaticCredentials(
+			config.KeyID,
+			config.SecretKey,
+			"",
+		)
+	}
+	// shared config enables profiles with roles and web identity
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            awsConfig,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot create aws session: %s", err.Error())
+	}
+
+	creds := sess.Config.Credentials
+	if config.RoleArn != "" {
+		stsSession := sess
+		if config.STSEndpoint != "" {
+			stsSession = sess.Copy(&aws.Config{Endpoint: aws.String(config.STSEndpoint)})
+		}
+		sessionName := config.RoleSessionName
+		if sessionName == "" {
+			sessionName = DefaultRoleSessionName
+		}
+		creds = stscreds.NewCredentials(stsSession, config.RoleArn, func(p *stscreds.AssumeRoleProvider) {
+			p.RoleSessionName = sessionName
+			if config.ExternalID != "" {
+				p.ExternalID = aws.String(config.ExternalID)
+			}
+		})
+	}
+
+	sesConfig := &aws.Config{Credentials: creds}
+	if config.Endpoint != "" {
+		sesConfig.Endpoint = aws.String(config.Endpoint)
+	}
+	sesClient := ses.New(sess, sesConfig)
+	sesClient.Handlers.Build.PushBack(func(r *request.Request) {
+		tracing.Inject(r.Context(), r.HTTPRequest.Header)
+	})
+
 	return &AmazonClient{
-		logger: logger,
-		sesClient: ses.New(session.Must(session.NewSession(
-			&aws.Config{
-				Logger: aws.LoggerFunc(func(args ...interface{}) {
-					logger.Debug("abc", zap.Any("values", args))
-				}),
-				Credentials: credentials.NewStaticCredentials(
-					keyID,
-					secretKey,
-					"",
-				),
-				Region: aws.String("eu-west-1"),
-			},
-		))),
+		logger:      logger,
+		sesClient:   sesClient,
+		credentials: creds,
+		config:      config,
 	}, nil
 }
 
+// CredentialSource retrieves credentials and returns a name of their
+// provider, e.g. EnvConfigProvider or AssumeRoleProvider, and a masked
+// access key ID, so they can be reported without leaking secrets
+func (ac *AmazonClient) CredentialSource() (string, string, error) {
+	value, err := ac.credentials.Get()
+	if err != nil {
+		return "", "", fmt.Errorf("cannot retrieve aws credentials: %s", err.Error())
+	}
+
+	return value.ProviderName, maskKeyID(value.AccessKeyID), nil
+}
+
+// maskKeyID keeps first and last 4 characters of an access key ID
+func maskKeyID(keyID string) string {
+	if len(keyID) <= 8 {
+		return strings.Repeat("*", len(keyID))
+	}
+
+	return keyID[:4] + strings.Repeat("*", len(keyID)-8) + keyID[len(keyID)-4:]
+}
+
 // ProviderName returns "aws"
 func (ac *AmazonClient) ProviderName() string {
 	return "aws"
 }
 
-// Send sends an email using Amazon SNS
-func (ac *AmazonClient) Send(ctx context.Context, sender string, recipients []string, subject string, opts ...EmailOption) error {
+// tags returns configured tags, sorted by name, and tags of a message
+func (ac *AmazonClient) tags(ctx context.Context, options *emailOptions) []*ses.MessageTag {
+	names := make([]string, 0, len(ac.config.Tags))
+	for name := range ac.config.Tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var tags []*ses.MessageTag
+	for _, name := range names {
+		tags = append(tags, &ses.MessageTag{
+			Name:  aws.String(name),
+			Value: aws.String(ac.config.Tags[name]),
+		})
+	}
+	if id := requestid.FromContext(ctx); id != "" {
+		tags = append(tags, &ses.MessageTag{
+			Name:  aws.String("request_id"),
+			Value: aws.String(id),
+		})
+	}
+	if options.messageID != "" {
+		tags = append(tags, &ses.MessageTag{
+			Name:  aws.String("message_id"),
+			Value: aws.String(options.messageID),
+		})
+	}
+
+	return tags
+}
+
+// rawMessage builds a MIME message, signed when DKIM is configured
+func (ac *AmazonClient) rawMessage(sender string, recipients []string, subject string, options *emailOptions) ([]byte, error) {
+	message := &mime.Message{
+		From:    sender,
+		To:      recipients,
+		Cc:      options.ccRecipients,
+		Subject: subject,
+		Text:    options.body,
+	}
+	if message.Text == "" {
+		// a message requires a body
+		message.Text = " "
+	}
+	for _, a := range options.attachments {
+		message.Attachments = append(message.Attachments, mime.Attachment{
+			Filename:    a.Filename,
+			ContentType: a.ContentType,
+			Data:        a.Data,
+		})
+	}
+	raw, err := message.Build()
+	if err != nil {
+		return nil, err
+	}
+	if ac.config.DKIM != nil {
+		return ac.config.DKIM.Sign(raw)
+	}
+
+	return raw, nil
+}
+
+// Send sends an email using Amazon SES raw email API
+func (ac *AmazonClient) Send(ctx context.Context, sender string, recipients []string, subject string, opts ...EmailOption) (string, error) {
 	options := processOptions(opts...)
 	logger := ac.logger.With(
-		loggerFields(sender, recipients, subject, options)...,
+		loggerFields(ctx, sender, recipients, subject, options)...,
 	)
 
 	logger.Debug("sending a message")
 
-	input := &ses.SendEmailInput{
-		Destination: &ses.Destination{
-			ToAddresses:  aws.StringSlice(recipients),
-			CcAddresses:  aws.StringSlice(options.ccRecipients),
-			BccAddresses: aws.StringSlice(options.bccRecipients),
-		},
-		Message: &ses.Message{
-			Body: &ses.Body{
-				Text: &ses.Content{
-					Charset: aws.String("UTF-8"),
-					Data:    aws.String(options.body),
-				},
-			},
-			Subject: &ses.Content{
-				Charset: aws.String("UTF-8"),
-				Data:    aws.String(subject),
-			},
-		},
-		Source: aws.String(sender),
-	}
-
-	result, err := ac.sesClient.SendEmailWithContext(ctx, input)
+	raw, err := ac.rawMessage(sender, recipients, subject, options)
 	if err != nil {
+		// e.g. an invalid DKIM key, other clients can still send a message
+		logger.Error("cannot build a message", zap.Error(err))
+		return "", &Error{
+			Class: ClassConfiguration,
+			Err:   fmt.Errorf("cannot build a message: %s", err.Error()),
+		}
+	}
+
+	input := &ses.SendRawEmailInput{
+		Destinations: aws.StringSlice(AllRecipients(recipients, opts...)),
+		RawMessage:   &ses.RawMessage{Data: raw},
+		Source:       aws.String(sender),
+		Tags:         ac.tags(ctx, options),
+	}
+	if ac.config.ConfigurationSet != "" {
+		input.ConfigurationSetName = aws.String(ac.config.ConfigurationSet)
+	}
+	if ac.config.SourceArn != "" {
+		input.SourceArn = aws.String(ac.config.SourceArn)
+	}
+
+	result, err := ac.sesClient.SendRawEmailWithContext(ctx, input)
+	if err != nil {
+		class := ClassTemporary
+		// messages of SES can contain addresses, they are only logged
+		// in the response field and are not passed in errors
+		reason := err.Error()
 		if aerr, ok := err.(awserr.Error); ok {
+			reason = aerr.Code()
+			logger.Debug("aws error", zap.String("response", aerr.Message()))
 			switch aerr.Code() {
 			case ses.ErrCodeMessageRejected:
-				logger.Error("message cannot be sent", zap.Error(aerr))
+				// it is also returned for an account in the sandbox
+				// or an unverified address, so other clients are tried
+				logger.Error("message cannot be sent", zap.String("code", aerr.Code()))
+				class = ClassConfiguration
 			case ses.ErrCodeMailFromDomainNotVerifiedException:
-				logger.Error("sender's domain is not verified", zap.Error(aerr))
+				logger.Error("sender's domain is not verified", zap.String("code", aerr.Code()))
+				class = ClassConfiguration
 			case ses.ErrCodeConfigurationSetDoesNotExistException:
-				logger.Error("configuration set does not exist", zap.Error(aerr))
+				logger.Error("configuration set does not exist", zap.String("code", aerr.Code()))
+				class = ClassConfiguration
 			case ses.ErrCodeConfigurationSetSendingPausedException:
-				logger.Error("sending email is paused for a given configuration", zap.Error(aerr))
+				logger.Error("sending email is paused for a given configuration", zap.String("code", aerr.Code()))
+				class = ClassConfiguration
 			case ses.ErrCodeAccountSendingPausedException:
-				logger.Error("sending email is paused for a given SNS account", zap.Error(aerr))
+				logger.Error("sending email is paused for a given SES account", zap.String("code", aerr.Code()))
+				class = ClassConfiguration
+			case "Throttling":
+				logger.Error("sending rate exceeded", zap.String("code", aerr.Code()))
+				class = ClassThrottled
+			case "InvalidClientTokenId", "SignatureDoesNotMatch", "AccessDenied", "UnrecognizedClientException":
+				logger.Error("invalid credentials", zap.String("code", aerr.Code()))
+				class = ClassConfiguration
 			default:
-				logger.Error("unknown aws error", zap.Error(aerr))
+				logger.Error("unknown aws error", zap.String("code", aerr.Code()))
 			}
 		} else {
 			// Print the error, cast err to awserr.Error to get the Code and
 			// Message from an error.
 			logger.Error("unknown error", zap.Error(err))
 		}
-		return fmt.Errorf("message cannot be sent: %s", err.Error())
+		return "", &Error{
+			Class: class,
+			Err:   fmt.Errorf("message cannot be sent: %s", reason),
+		}
 	}
 
 	logger.Debug("message is sent", zap.String("aws_message_id", *result.MessageId))
 
-	return nil
+	return *result.MessageId, nil
 }
@@ -0,0 +1,295 @@
+package emailclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mikolajb/emailserv/internal/dkim"
+	"go.uber.org/zap/zaptest"
+)
+
+// fakeSES is a local SES query API server, it records a form of
+// the last request and responds with an error code when it is set
+type fakeSES struct {
+	form      url.Values
+	header    http.Header
+	errorCode string
+}
+
+func (f *fakeSES) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	f.form = r.PostForm
+	f.header = r.Header
+	w.Header().Set("Content-Type", "text/xml")
+	if f.errorCode != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `<ErrorResponse><Error><Type>Sender</Type><Code>%s</Code><Message>error</Message></Error><RequestId>1</RequestId></ErrorResponse>`, f.errorCode)
+		return
+	}
+	fmt.Fprint(w, `<SendRawEmailResponse><SendRawEmailResult><MessageId>ses-id</MessageId></SendRawEmailResult><ResponseMetadata><RequestId>1</RequestId></ResponseMetadata></SendRawEmailResponse>`)
+}
+
+func TestAmazonClient_Send(t *testing.T) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := &dkim.Key{Domain: "example.com", Selector: "s1", Signer: private}
+	record, err := key.Record()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fake := &fakeSES{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	ac, err := NewAmazonClient(zaptest.NewLogger(t), AmazonConfig{
+		KeyID:            "id",
+		SecretKey:        "secret",
+		Endpoint:         server.URL,
+		ConfigurationSet: "transactional",
+		Tags:             map[string]string{"env": "test", "app": "emailserv"},
+		SourceArn:        "arn:aws:ses:eu-west-1:123456789012:identity/example.com",
+		DKIM:             dkim.NewSigner([]*dkim.Key{key}),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	id, err := ac.Send(context.Background(), "a@example.com", []string{"b@example.net"}, "subject",
+		WithBody("Hello"),
+		WithCCRecipients([]string{"c@example.net"}),
+		WithBCCRecipients([]string{"d@example.net"}),
+		WithMessageID("message-1"),
+		WithAttachment(Attachment{Filename: "report.csv", ContentType: "text/csv", Data: []byte("a,b\n")}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if id != "ses-id" {
+		t.Errorf("wrong provider message id: %s", id)
+	}
+
+	for name, expected := range map[string]string{
+		"Action":                "SendRawEmail",
+		"Source":                "a@example.com",
+		"SourceArn":             "arn:aws:ses:eu-west-1:123456789012:identity/example.com",
+		"ConfigurationSetName":  "transactional",
+		"Destinations.member.1": "b@example.net",
+		"Destinations.member.2": "c@example.net",
+		"Destinations.member.3": "d@example.net",
+		"Tags.member.1.Name":    "app",
+		"Tags.member.1.Value":   "emailserv",
+		"Tags.member.2.Name":    "env",
+		"Tags.member.2.Value":   "test",
+		"Tags.member.3.Name":    "message_id",
+		"Tags.member.3.Value":   "message-1",
+	} {
+		if got := fake.form.Get(name); got != expected {
+			t.Errorf("wrong %s, expected: %q, got: %q", name, expected, got)
+		}
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(fake.form.Get("RawMessage.Data"))
+	if err != nil {
+		t.Fatalf("cannot decode a raw message: %s", err.Error())
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("cannot parse a raw message: %s", err.Error())
+	}
+	if msg.Header.Get("To") != "<b@example.net>" || msg.Header.Get("Cc") != "<c@example.net>" {
+		t.Errorf("wrong recipients, to: %q, cc: %q", msg.Header.Get("To"), msg.Header.Get("Cc"))
+	}
+	if msg.Header.Get("Bcc") != "" {
+		t.Errorf("bcc recipients should not be in a message")
+	}
+	if !strings.HasPrefix(msg.Header.Get("Content-Type"), "multipart/mixed;") {
+		t.Errorf("a message with an attachment should be multipart/mixed, got: %q", msg.Header.Get("Content-Type"))
+	}
+	domain, err := dkim.Verify(raw, func(name string) ([]string, error) {
+		if name != "s1._domainkey.example.com" {
+			return nil, errors.New("no such host")
+		}
+		return []string{record}, nil
+	})
+	if err != nil || domain != "example.com" {
+		t.Errorf("message should be signed by example.com, got: %q, %v", domain, err)
+	}
+}
+
+func TestAmazonClient_Send_errorClass(t *testing.T) {
+	cases := map[string]struct {
+		code  string
+		class Class
+	}{
+		"rejected": {
+			// e.g. an unverified address of an account in the sandbox
+			code:  "MessageRejected",
+			class: ClassConfiguration,
+		},
+		"no configuration set": {
+			code:  "ConfigurationSetDoesNotExist",
+			class: ClassConfiguration,
+		},
+		"invalid credentials": {
+			code:  "InvalidClientTokenId",
+			class: ClassConfiguration,
+		},
+	}
+
+	for hint, c := range cases {
+		t.Run(hint, func(t *testing.T) {
+			server := httptest.NewServer(&fakeSES{errorCode: c.code})
+			defer server.Close()
+
+			ac, _ := NewAmazonClient(zaptest.NewLogger(t), AmazonConfig{
+				KeyID:     "id",
+				SecretKey: "secret",
+				Endpoint:  server.URL,
+			})
+			_, err := ac.Send(context.Background(), "a@example.com", []string{"b@example.net"}, "subject")
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if class := ClassOf(err); class != c.class {
+				t.Errorf("wrong class, expected: %s, got: %s", c.class, class)
+			}
+		})
+	}
+}
+
+// fakeSTS is a local STS query API server, it records a form of
+// the last AssumeRole request
+type fakeSTS struct {
+	form url.Values
+}
+
+func (f *fakeSTS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	f.form = r.PostForm
+	w.Header().Set("Content-Type", "text/xml")
+	fmt.Fprintf(w, `<AssumeRoleResponse><AssumeRoleResult><Credentials><AccessKeyId>ASIAASSUMEDKEY1234</AccessKeyId><SecretAccessKey>assumed-secret</SecretAccessKey><SessionToken>assumed-token</SessionToken><Expiration>%s</Expiration></Credentials><AssumedRoleUser><Arn>arn:aws:sts::123456789012:assumed-role/sender/emailserv</Arn><AssumedRoleId>id:emailserv</AssumedRoleId></AssumedRoleUser></AssumeRoleResult></AssumeRoleResponse>`,
+		time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+}
+
+func TestAmazonClient_CredentialSource(t *testing.T) {
+	// shared config of a machine running tests is not used
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(t.TempDir(), "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(t.TempDir(), "credentials"))
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+	t.Setenv("AWS_PROFILE", "")
+
+	cases := map[string]struct {
+		config   AmazonConfig
+		env      map[string]string
+		provider string
+		keyID    string
+	}{
+		"static": {
+			config:   AmazonConfig{KeyID: "AKIASTATICKEY1234", SecretKey: "secret"},
+			provider: "StaticProvider",
+			keyID:    "AKIA*********1234",
+		},
+		"environment": {
+			env:      map[string]string{"AWS_ACCESS_KEY_ID": "AKIAENVKEY5678", "AWS_SECRET_ACCESS_KEY": "secret"},
+			provider: "EnvConfigProvider",
+			keyID:    "AKIA******5678",
+		},
+		"assumed role": {
+			config: AmazonConfig{
+				KeyID:      "AKIASTATICKEY1234",
+				SecretKey:  "secret",
+				RoleArn:    "arn:aws:iam::123456789012:role/sender",
+				ExternalID: "external-id",
+			},
+			provider: "AssumeRoleProvider",
+			keyID:    "ASIA**********1234",
+		},
+	}
+
+	for hint, c := range cases {
+		t.Run(hint, func(t *testing.T) {
+			for name, value := range c.env {
+				t.Setenv(name, value)
+			}
+			sts := &fakeSTS{}
+			stsServer := httptest.NewServer(sts)
+			defer stsServer.Close()
+			ses := &fakeSES{}
+			sesServer := httptest.NewServer(ses)
+			defer sesServer.Close()
+
+			config := c.config
+			config.Endpoint = sesServer.URL
+			config.STSEndpoint = stsServer.URL
+			ac, err := NewAmazonClient(zaptest.NewLogger(t), config)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+
+			provider, keyID, err := ac.CredentialSource()
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if provider != c.provider {
+				t.Errorf("wrong provider, expected: %s, got: %s", c.provider, provider)
+			}
+			if keyID != c.keyID {
+				t.Errorf("wrong key id, expected: %s, got: %s", c.keyID, keyID)
+			}
+
+			if c.config.RoleArn == "" {
+				return
+			}
+			for name, expected := range map[string]string{
+				"RoleArn":         c.config.RoleArn,
+				"ExternalId":      c.config.ExternalID,
+				"RoleSessionName": DefaultRoleSessionName,
+			} {
+				if got := sts.form.Get(name); got != expected {
+					t.Errorf("wrong %s, expected: %q, got: %q", name, expected, got)
+				}
+			}
+			if _, err := ac.Send(context.Background(), "a@example.com", []string{"b@example.net"}, "subject"); err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if token := ses.header.Get("X-Amz-Security-Token"); token != "assumed-token" {
+				t.Errorf("messages should be sent with credentials of a role, got token: %q", token)
+			}
+		})
+	}
+}
+
+func TestAmazonClient_CredentialSource_none(t *testing.T) {
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(t.TempDir(), "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(t.TempDir(), "credentials"))
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+	t.Setenv("AWS_PROFILE", "")
+	// instance metadata is not available
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+
+	ac, err := NewAmazonClient(zaptest.NewLogger(t), AmazonConfig{})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if _, _, err := ac.CredentialSource(); err == nil {
+		t.Error("expected an error without credentials")
+	}
+}
@@ -3,7 +3,9 @@ package emailclient
 
 import (
 	"context"
+	"time"
 
+	"github.com/mikolajb/emailserv/internal/requestid"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
@@ -12,15 +14,33 @@ import (
 type EmailOption func(*emailOptions)
 
 // EmailClient is an common interface used by all email clients
+// Send returns an ID of a message assigned by a provider, it can be empty
 type EmailClient interface {
-	Send(context.Context, string, []string, string, ...EmailOption) error
+	Send(context.Context, string, []string, string, ...EmailOption) (string, error)
 	ProviderName() string
 }
 
+// Scheduler is implemented by clients which can ask a provider
+// to deliver a message at a given time, see WithSendAt
+type Scheduler interface {
+	CanSchedule(sendAt time.Time) bool
+}
+
 type emailOptions struct {
 	ccRecipients  []string
 	bccRecipients []string
 	body          string
+	messageID     string
+	sendAt        time.Time
+	attachments   []Attachment
+	sendgrid      *SendgridOptions
+}
+
+// Attachment is a file attached to a message
+type Attachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
 }
 
 // WithCCRecipient adds a cc recipient to the list of options
@@ -58,6 +78,61 @@ func WithBody(body string) EmailOption {
 	}
 }
 
+// WithMessageID sets an ID of a message assigned by the service,
+// clients pass it to providers, so provider events can be matched with messages
+func WithMessageID(id string) EmailOption {
+	return func(o *emailOptions) {
+		o.messageID = id
+	}
+}
+
+// WithSendAt asks a provider to deliver a message at a given time,
+// only clients implementing Scheduler use it
+func WithSendAt(sendAt time.Time) EmailOption {
+	return func(o *emailOptions) {
+		o.sendAt = sendAt
+	}
+}
+
+// WithAttachment attaches a file to a message
+func WithAttachment(attachment Attachment) EmailOption {
+	return func(o *emailOptions) {
+		o.attachments = append(o.attachments, attachment)
+	}
+}
+
+// RequiredProvider returns a name of the only provider which can send
+// a message with given options or an empty string, e.g. a SendGrid
+// template cannot be rendered by other providers, other providers
+// would deliver a sandbox message and drop its unsubscribe group
+func RequiredProvider(opts ...EmailOption) string {
+	o := processOptions(opts...).sendgrid
+	if o != nil && (o.TemplateID != "" || o.SandboxMode || o.ASMGroupID != 0) {
+		return SendgridProvider
+	}
+
+	return ""
+}
+
+// SendAt returns a time set with WithSendAt or zero time
+func SendAt(opts ...EmailOption) time.Time {
+	return processOptions(opts...).sendAt
+}
+
+// AllRecipients returns recipients of a message with cc and bcc recipients
+func AllRecipients(recipients []string, opts ...EmailOption) []string {
+	o := processOptions(opts...)
+	result := make([]string, 0, len(recipients)+len(o.ccRecipients)+len(o.bccRecipients))
+	result = append(result, recipients...)
+	result = append(result, o.ccRecipients...)
+	return append(result, o.bccRecipients...)
+}
+
+// ContentSize returns a size of a subject and a body of a message in bytes
+func ContentSize(subject string, opts ...EmailOption) int {
+	return len(subject) + len(processOptions(opts...).body)
+}
+
 func processOptions(opts ...EmailOption) *emailOptions {
 	var result emailOptions
 	for _, fn := range opts {
@@ -67,8 +142,10 @@ func processOptions(opts ...EmailOption) *emailOptions {
 	return &result
 }
 
-func loggerFields(sender string, recipients []string, subject string, options *emailOptions) []zapcore.Field {
+func loggerFields(ctx context.Context, sender string, recipients []string, subject string, options *emailOptions) []zapcore.Field {
 	return []zapcore.Field{
+		requestid.Field(ctx),
+		zap.String("message_id", options.messageID),
 		zap.String("sender", sender),
 		zap.Strings("recipients", recipients),
 		zap.Strings("cc", options.ccRecipients),
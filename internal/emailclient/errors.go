@@ -0,0 +1,69 @@
+package emailclient
+
+import "fmt"
+
+// Class is a class of a client error, it decides
+// whether a message can be sent by another client
+type Class int
+
+// Error classes
+const (
+	// ClassTemporary is a failure which can pass later or with another client,
+	// e.g. a timeout, errors without a class are temporary
+	ClassTemporary Class = iota
+
+	// ClassThrottled is returned when a provider limits our sending
+	ClassThrottled
+
+	// ClassConfiguration is a problem of our account at a provider,
+	// e.g. invalid credentials or an unverified domain
+	ClassConfiguration
+
+	// ClassPermanent is a message rejected by a provider,
+	// other providers would reject it too
+	ClassPermanent
+)
+
+// String returns a name of a class used in logs
+func (c Class) String() string {
+	switch c {
+	case ClassThrottled:
+		return "throttled"
+	case ClassConfiguration:
+		return "configuration"
+	case ClassPermanent:
+		return "permanent"
+	default:
+		return "temporary"
+	}
+}
+
+// ParseClass returns a class of a name returned by Class.String
+func ParseClass(name string) (Class, error) {
+	for _, c := range []Class{ClassTemporary, ClassThrottled, ClassConfiguration, ClassPermanent} {
+		if c.String() == name {
+			return c, nil
+		}
+	}
+
+	return ClassTemporary, fmt.Errorf("unknown error class %q", name)
+}
+
+// Error is an error of a client with its class
+type Error struct {
+	Class Class
+	Err   error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+// ClassOf returns a class of an error returned by a client
+func ClassOf(err error) Class {
+	if e, ok := err.(*Error); ok {
+		return e.Class
+	}
+
+	return ClassTemporary
+}
@@ -0,0 +1,199 @@
+package emailclient
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mikolajb/emailserv/internal/dkim"
+	"github.com/mikolajb/emailserv/internal/mime"
+	"go.uber.org/zap"
+)
+
+// File formats
+const (
+	FormatMaildir = "maildir"
+	FormatMbox    = "mbox"
+)
+
+// mboxFromRe matches lines escaped in mboxrd format
+var mboxFromRe = regexp.MustCompile(`(?m)^(>*From )`)
+
+// FileConfig configures FileClient
+type FileConfig struct {
+	// Format is FormatMaildir or FormatMbox
+	Format string
+
+	// Path is a Maildir directory, created when missing, or an mbox file
+	Path string
+
+	// DKIM signs messages, optional
+	DKIM *dkim.Signer
+}
+
+// FileClient writes complete messages to a Maildir or an mbox file,
+// so they can be opened with a mail client, it is useful for development
+type FileClient struct {
+	logger *zap.Logger
+	config FileConfig
+
+	// mu serializes appends to an mbox file
+	mu sync.Mutex
+
+	// deliveries makes names of Maildir files unique
+	deliveries int64
+	now        func() time.Time
+}
+
+// NewFileClient returns a new file client for a given configuration
+func NewFileClient(logger *zap.Logger, config FileConfig) (*FileClient, error) {
+	if config.Path == "" {
+		return nil, fmt.Errorf("path of %s is required", config.Format)
+	}
+
+	switch config.Format {
+	case FormatMaildir:
+		for _, dir := range []string{"tmp", "new", "cur"} {
+			if err := os.MkdirAll(filepath.Join(config.Path, dir), 0700); err != nil {
+				return nil, fmt.Errorf("cannot create maildir: %s", err.Error())
+			}
+		}
+	case FormatMbox:
+		if dir := filepath.Dir(config.Path); dir != "" {
+			if err := os.MkdirAll(dir, 0700); err != nil {
+				return nil, fmt.Errorf("cannot create a directory of mbox: %s", err.Error())
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown file format %q", config.Format)
+	}
+
+	return &FileClient{
+		logger: logger,
+		config: config,
+		now:    time.Now,
+	}, nil
+}
+
+// ProviderName returns "file"
+func (fc *FileClient) ProviderName() string {
+	return "file"
+}
+
+// Send writes a message, an ID of a message is its Message-ID
+func (fc *FileClient) Send(ctx context.Context, sender string, recipients []string, subject string, opts ...EmailOption) (string, error) {
+	options := processOptions(opts...)
+	logger := fc.logger.With(
+		loggerFields(ctx, sender, recipients, subject, options)...,
+	)
+
+	now := fc.now()
+	message := &mime.Message{
+		From: sender,
+		To:   recipients,
+		Cc:   options.ccRecipients,
+		// bcc recipients are shown, there is no envelope
+		Bcc:       options.bccRecipients,
+		Subject:   subject,
+		Text:      options.body,
+		Date:      now,
+		MessageID: mime.NewMessageID(sender[strings.LastIndex(sender, "@")+1:]),
+	}
+	if message.Text == "" {
+		// a message requires a body
+		message.Text = " "
+	}
+	for _, a := range options.attachments {
+		message.Attachments = append(message.Attachments, mime.Attachment{
+			Filename:    a.Filename,
+			ContentType: a.ContentType,
+			Data:        a.Data,
+		})
+	}
+	raw, err := message.Build()
+	if err == nil && fc.config.DKIM != nil {
+		raw, err = fc.config.DKIM.Sign(raw)
+	}
+	if err != nil {
+		// e.g. an invalid DKIM key, other clients can still send a message
+		logger.Error("cannot build a message", zap.Error(err))
+		return "", &Error{
+			Class: ClassConfiguration,
+			Err:   fmt.Errorf("cannot build a message: %s", err.Error()),
+		}
+	}
+
+	var path string
+	if fc.config.Format == FormatMaildir {
+		path, err = fc.writeMaildir(raw, now)
+	} else {
+		path, err = fc.config.Path, fc.appendMbox(raw, sender, now)
+	}
+	if err != nil {
+		logger.Error("cannot write a message", zap.Error(err))
+		return "", &Error{
+			Class: ClassConfiguration,
+			Err:   fmt.Errorf("cannot write a message: %s", err.Error()),
+		}
+	}
+
+	logger.Debug("message is written", zap.String("path", path))
+
+	return strings.Trim(message.MessageID, "<>"), nil
+}
+
+// writeMaildir writes a message to tmp and moves it to new,
+// so readers never see partial messages
+func (fc *FileClient) writeMaildir(raw []byte, now time.Time) (string, error) {
+	hostname, _ := os.Hostname()
+	hostname = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(hostname)
+	name := fmt.Sprintf("%d.M%dP%dQ%d.%s",
+		now.Unix(), now.Nanosecond()/1000, os.Getpid(), atomic.AddInt64(&fc.deliveries, 1), hostname)
+
+	tmp := filepath.Join(fc.config.Path, "tmp", name)
+	if err := ioutil.WriteFile(tmp, raw, 0600); err != nil {
+		return "", err
+	}
+	path := filepath.Join(fc.config.Path, "new", name)
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+
+	return path, nil
+}
+
+// appendMbox appends a message in mboxrd format: a "From " line,
+// lines starting with "From " escaped with ">" and an empty line
+func (fc *FileClient) appendMbox(raw []byte, sender string, now time.Time) error {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From %s %s\n", sender, now.UTC().Format(time.ANSIC))
+	message := bytes.Replace(raw, []byte("\r\n"), []byte("\n"), -1)
+	b.Write(mboxFromRe.ReplaceAll(message, []byte(">$1")))
+	if !bytes.HasSuffix(message, []byte("\n")) {
+		b.WriteString("\n")
+	}
+	b.WriteString("\n")
+
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	f, err := os.OpenFile(fc.config.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
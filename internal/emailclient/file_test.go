@@ -0,0 +1,108 @@
+package emailclient
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/mail"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zaptest"
+)
+
+func TestFileClient_Send_maildir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "mail")
+	fc, err := NewFileClient(zaptest.NewLogger(t), FileConfig{Format: FormatMaildir, Path: dir})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	ids := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		id, err := fc.Send(context.Background(), "a@example.com", []string{"b@example.com"}, "subject",
+			WithBody("Hello"),
+			WithBCCRecipients([]string{"c@example.com"}),
+		)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		ids[id] = true
+	}
+
+	files, _ := ioutil.ReadDir(filepath.Join(dir, "new"))
+	if len(files) != 2 || len(ids) != 2 {
+		t.Fatalf("expected 2 messages with unique ids, got %d files, ids: %v", len(files), ids)
+	}
+	if tmp, _ := ioutil.ReadDir(filepath.Join(dir, "tmp")); len(tmp) != 0 {
+		t.Errorf("tmp should be empty, got %d files", len(tmp))
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "new", files[0].Name()))
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("cannot parse a message: %s", err.Error())
+	}
+	if !ids[strings.Trim(msg.Header.Get("Message-Id"), "<>")] {
+		t.Errorf("unexpected Message-ID: %s", msg.Header.Get("Message-Id"))
+	}
+	if msg.Header.Get("Bcc") != "<c@example.com>" {
+		t.Errorf("bcc recipients should be shown, got: %q", msg.Header.Get("Bcc"))
+	}
+	body, _ := ioutil.ReadAll(msg.Body)
+	if string(body) != "Hello" {
+		t.Errorf("wrong body: %q", body)
+	}
+}
+
+func TestFileClient_Send_mbox(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mail", "emailserv.mbox")
+	fc, err := NewFileClient(zaptest.NewLogger(t), FileConfig{Format: FormatMbox, Path: path})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	fc.now = func() time.Time { return time.Date(2018, 5, 1, 12, 0, 0, 0, time.UTC) }
+
+	bodies := []string{"Hello", "From here\n>From there"}
+	for _, body := range bodies {
+		if _, err := fc.Send(context.Background(), "a@example.com", []string{"b@example.com"}, "subject", WithBody(body)); err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+	}
+
+	data, _ := ioutil.ReadFile(path)
+	content := string(data)
+	if strings.Contains(content, "\r\n") {
+		t.Errorf("mbox should have LF line endings")
+	}
+	if !strings.HasPrefix(content, "From a@example.com Tue May  1 12:00:00 2018\n") {
+		t.Errorf("wrong From line: %q", strings.SplitN(content, "\n", 2)[0])
+	}
+	// messages are separated by "From " lines at the start of a file or after an empty line
+	messages := strings.Split(content, "\n\nFrom a@example.com ")
+	if len(messages) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(messages))
+	}
+	if !strings.Contains(messages[1], "\n>From here\n>>From there\n") {
+		t.Errorf("From lines should be escaped: %q", messages[1])
+	}
+	if !strings.HasSuffix(content, "\n\n") {
+		t.Errorf("a message should end with an empty line")
+	}
+}
+
+func TestNewFileClient_errors(t *testing.T) {
+	cases := map[string]FileConfig{
+		"no path":        {Format: FormatMaildir},
+		"unknown format": {Format: "eml", Path: t.TempDir()},
+	}
+
+	for hint, config := range cases {
+		t.Run(hint, func(t *testing.T) {
+			if _, err := NewFileClient(zaptest.NewLogger(t), config); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,241 @@
+package emailclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strings"
+
+	"github.com/mikolajb/emailserv/internal/requestid"
+	"github.com/mikolajb/emailserv/internal/tracing"
+	"go.uber.org/zap"
+)
+
+// Mailgun regions
+const (
+	MailgunRegionUS = "us"
+	MailgunRegionEU = "eu"
+)
+
+var mailgunURLs = map[string]string{
+	MailgunRegionUS: "https://api.mailgun.net",
+	MailgunRegionEU: "https://api.eu.mailgun.net",
+}
+
+// MailgunConfig configures MailgunClient
+type MailgunConfig struct {
+	// Domain is a sending domain of Mailgun
+	Domain string
+
+	// Key is a private API key
+	Key string
+
+	// Region is MailgunRegionUS (default) or MailgunRegionEU,
+	// a domain is only available in a region it was created in
+	Region string
+
+	// BaseURL overrides a URL of a region, e.g. a local fake server
+	BaseURL string
+
+	// Tags are added to every message
+	Tags []string
+
+	// Variables are added to every message next to request_id and message_id
+	Variables map[string]string
+}
+
+// MailgunClient holds a state of a client
+type MailgunClient struct {
+	logger     *zap.Logger
+	config     MailgunConfig
+	baseURL    string
+	httpClient *http.Client
+}
+
+// NewMailgunClient returns a new Mailgun client for a given configuration
+func NewMailgunClient(logger *zap.Logger, config MailgunConfig) (*MailgunClient, error) {
+	if config.Domain == "" {
+		return nil, fmt.Errorf("mailgun domain is required")
+	}
+	if config.Region == "" {
+		config.Region = MailgunRegionUS
+	}
+	baseURL, ok := mailgunURLs[config.Region]
+	if !ok {
+		return nil, fmt.Errorf("unknown mailgun region %q", config.Region)
+	}
+	if config.BaseURL != "" {
+		baseURL = config.BaseURL
+	}
+
+	return &MailgunClient{
+		logger:     logger,
+		config:     config,
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: http.DefaultClient,
+	}, nil
+}
+
+// ProviderName returns "mailgun"
+func (mc *MailgunClient) ProviderName() string {
+	return "mailgun"
+}
+
+// mailgunField is a field of a form, it is repeated for every value
+type mailgunField struct {
+	name   string
+	values []string
+}
+
+// form builds a multipart form of a message
+func (mc *MailgunClient) form(ctx context.Context, sender string, recipients []string, subject string, options *emailOptions) (*bytes.Buffer, string, error) {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+
+	fields := []mailgunField{
+		{"from", []string{sender}},
+		{"to", recipients},
+		{"cc", options.ccRecipients},
+		{"bcc", options.bccRecipients},
+		{"subject", []string{subject}},
+		{"o:tag", mc.config.Tags},
+	}
+	text := options.body
+	if text == "" {
+		// mailgun requires a body
+		text = " "
+	}
+	fields = append(fields, mailgunField{"text", []string{text}})
+
+	variables := map[string]string{}
+	for name, value := range mc.config.Variables {
+		variables[name] = value
+	}
+	if id := requestid.FromContext(ctx); id != "" {
+		variables["request_id"] = id
+	}
+	if options.messageID != "" {
+		variables["message_id"] = options.messageID
+	}
+	names := make([]string, 0, len(variables))
+	for name := range variables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fields = append(fields, mailgunField{"v:" + name, []string{variables[name]}})
+	}
+
+	for _, f := range fields {
+		for _, value := range f.values {
+			if err := w.WriteField(f.name, value); err != nil {
+				return nil, "", err
+			}
+		}
+	}
+
+	for _, a := range options.attachments {
+		contentType := a.ContentType
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="attachment"; filename=%q`, a.Filename))
+		header.Set("Content-Type", contentType)
+		part, err := w.CreatePart(header)
+		if err != nil {
+			return nil, "", err
+		}
+		if _, err := part.Write(a.Data); err != nil {
+			return nil, "", err
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, "", err
+	}
+
+	return &body, w.FormDataContentType(), nil
+}
+
+// Send sends an email using Mailgun messages API
+func (mc *MailgunClient) Send(ctx context.Context, sender string, recipients []string, subject string, opts ...EmailOption) (string, error) {
+	options := processOptions(opts...)
+	logger := mc.logger.With(
+		loggerFields(ctx, sender, recipients, subject, options)...,
+	)
+
+	logger.Debug("sending a message")
+
+	body, contentType, err := mc.form(ctx, sender, recipients, subject, options)
+	if err != nil {
+		logger.Error("cannot build a request", zap.Error(err))
+		return "", fmt.Errorf("cannot build a request: %s", err.Error())
+	}
+
+	req, err := http.NewRequest(http.MethodPost, mc.baseURL+"/v3/"+mc.config.Domain+"/messages", body)
+	if err != nil {
+		return "", fmt.Errorf("cannot build a request: %s", err.Error())
+	}
+	req = req.WithContext(ctx)
+	req.SetBasicAuth("api", mc.config.Key)
+	req.Header.Set("Content-Type", contentType)
+	tracing.Inject(ctx, req.Header)
+
+	res, err := mc.httpClient.Do(req)
+	if err != nil {
+		logger.Error("sending error", zap.Error(err))
+		return "", fmt.Errorf("sending error: %s", err.Error())
+	}
+	defer res.Body.Close()
+
+	var response struct {
+		ID      string `json:"id"`
+		Message string `json:"message"`
+	}
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		logger.Error("cannot read a response", zap.Error(err))
+		return "", fmt.Errorf("cannot read a response: %s", err.Error())
+	}
+	// errors are not always JSON, e.g. 401 has a plain text body
+	json.Unmarshal(data, &response)
+	if response.Message == "" {
+		response.Message = strings.TrimSpace(string(data))
+	}
+	logger.Debug("request sent",
+		zap.Int("status_code", res.StatusCode),
+		zap.String("response", response.Message),
+	)
+	// a message of a response can contain addresses, so it is only logged
+	if res.StatusCode != http.StatusOK {
+		return "", &Error{
+			Class: mailgunErrorClass(res.StatusCode),
+			Err:   fmt.Errorf("unsuccessful request, status code: %d", res.StatusCode),
+		}
+	}
+
+	// events of Mailgun have IDs without angle brackets
+	return strings.Trim(response.ID, "<>"), nil
+}
+
+// mailgunErrorClass returns a class of an unsuccessful response
+func mailgunErrorClass(statusCode int) Class {
+	switch statusCode {
+	case http.StatusTooManyRequests:
+		return ClassThrottled
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+		// invalid key or a domain not found in a region
+		return ClassConfiguration
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge:
+		return ClassPermanent
+	default:
+		return ClassTemporary
+	}
+}
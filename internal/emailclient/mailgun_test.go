@@ -0,0 +1,184 @@
+package emailclient
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mikolajb/emailserv/internal/requestid"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestMailgunClient_Send(t *testing.T) {
+	var (
+		path, user, key string
+		form            map[string][]string
+		attachment      string
+		attachmentType  string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		user, key, _ = r.BasicAuth()
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			t.Errorf("cannot parse a form: %s", err.Error())
+		}
+		form = r.MultipartForm.Value
+		if files := r.MultipartForm.File["attachment"]; len(files) == 1 {
+			f, _ := files[0].Open()
+			data, _ := ioutil.ReadAll(f)
+			attachment = files[0].Filename + ":" + string(data)
+			attachmentType = files[0].Header.Get("Content-Type")
+		}
+		w.Write([]byte(`{"id": "<20180101.1@mg.example.com>", "message": "Queued. Thank you."}`))
+	}))
+	defer server.Close()
+
+	mc, err := NewMailgunClient(zaptest.NewLogger(t), MailgunConfig{
+		Domain:    "mg.example.com",
+		Key:       "key",
+		Region:    MailgunRegionEU,
+		BaseURL:   server.URL,
+		Tags:      []string{"transactional", "emailserv"},
+		Variables: map[string]string{"env": "test"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	ctx := requestid.NewContext(context.Background(), "request-1")
+	id, err := mc.Send(ctx, "a@example.com", []string{"b@example.com", "c@example.com"}, "subject",
+		WithBody("Hello"),
+		WithCCRecipients([]string{"d@example.com"}),
+		WithBCCRecipients([]string{"e@example.com"}),
+		WithMessageID("message-1"),
+		WithAttachment(Attachment{Filename: "report.csv", ContentType: "text/csv", Data: []byte("a,b\n")}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if id != "20180101.1@mg.example.com" {
+		t.Errorf("wrong provider message id: %s", id)
+	}
+	if path != "/v3/mg.example.com/messages" {
+		t.Errorf("wrong path: %s", path)
+	}
+	if user != "api" || key != "key" {
+		t.Errorf("wrong credentials: %s:%s", user, key)
+	}
+
+	expected := map[string][]string{
+		"from":         {"a@example.com"},
+		"to":           {"b@example.com", "c@example.com"},
+		"cc":           {"d@example.com"},
+		"bcc":          {"e@example.com"},
+		"subject":      {"subject"},
+		"text":         {"Hello"},
+		"o:tag":        {"transactional", "emailserv"},
+		"v:env":        {"test"},
+		"v:request_id": {"request-1"},
+		"v:message_id": {"message-1"},
+	}
+	if !reflect.DeepEqual(form, expected) {
+		t.Errorf("wrong form, expected: %v, got: %v", expected, form)
+	}
+	if attachment != "report.csv:a,b\n" || attachmentType != "text/csv" {
+		t.Errorf("wrong attachment: %q, %s", attachment, attachmentType)
+	}
+}
+
+func TestMailgunClient_Send_errorClass(t *testing.T) {
+	cases := map[string]struct {
+		statusCode int
+		class      Class
+	}{
+		"throttled": {
+			statusCode: http.StatusTooManyRequests,
+			class:      ClassThrottled,
+		},
+		"unauthorized": {
+			statusCode: http.StatusUnauthorized,
+			class:      ClassConfiguration,
+		},
+		"domain not found": {
+			statusCode: http.StatusNotFound,
+			class:      ClassConfiguration,
+		},
+		"bad request": {
+			statusCode: http.StatusBadRequest,
+			class:      ClassPermanent,
+		},
+		"server error": {
+			statusCode: http.StatusInternalServerError,
+			class:      ClassTemporary,
+		},
+	}
+
+	for hint, c := range cases {
+		t.Run(hint, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(c.statusCode)
+				w.Write([]byte(`{"message": "'to' parameter is not a valid address: b@example.com"}`))
+			}))
+			defer server.Close()
+
+			mc, _ := NewMailgunClient(zaptest.NewLogger(t), MailgunConfig{Domain: "mg.example.com", Key: "key", BaseURL: server.URL})
+			_, err := mc.Send(context.Background(), "a@example.com", []string{"b@example.com"}, "subject")
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if class := ClassOf(err); class != c.class {
+				t.Errorf("wrong class, expected: %s, got: %s", c.class, class)
+			}
+			if strings.Contains(err.Error(), "b@example.com") {
+				t.Errorf("an error should not contain a message of a response: %s", err.Error())
+			}
+		})
+	}
+}
+
+func TestNewMailgunClient(t *testing.T) {
+	cases := map[string]struct {
+		config  MailgunConfig
+		baseURL string
+		err     bool
+	}{
+		"us": {
+			config:  MailgunConfig{Domain: "mg.example.com"},
+			baseURL: "https://api.mailgun.net",
+		},
+		"eu": {
+			config:  MailgunConfig{Domain: "mg.example.com", Region: MailgunRegionEU},
+			baseURL: "https://api.eu.mailgun.net",
+		},
+		"unknown region": {
+			config: MailgunConfig{Domain: "mg.example.com", Region: "asia"},
+			err:    true,
+		},
+		"no domain": {
+			config: MailgunConfig{},
+			err:    true,
+		},
+	}
+
+	for hint, c := range cases {
+		t.Run(hint, func(t *testing.T) {
+			mc, err := NewMailgunClient(zaptest.NewLogger(t), c.config)
+			if c.err {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if mc.baseURL != c.baseURL {
+				t.Errorf("wrong base url, expected: %s, got: %s", c.baseURL, mc.baseURL)
+			}
+		})
+	}
+}
@@ -34,14 +34,15 @@ func (m *MockEmailClient) EXPECT() *MockEmailClientMockRecorder {
 }
 
 // Send mocks base method
-func (m *MockEmailClient) Send(arg0 context.Context, arg1 string, arg2 []string, arg3 string, arg4 ...EmailOption) error {
+func (m *MockEmailClient) Send(arg0 context.Context, arg1 string, arg2 []string, arg3 string, arg4 ...EmailOption) (string, error) {
 	varargs := []interface{}{arg0, arg1, arg2, arg3}
 	for _, a := range arg4 {
 		varargs = append(varargs, a)
 	}
 	ret := m.ctrl.Call(m, "Send", varargs...)
-	ret0, _ := ret[0].(error)
-	return ret0
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
 }
 
 // Send indicates an expected call of Send
@@ -25,13 +25,13 @@ func (nc *NopClient) ProviderName() string {
 }
 
 // Send logs message content and does nothing
-func (nc *NopClient) Send(ctx context.Context, sender string, recipients []string, subject string, opts ...EmailOption) error {
+func (nc *NopClient) Send(ctx context.Context, sender string, recipients []string, subject string, opts ...EmailOption) (string, error) {
 	options := processOptions(opts...)
 	logger := nc.logger.With(
-		loggerFields(sender, recipients, subject, options)...,
+		loggerFields(ctx, sender, recipients, subject, options)...,
 	)
 
 	logger.Debug("logging a message in NOP client")
 
-	return nil
+	return "", nil
 }
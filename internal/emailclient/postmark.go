@@ -0,0 +1,222 @@
+package emailclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/mikolajb/emailserv/internal/requestid"
+	"github.com/mikolajb/emailserv/internal/tracing"
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultPostmarkURL is a base URL of Postmark API
+	DefaultPostmarkURL = "https://api.postmarkapp.com"
+
+	// DefaultPostmarkStream is a default transactional message stream
+	DefaultPostmarkStream = "outbound"
+)
+
+// Postmark error codes, see https://postmarkapp.com/developer/api/overview#error-codes
+const (
+	postmarkInvalidToken           = 10
+	postmarkInvalidEmailRequest    = 300
+	postmarkSenderNotFound         = 400
+	postmarkSenderNotConfirmed     = 401
+	postmarkNotAllowedToSend       = 405
+	postmarkInactiveRecipient      = 406
+	postmarkAccountPending         = 412
+	postmarkMessageStreamNotFound  = 1235
+	postmarkMessageStreamNotActive = 1236
+)
+
+// PostmarkConfig configures PostmarkClient
+type PostmarkConfig struct {
+	// ServerToken is an API token of a Postmark server
+	ServerToken string
+
+	// MessageStream is a stream of messages, DefaultPostmarkStream when empty
+	MessageStream string
+
+	// Tag is a tag of every message, optional
+	Tag string
+
+	// Metadata is added to every message next to request_id and message_id
+	Metadata map[string]string
+
+	// BaseURL overrides DefaultPostmarkURL, e.g. a local fake server
+	BaseURL string
+}
+
+// PostmarkClient holds a state of a client
+type PostmarkClient struct {
+	logger     *zap.Logger
+	config     PostmarkConfig
+	httpClient *http.Client
+}
+
+// NewPostmarkClient returns a new Postmark client for a given configuration
+func NewPostmarkClient(logger *zap.Logger, config PostmarkConfig) (*PostmarkClient, error) {
+	if config.ServerToken == "" {
+		return nil, fmt.Errorf("postmark server token is required")
+	}
+	if config.MessageStream == "" {
+		config.MessageStream = DefaultPostmarkStream
+	}
+	if config.BaseURL == "" {
+		config.BaseURL = DefaultPostmarkURL
+	}
+	config.BaseURL = strings.TrimSuffix(config.BaseURL, "/")
+
+	return &PostmarkClient{
+		logger:     logger,
+		config:     config,
+		httpClient: http.DefaultClient,
+	}, nil
+}
+
+// ProviderName returns "postmark"
+func (pc *PostmarkClient) ProviderName() string {
+	return "postmark"
+}
+
+type postmarkAttachment struct {
+	Name        string
+	Content     string
+	ContentType string
+}
+
+type postmarkMessage struct {
+	From          string
+	To            string
+	Cc            string `json:",omitempty"`
+	Bcc           string `json:",omitempty"`
+	Subject       string
+	TextBody      string
+	Tag           string               `json:",omitempty"`
+	Metadata      map[string]string    `json:",omitempty"`
+	MessageStream string               `json:",omitempty"`
+	Attachments   []postmarkAttachment `json:",omitempty"`
+}
+
+type postmarkResponse struct {
+	MessageID string
+	ErrorCode int
+	Message   string
+}
+
+// Send sends an email using Postmark email API
+func (pc *PostmarkClient) Send(ctx context.Context, sender string, recipients []string, subject string, opts ...EmailOption) (string, error) {
+	options := processOptions(opts...)
+	logger := pc.logger.With(
+		loggerFields(ctx, sender, recipients, subject, options)...,
+	)
+
+	logger.Debug("sending a message")
+
+	message := postmarkMessage{
+		From:          sender,
+		To:            strings.Join(recipients, ","),
+		Cc:            strings.Join(options.ccRecipients, ","),
+		Bcc:           strings.Join(options.bccRecipients, ","),
+		Subject:       subject,
+		TextBody:      options.body,
+		Tag:           pc.config.Tag,
+		Metadata:      map[string]string{},
+		MessageStream: pc.config.MessageStream,
+	}
+	if message.TextBody == "" {
+		// postmark requires a body
+		message.TextBody = " "
+	}
+	for name, value := range pc.config.Metadata {
+		message.Metadata[name] = value
+	}
+	if id := requestid.FromContext(ctx); id != "" {
+		message.Metadata["request_id"] = id
+	}
+	if options.messageID != "" {
+		message.Metadata["message_id"] = options.messageID
+	}
+	for _, a := range options.attachments {
+		contentType := a.ContentType
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		message.Attachments = append(message.Attachments, postmarkAttachment{
+			Name:        a.Filename,
+			Content:     base64.StdEncoding.EncodeToString(a.Data),
+			ContentType: contentType,
+		})
+	}
+
+	body, err := json.Marshal(message)
+	if err != nil {
+		return "", fmt.Errorf("cannot build a request: %s", err.Error())
+	}
+	req, err := http.NewRequest(http.MethodPost, pc.config.BaseURL+"/email", bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("cannot build a request: %s", err.Error())
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Postmark-Server-Token", pc.config.ServerToken)
+	tracing.Inject(ctx, req.Header)
+
+	res, err := pc.httpClient.Do(req)
+	if err != nil {
+		logger.Error("sending error", zap.Error(err))
+		return "", fmt.Errorf("sending error: %s", err.Error())
+	}
+	defer res.Body.Close()
+
+	var response postmarkResponse
+	// errors of a proxy in front of Postmark are not JSON
+	json.NewDecoder(res.Body).Decode(&response)
+	logger.Debug("request sent",
+		zap.Int("status_code", res.StatusCode),
+		zap.Int("error_code", response.ErrorCode),
+		zap.String("response", response.Message),
+	)
+	// a message of a response can contain addresses, so it is only logged
+	if res.StatusCode != http.StatusOK || response.ErrorCode != 0 {
+		return "", &Error{
+			Class: postmarkErrorClass(res.StatusCode, response.ErrorCode),
+			Err: fmt.Errorf("unsuccessful request, status code: %d, error code: %d",
+				res.StatusCode, response.ErrorCode),
+		}
+	}
+
+	return response.MessageID, nil
+}
+
+// postmarkErrorClass returns a class of an unsuccessful response,
+// Postmark returns most errors with 422 status and an error code
+func postmarkErrorClass(statusCode, errorCode int) Class {
+	switch errorCode {
+	case postmarkInvalidEmailRequest, postmarkInactiveRecipient:
+		return ClassPermanent
+	case postmarkInvalidToken, postmarkSenderNotFound, postmarkSenderNotConfirmed,
+		postmarkNotAllowedToSend, postmarkAccountPending,
+		postmarkMessageStreamNotFound, postmarkMessageStreamNotActive:
+		return ClassConfiguration
+	}
+
+	switch {
+	case statusCode == http.StatusTooManyRequests:
+		return ClassThrottled
+	case statusCode == http.StatusUnauthorized:
+		return ClassConfiguration
+	case statusCode == http.StatusUnprocessableEntity:
+		// other codes describe an invalid message
+		return ClassPermanent
+	default:
+		return ClassTemporary
+	}
+}
@@ -0,0 +1,132 @@
+package emailclient
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/mikolajb/emailserv/internal/requestid"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestPostmarkClient_Send(t *testing.T) {
+	var (
+		path, token string
+		message     postmarkMessage
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		token = r.Header.Get("X-Postmark-Server-Token")
+		json.NewDecoder(r.Body).Decode(&message)
+		w.Write([]byte(`{"To": "b@example.com", "MessageID": "postmark-id", "ErrorCode": 0, "Message": "OK"}`))
+	}))
+	defer server.Close()
+
+	pc, err := NewPostmarkClient(zaptest.NewLogger(t), PostmarkConfig{
+		ServerToken: "token",
+		Tag:         "password-reset",
+		Metadata:    map[string]string{"env": "test"},
+		BaseURL:     server.URL,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	ctx := requestid.NewContext(context.Background(), "request-1")
+	id, err := pc.Send(ctx, "a@example.com", []string{"b@example.com", "c@example.com"}, "subject",
+		WithBody("Hello"),
+		WithBCCRecipients([]string{"d@example.com"}),
+		WithMessageID("message-1"),
+		WithAttachment(Attachment{Filename: "report.csv", Data: []byte("a,b\n")}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if id != "postmark-id" {
+		t.Errorf("wrong provider message id: %s", id)
+	}
+	if path != "/email" || token != "token" {
+		t.Errorf("wrong request, path: %s, token: %s", path, token)
+	}
+
+	expected := postmarkMessage{
+		From:          "a@example.com",
+		To:            "b@example.com,c@example.com",
+		Bcc:           "d@example.com",
+		Subject:       "subject",
+		TextBody:      "Hello",
+		Tag:           "password-reset",
+		Metadata:      map[string]string{"env": "test", "request_id": "request-1", "message_id": "message-1"},
+		MessageStream: DefaultPostmarkStream,
+		Attachments: []postmarkAttachment{
+			{Name: "report.csv", Content: "YSxiCg==", ContentType: "application/octet-stream"},
+		},
+	}
+	if !reflect.DeepEqual(message, expected) {
+		t.Errorf("wrong message, expected: %+v, got: %+v", expected, message)
+	}
+}
+
+func TestPostmarkClient_Send_errorClass(t *testing.T) {
+	cases := map[string]struct {
+		statusCode int
+		errorCode  int
+		class      Class
+	}{
+		"inactive recipient": {
+			statusCode: http.StatusUnprocessableEntity,
+			errorCode:  406,
+			class:      ClassPermanent,
+		},
+		"invalid request": {
+			statusCode: http.StatusUnprocessableEntity,
+			errorCode:  300,
+			class:      ClassPermanent,
+		},
+		"sender not confirmed": {
+			statusCode: http.StatusUnprocessableEntity,
+			errorCode:  401,
+			class:      ClassConfiguration,
+		},
+		"message stream not found": {
+			statusCode: http.StatusUnprocessableEntity,
+			errorCode:  1235,
+			class:      ClassConfiguration,
+		},
+		"invalid token": {
+			statusCode: http.StatusUnauthorized,
+			errorCode:  10,
+			class:      ClassConfiguration,
+		},
+		"throttled": {
+			statusCode: http.StatusTooManyRequests,
+			class:      ClassThrottled,
+		},
+		"server error": {
+			statusCode: http.StatusInternalServerError,
+			class:      ClassTemporary,
+		},
+	}
+
+	for hint, c := range cases {
+		t.Run(hint, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(c.statusCode)
+				json.NewEncoder(w).Encode(postmarkResponse{ErrorCode: c.errorCode, Message: "error"})
+			}))
+			defer server.Close()
+
+			pc, _ := NewPostmarkClient(zaptest.NewLogger(t), PostmarkConfig{ServerToken: "token", BaseURL: server.URL})
+			_, err := pc.Send(context.Background(), "a@example.com", []string{"b@example.com"}, "subject")
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if class := ClassOf(err); class != c.class {
+				t.Errorf("wrong class, expected: %s, got: %s", c.class, class)
+			}
+		})
+	}
+}
@@ -2,50 +2,149 @@ package emailclient
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"strings"
+	"time"
 
+	"github.com/mikolajb/emailserv/internal/requestid"
+	"github.com/mikolajb/emailserv/internal/tracing"
+	"github.com/sendgrid/rest"
 	sendgrid "github.com/sendgrid/sendgrid-go"
 	"github.com/sendgrid/sendgrid-go/helpers/mail"
 	"go.uber.org/zap"
 )
 
+const (
+	// DefaultSendgridURL is a base URL of SendGrid API
+	DefaultSendgridURL = "https://api.sendgrid.com"
+
+	// SendgridProvider is a provider name of SendgridClient
+	SendgridProvider = "sendgrid"
+
+	// sendgridMaxSchedule is how far ahead SendGrid accepts send_at
+	sendgridMaxSchedule = 72 * time.Hour
+)
+
 // SendgridClient holds a state of a client
 type SendgridClient struct {
-	logger         *zap.Logger
-	sendgridClient *sendgrid.Client
+	logger     *zap.Logger
+	key        string
+	host       string
+	httpClient *http.Client
+}
+
+// SendgridOptions are options only SendGrid supports, other clients
+// ignore them, but a message with a template, sandbox mode
+// or an unsubscribe group requires SendGrid
+type SendgridOptions struct {
+	// TemplateID is an ID of a dynamic template rendering a message
+	TemplateID string `json:"template_id,omitempty"`
+
+	// TemplateData is data of a dynamic template
+	TemplateData map[string]interface{} `json:"dynamic_template_data,omitempty"`
+
+	Categories []string `json:"categories,omitempty"`
+
+	// ASMGroupID is an unsubscribe group of a message
+	ASMGroupID int `json:"asm_group_id,omitempty"`
+
+	// ASMGroupsToDisplay are unsubscribe groups shown on a preferences page
+	ASMGroupsToDisplay []int `json:"asm_groups_to_display,omitempty"`
+
+	IPPoolName string `json:"ip_pool_name,omitempty"`
+
+	// SandboxMode validates a message without delivering it
+	SandboxMode bool `json:"sandbox_mode,omitempty"`
 }
 
-// NewSendgridClient creates a new SendgridClient
-func NewSendgridClient(logger *zap.Logger, key string) (*SendgridClient, error) {
+// WithSendgrid sets SendGrid specific options
+func WithSendgrid(options SendgridOptions) EmailOption {
+	return func(o *emailOptions) {
+		o.sendgrid = &options
+	}
+}
+
+// NewSendgridClient creates a new SendgridClient,
+// DefaultSendgridURL is used when baseURL is empty
+func NewSendgridClient(logger *zap.Logger, key, baseURL string) (*SendgridClient, error) {
+	if baseURL == "" {
+		baseURL = DefaultSendgridURL
+	}
+
 	return &SendgridClient{
-		logger:         logger,
-		sendgridClient: sendgrid.NewSendClient(key),
+		logger:     logger,
+		key:        key,
+		host:       strings.TrimSuffix(baseURL, "/"),
+		httpClient: http.DefaultClient,
 	}, nil
 }
 
 // ProviderName returns "sendgrid"
 func (sc *SendgridClient) ProviderName() string {
-	return "sendgrid"
+	return SendgridProvider
+}
+
+// CanSchedule returns true when SendGrid accepts a given send_at
+func (sc *SendgridClient) CanSchedule(sendAt time.Time) bool {
+	return time.Until(sendAt) <= sendgridMaxSchedule
 }
 
 // Send sends an email using SendGrid service
-func (sc *SendgridClient) Send(ctx context.Context, sender string, recipients []string, subject string, opts ...EmailOption) error {
+func (sc *SendgridClient) Send(ctx context.Context, sender string, recipients []string, subject string, opts ...EmailOption) (string, error) {
 	options := processOptions(opts...)
 	logger := sc.logger.With(
-		loggerFields(sender, recipients, subject, options)...,
+		loggerFields(ctx, sender, recipients, subject, options)...,
 	)
 
 	message := mail.NewV3Mail()
 	message.SetFrom(mail.NewEmail("", sender))
 	message.Subject = subject
-	if options.body == "" {
-		// snedgrid requires content to be at lest one character long
-		options.body = " "
+	sendgridOptions := options.sendgrid
+	if sendgridOptions == nil {
+		sendgridOptions = &SendgridOptions{}
+	}
+	if sendgridOptions.TemplateID != "" {
+		// a template renders content
+		message.SetTemplateID(sendgridOptions.TemplateID)
+		logger = logger.With(zap.String("template_id", sendgridOptions.TemplateID))
+	} else {
+		if options.body == "" {
+			// snedgrid requires content to be at lest one character long
+			options.body = " "
+		}
+		message.AddContent(
+			mail.NewContent("text/plain", options.body),
+			mail.NewContent("text/html", options.body),
+		)
+	}
+	if len(sendgridOptions.Categories) > 0 {
+		message.AddCategories(sendgridOptions.Categories...)
+	}
+	if sendgridOptions.ASMGroupID != 0 {
+		asm := mail.NewASM()
+		asm.SetGroupID(sendgridOptions.ASMGroupID)
+		asm.AddGroupsToDisplay(sendgridOptions.ASMGroupsToDisplay...)
+		message.SetASM(asm)
+	}
+	if sendgridOptions.IPPoolName != "" {
+		message.SetIPPoolID(sendgridOptions.IPPoolName)
+	}
+	if sendgridOptions.SandboxMode {
+		message.SetMailSettings(mail.NewMailSettings().SetSandboxMode(mail.NewSetting(true)))
+	}
+	for _, a := range options.attachments {
+		attachment := mail.NewAttachment()
+		attachment.SetContent(base64.StdEncoding.EncodeToString(a.Data))
+		attachment.SetFilename(a.Filename)
+		if a.ContentType != "" {
+			attachment.SetType(a.ContentType)
+		}
+		attachment.SetDisposition("attachment")
+		message.AddAttachment(attachment)
 	}
-	message.AddContent(
-		mail.NewContent("text/plain", options.body),
-		mail.NewContent("text/html", options.body),
-	)
 
 	personalization := mail.NewPersonalization()
 	for _, r := range recipients {
@@ -57,12 +156,25 @@ func (sc *SendgridClient) Send(ctx context.Context, sender string, recipients []
 	for _, r := range options.bccRecipients {
 		personalization.AddBCCs(mail.NewEmail("", r))
 	}
+	for key, value := range sendgridOptions.TemplateData {
+		personalization.SetDynamicTemplateData(key, value)
+	}
 	message.AddPersonalizations(personalization)
+	if id := requestid.FromContext(ctx); id != "" {
+		message.SetCustomArg("request_id", id)
+	}
+	if options.messageID != "" {
+		message.SetCustomArg("message_id", options.messageID)
+	}
+	if options.sendAt.After(time.Now()) {
+		message.SetSendAt(int(options.sendAt.Unix()))
+		logger = logger.With(zap.Time("send_at", options.sendAt))
+	}
 
-	response, err := sc.sendgridClient.Send(message)
+	response, err := sc.send(ctx, message)
 	if err != nil {
 		logger.Error("sending error", zap.Error(err))
-		return fmt.Errorf("sending error: %s", err.Error())
+		return "", fmt.Errorf("sending error: %s", err.Error())
 	}
 	logger.Debug("request sent",
 		zap.Int("status_code", response.StatusCode),
@@ -70,8 +182,96 @@ func (sc *SendgridClient) Send(ctx context.Context, sender string, recipients []
 		zap.Reflect("headers", response.Headers),
 	)
 	if response.StatusCode/200 != 1 {
-		return fmt.Errorf("unsuccessful request, status code: %d", response.StatusCode)
+		return "", &Error{
+			Class: sendgridErrorClass(response.StatusCode, response.Body),
+			Err:   fmt.Errorf("unsuccessful request, status code: %d", response.StatusCode),
+		}
+	}
+
+	var providerMessageID string
+	if ids := response.Headers["X-Message-Id"]; len(ids) > 0 {
+		providerMessageID = ids[0]
+	}
+
+	return providerMessageID, nil
+}
+
+// sendgridMessageFields are fields of a message itself, SendGrid
+// returns 400 for errors of its own options too, e.g. a template
+// or an unsubscribe group, other clients can send such a message
+var sendgridMessageFields = []string{
+	"from",
+	"reply_to",
+	"subject",
+	"content",
+	"attachments",
+	"headers",
+	"personalizations",
+}
+
+// sendgridErrorClass returns a class of an unsuccessful response
+func sendgridErrorClass(statusCode int, body string) Class {
+	switch statusCode {
+	case http.StatusTooManyRequests:
+		return ClassThrottled
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return ClassConfiguration
+	case http.StatusBadRequest:
+		if sendgridMessageError(body) {
+			return ClassPermanent
+		}
+		return ClassConfiguration
+	case http.StatusRequestEntityTooLarge:
+		return ClassPermanent
+	default:
+		return ClassTemporary
+	}
+}
+
+// sendgridMessageError checks if errors of a response are in fields
+// of a message, template data of personalizations is an option
+func sendgridMessageError(body string) bool {
+	var response struct {
+		Errors []struct {
+			Field string `json:"field"`
+		} `json:"errors"`
+	}
+	if err := json.Unmarshal([]byte(body), &response); err != nil {
+		return false
+	}
+
+	for _, e := range response.Errors {
+		if strings.Contains(e.Field, "dynamic_template_data") {
+			continue
+		}
+		for _, field := range sendgridMessageFields {
+			if e.Field == field || strings.HasPrefix(e.Field, field+".") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// send makes a request to SendGrid API, it passes a trace context in headers
+func (sc *SendgridClient) send(ctx context.Context, message *mail.SGMailV3) (*rest.Response, error) {
+	request := sendgrid.GetRequest(sc.key, "/v3/mail/send", sc.host)
+	request.Method = rest.Post
+	request.Body = mail.GetRequestBody(message)
+
+	req, err := rest.BuildRequestObject(request)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	tracing.Inject(ctx, req.Header)
+
+	res, err := sc.httpClient.Do(req)
+	if err != nil {
+		return nil, err
 	}
+	defer res.Body.Close()
 
-	return nil
+	return rest.BuildResponse(res)
 }
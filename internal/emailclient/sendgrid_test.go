@@ -0,0 +1,207 @@
+package emailclient
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zaptest"
+)
+
+func TestSendgridClient_Send_sendAt(t *testing.T) {
+	sendAt := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	cases := map[string]struct {
+		opts     []EmailOption
+		expected int64
+	}{
+		"immediately": {},
+		"scheduled": {
+			opts:     []EmailOption{WithSendAt(sendAt)},
+			expected: sendAt.Unix(),
+		},
+		"past": {
+			opts: []EmailOption{WithSendAt(time.Now().Add(-time.Hour))},
+		},
+	}
+
+	for hint, c := range cases {
+		t.Run(hint, func(t *testing.T) {
+			var body struct {
+				SendAt int64 `json:"send_at"`
+			}
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				json.NewDecoder(r.Body).Decode(&body)
+				w.Header().Set("X-Message-Id", "sendgrid-id")
+				w.WriteHeader(http.StatusAccepted)
+			}))
+			defer server.Close()
+
+			sc, _ := NewSendgridClient(zaptest.NewLogger(t), "key", server.URL)
+
+			id, err := sc.Send(context.Background(), "a@example.com", []string{"b@example.com"}, "subject", c.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if id != "sendgrid-id" {
+				t.Errorf("wrong provider message id: %s", id)
+			}
+			if body.SendAt != c.expected {
+				t.Errorf("wrong send_at, expected: %d, got: %d", c.expected, body.SendAt)
+			}
+		})
+	}
+}
+
+func TestSendgridClient_CanSchedule(t *testing.T) {
+	sc, _ := NewSendgridClient(zaptest.NewLogger(t), "key", "")
+
+	if !sc.CanSchedule(time.Now().Add(time.Hour)) {
+		t.Errorf("sendgrid should schedule a message an hour ahead")
+	}
+	if sc.CanSchedule(time.Now().Add(sendgridMaxSchedule + time.Hour)) {
+		t.Errorf("sendgrid should not schedule a message after %s", sendgridMaxSchedule)
+	}
+}
+
+func TestSendgridClient_Send_errorClass(t *testing.T) {
+	cases := map[string]struct {
+		statusCode int
+		body       string
+		class      Class
+	}{
+		"throttled": {
+			statusCode: http.StatusTooManyRequests,
+			class:      ClassThrottled,
+		},
+		"unauthorized": {
+			statusCode: http.StatusUnauthorized,
+			class:      ClassConfiguration,
+		},
+		"invalid-recipient": {
+			statusCode: http.StatusBadRequest,
+			body:       `{"errors": [{"message": "Does not contain a valid address.", "field": "personalizations.0.to.0.email"}]}`,
+			class:      ClassPermanent,
+		},
+		"invalid-subject": {
+			statusCode: http.StatusBadRequest,
+			body:       `{"errors": [{"message": "The subject is required.", "field": "subject"}]}`,
+			class:      ClassPermanent,
+		},
+		"invalid-template": {
+			statusCode: http.StatusBadRequest,
+			body:       `{"errors": [{"message": "The template_id must be a valid GUID.", "field": "template_id"}]}`,
+			class:      ClassConfiguration,
+		},
+		"unknown-group": {
+			statusCode: http.StatusBadRequest,
+			body:       `{"errors": [{"message": "The group_id must be a valid group.", "field": "asm.group_id"}]}`,
+			class:      ClassConfiguration,
+		},
+		"invalid-ip-pool": {
+			statusCode: http.StatusBadRequest,
+			body:       `{"errors": [{"message": "The ip_pool_name is invalid.", "field": "ip_pool_name"}]}`,
+			class:      ClassConfiguration,
+		},
+		"invalid-template-data": {
+			statusCode: http.StatusBadRequest,
+			body:       `{"errors": [{"message": "Invalid data.", "field": "personalizations.0.dynamic_template_data"}]}`,
+			class:      ClassConfiguration,
+		},
+		"bad-request-without-body": {
+			statusCode: http.StatusBadRequest,
+			class:      ClassConfiguration,
+		},
+		"server-error": {
+			statusCode: http.StatusBadGateway,
+			class:      ClassTemporary,
+		},
+	}
+
+	for hint, c := range cases {
+		t.Run(hint, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(c.statusCode)
+				w.Write([]byte(c.body))
+			}))
+			defer server.Close()
+
+			sc, _ := NewSendgridClient(zaptest.NewLogger(t), "key", server.URL)
+
+			_, err := sc.Send(context.Background(), "a@example.com", []string{"b@example.com"}, "subject")
+			if err == nil {
+				t.Fatalf("expected an error")
+			}
+			if class := ClassOf(err); class != c.class {
+				t.Errorf("wrong class, expected: %s, got: %s", c.class, class)
+			}
+		})
+	}
+}
+
+func TestSendgridClient_Send_options(t *testing.T) {
+	var body struct {
+		TemplateID       string `json:"template_id"`
+		Content          []json.RawMessage
+		Categories       []string `json:"categories"`
+		IPPoolName       string   `json:"ip_pool_name"`
+		Personalizations []struct {
+			DynamicTemplateData map[string]interface{} `json:"dynamic_template_data"`
+		} `json:"personalizations"`
+		ASM struct {
+			GroupID         int   `json:"group_id"`
+			GroupsToDisplay []int `json:"groups_to_display"`
+		} `json:"asm"`
+		MailSettings struct {
+			SandboxMode struct {
+				Enable bool `json:"enable"`
+			} `json:"sandbox_mode"`
+		} `json:"mail_settings"`
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&body)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	sc, _ := NewSendgridClient(zaptest.NewLogger(t), "key", server.URL+"/")
+	_, err := sc.Send(context.Background(), "a@example.com", []string{"b@example.com"}, "subject",
+		WithSendgrid(SendgridOptions{
+			TemplateID:         "d-123",
+			TemplateData:       map[string]interface{}{"name": "Bob"},
+			Categories:         []string{"welcome"},
+			ASMGroupID:         7,
+			ASMGroupsToDisplay: []int{7, 8},
+			IPPoolName:         "transactional",
+			SandboxMode:        true,
+		}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	if body.TemplateID != "d-123" {
+		t.Errorf("wrong template_id: %s", body.TemplateID)
+	}
+	if len(body.Content) != 0 {
+		t.Errorf("a template should render content, got: %d contents", len(body.Content))
+	}
+	if len(body.Personalizations) != 1 || body.Personalizations[0].DynamicTemplateData["name"] != "Bob" {
+		t.Errorf("wrong dynamic_template_data: %+v", body.Personalizations)
+	}
+	if len(body.Categories) != 1 || body.Categories[0] != "welcome" {
+		t.Errorf("wrong categories: %v", body.Categories)
+	}
+	if body.ASM.GroupID != 7 || len(body.ASM.GroupsToDisplay) != 2 {
+		t.Errorf("wrong asm: %+v", body.ASM)
+	}
+	if body.IPPoolName != "transactional" {
+		t.Errorf("wrong ip_pool_name: %s", body.IPPoolName)
+	}
+	if !body.MailSettings.SandboxMode.Enable {
+		t.Errorf("sandbox mode should be enabled")
+	}
+}
@@ -0,0 +1,206 @@
+package emailclient
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/mail"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/mikolajb/emailserv/internal/dkim"
+	"github.com/mikolajb/emailserv/internal/mime"
+	"go.uber.org/zap"
+)
+
+// DefaultSendmailCommand is a common command of local MTAs
+var DefaultSendmailCommand = []string{"/usr/sbin/sendmail", "-t", "-i"}
+
+// Exit codes of sendmail, see sysexits.h
+const (
+	exUsage       = 64
+	exDataErr     = 65
+	exNoInput     = 66
+	exNoUser      = 67
+	exNoHost      = 68
+	exUnavailable = 69
+	exSoftware    = 70
+	exOSErr       = 71
+	exOSFile      = 72
+	exCantCreat   = 73
+	exIOErr       = 74
+	exTempFail    = 75
+	exProtocol    = 76
+	exNoPerm      = 77
+	exConfig      = 78
+)
+
+// sendmailWaitDelay is how long a killed command can keep its output open,
+// e.g. a child of a shell script
+const sendmailWaitDelay = time.Second
+
+// maxSendmailOutput limits output of a command in errors
+const maxSendmailOutput = 512
+
+// SendmailConfig configures SendmailClient
+type SendmailConfig struct {
+	// Command is a command with arguments, DefaultSendmailCommand when empty,
+	// with -t recipients are read from headers, otherwise they are arguments
+	Command []string
+
+	// DKIM signs messages, optional
+	DKIM *dkim.Signer
+}
+
+// SendmailClient pipes messages to a command of a local MTA
+type SendmailClient struct {
+	logger *zap.Logger
+	config SendmailConfig
+}
+
+// NewSendmailClient returns a new sendmail client for a given configuration
+func NewSendmailClient(logger *zap.Logger, config SendmailConfig) (*SendmailClient, error) {
+	if len(config.Command) == 0 {
+		config.Command = DefaultSendmailCommand
+	}
+
+	return &SendmailClient{
+		logger: logger,
+		config: config,
+	}, nil
+}
+
+// ProviderName returns "sendmail"
+func (sc *SendmailClient) ProviderName() string {
+	return "sendmail"
+}
+
+// readsHeaders returns true when a command reads recipients from headers
+func (sc *SendmailClient) readsHeaders() bool {
+	for _, arg := range sc.config.Command[1:] {
+		if arg == "-t" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// setsSender returns true when a command sets an envelope sender with -f
+func (sc *SendmailClient) setsSender() bool {
+	for _, arg := range sc.config.Command[1:] {
+		if strings.HasPrefix(arg, "-f") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Send writes a message to stdin of a command, a command is killed
+// when a context is done, an ID of a message is its Message-ID
+func (sc *SendmailClient) Send(ctx context.Context, sender string, recipients []string, subject string, opts ...EmailOption) (string, error) {
+	options := processOptions(opts...)
+	logger := sc.logger.With(
+		loggerFields(ctx, sender, recipients, subject, options)...,
+	)
+
+	logger.Debug("sending a message")
+
+	message := &mime.Message{
+		From:      sender,
+		To:        recipients,
+		Cc:        options.ccRecipients,
+		Subject:   subject,
+		Text:      options.body,
+		MessageID: mime.NewMessageID(sender[strings.LastIndex(sender, "@")+1:]),
+	}
+	if message.Text == "" {
+		// a message requires a body
+		message.Text = " "
+	}
+	args := append([]string{}, sc.config.Command[1:]...)
+	if !sc.setsSender() {
+		// bounces go to a sender, not to a user running a command,
+		// and SPF and DMARC check a domain of a sender
+		if from, err := mail.ParseAddress(sender); err == nil {
+			args = append(args, "-f", from.Address)
+		}
+	}
+	if sc.readsHeaders() {
+		// sendmail removes Bcc header
+		message.Bcc = options.bccRecipients
+	} else {
+		args = append(append(args, "--"), AllRecipients(recipients, opts...)...)
+	}
+	for _, a := range options.attachments {
+		message.Attachments = append(message.Attachments, mime.Attachment{
+			Filename:    a.Filename,
+			ContentType: a.ContentType,
+			Data:        a.Data,
+		})
+	}
+	raw, err := message.Build()
+	if err == nil && sc.config.DKIM != nil {
+		raw, err = sc.config.DKIM.Sign(raw)
+	}
+	if err != nil {
+		// e.g. an invalid DKIM key, other clients can still send a message
+		logger.Error("cannot build a message", zap.Error(err))
+		return "", &Error{
+			Class: ClassConfiguration,
+			Err:   fmt.Errorf("cannot build a message: %s", err.Error()),
+		}
+	}
+
+	cmd := exec.CommandContext(ctx, sc.config.Command[0], args...)
+	cmd.WaitDelay = sendmailWaitDelay
+	cmd.Stdin = bytes.NewReader(raw)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	if err := cmd.Run(); err != nil {
+		out := strings.TrimSpace(output.String())
+		if len(out) > maxSendmailOutput {
+			out = out[:maxSendmailOutput]
+		}
+		class := sendmailErrorClass(ctx, err)
+		// an output can contain addresses, so it is only logged
+		logger.Error("sendmail error", zap.Error(err), zap.String("output", out), zap.Stringer("class", class))
+		return "", &Error{
+			Class: class,
+			Err:   fmt.Errorf("sendmail error: %s", err.Error()),
+		}
+	}
+
+	logger.Debug("message is sent", zap.String("message_id_header", message.MessageID))
+
+	return strings.Trim(message.MessageID, "<>"), nil
+}
+
+// sendmailErrorClass returns a class of an error of a command
+func sendmailErrorClass(ctx context.Context, err error) Class {
+	if ctx.Err() != nil {
+		// a command was killed
+		return ClassTemporary
+	}
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		// a command cannot be started
+		return ClassConfiguration
+	}
+
+	switch exitErr.ExitCode() {
+	case exDataErr, exNoUser, exNoHost:
+		return ClassPermanent
+	case exUsage, exNoInput, exOSFile, exCantCreat, exNoPerm, exConfig:
+		return ClassConfiguration
+	case exUnavailable, exSoftware, exOSErr, exIOErr, exTempFail, exProtocol:
+		return ClassTemporary
+	default:
+		return ClassTemporary
+	}
+}
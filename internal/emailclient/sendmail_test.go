@@ -0,0 +1,162 @@
+package emailclient
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/mail"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zaptest"
+)
+
+// fakeSendmail writes a shell script saving its arguments and stdin
+// to files in a directory and running a given command
+func fakeSendmail(t *testing.T, command string) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	script := filepath.Join(dir, "sendmail")
+	content := fmt.Sprintf("#!/bin/sh\necho \"$@\" > %s/args\ncat > %s/stdin\n%s\n", dir, dir, command)
+	if err := ioutil.WriteFile(script, []byte(content), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	return script, dir
+}
+
+func TestSendmailClient_Send(t *testing.T) {
+	cases := map[string]struct {
+		args     []string
+		expected string
+		bcc      string
+	}{
+		"recipients from headers": {
+			args:     []string{"-t", "-i"},
+			expected: "-t -i -f a@example.com",
+			bcc:      "<d@example.com>",
+		},
+		"recipients as arguments": {
+			args:     []string{"-i"},
+			expected: "-i -f a@example.com -- b@example.com c@example.com d@example.com",
+		},
+		"configured sender": {
+			args:     []string{"-i", "-fbounces@example.com"},
+			expected: "-i -fbounces@example.com -- b@example.com c@example.com d@example.com",
+		},
+	}
+
+	for hint, c := range cases {
+		t.Run(hint, func(t *testing.T) {
+			script, dir := fakeSendmail(t, "exit 0")
+			sc, _ := NewSendmailClient(zaptest.NewLogger(t), SendmailConfig{
+				Command: append([]string{script}, c.args...),
+			})
+
+			id, err := sc.Send(context.Background(), "a@example.com", []string{"b@example.com"}, "subject",
+				WithBody("Hello"),
+				WithCCRecipients([]string{"c@example.com"}),
+				WithBCCRecipients([]string{"d@example.com"}),
+			)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+
+			args, _ := ioutil.ReadFile(filepath.Join(dir, "args"))
+			if strings.TrimSpace(string(args)) != c.expected {
+				t.Errorf("wrong arguments, expected: %q, got: %q", c.expected, args)
+			}
+			stdin, _ := ioutil.ReadFile(filepath.Join(dir, "stdin"))
+			msg, err := mail.ReadMessage(bytes.NewReader(stdin))
+			if err != nil {
+				t.Fatalf("cannot parse a message: %s", err.Error())
+			}
+			if msg.Header.Get("To") != "<b@example.com>" || msg.Header.Get("Bcc") != c.bcc {
+				t.Errorf("wrong recipients, to: %q, bcc: %q", msg.Header.Get("To"), msg.Header.Get("Bcc"))
+			}
+			if "<"+id+">" != msg.Header.Get("Message-Id") {
+				t.Errorf("id %q should be a Message-ID %q", id, msg.Header.Get("Message-Id"))
+			}
+		})
+	}
+}
+
+func TestSendmailClient_Send_errorClass(t *testing.T) {
+	cases := map[string]struct {
+		command string
+		class   Class
+	}{
+		"no user": {
+			command: "exit 67",
+			class:   ClassPermanent,
+		},
+		"data error": {
+			command: "exit 65",
+			class:   ClassPermanent,
+		},
+		"temporary failure": {
+			command: "echo 'queue is full' >&2; exit 75",
+			class:   ClassTemporary,
+		},
+		"configuration": {
+			command: "exit 78",
+			class:   ClassConfiguration,
+		},
+		"no permission": {
+			command: "exit 77",
+			class:   ClassConfiguration,
+		},
+		"unknown": {
+			command: "exit 1",
+			class:   ClassTemporary,
+		},
+	}
+
+	for hint, c := range cases {
+		t.Run(hint, func(t *testing.T) {
+			script, _ := fakeSendmail(t, c.command)
+			sc, _ := NewSendmailClient(zaptest.NewLogger(t), SendmailConfig{Command: []string{script, "-t"}})
+
+			_, err := sc.Send(context.Background(), "a@example.com", []string{"b@example.com"}, "subject")
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if class := ClassOf(err); class != c.class {
+				t.Errorf("wrong class, expected: %s, got: %s", c.class, class)
+			}
+		})
+	}
+}
+
+func TestSendmailClient_Send_notFound(t *testing.T) {
+	sc, _ := NewSendmailClient(zaptest.NewLogger(t), SendmailConfig{
+		Command: []string{filepath.Join(t.TempDir(), "sendmail")},
+	})
+
+	_, err := sc.Send(context.Background(), "a@example.com", []string{"b@example.com"}, "subject")
+	if class := ClassOf(err); err == nil || class != ClassConfiguration {
+		t.Errorf("missing command should be a configuration error, got: %v", err)
+	}
+}
+
+func TestSendmailClient_Send_cancel(t *testing.T) {
+	script, _ := fakeSendmail(t, "sleep 10")
+	sc, _ := NewSendmailClient(zaptest.NewLogger(t), SendmailConfig{Command: []string{script, "-t"}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := sc.Send(ctx, "a@example.com", []string{"b@example.com"}, "subject")
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if class := ClassOf(err); class != ClassTemporary {
+		t.Errorf("wrong class, expected: %s, got: %s", ClassTemporary, class)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("command should be killed, it took %s", elapsed)
+	}
+}
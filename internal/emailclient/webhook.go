@@ -0,0 +1,287 @@
+package emailclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"text/template"
+	"time"
+
+	"github.com/mikolajb/emailserv/internal/callbacks"
+	"github.com/mikolajb/emailserv/internal/requestid"
+	"github.com/mikolajb/emailserv/internal/tracing"
+	"go.uber.org/zap"
+)
+
+// DefaultWebhookName is a provider name of a webhook client without a name
+const DefaultWebhookName = "webhook"
+
+// maxWebhookResponseBytes limits a response read from a service
+const maxWebhookResponseBytes = 1 << 20
+
+// WebhookConfig configures WebhookClient
+type WebhookConfig struct {
+	// Name is a provider name of a client, DefaultWebhookName when empty
+	Name string `json:"name"`
+
+	// URL receives messages in POST requests
+	URL string `json:"url"`
+
+	// Template is a text/template of a request body executed with
+	// WebhookMessage, a "json" function encodes values, a message
+	// is encoded as JSON when it is empty
+	Template string `json:"template"`
+
+	// ContentType of a body, application/json when empty
+	ContentType string `json:"content_type"`
+
+	// Headers are added to every request
+	Headers map[string]string `json:"headers"`
+
+	// Secret signs bodies in X-Emailserv-Signature header
+	// like callbacks, requests are not signed when it is empty
+	Secret string `json:"secret"`
+
+	// Classes map status codes, e.g. "429", or their ranges, e.g. "4xx",
+	// to classes of errors, they override default classes
+	Classes map[string]string `json:"classes"`
+
+	// IDField is a field of a JSON response with an ID of a message, "id" when empty
+	IDField string `json:"id_field"`
+}
+
+// LoadWebhookConfig reads a JSON file with a configuration of a webhook client
+func LoadWebhookConfig(path string) (*WebhookConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read webhook config: %s", err.Error())
+	}
+
+	var config WebhookConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("invalid webhook config: %s", err.Error())
+	}
+
+	return &config, nil
+}
+
+// WebhookAttachment is an attachment of WebhookMessage
+type WebhookAttachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type,omitempty"`
+
+	// Content is base64 encoded
+	Content string `json:"content"`
+}
+
+// WebhookMessage is a normalised message posted by WebhookClient
+type WebhookMessage struct {
+	MessageID     string              `json:"message_id,omitempty"`
+	RequestID     string              `json:"request_id,omitempty"`
+	Sender        string              `json:"sender"`
+	Recipients    []string            `json:"recipients"`
+	CCRecipients  []string            `json:"cc_recipients,omitempty"`
+	BCCRecipients []string            `json:"bcc_recipients,omitempty"`
+	Subject       string              `json:"subject"`
+	Body          string              `json:"body"`
+	Attachments   []WebhookAttachment `json:"attachments,omitempty"`
+}
+
+// WebhookClient posts messages to a URL of an HTTP service
+type WebhookClient struct {
+	logger     *zap.Logger
+	config     WebhookConfig
+	template   *template.Template
+	classes    map[string]Class
+	httpClient *http.Client
+	now        func() time.Time
+}
+
+// NewWebhookClient returns a new webhook client for a given configuration
+func NewWebhookClient(logger *zap.Logger, config WebhookConfig) (*WebhookClient, error) {
+	if config.URL == "" {
+		return nil, fmt.Errorf("webhook url is required")
+	}
+	if config.Name == "" {
+		config.Name = DefaultWebhookName
+	}
+	if config.ContentType == "" {
+		config.ContentType = "application/json"
+	}
+	if config.IDField == "" {
+		config.IDField = "id"
+	}
+
+	wc := &WebhookClient{
+		logger:     logger,
+		config:     config,
+		classes:    map[string]Class{},
+		httpClient: http.DefaultClient,
+		now:        time.Now,
+	}
+	if config.Template != "" {
+		t, err := template.New("body").Funcs(template.FuncMap{
+			"json": func(v interface{}) (string, error) {
+				data, err := json.Marshal(v)
+				return string(data), err
+			},
+		}).Parse(config.Template)
+		if err != nil {
+			return nil, fmt.Errorf("invalid webhook template: %s", err.Error())
+		}
+		wc.template = t
+	}
+	for status, name := range config.Classes {
+		if !validStatusPattern(status) {
+			return nil, fmt.Errorf("invalid status %q, expected a code or a range like 4xx", status)
+		}
+		class, err := ParseClass(name)
+		if err != nil {
+			return nil, err
+		}
+		wc.classes[status] = class
+	}
+
+	return wc, nil
+}
+
+// validStatusPattern returns true for "404" or "4xx"
+func validStatusPattern(status string) bool {
+	if len(status) != 3 || status[0] < '1' || status[0] > '5' {
+		return false
+	}
+	if status[1:] == "xx" {
+		return true
+	}
+	_, err := strconv.Atoi(status)
+
+	return err == nil
+}
+
+// ProviderName returns a configured name
+func (wc *WebhookClient) ProviderName() string {
+	return wc.config.Name
+}
+
+// body returns a request body of a message
+func (wc *WebhookClient) body(message *WebhookMessage) ([]byte, error) {
+	if wc.template == nil {
+		return json.Marshal(message)
+	}
+
+	var b bytes.Buffer
+	if err := wc.template.Execute(&b, message); err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
+// Send posts a message to a configured URL
+func (wc *WebhookClient) Send(ctx context.Context, sender string, recipients []string, subject string, opts ...EmailOption) (string, error) {
+	options := processOptions(opts...)
+	logger := wc.logger.With(
+		loggerFields(ctx, sender, recipients, subject, options)...,
+	)
+
+	logger.Debug("sending a message")
+
+	message := &WebhookMessage{
+		MessageID:     options.messageID,
+		RequestID:     requestid.FromContext(ctx),
+		Sender:        sender,
+		Recipients:    recipients,
+		CCRecipients:  options.ccRecipients,
+		BCCRecipients: options.bccRecipients,
+		Subject:       subject,
+		Body:          options.body,
+	}
+	for _, a := range options.attachments {
+		message.Attachments = append(message.Attachments, WebhookAttachment{
+			Filename:    a.Filename,
+			ContentType: a.ContentType,
+			Content:     base64.StdEncoding.EncodeToString(a.Data),
+		})
+	}
+	body, err := wc.body(message)
+	if err != nil {
+		logger.Error("cannot build a request body", zap.Error(err))
+		return "", &Error{
+			Class: ClassConfiguration,
+			Err:   fmt.Errorf("cannot build a request body: %s", err.Error()),
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodPost, wc.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("cannot build a request: %s", err.Error())
+	}
+	req = req.WithContext(ctx)
+	for name, value := range wc.config.Headers {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set("Content-Type", wc.config.ContentType)
+	if wc.config.Secret != "" {
+		req.Header.Set(callbacks.SignatureHeader, callbacks.Sign(wc.config.Secret, wc.now().Unix(), body))
+	}
+	tracing.Inject(ctx, req.Header)
+
+	res, err := wc.httpClient.Do(req)
+	if err != nil {
+		logger.Error("sending error", zap.Error(err))
+		return "", fmt.Errorf("sending error: %s", err.Error())
+	}
+	defer res.Body.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(res.Body, maxWebhookResponseBytes))
+	if err != nil {
+		logger.Error("cannot read a response", zap.Error(err))
+		return "", fmt.Errorf("cannot read a response: %s", err.Error())
+	}
+	logger.Debug("request sent", zap.Int("status_code", res.StatusCode))
+	if res.StatusCode/100 != 2 {
+		return "", &Error{
+			Class: wc.class(res.StatusCode),
+			Err:   fmt.Errorf("unsuccessful request, status code: %d", res.StatusCode),
+		}
+	}
+
+	// an ID is optional, a response does not have to be JSON
+	var response map[string]interface{}
+	if err := json.Unmarshal(data, &response); err == nil {
+		if id, ok := response[wc.config.IDField].(string); ok {
+			return id, nil
+		}
+	}
+
+	return "", nil
+}
+
+// class returns a class of an unsuccessful status, a configured code
+// goes before a configured range and then a default class,
+// a service is not known to reject only invalid messages with 4xx,
+// so they are not permanent unless it is configured
+func (wc *WebhookClient) class(statusCode int) Class {
+	status := strconv.Itoa(statusCode)
+	if class, ok := wc.classes[status]; ok {
+		return class
+	}
+	if class, ok := wc.classes[status[:1]+"xx"]; ok {
+		return class
+	}
+
+	switch {
+	case statusCode == http.StatusTooManyRequests:
+		return ClassThrottled
+	case statusCode/100 == 4:
+		return ClassConfiguration
+	default:
+		return ClassTemporary
+	}
+}
@@ -0,0 +1,223 @@
+package emailclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mikolajb/emailserv/internal/callbacks"
+	"github.com/mikolajb/emailserv/internal/requestid"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestWebhookClient_Send(t *testing.T) {
+	cases := map[string]struct {
+		template    string
+		contentType string
+		response    string
+		expected    string
+		id          string
+	}{
+		"json": {
+			response: `{"id": "hub-1"}`,
+			expected: `{"message_id":"message-1","request_id":"request-1","sender":"a@example.com","recipients":["b@example.com"],"cc_recipients":["c@example.com"],"subject":"subject","body":"Hello \"Bob\"","attachments":[{"filename":"a.txt","content":"YQ=="}]}`,
+			id:       "hub-1",
+		},
+		"template": {
+			template:    `{"to": {{json .Recipients}}, "title": {{json .Subject}}, "text": {{json .Body}}}`,
+			contentType: "application/vnd.hub+json",
+			response:    `OK`,
+			expected:    `{"to": ["b@example.com"], "title": "subject", "text": "Hello \"Bob\""}`,
+		},
+	}
+
+	for hint, c := range cases {
+		t.Run(hint, func(t *testing.T) {
+			var (
+				body   []byte
+				header http.Header
+			)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ = ioutil.ReadAll(r.Body)
+				header = r.Header
+				w.Write([]byte(c.response))
+			}))
+			defer server.Close()
+
+			wc, err := NewWebhookClient(zaptest.NewLogger(t), WebhookConfig{
+				Name:        "hub",
+				URL:         server.URL,
+				Template:    c.template,
+				ContentType: c.contentType,
+				Headers:     map[string]string{"Authorization": "Bearer token"},
+				Secret:      "secret",
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+
+			ctx := requestid.NewContext(context.Background(), "request-1")
+			id, err := wc.Send(ctx, "a@example.com", []string{"b@example.com"}, "subject",
+				WithBody(`Hello "Bob"`),
+				WithCCRecipients([]string{"c@example.com"}),
+				WithMessageID("message-1"),
+				WithAttachment(Attachment{Filename: "a.txt", Data: []byte("a")}),
+			)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if id != c.id {
+				t.Errorf("wrong provider message id, expected: %q, got: %q", c.id, id)
+			}
+			if string(body) != c.expected {
+				t.Errorf("wrong body, expected: %s, got: %s", c.expected, body)
+			}
+			contentType := c.contentType
+			if contentType == "" {
+				contentType = "application/json"
+			}
+			if header.Get("Content-Type") != contentType {
+				t.Errorf("wrong content type: %s", header.Get("Content-Type"))
+			}
+			if header.Get("Authorization") != "Bearer token" {
+				t.Errorf("custom header is missing")
+			}
+			if err := callbacks.Verify("secret", header.Get(callbacks.SignatureHeader), body, time.Minute, time.Now()); err != nil {
+				t.Errorf("invalid signature: %s", err.Error())
+			}
+		})
+	}
+}
+
+func TestWebhookClient_Send_errorClass(t *testing.T) {
+	classes := map[string]string{
+		"409": "temporary",
+		"4xx": "configuration",
+	}
+	cases := map[string]struct {
+		statusCode int
+		classes    map[string]string
+		class      Class
+	}{
+		"default throttled": {
+			statusCode: http.StatusTooManyRequests,
+			class:      ClassThrottled,
+		},
+		"default configuration": {
+			statusCode: http.StatusBadRequest,
+			class:      ClassConfiguration,
+		},
+		"configured permanent": {
+			statusCode: http.StatusUnprocessableEntity,
+			classes:    map[string]string{"422": "permanent"},
+			class:      ClassPermanent,
+		},
+		"default temporary": {
+			statusCode: http.StatusBadGateway,
+			class:      ClassTemporary,
+		},
+		"configured code": {
+			statusCode: http.StatusConflict,
+			classes:    classes,
+			class:      ClassTemporary,
+		},
+		"configured range": {
+			statusCode: http.StatusBadRequest,
+			classes:    classes,
+			class:      ClassConfiguration,
+		},
+		"range not configured": {
+			statusCode: http.StatusServiceUnavailable,
+			classes:    classes,
+			class:      ClassTemporary,
+		},
+	}
+
+	for hint, c := range cases {
+		t.Run(hint, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(c.statusCode)
+			}))
+			defer server.Close()
+
+			wc, err := NewWebhookClient(zaptest.NewLogger(t), WebhookConfig{URL: server.URL, Classes: c.classes})
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			_, err = wc.Send(context.Background(), "a@example.com", []string{"b@example.com"}, "subject")
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if class := ClassOf(err); class != c.class {
+				t.Errorf("wrong class, expected: %s, got: %s", c.class, class)
+			}
+		})
+	}
+}
+
+func TestWebhookClient_Send_largeResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id": "`))
+		w.Write(bytes.Repeat([]byte("a"), 2*maxWebhookResponseBytes))
+		w.Write([]byte(`"}`))
+	}))
+	defer server.Close()
+
+	wc, err := NewWebhookClient(zaptest.NewLogger(t), WebhookConfig{URL: server.URL})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	id, err := wc.Send(context.Background(), "a@example.com", []string{"b@example.com"}, "subject")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if id != "" {
+		t.Errorf("an ID of a truncated response should be ignored, got %d bytes", len(id))
+	}
+}
+
+func TestNewWebhookClient_errors(t *testing.T) {
+	cases := map[string]WebhookConfig{
+		"no url":           {},
+		"invalid template": {URL: "http://localhost", Template: "{{.Subject"},
+		"invalid status":   {URL: "http://localhost", Classes: map[string]string{"4x": "permanent"}},
+		"invalid class":    {URL: "http://localhost", Classes: map[string]string{"404": "fatal"}},
+	}
+
+	for hint, config := range cases {
+		t.Run(hint, func(t *testing.T) {
+			if _, err := NewWebhookClient(zaptest.NewLogger(t), config); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestLoadWebhookConfig(t *testing.T) {
+	expected := &WebhookConfig{
+		Name:    "hub",
+		URL:     "https://hub.example.com/email",
+		Headers: map[string]string{"Authorization": "Bearer token"},
+		Classes: map[string]string{"4xx": "permanent"},
+	}
+	data, _ := json.Marshal(expected)
+	path := filepath.Join(t.TempDir(), "webhook.json")
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := LoadWebhookConfig(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if !reflect.DeepEqual(config, expected) {
+		t.Errorf("wrong config, expected: %+v, got: %+v", expected, config)
+	}
+}
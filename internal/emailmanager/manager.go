@@ -3,9 +3,17 @@ package emailmanager
 import (
 	"context"
 	"errors"
+	"fmt"
+	"sync"
 	"time"
 
 	"github.com/mikolajb/emailserv/internal/emailclient"
+	"github.com/mikolajb/emailserv/internal/pacing"
+	"github.com/mikolajb/emailserv/internal/ratelimit"
+	"github.com/mikolajb/emailserv/internal/requestid"
+	"github.com/mikolajb/emailserv/internal/tracing"
+	"github.com/mikolajb/emailserv/internal/usage"
+	"go.opentelemetry.io/otel/attribute"
 	"go.uber.org/zap"
 )
 
@@ -15,47 +23,267 @@ type EmailManager struct {
 	Logger        *zap.Logger
 	EmailClients  []emailclient.EmailClient
 	ClientTimeout time.Duration
+
+	// RateLimits limit recipients per second of clients by provider names,
+	// e.g. SES maximum send rate, a client at its limit is skipped
+	RateLimits map[string]*ratelimit.Bucket
+
+	// Pacer paces messages per recipient domain, optional
+	Pacer *pacing.Pacer
+
+	// Routing is RoutingPriority (default) or RoutingCost
+	Routing string
+
+	// Pricing are prices of providers used by RoutingCost,
+	// clients without a price cost nothing
+	Pricing usage.Pricing
+
+	mu      sync.Mutex
+	health  map[string]*health
+	month   string
+	volumes map[string]int64
+}
+
+// RateLimitError is returned when all clients are at their rate limits
+type RateLimitError struct {
+	// RetryAfter is how long until one of clients can send a message
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("all clients are at their rate limits, retry after %s", e.RetryAfter)
+}
+
+// ProviderRequiredError is returned when options of a message,
+// e.g. a SendGrid template, require a client which is not configured
+type ProviderRequiredError struct {
+	Provider string
+}
+
+func (e *ProviderRequiredError) Error() string {
+	return fmt.Sprintf("message requires %s client, which is not configured", e.Provider)
+}
+
+// ErrNotScheduled is returned when a message has to be sent later
+// and no client can ask its provider to deliver it at a given time
+var ErrNotScheduled = errors.New("no client can schedule a message")
+
+// SendResult describes how a message was sent
+type SendResult struct {
+	// Provider is a name of a client which sent a message
+	Provider string
+
+	// ProviderMessageID is an ID assigned to a message by a provider
+	ProviderMessageID string
+
+	// Scheduled is true when a provider delivers a message later,
+	// see emailclient.WithSendAt
+	Scheduled bool
+
+	// Routing is a routing strategy used for a message
+	Routing string
+
+	// Attempts are clients in an order they were considered,
+	// the last one sent a message
+	Attempts []Attempt
+}
+
+// clientResult is an outcome of a single client
+type clientResult struct {
+	providerMessageID string
+	err               error
 }
 
 // Send sends an email using one of the available clients
-func (em *EmailManager) Send(ctx context.Context, sender string, recipients []string, subject string, opts ...emailclient.EmailOption) error {
+// When a message has a send time in the future only clients
+// which can schedule it are used, ErrNotScheduled is returned when
+// none of them succeeds, so a message can be sent later with a failover
+// to all clients.
+func (em *EmailManager) Send(ctx context.Context, sender string, recipients []string, subject string, opts ...emailclient.EmailOption) (*SendResult, error) {
 	logger := em.Logger.With(
+		requestid.Field(ctx),
 		zap.String("sender", sender),
 		zap.Strings("recipients", recipients),
 		zap.String("subject", subject),
 	)
 
-	isSent := false
+	ctx, span := tracing.Start(ctx, "EmailManager.Send")
+	defer span.End()
+
+	var result *SendResult
+	sendAt := emailclient.SendAt(opts...)
+	scheduled := sendAt.After(time.Now())
+	allRecipients := emailclient.AllRecipients(recipients, opts...)
+	recipientCount := len(allRecipients)
+
+	// a provider delivers a scheduled message later, so it is not paced
+	if em.Pacer != nil && !scheduled {
+		_, pacingSpan := tracing.Start(ctx, "pacing")
+		release, err := em.Pacer.Acquire(ctx, allRecipients)
+		pacingSpan.End()
+		if err != nil {
+			logger.Error("message not paced", zap.Error(err))
+			tracing.RecordError(span, err)
+			if _, ok := err.(*pacing.TimeoutError); ok {
+				return nil, err
+			}
+			return nil, fmt.Errorf("message not paced: %s", err.Error())
+		}
+		defer release()
+	}
+	var retryAfter time.Duration
+
+	required := emailclient.RequiredProvider(opts...)
+	if required != "" && !em.HasClient(required) {
+		err := &ProviderRequiredError{Provider: required}
+		logger.Error("message cannot be sent", zap.Error(err))
+		tracing.RecordError(span, err)
+		return nil, err
+	}
+
+	routing := em.Routing
+	if routing == "" {
+		routing = RoutingPriority
+	}
+	size := emailclient.ContentSize(subject, opts...)
+	route := em.route(recipientCount, size, time.Now())
+	routeFields := make([]string, len(route))
+	for i, entry := range route {
+		routeFields[i] = entry.attempt.Provider
+	}
+	logger.Debug("route", zap.String("routing", routing), zap.Strings("route", routeFields))
+	var attempts []Attempt
+	var permanentErr error
 
 LoopOverClients:
-	for _, ec := range em.EmailClients {
-		iLogger := logger.With(zap.String("email_provider", ec.ProviderName()))
+	for _, entry := range route {
+		ec := entry.client
+		attempt := entry.attempt
+		providerName := attempt.Provider
+		iLogger := logger.With(
+			zap.String("email_provider", providerName),
+			zap.Float64("cost", attempt.Cost),
+			zap.Bool("unhealthy", attempt.Unhealthy),
+		)
+		if scheduled {
+			if s, ok := ec.(emailclient.Scheduler); !ok || !s.CanSchedule(sendAt) {
+				iLogger.Debug("client cannot schedule a message, skipped", zap.Time("send_at", sendAt))
+				attempt.Skipped = "cannot schedule"
+				attempts = append(attempts, attempt)
+				continue
+			}
+		}
+		if required != "" && providerName != required {
+			iLogger.Debug("message requires another client, skipped", zap.String("required_provider", required))
+			attempt.Skipped = "requires " + required
+			attempts = append(attempts, attempt)
+			continue
+		}
+		if limit := em.RateLimits[providerName]; limit != nil {
+			if ok, wait := limit.Allow(recipientCount); !ok {
+				iLogger.Debug("client is at its rate limit, skipped", zap.Duration("retry_after", wait))
+				if retryAfter == 0 || wait < retryAfter {
+					retryAfter = wait
+				}
+				attempt.Skipped = "rate limit"
+				attempts = append(attempts, attempt)
+				continue
+			}
+		}
 		clientCtx, cancel := context.WithTimeout(ctx, em.ClientTimeout)
 		defer cancel()
-		done := make(chan error)
+		clientCtx, clientSpan := tracing.Start(
+			clientCtx,
+			"EmailClient.Send",
+			attribute.String("email.provider", providerName),
+		)
+		done := make(chan clientResult, 1)
 
 		go func() {
-			done <- ec.Send(clientCtx, sender, recipients, subject, opts...)
+			id, err := ec.Send(clientCtx, sender, recipients, subject, opts...)
+			done <- clientResult{providerMessageID: id, err: err}
 		}()
 
 		select {
-		case err := <-done:
-			if err != nil {
-				iLogger.Error("email client error", zap.Error(err))
+		case r := <-done:
+			em.report(providerName, r.err, time.Now())
+			if r.err != nil {
+				class := emailclient.ClassOf(r.err)
+				iLogger.Error("email client error", zap.Error(r.err), zap.Stringer("class", class))
+				tracing.RecordError(clientSpan, r.err)
+				clientSpan.End()
+				attempt.Error = r.err.Error()
+				attempt.Class = class.String()
+				attempts = append(attempts, attempt)
+				if class == emailclient.ClassPermanent {
+					// other providers would reject a message too
+					permanentErr = r.err
+					break LoopOverClients
+				}
 			} else {
-				iLogger.Debug("sent")
-				isSent = true
+				iLogger.Debug("sent", zap.String("provider_message_id", r.providerMessageID))
+				clientSpan.End()
+				em.AddVolume(providerName, int64(recipientCount))
+				attempts = append(attempts, attempt)
+				result = &SendResult{
+					Provider:          providerName,
+					ProviderMessageID: r.providerMessageID,
+					Scheduled:         scheduled,
+					Routing:           routing,
+					Attempts:          attempts,
+				}
 				break LoopOverClients
 			}
 		case <-clientCtx.Done():
 			logger.Error("client timeout")
+			em.report(providerName, clientCtx.Err(), time.Now())
+			tracing.RecordError(clientSpan, clientCtx.Err())
+			clientSpan.End()
+			attempt.Error = clientCtx.Err().Error()
+			attempt.Class = emailclient.ClassTemporary.String()
+			attempts = append(attempts, attempt)
 		}
 	}
 
-	if !isSent {
+	if permanentErr != nil {
+		err := &emailclient.Error{
+			Class: emailclient.ClassPermanent,
+			Err:   fmt.Errorf("message rejected: %s", permanentErr.Error()),
+		}
+		logger.Error("message rejected, other clients are not used", zap.Error(err))
+		tracing.RecordError(span, err)
+		return nil, err
+	}
+	if result == nil && retryAfter > 0 && !scheduled {
+		// a provider at its limit is only temporarily unavailable,
+		// a message can be retried when no other client sent it
+		err := &RateLimitError{RetryAfter: retryAfter}
+		logger.Error("sending failed for all clients", zap.Error(err))
+		tracing.RecordError(span, err)
+		return nil, err
+	}
+	if result == nil && scheduled {
+		logger.Debug("scheduling failed for all clients")
+		tracing.RecordError(span, ErrNotScheduled)
+		return nil, ErrNotScheduled
+	}
+	if result == nil {
 		logger.Error("sending failed for all clients")
-		return errors.New("sending emails failed for all clients")
+		err := errors.New("sending emails failed for all clients")
+		tracing.RecordError(span, err)
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// HasClient returns true when a client of a provider is configured
+func (em *EmailManager) HasClient(provider string) bool {
+	for _, ec := range em.EmailClients {
+		if ec.ProviderName() == provider {
+			return true
+		}
 	}
 
-	return nil
+	return false
 }
@@ -8,6 +8,7 @@ import (
 
 	"github.com/golang/mock/gomock"
 	"github.com/mikolajb/emailserv/internal/emailclient"
+	"github.com/mikolajb/emailserv/internal/ratelimit"
 	"go.uber.org/zap/zaptest"
 )
 
@@ -42,11 +43,11 @@ func TestEmailManager_Send(t *testing.T) {
 			client1.EXPECT().ProviderName().Return("mock_client1")
 			client2.EXPECT().ProviderName().Return("mock_client2")
 			firstClientCall := client1.EXPECT().Send(gomock.Any(), "a", []string{"b"}, "c")
-			firstClientCall.Return(errors.New("some error")).Times(1)
+			firstClientCall.Return("", errors.New("some error")).Times(1)
 
 			secondClientCall := client2.EXPECT().Send(gomock.Any(), "a", []string{"b"}, "c")
 			secondClientCall.After(firstClientCall)
-			secondClientCall.DoAndReturn(func(ctx context.Context, sender string, recipients []string, subject string) error {
+			secondClientCall.DoAndReturn(func(ctx context.Context, sender string, recipients []string, subject string, opts ...emailclient.EmailOption) (string, error) {
 				if c.delay != 0 {
 					select {
 					case <-time.After(c.delay):
@@ -55,10 +56,10 @@ func TestEmailManager_Send(t *testing.T) {
 						<-time.After(10 * time.Millisecond)
 					}
 				}
-				return nil
+				return "provider-id", nil
 			}).Times(1)
 
-			err := em.Send(context.Background(), "a", []string{"b"}, "c")
+			result, err := em.Send(context.Background(), "a", []string{"b"}, "c")
 			if c.err != nil && err != nil {
 				if c.err.Error() != err.Error() {
 					t.Errorf("expected error '%s' but got '%s'", c.err.Error(), err.Error())
@@ -71,6 +72,119 @@ func TestEmailManager_Send(t *testing.T) {
 					t.Errorf("expected error '%s' but got nothing", c.err.Error())
 				}
 			}
+			if c.err == nil && err == nil {
+				if result.Provider != "mock_client2" || result.ProviderMessageID != "provider-id" {
+					t.Errorf("unexpected result %v", result)
+				}
+			}
 		})
 	}
 }
+
+// schedulingClient is a client which can schedule messages up to an hour ahead
+type schedulingClient struct {
+	name   string
+	err    error
+	sendAt time.Time
+}
+
+func (sc *schedulingClient) Send(ctx context.Context, sender string, recipients []string, subject string, opts ...emailclient.EmailOption) (string, error) {
+	sc.sendAt = emailclient.SendAt(opts...)
+	return sc.name + "-id", sc.err
+}
+
+func (sc *schedulingClient) ProviderName() string {
+	return sc.name
+}
+
+func (sc *schedulingClient) CanSchedule(sendAt time.Time) bool {
+	return time.Until(sendAt) <= time.Hour
+}
+
+func TestEmailManager_Send_scheduled(t *testing.T) {
+	cases := map[string]struct {
+		sendAt    time.Duration
+		err       error
+		provider  string
+		scheduled bool
+		resultErr error
+	}{
+		"scheduled": {
+			sendAt:    30 * time.Minute,
+			provider:  "scheduling",
+			scheduled: true,
+		},
+		"too-far": {
+			sendAt:    2 * time.Hour,
+			resultErr: ErrNotScheduled,
+		},
+		"scheduling-failed": {
+			sendAt:    30 * time.Minute,
+			err:       errors.New("some error"),
+			resultErr: ErrNotScheduled,
+		},
+	}
+
+	for hint, c := range cases {
+		t.Run(hint, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+
+			// a client which cannot schedule is never used for future messages
+			plain := emailclient.NewMockEmailClient(mockCtrl)
+			plain.EXPECT().ProviderName().Return("plain")
+			scheduling := &schedulingClient{name: "scheduling", err: c.err}
+
+			em := EmailManager{
+				Logger:        zaptest.NewLogger(t),
+				EmailClients:  []emailclient.EmailClient{plain, scheduling},
+				ClientTimeout: 100 * time.Millisecond,
+			}
+
+			sendAt := time.Now().Add(c.sendAt)
+			result, err := em.Send(context.Background(), "a", []string{"b"}, "c", emailclient.WithSendAt(sendAt))
+			if err != c.resultErr {
+				t.Fatalf("expected error %v, got: %v", c.resultErr, err)
+			}
+			if err != nil {
+				return
+			}
+			if result.Provider != c.provider || result.Scheduled != c.scheduled {
+				t.Errorf("wrong result: %+v", result)
+			}
+			if !scheduling.sendAt.Equal(sendAt) {
+				t.Errorf("send time not passed to a client: %s", scheduling.sendAt)
+			}
+		})
+	}
+}
+
+func TestEmailManager_Send_rateLimits(t *testing.T) {
+	first := &schedulingClient{name: "first"}
+	second := &schedulingClient{name: "second"}
+	em := EmailManager{
+		Logger:        zaptest.NewLogger(t),
+		EmailClients:  []emailclient.EmailClient{first, second},
+		ClientTimeout: 100 * time.Millisecond,
+		RateLimits: map[string]*ratelimit.Bucket{
+			"first":  ratelimit.NewBucket(0.01, 2),
+			"second": ratelimit.NewBucket(0.01, 1),
+		},
+	}
+
+	// a cc recipient takes the second token of the first client
+	result, err := em.Send(context.Background(), "a", []string{"b"}, "c", emailclient.WithCCRecipient("d"))
+	if err != nil || result.Provider != "first" {
+		t.Fatalf("expected a message sent by first, got: %+v, %v", result, err)
+	}
+	result, err = em.Send(context.Background(), "a", []string{"b"}, "c")
+	if err != nil || result.Provider != "second" {
+		t.Fatalf("a client at its limit should be skipped, got: %+v, %v", result, err)
+	}
+
+	_, err = em.Send(context.Background(), "a", []string{"b"}, "c")
+	rateLimitErr, ok := err.(*RateLimitError)
+	if !ok || rateLimitErr.RetryAfter <= 0 {
+		t.Errorf("expected a rate limit error, got: %v", err)
+	}
+}
@@ -0,0 +1,164 @@
+package emailmanager
+
+import (
+	"sort"
+	"time"
+
+	"github.com/mikolajb/emailserv/internal/emailclient"
+)
+
+// Routing strategies
+const (
+	// RoutingPriority tries clients in an order of EmailClients
+	RoutingPriority = "priority"
+
+	// RoutingCost tries the cheapest clients first,
+	// clients with the same cost keep an order of EmailClients
+	RoutingCost = "cost"
+)
+
+const (
+	// throttledCooldown is how long a throttled client is unhealthy
+	throttledCooldown = 30 * time.Second
+
+	// configurationCooldown is how long a client with
+	// a configuration error is unhealthy
+	configurationCooldown = 5 * time.Minute
+
+	// temporaryCooldown is how long a client is unhealthy
+	// after maxTemporaryFailures temporary errors in a row
+	temporaryCooldown    = time.Minute
+	maxTemporaryFailures = 3
+)
+
+// health is a health of a client
+type health struct {
+	failures       int
+	unhealthyUntil time.Time
+}
+
+// Attempt describes what happened with a client while sending a message
+type Attempt struct {
+	Provider string `json:"provider"`
+
+	// Cost is an estimated cost of a message with RoutingCost
+	Cost float64 `json:"cost,omitempty"`
+
+	// Unhealthy is true when a client recently failed,
+	// such clients are tried after healthy ones
+	Unhealthy bool `json:"unhealthy,omitempty"`
+
+	// Skipped explains why a client was not used, e.g. "rate limit"
+	Skipped string `json:"skipped,omitempty"`
+
+	// Error is an error of a client with its class
+	Error string `json:"error,omitempty"`
+	Class string `json:"class,omitempty"`
+}
+
+// routeEntry is a client with its place in a route
+type routeEntry struct {
+	client  emailclient.EmailClient
+	attempt Attempt
+}
+
+// route orders clients, healthy clients are first, then they are ordered
+// by cost with RoutingCost and by an order of EmailClients
+func (em *EmailManager) route(recipients, size int, now time.Time) []*routeEntry {
+	em.mu.Lock()
+	defer em.mu.Unlock()
+	em.rollVolumes(now)
+
+	entries := make([]*routeEntry, 0, len(em.EmailClients))
+	for _, ec := range em.EmailClients {
+		name := ec.ProviderName()
+		entry := &routeEntry{
+			client:  ec,
+			attempt: Attempt{Provider: name},
+		}
+		if h, ok := em.health[name]; ok && now.Before(h.unhealthyUntil) {
+			entry.attempt.Unhealthy = true
+		}
+		if em.Routing == RoutingCost {
+			entry.attempt.Cost = em.cost(name, recipients, size)
+		}
+		entries = append(entries, entry)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i].attempt, entries[j].attempt
+		if a.Unhealthy != b.Unhealthy {
+			return !a.Unhealthy
+		}
+		return a.Cost < b.Cost
+	})
+
+	return entries
+}
+
+// cost estimates a cost of a message, it is free
+// when it fits in a volume included in a plan
+// It has to be called with a lock held.
+func (em *EmailManager) cost(provider string, recipients, size int) float64 {
+	price, ok := em.Pricing[provider]
+	if !ok {
+		return 0
+	}
+	if price.IncludedPerMonth > 0 && em.volumes[provider]+int64(recipients) <= price.IncludedPerMonth {
+		return 0
+	}
+
+	return price.Cost(1, int64(recipients), int64(size))
+}
+
+// rollVolumes clears volumes when a month is over
+// It has to be called with a lock held.
+func (em *EmailManager) rollVolumes(now time.Time) {
+	month := now.UTC().Format("2006-01")
+	if em.month != month || em.volumes == nil {
+		em.month = month
+		em.volumes = map[string]int64{}
+	}
+}
+
+// AddVolume adds recipients sent by a provider in a current month,
+// e.g. from usage records when a service starts
+func (em *EmailManager) AddVolume(provider string, recipients int64) {
+	em.mu.Lock()
+	defer em.mu.Unlock()
+
+	em.rollVolumes(time.Now())
+	em.volumes[provider] += recipients
+}
+
+// report updates a health of a client after it was used
+func (em *EmailManager) report(provider string, err error, now time.Time) {
+	em.mu.Lock()
+	defer em.mu.Unlock()
+
+	if em.health == nil {
+		em.health = map[string]*health{}
+	}
+	h, ok := em.health[provider]
+	if !ok {
+		h = &health{}
+		em.health[provider] = h
+	}
+	if err == nil {
+		h.failures = 0
+		h.unhealthyUntil = time.Time{}
+		return
+	}
+
+	switch emailclient.ClassOf(err) {
+	case emailclient.ClassThrottled:
+		h.unhealthyUntil = now.Add(throttledCooldown)
+	case emailclient.ClassConfiguration:
+		h.unhealthyUntil = now.Add(configurationCooldown)
+	case emailclient.ClassTemporary:
+		h.failures++
+		if h.failures >= maxTemporaryFailures {
+			h.unhealthyUntil = now.Add(temporaryCooldown)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package emailmanager
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mikolajb/emailserv/internal/emailclient"
+	"github.com/mikolajb/emailserv/internal/usage"
+	"go.uber.org/zap/zaptest"
+)
+
+// fakeClient is a client returning errors in turn, then succeeding
+type fakeClient struct {
+	name  string
+	errs  []error
+	calls int
+}
+
+func (fc *fakeClient) Send(ctx context.Context, sender string, recipients []string, subject string, opts ...emailclient.EmailOption) (string, error) {
+	fc.calls++
+	if len(fc.errs) > 0 {
+		err := fc.errs[0]
+		fc.errs = fc.errs[1:]
+		return "", err
+	}
+	return fc.name + "-id", nil
+}
+
+func (fc *fakeClient) ProviderName() string {
+	return fc.name
+}
+
+func providers(attempts []Attempt) []string {
+	var result []string
+	for _, a := range attempts {
+		result = append(result, a.Provider)
+	}
+	return result
+}
+
+func TestEmailManager_Send_costRouting(t *testing.T) {
+	aws := &fakeClient{name: "aws"}
+	sendgrid := &fakeClient{name: "sendgrid"}
+	em := &EmailManager{
+		Logger:        zaptest.NewLogger(t),
+		EmailClients:  []emailclient.EmailClient{aws, sendgrid},
+		ClientTimeout: 100 * time.Millisecond,
+		Routing:       RoutingCost,
+		Pricing: usage.Pricing{
+			"aws":      {PerRecipient: 0.0001},
+			"sendgrid": {PerRecipient: 0.001, IncludedPerMonth: 100},
+		},
+	}
+	em.AddVolume("sendgrid", 98)
+
+	expected := []string{
+		// a plan allowance is cheaper
+		"sendgrid",
+		// a message with 2 recipients does not fit in it
+		"aws",
+		// the last recipient of the allowance
+		"sendgrid",
+		// the allowance is used up
+		"aws",
+	}
+	recipients := [][]string{{"a"}, {"a", "b"}, {"a"}, {"a"}}
+	for i := range expected {
+		result, err := em.Send(context.Background(), "sender", recipients[i], "subject")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		if result.Provider != expected[i] || result.Routing != RoutingCost {
+			t.Errorf("message %d: expected provider %s, got: %+v", i, expected[i], result)
+		}
+	}
+}
+
+func TestEmailManager_Send_health(t *testing.T) {
+	throttled := &emailclient.Error{Class: emailclient.ClassThrottled, Err: errors.New("throttled")}
+	first := &fakeClient{name: "first", errs: []error{throttled}}
+	second := &fakeClient{name: "second"}
+	em := &EmailManager{
+		Logger:        zaptest.NewLogger(t),
+		EmailClients:  []emailclient.EmailClient{first, second},
+		ClientTimeout: 100 * time.Millisecond,
+	}
+
+	result, err := em.Send(context.Background(), "sender", []string{"a"}, "subject")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if p := providers(result.Attempts); len(p) != 2 || result.Provider != "second" || result.Attempts[0].Class != "throttled" {
+		t.Errorf("a throttled client should fail over, got: %+v", result)
+	}
+
+	// a throttled client is tried last until it cools down
+	result, err = em.Send(context.Background(), "sender", []string{"a"}, "subject")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if result.Provider != "second" || first.calls != 1 {
+		t.Errorf("an unhealthy client should be tried last, got: %+v", result)
+	}
+	em.health["first"].unhealthyUntil = time.Now().Add(-time.Second)
+	result, err = em.Send(context.Background(), "sender", []string{"a"}, "subject")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if result.Provider != "first" {
+		t.Errorf("a client should be used after a cooldown, got: %+v", result)
+	}
+}
+
+func TestEmailManager_Send_permanent(t *testing.T) {
+	rejected := &emailclient.Error{Class: emailclient.ClassPermanent, Err: errors.New("rejected")}
+	first := &fakeClient{name: "first", errs: []error{rejected}}
+	second := &fakeClient{name: "second"}
+	em := &EmailManager{
+		Logger:        zaptest.NewLogger(t),
+		EmailClients:  []emailclient.EmailClient{first, second},
+		ClientTimeout: 100 * time.Millisecond,
+	}
+
+	_, err := em.Send(context.Background(), "sender", []string{"a"}, "subject")
+	if emailclient.ClassOf(err) != emailclient.ClassPermanent {
+		t.Errorf("expected a permanent error, got: %v", err)
+	}
+	if second.calls != 0 {
+		t.Errorf("a rejected message should not be sent by other clients")
+	}
+}
+
+func TestEmailManager_Send_requiredProvider(t *testing.T) {
+	cases := map[string]struct {
+		options emailclient.SendgridOptions
+	}{
+		"template": {
+			options: emailclient.SendgridOptions{TemplateID: "d-123"},
+		},
+		"sandbox": {
+			options: emailclient.SendgridOptions{SandboxMode: true},
+		},
+		"asm group": {
+			options: emailclient.SendgridOptions{ASMGroupID: 42},
+		},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			aws := &fakeClient{name: "aws"}
+			sendgrid := &fakeClient{name: "sendgrid"}
+			em := &EmailManager{
+				Logger:        zaptest.NewLogger(t),
+				EmailClients:  []emailclient.EmailClient{aws, sendgrid},
+				ClientTimeout: 100 * time.Millisecond,
+			}
+
+			result, err := em.Send(context.Background(), "sender", []string{"a"}, "subject", emailclient.WithSendgrid(c.options))
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if result.Provider != "sendgrid" || aws.calls != 0 {
+				t.Errorf("a message should only be sent by sendgrid, got: %+v", result)
+			}
+			if result.Attempts[0].Skipped != "requires sendgrid" {
+				t.Errorf("aws should be skipped, got: %+v", result.Attempts[0])
+			}
+		})
+	}
+
+	t.Run("categories", func(t *testing.T) {
+		aws := &fakeClient{name: "aws"}
+		sendgrid := &fakeClient{name: "sendgrid"}
+		em := &EmailManager{
+			Logger:        zaptest.NewLogger(t),
+			EmailClients:  []emailclient.EmailClient{aws, sendgrid},
+			ClientTimeout: 100 * time.Millisecond,
+		}
+
+		options := emailclient.WithSendgrid(emailclient.SendgridOptions{Categories: []string{"welcome"}})
+		result, err := em.Send(context.Background(), "sender", []string{"a"}, "subject", options)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		if result.Provider != "aws" {
+			t.Errorf("categories should not require sendgrid, got: %+v", result)
+		}
+	})
+
+	t.Run("not configured", func(t *testing.T) {
+		aws := &fakeClient{name: "aws"}
+		em := &EmailManager{
+			Logger:        zaptest.NewLogger(t),
+			EmailClients:  []emailclient.EmailClient{aws},
+			ClientTimeout: 100 * time.Millisecond,
+		}
+
+		options := emailclient.WithSendgrid(emailclient.SendgridOptions{SandboxMode: true})
+		_, err := em.Send(context.Background(), "sender", []string{"a"}, "subject", options)
+		if e, ok := err.(*ProviderRequiredError); !ok || e.Provider != "sendgrid" {
+			t.Errorf("expected ProviderRequiredError, got: %v", err)
+		}
+		if aws.calls != 0 {
+			t.Errorf("aws should not be called")
+		}
+	})
+}
@@ -0,0 +1,51 @@
+// Package events holds a provider-neutral model of events
+// reported by email providers, e.g. deliveries and bounces.
+package events
+
+import "time"
+
+// Type is a type of an event
+type Type string
+
+// Event types
+const (
+	TypeSent         Type = "sent"
+	TypeDelivered    Type = "delivered"
+	TypeDeferred     Type = "deferred"
+	TypeBounced      Type = "bounced"
+	TypeComplained   Type = "complained"
+	TypeDropped      Type = "dropped"
+	TypeUnsubscribed Type = "unsubscribed"
+	TypeFailed       Type = "failed"
+)
+
+// Event is something that happened to a message for a single recipient
+type Event struct {
+	// Type is a type of an event, e.g. "bounced"
+	Type Type `json:"type"`
+
+	// Provider is a name of a provider reporting an event, e.g. "aws"
+	Provider string `json:"provider"`
+
+	// ProviderMessageID is an ID assigned to a message by a provider
+	ProviderMessageID string `json:"provider_message_id,omitempty"`
+
+	// MessageID is an ID assigned to a message by the service,
+	// it is known when a provider passes it back in tags or custom arguments
+	MessageID string `json:"message_id,omitempty"`
+
+	// RequestID is an ID of a request which sent a message, when known
+	RequestID string `json:"request_id,omitempty"`
+
+	// Recipient is an address an event is about
+	Recipient string `json:"recipient,omitempty"`
+
+	// Reason is a diagnostic information, e.g. an SMTP response
+	Reason string `json:"reason,omitempty"`
+
+	// Permanent is true for bounces which will not succeed on retry
+	Permanent bool `json:"permanent,omitempty"`
+
+	// Timestamp is a time of an event reported by a provider
+	Timestamp time.Time `json:"timestamp"`
+}
@@ -0,0 +1,79 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// sendgridEvent is a single event of a SendGrid Event Webhook batch,
+// custom arguments set when sending are top level fields
+type sendgridEvent struct {
+	Event       string `json:"event"`
+	Email       string `json:"email"`
+	Timestamp   int64  `json:"timestamp"`
+	SGMessageID string `json:"sg_message_id"`
+	Type        string `json:"type"`
+	Reason      string `json:"reason"`
+	Response    string `json:"response"`
+	MessageID   string `json:"message_id"`
+	RequestID   string `json:"request_id"`
+}
+
+// sendgridTypes maps SendGrid events to event types,
+// other events (e.g. opens and clicks) are ignored
+var sendgridTypes = map[string]Type{
+	"delivered":   TypeDelivered,
+	"deferred":    TypeDeferred,
+	"bounce":      TypeBounced,
+	"dropped":     TypeDropped,
+	"spamreport":  TypeComplained,
+	"unsubscribe": TypeUnsubscribed,
+}
+
+// ParseSendGrid parses a batch of SendGrid Event Webhook events
+func ParseSendGrid(data []byte) ([]Event, error) {
+	var batch []sendgridEvent
+	if err := json.Unmarshal(data, &batch); err != nil {
+		return nil, fmt.Errorf("invalid SendGrid events: %s", err.Error())
+	}
+
+	var result []Event
+	for _, se := range batch {
+		t, ok := sendgridTypes[se.Event]
+		if !ok {
+			continue
+		}
+		e := Event{
+			Type:              t,
+			Provider:          "sendgrid",
+			ProviderMessageID: SendGridMessageID(se.SGMessageID),
+			MessageID:         se.MessageID,
+			RequestID:         se.RequestID,
+			Recipient:         se.Email,
+			Reason:            se.Reason,
+			Timestamp:         time.Unix(se.Timestamp, 0).UTC(),
+		}
+		if e.Reason == "" {
+			e.Reason = se.Response
+		}
+		// "blocked" bounces are temporary, older payloads have no type
+		if t == TypeBounced {
+			e.Permanent = se.Type != "blocked"
+		}
+		result = append(result, e)
+	}
+
+	return result, nil
+}
+
+// SendGridMessageID returns an ID of a message returned by SendGrid
+// in X-Message-Id header, events carry it followed by a filter suffix,
+// e.g. "14c5d75ce93.dfd.64b469.filter0001.16648.5515E0B88.0"
+func SendGridMessageID(sgMessageID string) string {
+	if i := strings.Index(sgMessageID, "."); i >= 0 {
+		return sgMessageID[:i]
+	}
+	return sgMessageID
+}
@@ -0,0 +1,96 @@
+package events
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseSendGrid(t *testing.T) {
+	payload, err := ioutil.ReadFile(filepath.Join("testdata", "sendgrid_events.json"))
+	if err != nil {
+		t.Fatalf("cannot read fixture: %s", err.Error())
+	}
+
+	expected := []Event{
+		{
+			Type:              TypeDelivered,
+			Provider:          "sendgrid",
+			ProviderMessageID: "14c5d75ce93",
+			MessageID:         "message-1",
+			RequestID:         "request-1",
+			Recipient:         "a@example.com",
+			Reason:            "250 OK",
+			Timestamp:         time.Date(2018, 5, 10, 12, 0, 3, 0, time.UTC),
+		},
+		{
+			Type:              TypeBounced,
+			Provider:          "sendgrid",
+			ProviderMessageID: "14c5d75ce93",
+			MessageID:         "message-1",
+			RequestID:         "request-1",
+			Recipient:         "bounced@example.com",
+			Reason:            "550 5.1.1 user unknown",
+			Permanent:         true,
+			Timestamp:         time.Date(2018, 5, 10, 12, 0, 4, 0, time.UTC),
+		},
+		{
+			Type:              TypeBounced,
+			Provider:          "sendgrid",
+			ProviderMessageID: "14c5d75ce93",
+			Recipient:         "blocked@example.com",
+			Reason:            "421 try again later",
+			Timestamp:         time.Date(2018, 5, 10, 12, 0, 5, 0, time.UTC),
+		},
+		{
+			Type:              TypeDropped,
+			Provider:          "sendgrid",
+			ProviderMessageID: "14c5d75ce93",
+			Recipient:         "dropped@example.com",
+			Reason:            "Bounced Address",
+			Timestamp:         time.Date(2018, 5, 10, 12, 0, 6, 0, time.UTC),
+		},
+		{
+			Type:              TypeComplained,
+			Provider:          "sendgrid",
+			ProviderMessageID: "14c5d75ce93",
+			Recipient:         "complained@example.com",
+			Timestamp:         time.Date(2018, 5, 10, 12, 0, 8, 0, time.UTC),
+		},
+		{
+			Type:              TypeUnsubscribed,
+			Provider:          "sendgrid",
+			ProviderMessageID: "14c5d75ce93",
+			Recipient:         "unsubscribed@example.com",
+			Timestamp:         time.Date(2018, 5, 10, 12, 0, 9, 0, time.UTC),
+		},
+	}
+
+	result, err := ParseSendGrid(payload)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if !reflect.DeepEqual(expected, result) {
+		t.Errorf("expected events %+v but got %+v", expected, result)
+	}
+
+	if _, err := ParseSendGrid([]byte(`{"event": "delivered"}`)); err == nil {
+		t.Errorf("expected an error for a payload which is not a batch")
+	}
+}
+
+func TestSendGridMessageID(t *testing.T) {
+	cases := map[string]string{
+		"14c5d75ce93.dfd.64b469.filter0001.16648.5515E0B88.0": "14c5d75ce93",
+		"14c5d75ce93": "14c5d75ce93",
+		"":            "",
+	}
+
+	for in, expected := range cases {
+		if got := SendGridMessageID(in); got != expected {
+			t.Errorf("expected %q for %q, got %q", expected, in, got)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// sesNotification is a notification published by SES to SNS,
+// notificationType is used by identity notifications
+// and eventType by configuration set event publishing
+type sesNotification struct {
+	NotificationType string `json:"notificationType"`
+	EventType        string `json:"eventType"`
+	Mail             struct {
+		MessageID string              `json:"messageId"`
+		Timestamp time.Time           `json:"timestamp"`
+		Tags      map[string][]string `json:"tags"`
+	} `json:"mail"`
+	Bounce *struct {
+		BounceType        string    `json:"bounceType"`
+		BounceSubType     string    `json:"bounceSubType"`
+		Timestamp         time.Time `json:"timestamp"`
+		BouncedRecipients []struct {
+			EmailAddress   string `json:"emailAddress"`
+			DiagnosticCode string `json:"diagnosticCode"`
+		} `json:"bouncedRecipients"`
+	} `json:"bounce"`
+	Complaint *struct {
+		ComplaintFeedbackType string    `json:"complaintFeedbackType"`
+		Timestamp             time.Time `json:"timestamp"`
+		ComplainedRecipients  []struct {
+			EmailAddress string `json:"emailAddress"`
+		} `json:"complainedRecipients"`
+	} `json:"complaint"`
+	Delivery *struct {
+		Timestamp    time.Time `json:"timestamp"`
+		Recipients   []string  `json:"recipients"`
+		SMTPResponse string    `json:"smtpResponse"`
+	} `json:"delivery"`
+}
+
+// ParseSES parses an SES Bounce, Complaint or Delivery notification,
+// other notifications are ignored
+func ParseSES(data []byte) ([]Event, error) {
+	var n sesNotification
+	if err := json.Unmarshal(data, &n); err != nil {
+		return nil, fmt.Errorf("invalid SES notification: %s", err.Error())
+	}
+
+	notificationType := n.NotificationType
+	if notificationType == "" {
+		notificationType = n.EventType
+	}
+
+	base := Event{
+		Provider:          "aws",
+		ProviderMessageID: n.Mail.MessageID,
+		MessageID:         tag(n.Mail.Tags, "message_id"),
+		RequestID:         tag(n.Mail.Tags, "request_id"),
+	}
+
+	var result []Event
+	switch notificationType {
+	case "Bounce":
+		if n.Bounce == nil {
+			return nil, fmt.Errorf("bounce notification without bounce details")
+		}
+		for _, r := range n.Bounce.BouncedRecipients {
+			e := base
+			e.Type = TypeBounced
+			e.Recipient = r.EmailAddress
+			e.Reason = r.DiagnosticCode
+			if e.Reason == "" {
+				e.Reason = n.Bounce.BounceType + "/" + n.Bounce.BounceSubType
+			}
+			e.Permanent = n.Bounce.BounceType == "Permanent"
+			e.Timestamp = n.Bounce.Timestamp
+			result = append(result, e)
+		}
+	case "Complaint":
+		if n.Complaint == nil {
+			return nil, fmt.Errorf("complaint notification without complaint details")
+		}
+		for _, r := range n.Complaint.ComplainedRecipients {
+			e := base
+			e.Type = TypeComplained
+			e.Recipient = r.EmailAddress
+			e.Reason = n.Complaint.ComplaintFeedbackType
+			e.Timestamp = n.Complaint.Timestamp
+			result = append(result, e)
+		}
+	case "Delivery":
+		if n.Delivery == nil {
+			return nil, fmt.Errorf("delivery notification without delivery details")
+		}
+		for _, r := range n.Delivery.Recipients {
+			e := base
+			e.Type = TypeDelivered
+			e.Recipient = r
+			e.Reason = n.Delivery.SMTPResponse
+			e.Timestamp = n.Delivery.Timestamp
+			result = append(result, e)
+		}
+	}
+
+	return result, nil
+}
+
+func tag(tags map[string][]string, name string) string {
+	if values := tags[name]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
@@ -0,0 +1,105 @@
+package events
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseSES(t *testing.T) {
+	cases := map[string]struct {
+		fixture  string
+		payload  string
+		expected []Event
+		err      bool
+	}{
+		"bounce": {
+			fixture: "ses_bounce.json",
+			expected: []Event{{
+				Type:              TypeBounced,
+				Provider:          "aws",
+				ProviderMessageID: "0102015a23e1b5c4-ses-message-id",
+				MessageID:         "message-1",
+				RequestID:         "request-1",
+				Recipient:         "bounced@example.com",
+				Reason:            "smtp; 550 5.1.1 user unknown",
+				Permanent:         true,
+				Timestamp:         time.Date(2018, 5, 10, 12, 0, 1, 0, time.UTC),
+			}},
+		},
+		"complaint": {
+			fixture: "ses_complaint.json",
+			expected: []Event{{
+				Type:              TypeComplained,
+				Provider:          "aws",
+				ProviderMessageID: "0102015a23e1b5c4-ses-message-id",
+				Recipient:         "complained@example.com",
+				Reason:            "abuse",
+				Timestamp:         time.Date(2018, 5, 10, 12, 5, 0, 0, time.UTC),
+			}},
+		},
+		"delivery": {
+			fixture: "ses_delivery.json",
+			expected: []Event{
+				{
+					Type:              TypeDelivered,
+					Provider:          "aws",
+					ProviderMessageID: "0102015a23e1b5c4-ses-message-id",
+					MessageID:         "message-1",
+					Recipient:         "a@example.com",
+					Reason:            "250 2.6.0 Message received",
+					Timestamp:         time.Date(2018, 5, 10, 12, 0, 2, 0, time.UTC),
+				},
+				{
+					Type:              TypeDelivered,
+					Provider:          "aws",
+					ProviderMessageID: "0102015a23e1b5c4-ses-message-id",
+					MessageID:         "message-1",
+					Recipient:         "b@example.com",
+					Reason:            "250 2.6.0 Message received",
+					Timestamp:         time.Date(2018, 5, 10, 12, 0, 2, 0, time.UTC),
+				},
+			},
+		},
+		"other": {
+			payload: `{"notificationType": "AmazonSnsSubscriptionSucceeded"}`,
+		},
+		"invalid": {
+			payload: `abc`,
+			err:     true,
+		},
+		"bounce-without-details": {
+			payload: `{"notificationType": "Bounce"}`,
+			err:     true,
+		},
+	}
+
+	for hint, c := range cases {
+		t.Run(hint, func(t *testing.T) {
+			payload := []byte(c.payload)
+			if c.fixture != "" {
+				var err error
+				payload, err = ioutil.ReadFile(filepath.Join("testdata", c.fixture))
+				if err != nil {
+					t.Fatalf("cannot read fixture: %s", err.Error())
+				}
+			}
+
+			result, err := ParseSES(payload)
+			if c.err {
+				if err == nil {
+					t.Errorf("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if !reflect.DeepEqual(c.expected, result) {
+				t.Errorf("expected events %+v but got %+v", c.expected, result)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+// Package eventwebhook verifies requests of SendGrid Signed Event Webhook.
+package eventwebhook
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"time"
+)
+
+const (
+	// SignatureHeader holds a base64 encoded ECDSA signature
+	SignatureHeader = "X-Twilio-Email-Event-Webhook-Signature"
+
+	// TimestampHeader holds a time a request was signed at, it is signed as well
+	TimestampHeader = "X-Twilio-Email-Event-Webhook-Timestamp"
+
+	// DefaultTolerance is how old a signed request can be
+	DefaultTolerance = 10 * time.Minute
+)
+
+// ErrInvalidSignature is returned when a signature does not match a payload
+var ErrInvalidSignature = errors.New("invalid signature")
+
+// Verifier checks signatures with a public key
+// shown in SendGrid Mail Settings
+type Verifier struct {
+	publicKey *ecdsa.PublicKey
+	tolerance time.Duration
+	now       func() time.Time
+}
+
+// NewVerifier creates a verifier for a base64 encoded public key,
+// requests older than tolerance are rejected, tolerance 0 disables the check
+func NewVerifier(publicKey string, tolerance time.Duration) (*Verifier, error) {
+	der, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key encoding: %s", err.Error())
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %s", err.Error())
+	}
+	ecdsaKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("public key is not an ECDSA key")
+	}
+
+	return &Verifier{
+		publicKey: ecdsaKey,
+		tolerance: tolerance,
+		now:       time.Now,
+	}, nil
+}
+
+// Verify checks a signature of a timestamp followed by a raw request body
+func (v *Verifier) Verify(payload []byte, signature, timestamp string) error {
+	if signature == "" || timestamp == "" {
+		return fmt.Errorf("missing signature or timestamp")
+	}
+
+	if v.tolerance > 0 {
+		seconds, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid timestamp: %s", timestamp)
+		}
+		age := v.now().Sub(time.Unix(seconds, 0))
+		if age > v.tolerance || age < -v.tolerance {
+			return fmt.Errorf("timestamp outside of tolerance: %s", timestamp)
+		}
+	}
+
+	der, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding: %s", err.Error())
+	}
+	var rs struct {
+		R, S *big.Int
+	}
+	if _, err := asn1.Unmarshal(der, &rs); err != nil {
+		return fmt.Errorf("invalid signature: %s", err.Error())
+	}
+
+	h := sha256.New()
+	h.Write([]byte(timestamp))
+	h.Write(payload)
+	if !ecdsa.Verify(v.publicKey, h.Sum(nil), rs.R, rs.S) {
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
@@ -0,0 +1,133 @@
+package eventwebhook
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"math/big"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func sign(t *testing.T, key *ecdsa.PrivateKey, timestamp string, payload []byte) string {
+	t.Helper()
+
+	h := sha256.Sum256(append([]byte(timestamp), payload...))
+	r, s, err := ecdsa.Sign(rand.Reader, key, h[:])
+	if err != nil {
+		t.Fatalf("cannot sign: %s", err.Error())
+	}
+	signature, err := asn1.Marshal(struct{ R, S *big.Int }{r, s})
+	if err != nil {
+		t.Fatalf("cannot encode signature: %s", err.Error())
+	}
+
+	return base64.StdEncoding.EncodeToString(signature)
+}
+
+func TestVerifier(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate key: %s", err.Error())
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("cannot marshal key: %s", err.Error())
+	}
+
+	verifier, err := NewVerifier(base64.StdEncoding.EncodeToString(der), DefaultTolerance)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	now := time.Unix(1525953600, 0)
+	verifier.now = func() time.Time { return now }
+
+	payload := []byte(`[{"event":"delivered","email":"a@example.com"}]`)
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	old := strconv.FormatInt(now.Add(-time.Hour).Unix(), 10)
+
+	cases := map[string]struct {
+		payload   []byte
+		signature string
+		timestamp string
+		err       bool
+	}{
+		"valid": {
+			payload:   payload,
+			signature: sign(t, key, timestamp, payload),
+			timestamp: timestamp,
+		},
+		"modified-payload": {
+			payload:   []byte(`[{"event":"delivered","email":"b@example.com"}]`),
+			signature: sign(t, key, timestamp, payload),
+			timestamp: timestamp,
+			err:       true,
+		},
+		"modified-timestamp": {
+			payload:   payload,
+			signature: sign(t, key, timestamp, payload),
+			timestamp: strconv.FormatInt(now.Unix()+1, 10),
+			err:       true,
+		},
+		"old": {
+			payload:   payload,
+			signature: sign(t, key, old, payload),
+			timestamp: old,
+			err:       true,
+		},
+		"missing-signature": {
+			payload:   payload,
+			timestamp: timestamp,
+			err:       true,
+		},
+		"invalid-signature": {
+			payload:   payload,
+			signature: "abc",
+			timestamp: timestamp,
+			err:       true,
+		},
+	}
+
+	for hint, c := range cases {
+		t.Run(hint, func(t *testing.T) {
+			err := verifier.Verify(c.payload, c.signature, c.timestamp)
+			if c.err && err == nil {
+				t.Errorf("expected an error")
+			}
+			if !c.err && err != nil {
+				t.Errorf("unexpected error: %s", err.Error())
+			}
+		})
+	}
+}
+
+func TestNewVerifier(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("cannot generate key: %s", err.Error())
+	}
+	der, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatalf("cannot marshal key: %s", err.Error())
+	}
+
+	cases := map[string]string{
+		"not-base64": "!!!",
+		"not-a-key":  base64.StdEncoding.EncodeToString([]byte("abc")),
+		"rsa-key":    base64.StdEncoding.EncodeToString(der),
+	}
+
+	for hint, key := range cases {
+		t.Run(hint, func(t *testing.T) {
+			if _, err := NewVerifier(key, DefaultTolerance); err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+// Package idempotency remembers outcomes of requests sent with
+// an Idempotency-Key header, so retries do not send emails twice.
+package idempotency
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/mikolajb/emailserv/internal/storage"
+)
+
+const bucket = "idempotency"
+
+var (
+	// ErrInFlight is returned when a request with the same key is being processed
+	ErrInFlight = errors.New("request with the same idempotency key is in progress")
+
+	// ErrMismatch is returned when a key is reused with a different request
+	ErrMismatch = errors.New("idempotency key was used with a different request")
+)
+
+// Record is an outcome of a request
+type Record struct {
+	Key         string    `json:"key"`
+	RequestHash string    `json:"request_hash"`
+	Status      int       `json:"status"`
+	Body        []byte    `json:"body"`
+	CreatedAt   time.Time `json:"created_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// Keeper holds a state of idempotency keys
+type Keeper struct {
+	store    storage.Store
+	ttl      time.Duration
+	now      func() time.Time
+	mu       sync.Mutex
+	inFlight map[string]string
+}
+
+// NewKeeper returns a new Keeper remembering outcomes for a given time
+func NewKeeper(store storage.Store, ttl time.Duration) *Keeper {
+	return &Keeper{
+		store:    store,
+		ttl:      ttl,
+		now:      time.Now,
+		inFlight: map[string]string{},
+	}
+}
+
+// Hash returns a hash of a request body
+func Hash(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// storeKey returns a key of a record, keys are scoped by API key names,
+// so callers using the same idempotency key do not share responses
+func storeKey(apiKey, key string) string {
+	return apiKey + ":" + key
+}
+
+// Begin returns a stored record when a request of an API key can be
+// replayed, otherwise it locks a key until Complete or Release is called
+// and returns nil
+func (k *Keeper) Begin(apiKey, key, requestHash string) (*Record, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	key = storeKey(apiKey, key)
+
+	if hash, ok := k.inFlight[key]; ok {
+		if hash != requestHash {
+			return nil, ErrMismatch
+		}
+		return nil, ErrInFlight
+	}
+
+	var record Record
+	err := k.store.Get(bucket, key, &record)
+	switch {
+	case err == storage.ErrNotFound:
+	case err != nil:
+		return nil, err
+	case k.now().Before(record.ExpiresAt):
+		if record.RequestHash != requestHash {
+			return nil, ErrMismatch
+		}
+		return &record, nil
+	}
+
+	k.inFlight[key] = requestHash
+	return nil, nil
+}
+
+// Complete stores an outcome of a request and unlocks a key
+func (k *Keeper) Complete(apiKey, key string, status int, body []byte) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	key = storeKey(apiKey, key)
+
+	requestHash, ok := k.inFlight[key]
+	if !ok {
+		return errors.New("idempotency key is not locked")
+	}
+	delete(k.inFlight, key)
+
+	now := k.now()
+	return k.store.Put(bucket, key, &Record{
+		Key:         key,
+		RequestHash: requestHash,
+		Status:      status,
+		Body:        body,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(k.ttl),
+	})
+}
+
+// Release unlocks a key without storing an outcome,
+// so a request can be retried
+func (k *Keeper) Release(apiKey, key string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	delete(k.inFlight, storeKey(apiKey, key))
+}
+
+// Purge removes expired records
+func (k *Keeper) Purge() (int, error) {
+	now := k.now()
+	var expired []string
+	err := k.store.List(bucket, func(key string, decode func(v interface{}) error) error {
+		var record Record
+		if err := decode(&record); err != nil {
+			return err
+		}
+		if !now.Before(record.ExpiresAt) {
+			expired = append(expired, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, key := range expired {
+		if err := k.store.Delete(bucket, key); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(expired), nil
+}
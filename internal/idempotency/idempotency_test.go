@@ -0,0 +1,96 @@
+package idempotency
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mikolajb/emailserv/internal/storage"
+)
+
+func TestKeeper(t *testing.T) {
+	now := time.Date(2018, 5, 10, 12, 0, 0, 0, time.UTC)
+	keeper := NewKeeper(storage.NewMemoryStore(), time.Hour)
+	keeper.now = func() time.Time { return now }
+
+	hash := Hash([]byte("body"))
+	otherHash := Hash([]byte("other body"))
+
+	record, err := keeper.Begin("team", "key", hash)
+	if record != nil || err != nil {
+		t.Fatalf("expected a key to be locked, got %v, %v", record, err)
+	}
+
+	if _, err := keeper.Begin("team", "key", hash); err != ErrInFlight {
+		t.Errorf("expected '%v' but got '%v'", ErrInFlight, err)
+	}
+	if _, err := keeper.Begin("team", "key", otherHash); err != ErrMismatch {
+		t.Errorf("expected '%v' but got '%v'", ErrMismatch, err)
+	}
+
+	if err := keeper.Complete("team", "key", 201, []byte("response")); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	record, err = keeper.Begin("team", "key", hash)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if record == nil || record.Status != 201 || string(record.Body) != "response" {
+		t.Errorf("expected a stored response, got %v", record)
+	}
+
+	if _, err := keeper.Begin("team", "key", otherHash); err != ErrMismatch {
+		t.Errorf("expected '%v' but got '%v'", ErrMismatch, err)
+	}
+
+	if record, err := keeper.Begin("team", "released", hash); record != nil || err != nil {
+		t.Fatalf("expected a key to be locked, got %v, %v", record, err)
+	}
+	keeper.Release("team", "released")
+	if record, err := keeper.Begin("team", "released", otherHash); record != nil || err != nil {
+		t.Errorf("expected a released key to be locked again, got %v, %v", record, err)
+	}
+
+	now = now.Add(2 * time.Hour)
+	n, err := keeper.Purge()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if n != 1 {
+		t.Errorf("expected one expired record but got %d", n)
+	}
+	if record, err := keeper.Begin("team", "key", otherHash); record != nil || err != nil {
+		t.Errorf("expected an expired key to be locked again, got %v, %v", record, err)
+	}
+}
+
+func TestKeeper_apiKeys(t *testing.T) {
+	keeper := NewKeeper(storage.NewMemoryStore(), time.Hour)
+	hash := Hash([]byte("body"))
+	otherHash := Hash([]byte("other body"))
+
+	if record, err := keeper.Begin("team-a", "order-123", hash); record != nil || err != nil {
+		t.Fatalf("expected a key to be locked, got %v, %v", record, err)
+	}
+	if record, err := keeper.Begin("team-b", "order-123", otherHash); record != nil || err != nil {
+		t.Fatalf("expected a key of another API key to be locked, got %v, %v", record, err)
+	}
+
+	if err := keeper.Complete("team-a", "order-123", 201, []byte("response a")); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if err := keeper.Complete("team-b", "order-123", 201, []byte("response b")); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	record, err := keeper.Begin("team-b", "order-123", otherHash)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if record == nil || string(record.Body) != "response b" {
+		t.Errorf("expected a response of team-b, got %v", record)
+	}
+	if _, err := keeper.Begin("team-b", "order-123", hash); err != ErrMismatch {
+		t.Errorf("expected '%v' but got '%v'", ErrMismatch, err)
+	}
+}
@@ -0,0 +1,248 @@
+// Package messages keeps statuses of messages sent by the service.
+package messages
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/mikolajb/emailserv/internal/events"
+	"github.com/mikolajb/emailserv/internal/storage"
+)
+
+const (
+	bucket      = "messages"
+	indexBucket = "messages_by_provider_id"
+)
+
+// Status is a status of a message
+type Status string
+
+// Message statuses
+const (
+	StatusScheduled    Status = "scheduled"
+	StatusCanceled     Status = "canceled"
+	StatusSent         Status = "sent"
+	StatusDelivered    Status = "delivered"
+	StatusDeferred     Status = "deferred"
+	StatusBounced      Status = "bounced"
+	StatusComplained   Status = "complained"
+	StatusDropped      Status = "dropped"
+	StatusUnsubscribed Status = "unsubscribed"
+	StatusFailed       Status = "failed"
+)
+
+// HistoryEntry is a single status change
+type HistoryEntry struct {
+	Status    Status    `json:"status"`
+	Recipient string    `json:"recipient,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Record holds a status of a message
+type Record struct {
+	// ID is an ID of a message assigned by the service
+	ID string `json:"id"`
+
+	// RequestID is an ID of a request which created a message
+	RequestID string `json:"request_id,omitempty"`
+
+	// Key is a name of an API key which sent a message
+	Key string `json:"key,omitempty"`
+
+	// Provider is a name of a client which sent a message
+	Provider string `json:"provider,omitempty"`
+
+	// ProviderMessageID is an ID assigned to a message by a provider
+	ProviderMessageID string `json:"provider_message_id,omitempty"`
+
+	// Status is the latest status of a message
+	Status Status `json:"status"`
+
+	// SendAt is a time a scheduled message should be delivered at
+	SendAt *time.Time `json:"send_at,omitempty"`
+
+	// DeferredReason explains why a message is sent later than requested,
+	// e.g. "quiet hours 22:00-08:00 Europe/Warsaw"
+	DeferredReason string `json:"deferred_reason,omitempty"`
+
+	// Recipients holds the latest status of every recipient
+	// a provider reported on
+	Recipients map[string]Status `json:"recipients,omitempty"`
+
+	// History holds all status changes
+	History []HistoryEntry `json:"history,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Store holds a state of message statuses
+type Store struct {
+	store storage.Store
+	now   func() time.Time
+}
+
+// NewStore returns a message store kept in a given store
+func NewStore(store storage.Store) *Store {
+	return &Store{
+		store: store,
+		now:   time.Now,
+	}
+}
+
+// NewID generates a random message ID
+func NewID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func indexKey(provider, providerMessageID string) string {
+	return provider + "/" + providerMessageID
+}
+
+// Create stores a new record
+func (s *Store) Create(record *Record) error {
+	now := s.now().UTC()
+	record.CreatedAt = now
+	record.UpdatedAt = now
+	record.History = append(record.History, HistoryEntry{
+		Status:    record.Status,
+		Timestamp: now,
+	})
+
+	if err := s.store.Put(bucket, record.ID, record); err != nil {
+		return err
+	}
+
+	return s.index(record)
+}
+
+func (s *Store) index(record *Record) error {
+	if record.Provider == "" || record.ProviderMessageID == "" {
+		return nil
+	}
+	return s.store.Put(
+		indexBucket,
+		indexKey(record.Provider, record.ProviderMessageID),
+		record.ID,
+	)
+}
+
+// Get returns a record or nil when it does not exist
+func (s *Store) Get(id string) (*Record, error) {
+	var record Record
+	err := s.store.Get(bucket, id, &record)
+	if err == storage.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &record, nil
+}
+
+// FindByProviderMessageID returns an ID of a message
+// with a given provider message ID or an empty string
+func (s *Store) FindByProviderMessageID(provider, providerMessageID string) (string, error) {
+	var id string
+	err := s.store.Get(indexBucket, indexKey(provider, providerMessageID), &id)
+	if err == storage.ErrNotFound {
+		return "", nil
+	}
+
+	return id, err
+}
+
+// Update modifies a record, it returns nil when a record does not exist
+func (s *Store) Update(id string, fn func(*Record) error) (*Record, error) {
+	var record Record
+	exists := true
+	err := s.store.Update(bucket, id, &record, func(found bool) error {
+		if !found {
+			exists = false
+			return storage.ErrNotFound
+		}
+		if err := fn(&record); err != nil {
+			return err
+		}
+		record.UpdatedAt = s.now().UTC()
+		return nil
+	})
+	if !exists {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &record, s.index(&record)
+}
+
+// ApplyEvent updates a status of a message an event is about,
+// it returns nil when a message is not known
+func (s *Store) ApplyEvent(e events.Event) (*Record, error) {
+	id := e.MessageID
+	if id == "" {
+		var err error
+		id, err = s.FindByProviderMessageID(e.Provider, e.ProviderMessageID)
+		if err != nil {
+			return nil, err
+		}
+		if id == "" {
+			return nil, nil
+		}
+	}
+
+	status := Status(e.Type)
+	return s.Update(id, func(r *Record) error {
+		if r.Provider == "" {
+			r.Provider = e.Provider
+		}
+		if r.ProviderMessageID == "" {
+			r.ProviderMessageID = e.ProviderMessageID
+		}
+		r.Status = status
+		if e.Recipient != "" {
+			if r.Recipients == nil {
+				r.Recipients = map[string]Status{}
+			}
+			r.Recipients[strings.ToLower(e.Recipient)] = status
+		}
+		timestamp := e.Timestamp
+		if timestamp.IsZero() {
+			timestamp = s.now().UTC()
+		}
+		r.History = append(r.History, HistoryEntry{
+			Status:    status,
+			Recipient: e.Recipient,
+			Reason:    e.Reason,
+			Timestamp: timestamp,
+		})
+		return nil
+	})
+}
+
+// SetStatus changes a status of a message and records it in a history,
+// fn can modify other fields, it can be nil
+// It returns nil when a message does not exist.
+func (s *Store) SetStatus(id string, status Status, reason string, fn func(*Record)) (*Record, error) {
+	return s.Update(id, func(r *Record) error {
+		if fn != nil {
+			fn(r)
+		}
+		r.Status = status
+		r.History = append(r.History, HistoryEntry{
+			Status:    status,
+			Reason:    reason,
+			Timestamp: s.now().UTC(),
+		})
+		return nil
+	})
+}
@@ -0,0 +1,119 @@
+package messages
+
+import (
+	"testing"
+
+	"github.com/mikolajb/emailserv/internal/events"
+	"github.com/mikolajb/emailserv/internal/storage"
+)
+
+func TestStore_ApplyEvent(t *testing.T) {
+	store := NewStore(storage.NewMemoryStore())
+	err := store.Create(&Record{
+		ID:                "message-1",
+		Provider:          "aws",
+		ProviderMessageID: "ses-1",
+		Status:            StatusSent,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	cases := map[string]struct {
+		event    events.Event
+		found    bool
+		expected Status
+	}{
+		"by-provider-message-id": {
+			event: events.Event{
+				Type:              events.TypeDelivered,
+				Provider:          "aws",
+				ProviderMessageID: "ses-1",
+				Recipient:         "A@example.com",
+			},
+			found:    true,
+			expected: StatusDelivered,
+		},
+		"by-message-id": {
+			event: events.Event{
+				Type:      events.TypeBounced,
+				Provider:  "aws",
+				MessageID: "message-1",
+				Recipient: "b@example.com",
+			},
+			found:    true,
+			expected: StatusBounced,
+		},
+		"unknown-provider-message-id": {
+			event: events.Event{
+				Type:              events.TypeDelivered,
+				Provider:          "sendgrid",
+				ProviderMessageID: "ses-1",
+			},
+		},
+		"unknown-message-id": {
+			event: events.Event{
+				Type:      events.TypeDelivered,
+				MessageID: "message-2",
+			},
+		},
+	}
+
+	for _, hint := range []string{"by-provider-message-id", "by-message-id", "unknown-provider-message-id", "unknown-message-id"} {
+		c := cases[hint]
+		t.Run(hint, func(t *testing.T) {
+			record, err := store.ApplyEvent(c.event)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if !c.found {
+				if record != nil {
+					t.Errorf("expected no record but got %v", record)
+				}
+				return
+			}
+			if record == nil {
+				t.Fatalf("expected a record")
+			}
+			if record.Status != c.expected {
+				t.Errorf("expected status %s but got %s", c.expected, record.Status)
+			}
+		})
+	}
+
+	record, err := store.Get("message-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if record.Recipients["a@example.com"] != StatusDelivered || record.Recipients["b@example.com"] != StatusBounced {
+		t.Errorf("unexpected recipient statuses %v", record.Recipients)
+	}
+	if len(record.History) != 3 {
+		t.Errorf("expected 3 history entries but got %d", len(record.History))
+	}
+}
+
+func TestStore_SetStatus(t *testing.T) {
+	store := NewStore(storage.NewMemoryStore())
+	if err := store.Create(&Record{ID: "message-1", Status: StatusScheduled}); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	record, err := store.SetStatus("message-1", StatusSent, "", func(r *Record) {
+		r.Provider = "aws"
+		r.ProviderMessageID = "ses-1"
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if record.Status != StatusSent || len(record.History) != 2 || record.History[1].Status != StatusSent {
+		t.Errorf("wrong record: %+v", record)
+	}
+	if id, _ := store.FindByProviderMessageID("aws", "ses-1"); id != "message-1" {
+		t.Errorf("a provider message ID should be indexed, got: %q", id)
+	}
+
+	if record, err := store.SetStatus("message-2", StatusSent, "", nil); record != nil || err != nil {
+		t.Errorf("expected no record, got: %v, %v", record, err)
+	}
+}
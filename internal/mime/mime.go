@@ -0,0 +1,492 @@
+// Package mime builds RFC 5322 messages with RFC 2045 MIME parts:
+// multipart trees, transfer encodings and RFC 2047 encoded headers.
+package mime
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Transfer encodings
+const (
+	Encoding7Bit            = "7bit"
+	EncodingQuotedPrintable = "quoted-printable"
+	EncodingBase64          = "base64"
+)
+
+const (
+	// maxLineLength is a maximum length of a line (RFC 5322)
+	maxLineLength = 998
+
+	// foldLength is a length lines are folded at when possible
+	foldLength = 78
+
+	// base64LineLength is a length of lines of base64 data (RFC 2045)
+	base64LineLength = 76
+
+	// encodedWordBytes is a number of bytes in a single base64
+	// encoded-word, it is shorter than 75 characters (RFC 2047)
+	encodedWordBytes = 45
+)
+
+// ErrLineTooLong is returned when a header line cannot be folded
+// to maxLineLength characters
+var ErrLineTooLong = errors.New("header line too long")
+
+// Header is a list of header fields, it keeps their order
+type Header struct {
+	fields []field
+}
+
+type field struct {
+	name  string
+	value string
+}
+
+// Set replaces all fields with a name by a single field
+func (h *Header) Set(name, value string) {
+	h.Del(name)
+	h.Add(name, value)
+}
+
+// Add adds a field, its value has to be already encoded, see EncodeWord
+func (h *Header) Add(name, value string) {
+	h.fields = append(h.fields, field{name: name, value: value})
+}
+
+// Get returns a value of the first field with a name
+func (h *Header) Get(name string) string {
+	for _, f := range h.fields {
+		if strings.EqualFold(f.name, name) {
+			return f.value
+		}
+	}
+
+	return ""
+}
+
+// Del removes all fields with a name
+func (h *Header) Del(name string) {
+	fields := h.fields[:0]
+	for _, f := range h.fields {
+		if !strings.EqualFold(f.name, name) {
+			fields = append(fields, f)
+		}
+	}
+	h.fields = fields
+}
+
+// writeTo writes folded fields followed by an empty line
+func (h *Header) writeTo(w io.Writer) error {
+	for _, f := range h.fields {
+		folded := fold(f.name + ": " + f.value)
+		for _, line := range strings.Split(folded, "\r\n") {
+			if len(line) > maxLineLength {
+				return fmt.Errorf("%s: %s", ErrLineTooLong.Error(), f.name)
+			}
+		}
+		if _, err := io.WriteString(w, folded+"\r\n"); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "\r\n")
+
+	return err
+}
+
+// fold folds a header line at spaces, so lines are not longer
+// than foldLength characters when possible
+func fold(line string) string {
+	var b strings.Builder
+	for len(line) > foldLength {
+		i := strings.LastIndexAny(line[:foldLength+1], " \t")
+		if i <= 0 || strings.TrimSpace(line[:i]) == "" {
+			// no place to fold before a limit, fold at the next space
+			j := strings.IndexAny(line[foldLength:], " \t")
+			if j < 0 {
+				break
+			}
+			i = foldLength + j
+		}
+		b.WriteString(line[:i])
+		b.WriteString("\r\n")
+		line = line[i:]
+	}
+	b.WriteString(line)
+
+	return b.String()
+}
+
+// EncodeWord encodes a header value as RFC 2047 encoded-words
+// when it has non-ASCII characters or words too long to be folded
+func EncodeWord(s string) string {
+	for _, word := range strings.Fields(s) {
+		if len(word) > foldLength {
+			return encodeWords(s)
+		}
+	}
+
+	return mime.QEncoding.Encode("utf-8", s)
+}
+
+// encodeWords encodes a value as base64 encoded-words separated by spaces,
+// a space between encoded-words is not a part of a decoded value
+func encodeWords(s string) string {
+	var words []string
+	for len(s) > 0 {
+		n := len(s)
+		if n > encodedWordBytes {
+			n = encodedWordBytes
+			// a character is not split between words
+			for n > 0 && !utf8.RuneStart(s[n]) {
+				n--
+			}
+		}
+		words = append(words, "=?utf-8?b?"+base64.StdEncoding.EncodeToString([]byte(s[:n]))+"?=")
+		s = s[n:]
+	}
+
+	return strings.Join(words, " ")
+}
+
+// Part is a MIME entity, a leaf with a body or a multipart with parts
+type Part struct {
+	Header Header
+
+	// Body is decoded content of a leaf part
+	Body []byte
+
+	// Encoding is a transfer encoding of Body,
+	// it is chosen by content when it is empty
+	Encoding string
+
+	// Parts are parts of a multipart
+	Parts []*Part
+
+	// boundary separates parts of a multipart
+	boundary string
+}
+
+// NewText returns a text part, e.g. of "plain" or "html" subtype
+func NewText(subtype, text string) *Part {
+	p := &Part{Body: []byte(text)}
+	p.Header.Set("Content-Type", mime.FormatMediaType("text/"+subtype, map[string]string{"charset": "utf-8"}))
+
+	return p
+}
+
+// NewAttachment returns a base64 encoded attachment, with a content ID
+// it is an inline part which an HTML part can refer to with cid:
+func NewAttachment(filename, contentType string, data []byte, contentID string) *Part {
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	p := &Part{Body: data, Encoding: EncodingBase64}
+	p.Header.Set("Content-Type", contentType)
+	disposition := "attachment"
+	if contentID != "" {
+		disposition = "inline"
+		p.Header.Set("Content-ID", "<"+contentID+">")
+	}
+	params := map[string]string{}
+	if filename != "" {
+		params["filename"] = filename
+	}
+	p.Header.Set("Content-Disposition", mime.FormatMediaType(disposition, params))
+
+	return p
+}
+
+// NewMultipart returns a multipart, e.g. of "mixed", "alternative"
+// or "related" subtype
+func NewMultipart(subtype string, parts ...*Part) *Part {
+	boundary := newBoundary()
+	p := &Part{Parts: parts, boundary: boundary}
+	p.Header.Set("Content-Type", mime.FormatMediaType("multipart/"+subtype, map[string]string{"boundary": boundary}))
+
+	return p
+}
+
+// newBoundary returns a random boundary, "=_" cannot appear
+// in quoted-printable or base64 data
+func newBoundary() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+
+	return "=_" + hex.EncodeToString(b)
+}
+
+// chooseEncoding returns 7bit for short ASCII lines,
+// otherwise quoted-printable
+func chooseEncoding(body []byte) string {
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		if len(line) > maxLineLength {
+			return EncodingQuotedPrintable
+		}
+		for _, c := range line {
+			if c >= 0x80 || (c < 0x20 && c != '\t' && c != '\r') {
+				return EncodingQuotedPrintable
+			}
+		}
+	}
+
+	return Encoding7Bit
+}
+
+// WriteTo writes a part with its header
+func (p *Part) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	err := p.write(cw)
+
+	return cw.n, err
+}
+
+func (p *Part) write(w io.Writer) error {
+	if len(p.Parts) > 0 {
+		if err := p.Header.writeTo(w); err != nil {
+			return err
+		}
+		for _, part := range p.Parts {
+			if _, err := io.WriteString(w, "--"+p.boundary+"\r\n"); err != nil {
+				return err
+			}
+			if err := part.write(w); err != nil {
+				return err
+			}
+			if _, err := io.WriteString(w, "\r\n"); err != nil {
+				return err
+			}
+		}
+		_, err := io.WriteString(w, "--"+p.boundary+"--\r\n")
+		return err
+	}
+
+	encoding := p.Encoding
+	if encoding == "" {
+		encoding = chooseEncoding(p.Body)
+	}
+	p.Header.Set("Content-Transfer-Encoding", encoding)
+	if err := p.Header.writeTo(w); err != nil {
+		return err
+	}
+
+	switch encoding {
+	case EncodingBase64:
+		encoded := base64.StdEncoding.EncodeToString(p.Body)
+		for len(encoded) > base64LineLength {
+			if _, err := io.WriteString(w, encoded[:base64LineLength]+"\r\n"); err != nil {
+				return err
+			}
+			encoded = encoded[base64LineLength:]
+		}
+		_, err := io.WriteString(w, encoded)
+		return err
+	case EncodingQuotedPrintable:
+		qw := quotedprintable.NewWriter(w)
+		if _, err := qw.Write(toCRLF(p.Body)); err != nil {
+			return err
+		}
+		return qw.Close()
+	case Encoding7Bit:
+		_, err := w.Write(toCRLF(p.Body))
+		return err
+	default:
+		return fmt.Errorf("unknown transfer encoding %q", encoding)
+	}
+}
+
+// toCRLF converts line endings to CRLF
+func toCRLF(b []byte) []byte {
+	b = bytes.Replace(b, []byte("\r\n"), []byte("\n"), -1)
+	return bytes.Replace(b, []byte("\n"), []byte("\r\n"), -1)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	n, err := cw.w.Write(b)
+	cw.n += int64(n)
+
+	return n, err
+}
+
+// Attachment is a file attached to a message
+type Attachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+
+	// ContentID makes an attachment inline, an HTML body
+	// can refer to it with "cid:" URLs
+	ContentID string
+}
+
+// Message is a message to build
+type Message struct {
+	From    string
+	To      []string
+	Cc      []string
+	ReplyTo []string
+	Subject string
+
+	// Bcc is only written for transports removing it, e.g. sendmail -t,
+	// others take bcc recipients from an envelope
+	Bcc []string
+
+	// Text and HTML are alternative bodies, at least one is required
+	Text string
+	HTML string
+
+	Attachments []Attachment
+
+	// Date is set to a current time when it is zero
+	Date time.Time
+
+	// MessageID is generated with a domain of From when it is empty
+	MessageID string
+
+	// Headers are additional headers, e.g. X-Request-ID,
+	// their values are encoded when needed
+	Headers map[string]string
+}
+
+// formatAddresses parses and formats addresses,
+// names are encoded as RFC 2047 encoded-words
+func formatAddresses(addresses []string) (string, error) {
+	formatted := make([]string, 0, len(addresses))
+	for _, a := range addresses {
+		address, err := mail.ParseAddress(a)
+		if err != nil {
+			return "", fmt.Errorf("invalid address %q: %s", a, err.Error())
+		}
+		formatted = append(formatted, address.String())
+	}
+
+	return strings.Join(formatted, ", "), nil
+}
+
+// NewMessageID returns a unique Message-ID with a given domain
+func NewMessageID(domain string) string {
+	b := make([]byte, 16)
+	rand.Read(b)
+
+	return "<" + hex.EncodeToString(b) + "@" + domain + ">"
+}
+
+// body builds a tree of a message body:
+// mixed(related(alternative(text, html), inline...), attachments...)
+// without multiparts which would have a single part
+func (m *Message) body() (*Part, error) {
+	var alternatives []*Part
+	if m.Text != "" {
+		alternatives = append(alternatives, NewText("plain", m.Text))
+	}
+	if m.HTML != "" {
+		alternatives = append(alternatives, NewText("html", m.HTML))
+	}
+	if len(alternatives) == 0 {
+		return nil, errors.New("message has no body")
+	}
+	body := alternatives[0]
+	if len(alternatives) > 1 {
+		body = NewMultipart("alternative", alternatives...)
+	}
+
+	var inline, attachments []*Part
+	for _, a := range m.Attachments {
+		part := NewAttachment(a.Filename, a.ContentType, a.Data, a.ContentID)
+		if a.ContentID != "" {
+			inline = append(inline, part)
+		} else {
+			attachments = append(attachments, part)
+		}
+	}
+	if len(inline) > 0 {
+		body = NewMultipart("related", append([]*Part{body}, inline...)...)
+	}
+	if len(attachments) > 0 {
+		body = NewMultipart("mixed", append([]*Part{body}, attachments...)...)
+	}
+
+	return body, nil
+}
+
+// Build returns a message in RFC 5322 format with CRLF line endings
+func (m *Message) Build() ([]byte, error) {
+	from, err := mail.ParseAddress(m.From)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sender %q: %s", m.From, err.Error())
+	}
+	body, err := m.body()
+	if err != nil {
+		return nil, err
+	}
+
+	var h Header
+	h.Set("From", from.String())
+	for _, a := range []struct {
+		name      string
+		addresses []string
+	}{
+		{"To", m.To},
+		{"Cc", m.Cc},
+		{"Bcc", m.Bcc},
+		{"Reply-To", m.ReplyTo},
+	} {
+		if len(a.addresses) == 0 {
+			continue
+		}
+		value, err := formatAddresses(a.addresses)
+		if err != nil {
+			return nil, err
+		}
+		h.Set(a.name, value)
+	}
+	h.Set("Subject", EncodeWord(m.Subject))
+
+	date := m.Date
+	if date.IsZero() {
+		date = time.Now()
+	}
+	h.Set("Date", date.Format(time.RFC1123Z))
+	messageID := m.MessageID
+	if messageID == "" {
+		messageID = NewMessageID(from.Address[strings.LastIndex(from.Address, "@")+1:])
+	}
+	h.Set("Message-ID", messageID)
+
+	names := make([]string, 0, len(m.Headers))
+	for name := range m.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		h.Set(name, EncodeWord(m.Headers[name]))
+	}
+	h.Set("MIME-Version", "1.0")
+
+	// a message header is followed by a header of its body
+	body.Header.fields = append(h.fields, body.Header.fields...)
+
+	var b bytes.Buffer
+	if _, err := body.WriteTo(&b); err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
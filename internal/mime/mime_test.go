@@ -0,0 +1,292 @@
+package mime
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+// leaf is a decoded leaf part of a parsed message
+type leaf struct {
+	contentType string
+	disposition string
+	contentID   string
+	body        string
+}
+
+// parse parses a message with net/mail and walks its multipart tree,
+// it returns a path of multipart subtypes and decoded leaves
+func parse(t *testing.T, raw []byte) (*mail.Message, []string, []leaf) {
+	t.Helper()
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("Cannot parse message: %s", err.Error())
+	}
+	var tree []string
+	var leaves []leaf
+	walk(t, msg.Header.Get("Content-Type"), msg.Header.Get("Content-Transfer-Encoding"),
+		msg.Header.Get("Content-Disposition"), msg.Header.Get("Content-ID"), msg.Body, &tree, &leaves)
+
+	return msg, tree, leaves
+}
+
+func walk(t *testing.T, contentType, encoding, disposition, contentID string, body io.Reader, tree *[]string, leaves *[]leaf) {
+	t.Helper()
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		t.Fatalf("Invalid content type %q: %s", contentType, err.Error())
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		*tree = append(*tree, mediaType)
+		r := multipart.NewReader(body, params["boundary"])
+		for {
+			p, err := r.NextRawPart()
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				t.Fatalf("Cannot read part: %s", err.Error())
+			}
+			walk(t, p.Header.Get("Content-Type"), p.Header.Get("Content-Transfer-Encoding"),
+				p.Header.Get("Content-Disposition"), p.Header.Get("Content-ID"), p, tree, leaves)
+		}
+	}
+
+	switch encoding {
+	case EncodingQuotedPrintable:
+		body = quotedprintable.NewReader(body)
+	case EncodingBase64:
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case Encoding7Bit:
+	default:
+		t.Fatalf("Unexpected transfer encoding %q", encoding)
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		t.Fatalf("Cannot decode body: %s", err.Error())
+	}
+	*leaves = append(*leaves, leaf{
+		contentType: mediaType,
+		disposition: disposition,
+		contentID:   contentID,
+		body:        string(data),
+	})
+}
+
+func TestMessage_Build(t *testing.T) {
+	image := bytes.Repeat([]byte{0x89, 'P', 'N', 'G', 0x00, 0xff}, 100)
+	cases := map[string]struct {
+		message Message
+		tree    []string
+		leaves  []leaf
+	}{
+		"text": {
+			message: Message{Text: "Hello,\nworld"},
+			leaves:  []leaf{{contentType: "text/plain", body: "Hello,\r\nworld"}},
+		},
+		"html": {
+			message: Message{HTML: "<p>Hello</p>"},
+			leaves:  []leaf{{contentType: "text/html", body: "<p>Hello</p>"}},
+		},
+		"alternative": {
+			message: Message{Text: "Zażółć gęślą jaźń", HTML: "<p>Zażółć gęślą jaźń</p>"},
+			tree:    []string{"multipart/alternative"},
+			leaves: []leaf{
+				{contentType: "text/plain", body: "Zażółć gęślą jaźń"},
+				{contentType: "text/html", body: "<p>Zażółć gęślą jaźń</p>"},
+			},
+		},
+		"long lines": {
+			message: Message{Text: strings.Repeat("long line ", 200)},
+			leaves:  []leaf{{contentType: "text/plain", body: strings.Repeat("long line ", 200)}},
+		},
+		"attachments": {
+			message: Message{
+				Text: "See attached",
+				HTML: `<p>See <img src="cid:logo"></p>`,
+				Attachments: []Attachment{
+					{Filename: "report.csv", ContentType: "text/csv", Data: []byte("a,b\n1,2\n")},
+					{Filename: "logo.png", ContentType: "image/png", Data: image, ContentID: "logo"},
+				},
+			},
+			tree: []string{"multipart/mixed", "multipart/related", "multipart/alternative"},
+			leaves: []leaf{
+				{contentType: "text/plain", body: "See attached"},
+				{contentType: "text/html", body: `<p>See <img src="cid:logo"></p>`},
+				{contentType: "image/png", disposition: `inline; filename=logo.png`, contentID: "<logo>", body: string(image)},
+				{contentType: "text/csv", disposition: `attachment; filename=report.csv`, body: "a,b\n1,2\n"},
+			},
+		},
+	}
+
+	for hint, c := range cases {
+		t.Run(hint, func(t *testing.T) {
+			c.message.From = "sender@example.com"
+			c.message.To = []string{"recipient@example.net"}
+			c.message.Subject = "Subject"
+			raw, err := c.message.Build()
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err.Error())
+			}
+			for _, line := range strings.Split(string(raw), "\r\n") {
+				if len(line) > foldLength {
+					t.Errorf("Line too long (%d): %q", len(line), line)
+				}
+				if strings.Contains(line, "\n") {
+					t.Errorf("Bare LF in a line: %q", line)
+				}
+			}
+
+			_, tree, leaves := parse(t, raw)
+			if strings.Join(tree, ",") != strings.Join(c.tree, ",") {
+				t.Errorf("Expected tree %v, got %v", c.tree, tree)
+			}
+			if len(leaves) != len(c.leaves) {
+				t.Fatalf("Expected %d parts, got %d", len(c.leaves), len(leaves))
+			}
+			for i, l := range c.leaves {
+				if leaves[i] != l {
+					t.Errorf("Expected part %d %+v, got %+v", i, l, leaves[i])
+				}
+			}
+		})
+	}
+}
+
+func TestMessage_Build_headers(t *testing.T) {
+	date := time.Date(2018, 3, 4, 5, 6, 7, 0, time.UTC)
+	subject := "Zażółć gęślą jaźń, " + strings.Repeat("a very long subject ", 10)
+	m := Message{
+		From:    `"Nadawca Łukasz" <sender@example.com>`,
+		To:      []string{"Odbiorca <to@example.net>", "other@example.net"},
+		Cc:      []string{"cc@example.net"},
+		ReplyTo: []string{"reply@example.com"},
+		Subject: subject,
+		Text:    "Hello",
+		Date:    date,
+		Headers: map[string]string{"X-Request-ID": "abc"},
+	}
+	raw, err := m.Build()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	for _, line := range strings.Split(string(raw), "\r\n") {
+		if len(line) > foldLength {
+			t.Errorf("Line too long (%d): %q", len(line), line)
+		}
+		for _, c := range []byte(line) {
+			if c >= 0x80 {
+				t.Errorf("Non-ASCII character in %q", line)
+				break
+			}
+		}
+	}
+
+	msg, _, _ := parse(t, raw)
+	var decoder mime.WordDecoder
+	decoded, err := decoder.DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		t.Fatalf("Cannot decode subject: %s", err.Error())
+	}
+	if decoded != subject {
+		t.Errorf("Expected subject %q, got %q", subject, decoded)
+	}
+	from, err := msg.Header.AddressList("From")
+	if err != nil || len(from) != 1 || from[0].Name != "Nadawca Łukasz" || from[0].Address != "sender@example.com" {
+		t.Errorf("Unexpected From %v: %v", from, err)
+	}
+	to, err := msg.Header.AddressList("To")
+	if err != nil || len(to) != 2 || to[0].Name != "Odbiorca" || to[1].Address != "other@example.net" {
+		t.Errorf("Unexpected To %v: %v", to, err)
+	}
+	for name, expected := range map[string]string{
+		"Cc":           "<cc@example.net>",
+		"Reply-To":     "<reply@example.com>",
+		"X-Request-Id": "abc",
+		"Mime-Version": "1.0",
+	} {
+		if got := msg.Header.Get(name); got != expected {
+			t.Errorf("Expected %s %q, got %q", name, expected, got)
+		}
+	}
+	if got, err := msg.Header.Date(); err != nil || !got.Equal(date) {
+		t.Errorf("Expected date %s, got %s: %v", date, got, err)
+	}
+	messageID := msg.Header.Get("Message-Id")
+	if !strings.HasPrefix(messageID, "<") || !strings.HasSuffix(messageID, "@example.com>") {
+		t.Errorf("Unexpected Message-ID %q", messageID)
+	}
+}
+
+func TestMessage_Build_longWords(t *testing.T) {
+	subject := strings.Repeat("a", 1200)
+	m := Message{
+		From:    "sender@example.com",
+		To:      []string{"to@example.net"},
+		Subject: subject,
+		Text:    "Hello",
+		Headers: map[string]string{"X-Campaign": "ż" + strings.Repeat("b", 1200)},
+	}
+	raw, err := m.Build()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	for _, line := range strings.Split(string(raw), "\r\n") {
+		if len(line) > foldLength {
+			t.Errorf("Line too long (%d): %q", len(line), line)
+		}
+	}
+
+	msg, _, _ := parse(t, raw)
+	var decoder mime.WordDecoder
+	for name, expected := range map[string]string{
+		"Subject":    subject,
+		"X-Campaign": m.Headers["X-Campaign"],
+	} {
+		decoded, err := decoder.DecodeHeader(msg.Header.Get(name))
+		if err != nil {
+			t.Fatalf("Cannot decode %s: %s", name, err.Error())
+		}
+		if decoded != expected {
+			t.Errorf("Expected %s %q, got %q", name, expected, decoded)
+		}
+	}
+}
+
+func TestMessage_Build_errors(t *testing.T) {
+	cases := map[string]Message{
+		"invalid sender":    {From: "sender", Text: "Hello"},
+		"invalid recipient": {From: "sender@example.com", To: []string{"<to"}, Text: "Hello"},
+		"no body":           {From: "sender@example.com"},
+		"long message id":   {From: "sender@example.com", MessageID: "<" + strings.Repeat("a", 1200) + "@example.com>", Text: "Hello"},
+	}
+
+	for hint, m := range cases {
+		t.Run(hint, func(t *testing.T) {
+			if _, err := m.Build(); err == nil {
+				t.Error("Expected an error")
+			}
+		})
+	}
+}
+
+func TestFold(t *testing.T) {
+	line := "Subject: " + strings.Repeat("word ", 40)
+	folded := fold(line)
+	if strings.Replace(folded, "\r\n", "", -1) != line {
+		t.Errorf("Folding changed content: %q", folded)
+	}
+	for _, l := range strings.Split(folded, "\r\n") {
+		if len(l) > foldLength {
+			t.Errorf("Line too long (%d): %q", len(l), l)
+		}
+	}
+}
@@ -0,0 +1,319 @@
+// Package pacing limits how fast messages are sent to recipient domains,
+// so big mailbox providers do not throttle us.
+package pacing
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mikolajb/emailserv/internal/ratelimit"
+)
+
+// Limit is a limit of a single domain, zero values disable limits
+type Limit struct {
+	// Concurrency is how many messages can be sent to a domain at once
+	Concurrency int
+
+	// PerMinute is how many messages can be sent to a domain in a minute,
+	// they are spread evenly over a minute
+	PerMinute int
+}
+
+// String formats a limit as "concurrency/per_minute"
+func (l Limit) String() string {
+	return fmt.Sprintf("%d/%d", l.Concurrency, l.PerMinute)
+}
+
+// ParseLimit parses a "concurrency/per_minute" limit, e.g. "5/600"
+func ParseLimit(s string) (Limit, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) != 2 {
+		return Limit{}, fmt.Errorf("invalid limit %q, expected concurrency/per_minute", s)
+	}
+	concurrency, err := strconv.Atoi(parts[0])
+	if err != nil || concurrency < 0 {
+		return Limit{}, fmt.Errorf("invalid concurrency %q", parts[0])
+	}
+	perMinute, err := strconv.Atoi(parts[1])
+	if err != nil || perMinute < 0 {
+		return Limit{}, fmt.Errorf("invalid messages per minute %q", parts[1])
+	}
+
+	return Limit{Concurrency: concurrency, PerMinute: perMinute}, nil
+}
+
+// ParseDomains parses comma separated domain=limit pairs,
+// e.g. "gmail.com=5/600,yahoo.com=2/120"
+func ParseDomains(s string) (map[string]Limit, error) {
+	result := map[string]Limit{}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid domain limit %q, expected domain=concurrency/per_minute", pair)
+		}
+		limit, err := ParseLimit(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		result[strings.ToLower(parts[0])] = limit
+	}
+
+	return result, nil
+}
+
+// Domains returns sorted unique lower case domains of addresses
+func Domains(addresses []string) []string {
+	seen := map[string]bool{}
+	var result []string
+	for _, address := range addresses {
+		i := strings.LastIndex(address, "@")
+		if i < 0 {
+			continue
+		}
+		domain := strings.ToLower(strings.TrimSuffix(address[i+1:], ">"))
+		if !seen[domain] {
+			seen[domain] = true
+			result = append(result, domain)
+		}
+	}
+	sort.Strings(result)
+
+	return result
+}
+
+// idleTimeout is how long a domain with a default limit is kept
+// after its last message, a bucket of a limit is full by then,
+// so a new state of a domain paces it in the same way
+const idleTimeout = time.Minute
+
+// domain is a state of a single domain
+type domain struct {
+	slots    chan struct{}
+	bucket   *ratelimit.Bucket
+	waiting  int
+	inFlight int
+	lastUsed time.Time
+}
+
+// Stats describes a domain, it is published as a metric
+type Stats struct {
+	// Backlog is a number of messages waiting for a domain
+	Backlog int `json:"backlog"`
+
+	// InFlight is a number of messages being sent to a domain
+	InFlight int `json:"in_flight"`
+}
+
+// TimeoutError is returned when a message waits for a domain
+// longer than a maximum wait, see WithMaxWait
+type TimeoutError struct {
+	Domain string
+
+	// RetryAfter is a hint when a message can be sent again
+	RetryAfter time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("domain %s is busy, retry after %s", e.Domain, e.RetryAfter)
+}
+
+type maxWaitKey struct{}
+
+// WithMaxWait returns a context limiting how long Acquire waits,
+// e.g. while an HTTP request is open, Acquire returns *TimeoutError
+// after that time, without it Acquire waits until a context is done
+func WithMaxWait(ctx context.Context, d time.Duration) context.Context {
+	return context.WithValue(ctx, maxWaitKey{}, d)
+}
+
+// Pacer paces messages per recipient domain
+type Pacer struct {
+	mu        sync.Mutex
+	def       Limit
+	limits    map[string]Limit
+	domains   map[string]*domain
+	lastSweep time.Time
+	now       func() time.Time
+	sleep     func(ctx context.Context, d time.Duration) error
+}
+
+// New returns a pacer with limits of given domains,
+// other domains have a default limit
+func New(def Limit, limits map[string]Limit) *Pacer {
+	l := map[string]Limit{}
+	for name, limit := range limits {
+		l[strings.ToLower(name)] = limit
+	}
+
+	return &Pacer{
+		def:     def,
+		limits:  l,
+		domains: map[string]*domain{},
+		now:     time.Now,
+		sleep:   sleep,
+	}
+}
+
+// sleep waits until a duration passes or a context is done
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// get returns a state of a domain, creating it when needed
+// It has to be called with a lock held.
+func (p *Pacer) get(name string) *domain {
+	p.sweep()
+
+	d, ok := p.domains[name]
+	if ok {
+		return d
+	}
+
+	limit, ok := p.limits[name]
+	if !ok {
+		limit = p.def
+	}
+	d = &domain{}
+	if limit.Concurrency > 0 {
+		d.slots = make(chan struct{}, limit.Concurrency)
+	}
+	if limit.PerMinute > 0 {
+		d.bucket = ratelimit.NewBucket(float64(limit.PerMinute)/60, 1)
+	}
+	p.domains[name] = d
+
+	return d
+}
+
+// sweep removes idle domains with a default limit, recipients
+// are given by callers, so there can be any number of such domains
+// It has to be called with a lock held.
+func (p *Pacer) sweep() {
+	now := p.now()
+	if now.Sub(p.lastSweep) < idleTimeout {
+		return
+	}
+	p.lastSweep = now
+
+	for name, d := range p.domains {
+		if _, ok := p.limits[name]; ok {
+			continue
+		}
+		if d.waiting == 0 && d.inFlight == 0 && now.Sub(d.lastUsed) >= idleTimeout {
+			delete(p.domains, name)
+		}
+	}
+}
+
+// Acquire waits until a message can be sent to domains of all recipients,
+// release has to be called when it is sent
+// Domains are acquired in order, so messages to many domains
+// cannot block each other.
+func (p *Pacer) Acquire(ctx context.Context, recipients []string) (release func(), err error) {
+	parent := ctx
+	maxWait, _ := ctx.Value(maxWaitKey{}).(time.Duration)
+	if maxWait > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, maxWait)
+		defer cancel()
+	}
+
+	var acquired []*domain
+	release = func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		now := p.now()
+		for _, d := range acquired {
+			d.inFlight--
+			d.lastUsed = now
+			if d.slots != nil {
+				<-d.slots
+			}
+		}
+		acquired = nil
+	}
+
+	for _, name := range Domains(recipients) {
+		p.mu.Lock()
+		d := p.get(name)
+		d.waiting++
+		p.mu.Unlock()
+
+		err := p.acquire(ctx, d)
+
+		p.mu.Lock()
+		d.waiting--
+		d.lastUsed = p.now()
+		if err == nil {
+			d.inFlight++
+		}
+		p.mu.Unlock()
+		if err != nil {
+			release()
+			if parent.Err() == nil && ctx.Err() == context.DeadlineExceeded {
+				return func() {}, &TimeoutError{Domain: name, RetryAfter: maxWait}
+			}
+			return func() {}, err
+		}
+		acquired = append(acquired, d)
+	}
+
+	return release, nil
+}
+
+// acquire takes a concurrency slot and a token of a domain
+func (p *Pacer) acquire(ctx context.Context, d *domain) error {
+	if d.slots != nil {
+		select {
+		case d.slots <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if d.bucket == nil {
+		return nil
+	}
+
+	for {
+		ok, wait := d.bucket.Allow(1)
+		if ok {
+			return nil
+		}
+		if err := p.sleep(ctx, wait); err != nil {
+			if d.slots != nil {
+				<-d.slots
+			}
+			return err
+		}
+	}
+}
+
+// Stats returns stats of domains which were used
+func (p *Pacer) Stats() map[string]Stats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	result := make(map[string]Stats, len(p.domains))
+	for name, d := range p.domains {
+		result[name] = Stats{Backlog: d.waiting, InFlight: d.inFlight}
+	}
+
+	return result
+}
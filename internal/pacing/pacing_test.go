@@ -0,0 +1,188 @@
+package pacing
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseDomains(t *testing.T) {
+	cases := map[string]struct {
+		value    string
+		expected map[string]Limit
+		err      bool
+	}{
+		"empty": {
+			expected: map[string]Limit{},
+		},
+		"domains": {
+			value: "gmail.com=5/600, Yahoo.com=2/0",
+			expected: map[string]Limit{
+				"gmail.com": {Concurrency: 5, PerMinute: 600},
+				"yahoo.com": {Concurrency: 2},
+			},
+		},
+		"no-limit": {
+			value: "gmail.com",
+			err:   true,
+		},
+		"invalid-limit": {
+			value: "gmail.com=5",
+			err:   true,
+		},
+		"negative": {
+			value: "gmail.com=-1/10",
+			err:   true,
+		},
+	}
+
+	for hint, c := range cases {
+		t.Run(hint, func(t *testing.T) {
+			result, err := ParseDomains(c.value)
+			if c.err {
+				if err == nil {
+					t.Errorf("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if !reflect.DeepEqual(result, c.expected) {
+				t.Errorf("expected: %v, got: %v", c.expected, result)
+			}
+		})
+	}
+}
+
+func TestDomains(t *testing.T) {
+	result := Domains([]string{"a@Gmail.com", "b@example.com", "c@gmail.com", "invalid"})
+	expected := []string{"example.com", "gmail.com"}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("expected: %v, got: %v", expected, result)
+	}
+}
+
+func TestPacer_concurrency(t *testing.T) {
+	p := New(Limit{}, map[string]Limit{"gmail.com": {Concurrency: 1}})
+
+	release, err := p.Acquire(context.Background(), []string{"a@gmail.com", "b@example.com"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	acquired := make(chan struct{})
+	go func() {
+		release, err := p.Acquire(context.Background(), []string{"c@gmail.com"})
+		if err == nil {
+			release()
+		}
+		close(acquired)
+	}()
+
+	// wait until a second message is in a backlog
+	for i := 0; p.Stats()["gmail.com"].Backlog == 0; i++ {
+		if i == 100 {
+			t.Fatalf("a message should wait for gmail.com")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	expected := map[string]Stats{
+		"gmail.com":   {Backlog: 1, InFlight: 1},
+		"example.com": {InFlight: 1},
+	}
+	if stats := p.Stats(); !reflect.DeepEqual(stats, expected) {
+		t.Errorf("expected stats: %+v, got: %+v", expected, stats)
+	}
+
+	release()
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatalf("a message should be sent after a previous one")
+	}
+	expected = map[string]Stats{"gmail.com": {}, "example.com": {}}
+	if stats := p.Stats(); !reflect.DeepEqual(stats, expected) {
+		t.Errorf("expected stats: %+v, got: %+v", expected, stats)
+	}
+}
+
+func TestPacer_perMinute(t *testing.T) {
+	var slept time.Duration
+	p := New(Limit{PerMinute: 600}, nil)
+	p.sleep = func(ctx context.Context, d time.Duration) error {
+		slept += d
+		time.Sleep(d)
+		return nil
+	}
+
+	// a default limit of a message every 100ms
+	for i := 0; i < 2; i++ {
+		release, err := p.Acquire(context.Background(), []string{"a@example.com"})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		release()
+	}
+	if slept < 90*time.Millisecond {
+		t.Errorf("a second message should wait about 100ms, waited: %s", slept)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p.sleep = sleep
+	if _, err := p.Acquire(ctx, []string{"a@example.com"}); err == nil {
+		t.Errorf("expected an error of a canceled context")
+	}
+	if stats := p.Stats()["example.com"]; stats.Backlog != 0 || stats.InFlight != 0 {
+		t.Errorf("a canceled message should not be counted: %+v", stats)
+	}
+}
+
+func TestPacer_maxWait(t *testing.T) {
+	p := New(Limit{}, map[string]Limit{"gmail.com": {Concurrency: 1}})
+
+	release, err := p.Acquire(context.Background(), []string{"a@gmail.com"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	defer release()
+
+	ctx := WithMaxWait(context.Background(), 10*time.Millisecond)
+	_, err = p.Acquire(ctx, []string{"b@gmail.com"})
+	if e, ok := err.(*TimeoutError); !ok || e.Domain != "gmail.com" || e.RetryAfter != 10*time.Millisecond {
+		t.Errorf("expected a timeout of gmail.com, got: %v", err)
+	}
+	if stats := p.Stats()["gmail.com"]; stats.Backlog != 0 || stats.InFlight != 1 {
+		t.Errorf("a message which timed out should not be counted: %+v", stats)
+	}
+}
+
+func TestPacer_idle(t *testing.T) {
+	now := time.Date(2018, 5, 10, 12, 0, 0, 0, time.UTC)
+	p := New(Limit{PerMinute: 60}, map[string]Limit{"gmail.com": {PerMinute: 60}})
+	p.now = func() time.Time { return now }
+
+	release, err := p.Acquire(context.Background(), []string{"a@example.com", "b@gmail.com", "c@example.net"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	now = now.Add(idleTimeout)
+	if _, err := p.Acquire(context.Background(), []string{"d@example.org"}); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if len(p.Stats()) != 4 {
+		t.Errorf("domains with messages in flight should be kept: %+v", p.Stats())
+	}
+
+	release()
+	now = now.Add(idleTimeout)
+	if _, err := p.Acquire(context.Background(), []string{"e@example.org"}); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	stats := p.Stats()
+	if _, ok := stats["gmail.com"]; !ok || len(stats) != 2 {
+		t.Errorf("only idle domains with a default limit should be removed: %+v", stats)
+	}
+}
@@ -0,0 +1,294 @@
+// Package quota accounts messages and recipients of API keys
+// per day and per month and enforces their limits.
+package quota
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/mikolajb/emailserv/internal/storage"
+)
+
+const bucket = "quotas"
+
+// ErrInvalidPeriod is returned when a period is not Day or Month
+var ErrInvalidPeriod = errors.New("period has to be day or month")
+
+// DefaultKey is a name of limits of keys without their own limits
+const DefaultKey = "*"
+
+// Periods of quotas
+const (
+	Day   = "day"
+	Month = "month"
+)
+
+// Limits are quotas of a key in UTC days and months, 0 means no limit
+type Limits struct {
+	MessagesPerDay     int64 `json:"messages_per_day,omitempty"`
+	RecipientsPerDay   int64 `json:"recipients_per_day,omitempty"`
+	MessagesPerMonth   int64 `json:"messages_per_month,omitempty"`
+	RecipientsPerMonth int64 `json:"recipients_per_month,omitempty"`
+}
+
+// Load reads a JSON file mapping names of keys to their limits,
+// limits of DefaultKey apply to other keys, e.g.
+// {"billing": {"messages_per_day": 1000}, "*": {"messages_per_month": 10000}}
+func Load(path string) (map[string]Limits, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read quotas: %s", err.Error())
+	}
+
+	var limits map[string]Limits
+	if err := json.Unmarshal(data, &limits); err != nil {
+		return nil, fmt.Errorf("invalid quotas file: %s", err.Error())
+	}
+
+	return limits, nil
+}
+
+// Counter counts messages and their recipients
+type Counter struct {
+	Messages   int64 `json:"messages"`
+	Recipients int64 `json:"recipients"`
+}
+
+// Usage is usage of a key in a current day and month
+type Usage struct {
+	Key string `json:"key"`
+
+	// Day is a current day, e.g. "2018-05-10"
+	Day   string  `json:"day"`
+	Daily Counter `json:"daily"`
+
+	// Month is a current month, e.g. "2018-05"
+	Month   string  `json:"month"`
+	Monthly Counter `json:"monthly"`
+}
+
+// roll starts new periods when a day or a month is over
+func (u *Usage) roll(now time.Time) {
+	day := now.UTC().Format("2006-01-02")
+	month := now.UTC().Format("2006-01")
+	if u.Day != day {
+		u.Day = day
+		u.Daily = Counter{}
+	}
+	if u.Month != month {
+		u.Month = month
+		u.Monthly = Counter{}
+	}
+}
+
+// ExceededError is returned when a message would exceed a quota
+type ExceededError struct {
+	Key string `json:"key"`
+
+	// Period is Day or Month
+	Period string `json:"period"`
+
+	// Resource is "messages" or "recipients"
+	Resource string `json:"resource"`
+
+	Limit int64 `json:"limit"`
+	Used  int64 `json:"used"`
+
+	// ResetsAt is a beginning of a next period
+	ResetsAt time.Time `json:"resets_at"`
+}
+
+func (e *ExceededError) Error() string {
+	period := "daily"
+	if e.Period == Month {
+		period = "monthly"
+	}
+
+	return fmt.Sprintf("%s quota of %s exceeded, %d of %d used", period, e.Resource, e.Used, e.Limit)
+}
+
+// Quotas keeps usage of keys in a store
+type Quotas struct {
+	store  storage.Store
+	limits map[string]Limits
+	now    func() time.Time
+}
+
+// New returns quotas with limits of keys, see Load
+func New(store storage.Store, limits map[string]Limits) *Quotas {
+	if limits == nil {
+		limits = map[string]Limits{}
+	}
+
+	return &Quotas{
+		store:  store,
+		limits: limits,
+		now:    time.Now,
+	}
+}
+
+// Limits returns limits of a key
+func (q *Quotas) Limits(key string) Limits {
+	if limits, ok := q.limits[key]; ok {
+		return limits
+	}
+
+	return q.limits[DefaultKey]
+}
+
+// check returns an error when usage after adding a message is over limits
+func check(key string, limits Limits, u *Usage, recipients int64, now time.Time) error {
+	now = now.UTC()
+	nextDay := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+	nextMonth := time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+
+	checks := []struct {
+		period   string
+		resource string
+		limit    int64
+		used     int64
+		add      int64
+		resetsAt time.Time
+	}{
+		{Day, "messages", limits.MessagesPerDay, u.Daily.Messages, 1, nextDay},
+		{Day, "recipients", limits.RecipientsPerDay, u.Daily.Recipients, recipients, nextDay},
+		{Month, "messages", limits.MessagesPerMonth, u.Monthly.Messages, 1, nextMonth},
+		{Month, "recipients", limits.RecipientsPerMonth, u.Monthly.Recipients, recipients, nextMonth},
+	}
+	for _, c := range checks {
+		if c.limit > 0 && c.used+c.add > c.limit {
+			return &ExceededError{
+				Key:      key,
+				Period:   c.period,
+				Resource: c.resource,
+				Limit:    c.limit,
+				Used:     c.used,
+				ResetsAt: c.resetsAt,
+			}
+		}
+	}
+
+	return nil
+}
+
+// Reserve accounts a message with a number of recipients,
+// it returns *ExceededError when it would exceed limits of a key
+func (q *Quotas) Reserve(key string, recipients int) (*Usage, error) {
+	var u Usage
+	now := q.now()
+	err := q.store.Update(bucket, key, &u, func(found bool) error {
+		u.Key = key
+		u.roll(now)
+		if err := check(key, q.Limits(key), &u, int64(recipients), now); err != nil {
+			return err
+		}
+		u.Daily.Messages++
+		u.Daily.Recipients += int64(recipients)
+		u.Monthly.Messages++
+		u.Monthly.Recipients += int64(recipients)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &u, nil
+}
+
+// Release gives back a message reserved in a current period,
+// e.g. when it was not sent
+func (q *Quotas) Release(key string, recipients int) error {
+	return q.ReleaseAt(key, recipients, q.now())
+}
+
+// ReleaseAt gives back a message reserved at a given time, e.g. a scheduled
+// message canceled later, periods which are already over are not changed
+func (q *Quotas) ReleaseAt(key string, recipients int, reservedAt time.Time) error {
+	var u Usage
+	now := q.now()
+	day := reservedAt.UTC().Format("2006-01-02")
+	month := reservedAt.UTC().Format("2006-01")
+	return q.store.Update(bucket, key, &u, func(found bool) error {
+		u.Key = key
+		u.roll(now)
+		if u.Day == day {
+			u.Daily.Messages = nonNegative(u.Daily.Messages - 1)
+			u.Daily.Recipients = nonNegative(u.Daily.Recipients - int64(recipients))
+		}
+		if u.Month == month {
+			u.Monthly.Messages = nonNegative(u.Monthly.Messages - 1)
+			u.Monthly.Recipients = nonNegative(u.Monthly.Recipients - int64(recipients))
+		}
+		return nil
+	})
+}
+
+func nonNegative(n int64) int64 {
+	if n < 0 {
+		return 0
+	}
+
+	return n
+}
+
+// Usage returns current usage of a key
+func (q *Quotas) Usage(key string) (*Usage, error) {
+	var u Usage
+	err := q.store.Get(bucket, key, &u)
+	if err != nil && err != storage.ErrNotFound {
+		return nil, err
+	}
+	u.Key = key
+	u.roll(q.now())
+
+	return &u, nil
+}
+
+// All returns current usage of all keys which sent messages
+func (q *Quotas) All() ([]*Usage, error) {
+	now := q.now()
+	var result []*Usage
+	err := q.store.List(bucket, func(key string, decode func(v interface{}) error) error {
+		var u Usage
+		if err := decode(&u); err != nil {
+			return err
+		}
+		u.roll(now)
+		result = append(result, &u)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// Reset clears usage of a key in a period, both periods when it is empty
+func (q *Quotas) Reset(key, period string) (*Usage, error) {
+	if period != "" && period != Day && period != Month {
+		return nil, ErrInvalidPeriod
+	}
+
+	var u Usage
+	now := q.now()
+	err := q.store.Update(bucket, key, &u, func(found bool) error {
+		u.Key = key
+		u.roll(now)
+		if period == "" || period == Day {
+			u.Daily = Counter{}
+		}
+		if period == "" || period == Month {
+			u.Monthly = Counter{}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &u, nil
+}
@@ -0,0 +1,131 @@
+package quota
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mikolajb/emailserv/internal/storage"
+)
+
+func TestQuotas_Reserve(t *testing.T) {
+	now := time.Date(2018, 5, 31, 23, 0, 0, 0, time.UTC)
+	q := New(storage.NewMemoryStore(), map[string]Limits{
+		"billing":  {MessagesPerDay: 2, RecipientsPerMonth: 5},
+		DefaultKey: {MessagesPerDay: 1},
+	})
+	q.now = func() time.Time { return now }
+
+	steps := []struct {
+		key        string
+		after      time.Duration
+		recipients int
+		period     string
+		resource   string
+	}{
+		{key: "billing", recipients: 2},
+		{key: "billing", recipients: 2},
+		{key: "billing", recipients: 1, period: Day, resource: "messages"},
+		{key: "marketing", recipients: 10},
+		{key: "marketing", recipients: 1, period: Day, resource: "messages"},
+		// a new day and a new month
+		{key: "billing", after: time.Hour, recipients: 5},
+		{key: "billing", recipients: 1, period: Month, resource: "recipients"},
+		{key: "marketing", recipients: 1},
+	}
+	for i, s := range steps {
+		now = now.Add(s.after)
+		_, err := q.Reserve(s.key, s.recipients)
+		if s.period == "" {
+			if err != nil {
+				t.Errorf("step %d: unexpected error: %s", i, err.Error())
+			}
+			continue
+		}
+		exceeded, ok := err.(*ExceededError)
+		if !ok {
+			t.Errorf("step %d: expected an exceeded quota, got: %v", i, err)
+			continue
+		}
+		if exceeded.Period != s.period || exceeded.Resource != s.resource {
+			t.Errorf("step %d: expected %s %s, got: %+v", i, s.period, s.resource, exceeded)
+		}
+		if !exceeded.ResetsAt.After(now) {
+			t.Errorf("step %d: a quota should reset later, got: %s", i, exceeded.ResetsAt)
+		}
+	}
+
+	u, err := q.Usage("billing")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	expected := Usage{
+		Key:     "billing",
+		Day:     "2018-06-01",
+		Daily:   Counter{Messages: 1, Recipients: 5},
+		Month:   "2018-06",
+		Monthly: Counter{Messages: 1, Recipients: 5},
+	}
+	if *u != expected {
+		t.Errorf("expected usage: %+v, got: %+v", expected, *u)
+	}
+}
+
+func TestQuotas_ReleaseReset(t *testing.T) {
+	q := New(storage.NewMemoryStore(), map[string]Limits{"billing": {MessagesPerDay: 1}})
+
+	if _, err := q.Reserve("billing", 3); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if err := q.Release("billing", 3); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if _, err := q.Reserve("billing", 3); err != nil {
+		t.Fatalf("a released message should not be counted: %s", err.Error())
+	}
+
+	if _, err := q.Reset("billing", "week"); err != ErrInvalidPeriod {
+		t.Errorf("expected an invalid period error, got: %v", err)
+	}
+	u, err := q.Reset("billing", Day)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if u.Daily != (Counter{}) || u.Monthly != (Counter{Messages: 1, Recipients: 3}) {
+		t.Errorf("only daily usage should be reset, got: %+v", u)
+	}
+
+	all, err := q.All()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if len(all) != 1 || all[0].Key != "billing" {
+		t.Errorf("wrong usage of all keys: %+v", all)
+	}
+}
+
+func TestQuotas_ReleaseAt(t *testing.T) {
+	now := time.Date(2018, 5, 31, 23, 0, 0, 0, time.UTC)
+	q := New(storage.NewMemoryStore(), nil)
+	q.now = func() time.Time { return now }
+
+	if _, err := q.Reserve("billing", 3); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	reservedAt := now
+
+	now = now.Add(2 * time.Hour)
+	if _, err := q.Reserve("billing", 2); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if err := q.ReleaseAt("billing", 3, reservedAt); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	u, err := q.Usage("billing")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if u.Daily != (Counter{Messages: 1, Recipients: 2}) || u.Monthly != (Counter{Messages: 1, Recipients: 2}) {
+		t.Errorf("a message of a previous period should not be released, got: %+v", u)
+	}
+}
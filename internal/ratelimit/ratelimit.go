@@ -0,0 +1,105 @@
+// Package ratelimit implements token bucket rate limits
+// of API keys and email providers.
+package ratelimit
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Bucket is a token bucket, it is refilled with rate tokens per second
+// up to burst tokens
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+}
+
+// NewBucket returns a full bucket, burst is at least 1
+func NewBucket(rate float64, burst int) *Bucket {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &Bucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		now:    time.Now,
+	}
+}
+
+// Allow takes n tokens, it returns false and how long to wait
+// for them when there are not enough tokens, nothing is taken then
+// A request for more tokens than burst takes all of them.
+func (b *Bucket) Allow(n int) (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	if !b.last.IsZero() {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	b.last = now
+
+	need := math.Min(float64(n), b.burst)
+	if b.tokens >= need {
+		b.tokens -= need
+		return true, 0
+	}
+	if b.rate <= 0 {
+		return false, time.Duration(math.MaxInt64)
+	}
+
+	wait := (need - b.tokens) / b.rate
+	return false, time.Duration(math.Ceil(wait * float64(time.Second)))
+}
+
+// Limiter keeps a bucket per key, e.g. per API key
+type Limiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   int
+	buckets map[string]*Bucket
+	now     func() time.Time
+}
+
+// NewLimiter returns a limiter with the same limits for every key
+func NewLimiter(rate float64, burst int) *Limiter {
+	return &Limiter{
+		rate:    rate,
+		burst:   burst,
+		buckets: map[string]*Bucket{},
+		now:     time.Now,
+	}
+}
+
+// Allow takes a token of a key, see Bucket.Allow
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = NewBucket(l.rate, l.burst)
+		b.now = l.now
+		l.buckets[key] = b
+	}
+	l.mu.Unlock()
+
+	return b.Allow(1)
+}
+
+// RetryAfter formats a wait time as a value of Retry-After header,
+// in whole seconds, at least 1
+func RetryAfter(wait time.Duration) string {
+	seconds := int64(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	return strconv.FormatInt(seconds, 10)
+}
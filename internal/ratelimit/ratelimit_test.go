@@ -0,0 +1,66 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucket_Allow(t *testing.T) {
+	now := time.Date(2018, 5, 10, 12, 0, 0, 0, time.UTC)
+	b := NewBucket(2, 3)
+	b.now = func() time.Time { return now }
+
+	steps := []struct {
+		after time.Duration
+		n     int
+		ok    bool
+		wait  time.Duration
+	}{
+		{n: 1, ok: true},
+		{n: 2, ok: true},
+		{n: 1, wait: 500 * time.Millisecond},
+		{after: 500 * time.Millisecond, n: 1, ok: true},
+		{after: 250 * time.Millisecond, n: 2, wait: 750 * time.Millisecond},
+		{after: time.Hour, n: 3, ok: true},
+		// more tokens than burst take all of them
+		{after: time.Hour, n: 5, ok: true},
+		{n: 1, wait: 500 * time.Millisecond},
+	}
+	for i, s := range steps {
+		now = now.Add(s.after)
+		ok, wait := b.Allow(s.n)
+		if ok != s.ok || wait != s.wait {
+			t.Errorf("step %d, expected: %t %s, got: %t %s", i, s.ok, s.wait, ok, wait)
+		}
+	}
+}
+
+func TestLimiter_Allow(t *testing.T) {
+	now := time.Date(2018, 5, 10, 12, 0, 0, 0, time.UTC)
+	l := NewLimiter(1, 1)
+	l.now = func() time.Time { return now }
+
+	if ok, _ := l.Allow("billing"); !ok {
+		t.Errorf("first request should be allowed")
+	}
+	if ok, wait := l.Allow("billing"); ok || wait != time.Second {
+		t.Errorf("second request should wait a second, got: %t %s", ok, wait)
+	}
+	if ok, _ := l.Allow("marketing"); !ok {
+		t.Errorf("keys should have separate limits")
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	cases := map[time.Duration]string{
+		0:                       "1",
+		100 * time.Millisecond:  "1",
+		time.Second:             "1",
+		1500 * time.Millisecond: "2",
+	}
+	for wait, expected := range cases {
+		if got := RetryAfter(wait); got != expected {
+			t.Errorf("wrong value for %s, expected: %s, got: %s", wait, expected, got)
+		}
+	}
+}
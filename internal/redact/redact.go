@@ -0,0 +1,173 @@
+// Package redact removes personal data from log fields.
+package redact
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// Mode specifies how a field is redacted
+type Mode string
+
+const (
+	// ModeNone leaves a field untouched
+	ModeNone Mode = "none"
+
+	// ModeHash replaces a value with a truncated SHA-256 hash,
+	// equal values have equal hashes so they can still be correlated
+	ModeHash Mode = "hash"
+
+	// ModeMask hides a local part of an email address,
+	// e.g. "john@example.com" becomes "j***@example.com"
+	ModeMask Mode = "mask"
+
+	// ModeDrop removes a field
+	ModeDrop Mode = "drop"
+)
+
+// DefaultPolicy is a policy used when nothing else is configured
+const DefaultPolicy = "sender=mask,recipients=mask,recipient=mask,email_address=mask,cc=mask,bcc=mask,subject=hash,body=drop,response=drop,output=drop,aws_sdk=drop"
+
+// Policy maps field names to redaction modes,
+// fields not present in a policy are not redacted
+type Policy map[string]Mode
+
+// ParsePolicy parses a policy in a form "field=mode,field=mode"
+func ParsePolicy(s string) (Policy, error) {
+	policy := Policy{}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid redaction entry: %s", entry)
+		}
+		mode := Mode(strings.TrimSpace(parts[1]))
+		switch mode {
+		case ModeNone, ModeHash, ModeMask, ModeDrop:
+		default:
+			return nil, fmt.Errorf("unknown redaction mode for field %s: %s", parts[0], mode)
+		}
+		policy[strings.TrimSpace(parts[0])] = mode
+	}
+
+	return policy, nil
+}
+
+// Fields returns fields redacted according to a policy
+func (p Policy) Fields(fields []zapcore.Field) []zapcore.Field {
+	if len(p) == 0 {
+		return fields
+	}
+
+	result := make([]zapcore.Field, 0, len(fields))
+	for _, f := range fields {
+		mode, ok := p[f.Key]
+		if !ok || mode == ModeNone {
+			result = append(result, f)
+			continue
+		}
+		if mode == ModeDrop {
+			continue
+		}
+		result = append(result, redactField(f, mode))
+	}
+
+	return result
+}
+
+// redactField encodes a field to find its value and builds a new field
+// holding a redacted value
+func redactField(f zapcore.Field, mode Mode) zapcore.Field {
+	enc := zapcore.NewMapObjectEncoder()
+	f.AddTo(enc)
+
+	switch v := enc.Fields[f.Key].(type) {
+	case string:
+		return zapcore.Field{Key: f.Key, Type: zapcore.StringType, String: Value(v, mode)}
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, e := range v {
+			values = append(values, Value(fmt.Sprint(e), mode))
+		}
+		return zapcore.Field{Key: f.Key, Type: zapcore.ReflectType, Interface: values}
+	default:
+		if mode == ModeHash {
+			return zapcore.Field{Key: f.Key, Type: zapcore.StringType, String: hash(fmt.Sprint(v))}
+		}
+		return zapcore.Field{Key: f.Key, Type: zapcore.StringType, String: "[redacted]"}
+	}
+}
+
+// Value redacts a single value
+func Value(value string, mode Mode) string {
+	switch mode {
+	case ModeHash:
+		return hash(value)
+	case ModeMask:
+		return mask(value)
+	case ModeDrop:
+		return ""
+	default:
+		return value
+	}
+}
+
+func hash(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return "sha256:" + hex.EncodeToString(sum[:8])
+}
+
+func mask(value string) string {
+	if value == "" {
+		return ""
+	}
+	first := string([]rune(value)[:1])
+	at := strings.LastIndex(value, "@")
+	if at < 0 {
+		return first + "***"
+	}
+	if at == 0 {
+		return "***" + value[at:]
+	}
+	return first + "***" + value[at:]
+}
+
+// core redacts fields before passing them to a wrapped core
+type core struct {
+	zapcore.Core
+	policy Policy
+}
+
+// NewCore wraps a core, fields are redacted according to a policy
+// It can be installed with zap.WrapCore
+func NewCore(c zapcore.Core, policy Policy) zapcore.Core {
+	return &core{
+		Core:   c,
+		policy: policy,
+	}
+}
+
+func (c *core) With(fields []zapcore.Field) zapcore.Core {
+	return &core{
+		Core:   c.Core.With(c.policy.Fields(fields)),
+		policy: c.policy,
+	}
+}
+
+func (c *core) Check(entry zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(entry.Level) {
+		return ce.AddCore(entry, c)
+	}
+	return ce
+}
+
+func (c *core) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	return c.Core.Write(entry, c.policy.Fields(fields))
+}
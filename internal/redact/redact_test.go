@@ -0,0 +1,160 @@
+package redact
+
+import (
+	"reflect"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestParsePolicy(t *testing.T) {
+	cases := map[string]struct {
+		policy   string
+		expected Policy
+		err      bool
+	}{
+		"empty": {
+			expected: Policy{},
+		},
+		"default": {
+			policy: DefaultPolicy,
+			expected: Policy{
+				"sender":        ModeMask,
+				"recipients":    ModeMask,
+				"recipient":     ModeMask,
+				"email_address": ModeMask,
+				"cc":            ModeMask,
+				"bcc":           ModeMask,
+				"subject":       ModeHash,
+				"body":          ModeDrop,
+				"response":      ModeDrop,
+				"output":        ModeDrop,
+				"aws_sdk":       ModeDrop,
+			},
+		},
+		"spaces": {
+			policy:   " sender = none , ",
+			expected: Policy{"sender": ModeNone},
+		},
+		"unknown-mode": {
+			policy: "sender=encrypt",
+			err:    true,
+		},
+		"missing-mode": {
+			policy: "sender",
+			err:    true,
+		},
+	}
+
+	for hint, c := range cases {
+		t.Run(hint, func(t *testing.T) {
+			policy, err := ParsePolicy(c.policy)
+			if c.err {
+				if err == nil {
+					t.Errorf("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if !reflect.DeepEqual(c.expected, policy) {
+				t.Errorf("expected policy %v but got %v", c.expected, policy)
+			}
+		})
+	}
+}
+
+func TestValue(t *testing.T) {
+	cases := map[string]struct {
+		value    string
+		mode     Mode
+		expected string
+	}{
+		"none": {
+			value:    "john@example.com",
+			mode:     ModeNone,
+			expected: "john@example.com",
+		},
+		"mask-email": {
+			value:    "john@example.com",
+			mode:     ModeMask,
+			expected: "j***@example.com",
+		},
+		"mask-text": {
+			value:    "Żółw",
+			mode:     ModeMask,
+			expected: "Ż***",
+		},
+		"hash": {
+			value:    "john@example.com",
+			mode:     ModeHash,
+			expected: "sha256:855f96e983f1f8e8",
+		},
+		"drop": {
+			value: "john@example.com",
+			mode:  ModeDrop,
+		},
+	}
+
+	for hint, c := range cases {
+		t.Run(hint, func(t *testing.T) {
+			if v := Value(c.value, c.mode); v != c.expected {
+				t.Errorf("expected '%s' but got '%s'", c.expected, v)
+			}
+		})
+	}
+}
+
+func TestNewCore(t *testing.T) {
+	observed, logs := observer.New(zapcore.DebugLevel)
+	logger := zap.New(NewCore(observed, Policy{
+		"sender":     ModeMask,
+		"recipients": ModeMask,
+		"subject":    ModeDrop,
+	}))
+
+	logger.With(
+		zap.String("sender", "john@example.com"),
+		zap.String("subject", "secret"),
+	).Info("sending", zap.Strings("recipients", []string{"ann@example.com", "bob@example.com"}), zap.Int("size", 3))
+
+	entries := logs.All()
+	if len(entries) != 1 {
+		t.Fatalf("expected one entry but got %d", len(entries))
+	}
+	expected := map[string]interface{}{
+		"sender":     "j***@example.com",
+		"recipients": []string{"a***@example.com", "b***@example.com"},
+		"size":       int64(3),
+	}
+	if fields := entries[0].ContextMap(); !reflect.DeepEqual(expected, fields) {
+		t.Errorf("expected fields %v but got %v", expected, fields)
+	}
+}
+
+func TestNewCore_defaultPolicy(t *testing.T) {
+	policy, err := ParsePolicy(DefaultPolicy)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	observed, logs := observer.New(zapcore.DebugLevel)
+	logger := zap.New(NewCore(observed, policy))
+
+	// fields which are not personal data keep their values,
+	// even when their names are similar to redacted ones
+	logger.Info("listening",
+		zap.String("address", "127.0.0.1:8080"),
+		zap.String("email_address", "john@example.com"),
+	)
+
+	expected := map[string]interface{}{
+		"address":       "127.0.0.1:8080",
+		"email_address": "j***@example.com",
+	}
+	if fields := logs.All()[0].ContextMap(); !reflect.DeepEqual(expected, fields) {
+		t.Errorf("expected fields %v but got %v", expected, fields)
+	}
+}
@@ -0,0 +1,67 @@
+// Package requestid passes an ID of a request through a context,
+// it is used to correlate responses with logs and provider messages.
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Header is an HTTP header holding a request ID
+const Header = "X-Request-ID"
+
+var validID = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,128}$`)
+
+type contextKey struct{}
+
+// New generates a random request ID
+func New() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Valid checks if an ID received from a client can be used,
+// it has to be short and cannot contain characters
+// rejected by providers in tags and custom arguments
+func Valid(id string) bool {
+	return validID.MatchString(id)
+}
+
+// FromRequest returns a request ID sent by a client in Header
+// when it is valid, otherwise it generates a new one
+func FromRequest(r *http.Request) string {
+	id := r.Header.Get(Header)
+	if !Valid(id) {
+		id = New()
+	}
+	return id
+}
+
+// NewContext returns a context holding a request ID
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns a request ID held by a context or an empty string
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
+
+// Field returns a logger field with a request ID held by a context
+func Field(ctx context.Context) zapcore.Field {
+	id := FromContext(ctx)
+	if id == "" {
+		return zap.Skip()
+	}
+	return zap.String("request_id", id)
+}
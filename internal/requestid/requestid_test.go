@@ -0,0 +1,41 @@
+package requestid
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFromRequest(t *testing.T) {
+	cases := map[string]struct {
+		header string
+		kept   bool
+	}{
+		"valid": {
+			header: "abc-123_DEF",
+			kept:   true,
+		},
+		"missing": {
+			header: "",
+		},
+		"invalid": {
+			header: "abc 123",
+		},
+	}
+
+	for hint, c := range cases {
+		t.Run(hint, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			if c.header != "" {
+				req.Header.Set(Header, c.header)
+			}
+
+			id := FromRequest(req)
+			if c.kept && id != c.header {
+				t.Errorf("expected %q but got %q", c.header, id)
+			}
+			if !c.kept && (id == c.header || !Valid(id)) {
+				t.Errorf("expected a new ID but got %q", id)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package scheduler
+
+import (
+	"fmt"
+	"time"
+)
+
+// QuietHours is a daily period of a recipient's local time
+// when messages are not sent, e.g. from 22:00 to 08:00
+type QuietHours struct {
+	// Start is a beginning of quiet hours in "15:04" format
+	Start string `json:"start"`
+
+	// End is an end of quiet hours in "15:04" format,
+	// it can be earlier than Start when quiet hours span midnight
+	End string `json:"end"`
+
+	// Timezone is an IANA name of a recipient's time zone,
+	// e.g. "Europe/Warsaw", UTC when empty
+	Timezone string `json:"timezone,omitempty"`
+}
+
+// parseClock returns minutes since midnight of a "15:04" time
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", s)
+	}
+
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Validate checks if quiet hours can be used
+func (q *QuietHours) Validate() error {
+	start, err := parseClock(q.Start)
+	if err != nil {
+		return err
+	}
+	end, err := parseClock(q.End)
+	if err != nil {
+		return err
+	}
+	if start == end {
+		return fmt.Errorf("quiet hours cannot start and end at the same time")
+	}
+	if _, err := time.LoadLocation(q.Timezone); err != nil {
+		return fmt.Errorf("unknown timezone %q", q.Timezone)
+	}
+
+	return nil
+}
+
+// Next returns the first time not earlier than t outside of quiet hours,
+// it returns t when it is already outside of them
+func (q *QuietHours) Next(t time.Time) (time.Time, error) {
+	if err := q.Validate(); err != nil {
+		return t, err
+	}
+	start, _ := parseClock(q.Start)
+	end, _ := parseClock(q.End)
+	location, _ := time.LoadLocation(q.Timezone)
+
+	local := t.In(location)
+	minute := local.Hour()*60 + local.Minute()
+
+	var quiet bool
+	if start < end {
+		quiet = minute >= start && minute < end
+	} else {
+		quiet = minute >= start || minute < end
+	}
+	if !quiet {
+		return t, nil
+	}
+
+	year, month, day := local.Date()
+	if minute >= end {
+		// quiet hours end tomorrow
+		day++
+	}
+
+	return time.Date(year, month, day, end/60, end%60, 0, 0, location), nil
+}
+
+// String describes quiet hours, e.g. "22:00-08:00 Europe/Warsaw"
+func (q *QuietHours) String() string {
+	timezone := q.Timezone
+	if timezone == "" {
+		timezone = "UTC"
+	}
+
+	return q.Start + "-" + q.End + " " + timezone
+}
@@ -0,0 +1,97 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQuietHours_Next(t *testing.T) {
+	warsaw, err := time.LoadLocation("Europe/Warsaw")
+	if err != nil {
+		t.Skipf("no time zone data: %s", err.Error())
+	}
+
+	overnight := &QuietHours{Start: "22:00", End: "08:00", Timezone: "Europe/Warsaw"}
+	afternoon := &QuietHours{Start: "13:00", End: "15:30"}
+
+	cases := map[string]struct {
+		quietHours *QuietHours
+		t          time.Time
+		expected   time.Time
+	}{
+		"before-quiet-hours": {
+			quietHours: overnight,
+			t:          time.Date(2018, 5, 10, 21, 59, 0, 0, warsaw),
+			expected:   time.Date(2018, 5, 10, 21, 59, 0, 0, warsaw),
+		},
+		"evening": {
+			quietHours: overnight,
+			t:          time.Date(2018, 5, 10, 22, 0, 0, 0, warsaw),
+			expected:   time.Date(2018, 5, 11, 8, 0, 0, 0, warsaw),
+		},
+		"night": {
+			quietHours: overnight,
+			t:          time.Date(2018, 5, 11, 3, 0, 0, 0, warsaw),
+			expected:   time.Date(2018, 5, 11, 8, 0, 0, 0, warsaw),
+		},
+		"night-in-utc": {
+			quietHours: overnight,
+			t:          time.Date(2018, 5, 11, 1, 0, 0, 0, time.UTC),
+			expected:   time.Date(2018, 5, 11, 6, 0, 0, 0, time.UTC),
+		},
+		"end-of-quiet-hours": {
+			quietHours: overnight,
+			t:          time.Date(2018, 5, 11, 8, 0, 0, 0, warsaw),
+			expected:   time.Date(2018, 5, 11, 8, 0, 0, 0, warsaw),
+		},
+		"end-of-month": {
+			quietHours: overnight,
+			t:          time.Date(2018, 5, 31, 23, 0, 0, 0, warsaw),
+			expected:   time.Date(2018, 6, 1, 8, 0, 0, 0, warsaw),
+		},
+		"daylight-saving-time-change": {
+			quietHours: overnight,
+			t:          time.Date(2018, 3, 24, 23, 0, 0, 0, warsaw),
+			expected:   time.Date(2018, 3, 25, 8, 0, 0, 0, warsaw),
+		},
+		"same-day": {
+			quietHours: afternoon,
+			t:          time.Date(2018, 5, 10, 14, 0, 0, 0, time.UTC),
+			expected:   time.Date(2018, 5, 10, 15, 30, 0, 0, time.UTC),
+		},
+		"after-same-day": {
+			quietHours: afternoon,
+			t:          time.Date(2018, 5, 10, 16, 0, 0, 0, time.UTC),
+			expected:   time.Date(2018, 5, 10, 16, 0, 0, 0, time.UTC),
+		},
+	}
+
+	for hint, c := range cases {
+		t.Run(hint, func(t *testing.T) {
+			next, err := c.quietHours.Next(c.t)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if !next.Equal(c.expected) {
+				t.Errorf("expected %s, got %s", c.expected, next)
+			}
+		})
+	}
+}
+
+func TestQuietHours_Validate(t *testing.T) {
+	cases := map[string]*QuietHours{
+		"invalid-start":    {Start: "25:00", End: "08:00"},
+		"invalid-end":      {Start: "22:00", End: "8"},
+		"empty":            {Start: "22:00", End: "22:00"},
+		"unknown-timezone": {Start: "22:00", End: "08:00", Timezone: "Mars/Olympus_Mons"},
+	}
+
+	for hint, q := range cases {
+		t.Run(hint, func(t *testing.T) {
+			if err := q.Validate(); err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+}
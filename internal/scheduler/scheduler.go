@@ -0,0 +1,318 @@
+// Package scheduler keeps messages which should be sent later
+// and releases them when they are due.
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/mikolajb/emailserv/internal/emailclient"
+	"github.com/mikolajb/emailserv/internal/storage"
+	"go.uber.org/zap"
+)
+
+const bucket = "scheduled"
+
+var (
+	// errNotCanceled stops an update of a job which cannot be canceled
+	errNotCanceled = errors.New("job cannot be canceled")
+
+	// errNotDue stops an update of a job which was claimed or canceled
+	errNotDue = errors.New("job is not due")
+)
+
+// Job states
+const (
+	// StatePending is a job waiting for its time
+	StatePending = "pending"
+
+	// StateDispatching is a job being sent, it cannot be canceled
+	StateDispatching = "dispatching"
+
+	// StateCanceled is a job being removed
+	StateCanceled = "canceled"
+)
+
+// Email holds a content of a scheduled message
+type Email struct {
+	Sender        string   `json:"sender"`
+	Recipients    []string `json:"recipients"`
+	CCRecipients  []string `json:"cc_recipients,omitempty"`
+	BCCRecipients []string `json:"bcc_recipients,omitempty"`
+	Subject       string   `json:"subject"`
+	Body          string   `json:"body"`
+
+	Sendgrid *emailclient.SendgridOptions `json:"sendgrid,omitempty"`
+}
+
+// RecipientCount returns a number of all recipients of a message
+func (e *Email) RecipientCount() int {
+	return len(e.Recipients) + len(e.CCRecipients) + len(e.BCCRecipients)
+}
+
+// Job is a message scheduled to be sent
+type Job struct {
+	// ID is an ID of a message
+	ID string `json:"id"`
+
+	// Key is a name of an API key which scheduled a message
+	Key string `json:"key"`
+
+	RequestID string `json:"request_id,omitempty"`
+
+	Email Email `json:"email"`
+
+	// SendAt is a time a message should be delivered at
+	SendAt time.Time `json:"send_at"`
+
+	// QuietHours defer a message when it is due during them, optional
+	QuietHours *QuietHours `json:"quiet_hours,omitempty"`
+
+	State string `json:"state"`
+
+	// Early is true when a job was released before SendAt,
+	// so a provider could schedule it, but it failed
+	Early bool `json:"early,omitempty"`
+
+	// DispatchedAt is a time a job was released
+	DispatchedAt time.Time `json:"dispatched_at,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// SendFunc sends a released job, early is true when a job is released
+// before its time, such a job should be scheduled by a provider
+// An error of an early job keeps it until its time,
+// any other job is removed after SendFunc returns.
+type SendFunc func(ctx context.Context, job *Job, early bool) error
+
+// Scheduler holds scheduled jobs in a store
+type Scheduler struct {
+	logger *zap.Logger
+	store  storage.Store
+	send   SendFunc
+	now    func() time.Time
+
+	// Lead is how long before its time a job is released,
+	// so a provider can schedule it, 0 disables it
+	Lead time.Duration
+
+	// Stale is how long a job can be dispatched,
+	// after that it is released again, e.g. after a crash
+	Stale time.Duration
+
+	// Deferred is called when a due job is moved out of quiet hours,
+	// job.SendAt is a new time, it is optional
+	Deferred func(job *Job, reason string)
+}
+
+// New returns a scheduler keeping jobs in a given store
+func New(logger *zap.Logger, store storage.Store, send SendFunc) *Scheduler {
+	return &Scheduler{
+		logger: logger,
+		store:  store,
+		send:   send,
+		now:    time.Now,
+		Stale:  10 * time.Minute,
+	}
+}
+
+// Schedule stores a new job
+func (s *Scheduler) Schedule(job *Job) error {
+	job.State = StatePending
+	job.CreatedAt = s.now().UTC()
+
+	return s.store.Put(bucket, job.ID, job)
+}
+
+// Get returns a job or nil when it does not exist
+func (s *Scheduler) Get(id string) (*Job, error) {
+	var job Job
+	err := s.store.Get(bucket, id, &job)
+	if err == storage.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &job, nil
+}
+
+// Cancel removes a pending job of a given API key, it returns
+// a removed job or nil when a job was not found or is being dispatched
+func (s *Scheduler) Cancel(key, id string) (*Job, error) {
+	var job Job
+	err := s.store.Update(bucket, id, &job, func(found bool) error {
+		if !found || job.Key != key || job.State != StatePending {
+			return errNotCanceled
+		}
+		// a canceled job is never claimed, even before it is deleted
+		job.State = StateCanceled
+		return nil
+	})
+	if err == errNotCanceled {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &job, s.store.Delete(bucket, id)
+}
+
+// Run releases due jobs every interval until a context is done
+func (s *Scheduler) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := s.DispatchDue(ctx); err != nil {
+			s.logger.Error("cannot dispatch scheduled messages", zap.Error(err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// due returns true when a job should be released, early is true
+// when it is released before its time
+func (s *Scheduler) due(job *Job, now time.Time) (due bool, early bool) {
+	if job.State == StateCanceled {
+		return false, false
+	}
+	if job.State == StateDispatching && now.Sub(job.DispatchedAt) < s.Stale {
+		return false, false
+	}
+	if !job.SendAt.After(now) {
+		return true, false
+	}
+	if s.Lead > 0 && !job.Early && job.SendAt.Sub(now) <= s.Lead {
+		return true, true
+	}
+
+	return false, false
+}
+
+// DispatchDue releases all due jobs, it returns a number of released jobs
+func (s *Scheduler) DispatchDue(ctx context.Context) (int, error) {
+	now := s.now()
+	var ids []string
+	err := s.store.List(bucket, func(id string, decode func(v interface{}) error) error {
+		var job Job
+		if err := decode(&job); err != nil {
+			return err
+		}
+		if due, _ := s.due(&job, now); due {
+			ids = append(ids, id)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	dispatched := 0
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			break
+		}
+		job, early, err := s.claim(id, now)
+		if err != nil {
+			return dispatched, err
+		}
+		if job == nil {
+			continue
+		}
+		dispatched++
+		if err := s.dispatch(ctx, job, early); err != nil {
+			return dispatched, err
+		}
+	}
+
+	return dispatched, nil
+}
+
+// claim marks a job as dispatched, so it cannot be canceled,
+// it returns nil when a job was canceled or claimed in the meantime
+// or when it is deferred because of quiet hours
+func (s *Scheduler) claim(id string, now time.Time) (*Job, bool, error) {
+	var job Job
+	var early, deferred bool
+	err := s.store.Update(bucket, id, &job, func(found bool) error {
+		var due bool
+		if found {
+			due, early = s.due(&job, now)
+		}
+		if !due {
+			return errNotDue
+		}
+		if job.QuietHours != nil {
+			// an early job is delivered by a provider at its time
+			target := now
+			if early {
+				target = job.SendAt
+			}
+			next, err := job.QuietHours.Next(target)
+			if err == nil && next.After(target) {
+				job.SendAt = next.UTC()
+				job.State = StatePending
+				job.Early = false
+				deferred = true
+				return nil
+			}
+		}
+		job.State = StateDispatching
+		job.DispatchedAt = now.UTC()
+		return nil
+	})
+	if err == errNotDue {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if deferred {
+		reason := "quiet hours " + job.QuietHours.String()
+		s.logger.Debug(
+			"message deferred",
+			zap.String("message_id", job.ID),
+			zap.String("reason", reason),
+			zap.Time("send_at", job.SendAt),
+		)
+		if s.Deferred != nil {
+			s.Deferred(&job, reason)
+		}
+		return nil, false, nil
+	}
+
+	return &job, early, nil
+}
+
+// dispatch sends a claimed job and updates a store
+func (s *Scheduler) dispatch(ctx context.Context, job *Job, early bool) error {
+	logger := s.logger.With(
+		zap.String("message_id", job.ID),
+		zap.Time("send_at", job.SendAt),
+		zap.Bool("early", early),
+	)
+
+	err := s.send(ctx, job, early)
+	if err != nil && early {
+		logger.Debug("message not scheduled by a provider, it is kept until its time", zap.Error(err))
+		job.State = StatePending
+		job.Early = true
+		return s.store.Put(bucket, job.ID, job)
+	}
+	if err != nil {
+		logger.Error("cannot send scheduled message", zap.Error(err))
+	} else {
+		logger.Debug("scheduled message released")
+	}
+
+	return s.store.Delete(bucket, job.ID)
+}
@@ -0,0 +1,195 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mikolajb/emailserv/internal/storage"
+	"go.uber.org/zap/zaptest"
+)
+
+type sent struct {
+	id    string
+	early bool
+}
+
+type clock struct {
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	return c.now
+}
+
+func newTestScheduler(t *testing.T, errs map[bool]error) (*Scheduler, *clock, *[]sent) {
+	var calls []sent
+	c := &clock{now: time.Date(2018, 5, 10, 12, 0, 0, 0, time.UTC)}
+	s := New(zaptest.NewLogger(t), storage.NewMemoryStore(), func(ctx context.Context, job *Job, early bool) error {
+		calls = append(calls, sent{id: job.ID, early: early})
+		return errs[early]
+	})
+	s.now = c.Now
+	s.Lead = 10 * time.Minute
+
+	return s, c, &calls
+}
+
+func TestScheduler(t *testing.T) {
+	cases := map[string]struct {
+		errs     map[bool]error
+		expected []sent
+	}{
+		"scheduled-by-provider": {
+			expected: []sent{{id: "message-1", early: true}},
+		},
+		"not-scheduled-by-provider": {
+			errs:     map[bool]error{true: errors.New("no client can schedule a message")},
+			expected: []sent{{id: "message-1", early: true}, {id: "message-1", early: false}},
+		},
+		"failed": {
+			errs: map[bool]error{
+				true:  errors.New("no client can schedule a message"),
+				false: errors.New("sending failed"),
+			},
+			expected: []sent{{id: "message-1", early: true}, {id: "message-1", early: false}},
+		},
+	}
+
+	for hint, c := range cases {
+		t.Run(hint, func(t *testing.T) {
+			s, clk, calls := newTestScheduler(t, c.errs)
+			err := s.Schedule(&Job{
+				ID:     "message-1",
+				Key:    "billing",
+				SendAt: clk.now.Add(time.Hour),
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+
+			for _, step := range []time.Duration{0, 49 * time.Minute, time.Minute, 5 * time.Minute, 5 * time.Minute, time.Hour} {
+				clk.now = clk.now.Add(step)
+				if _, err := s.DispatchDue(context.Background()); err != nil {
+					t.Fatalf("unexpected error: %s", err.Error())
+				}
+			}
+
+			if len(*calls) != len(c.expected) {
+				t.Fatalf("expected calls %+v, got %+v", c.expected, *calls)
+			}
+			for i := range c.expected {
+				if (*calls)[i] != c.expected[i] {
+					t.Errorf("expected calls %+v, got %+v", c.expected, *calls)
+				}
+			}
+			if job, _ := s.Get("message-1"); job != nil {
+				t.Errorf("a job should be removed: %+v", job)
+			}
+		})
+	}
+}
+
+func TestScheduler_Cancel(t *testing.T) {
+	s, clk, calls := newTestScheduler(t, nil)
+	s.Lead = 0
+	for _, id := range []string{"message-1", "message-2"} {
+		if err := s.Schedule(&Job{ID: id, Key: "billing", SendAt: clk.now.Add(time.Hour)}); err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+	}
+
+	cases := []struct {
+		key      string
+		id       string
+		canceled bool
+	}{
+		{key: "marketing", id: "message-1"},
+		{key: "billing", id: "message-3"},
+		{key: "billing", id: "message-1", canceled: true},
+		{key: "billing", id: "message-1"},
+	}
+	for _, c := range cases {
+		job, err := s.Cancel(c.key, c.id)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		if canceled := job != nil; canceled != c.canceled {
+			t.Errorf("wrong cancellation of %s by %s, expected: %t, got: %t", c.id, c.key, c.canceled, canceled)
+		}
+		if job != nil && job.ID != c.id {
+			t.Errorf("expected a canceled job %s, got: %+v", c.id, job)
+		}
+	}
+
+	clk.now = clk.now.Add(time.Hour)
+	n, err := s.DispatchDue(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if n != 1 || len(*calls) != 1 || (*calls)[0].id != "message-2" {
+		t.Errorf("only message-2 should be sent, got: %+v", *calls)
+	}
+}
+
+func TestScheduler_stale(t *testing.T) {
+	s, clk, calls := newTestScheduler(t, nil)
+	err := s.store.Put(bucket, "message-1", &Job{
+		ID:           "message-1",
+		SendAt:       clk.now.Add(-time.Hour),
+		State:        StateDispatching,
+		DispatchedAt: clk.now.Add(-time.Minute),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if job, _ := s.Cancel("", "message-1"); job != nil {
+		t.Errorf("a dispatched job cannot be canceled")
+	}
+
+	if n, _ := s.DispatchDue(context.Background()); n != 0 {
+		t.Errorf("a job being dispatched should not be released again")
+	}
+	clk.now = clk.now.Add(s.Stale)
+	if n, _ := s.DispatchDue(context.Background()); n != 1 || len(*calls) != 1 {
+		t.Errorf("a stale job should be released again, got: %+v", *calls)
+	}
+}
+
+func TestScheduler_quietHours(t *testing.T) {
+	s, clk, calls := newTestScheduler(t, nil)
+	var reasons []string
+	s.Deferred = func(job *Job, reason string) {
+		reasons = append(reasons, reason)
+	}
+
+	// a scheduler was not running, so a message is due at night
+	clk.now = time.Date(2018, 5, 10, 23, 0, 0, 0, time.UTC)
+	err := s.Schedule(&Job{
+		ID:         "message-1",
+		SendAt:     clk.now.Add(-2 * time.Hour),
+		QuietHours: &QuietHours{Start: "22:00", End: "08:00"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	if n, _ := s.DispatchDue(context.Background()); n != 0 || len(*calls) != 0 {
+		t.Errorf("a message should not be sent during quiet hours, got: %+v", *calls)
+	}
+	job, _ := s.Get("message-1")
+	expected := time.Date(2018, 5, 11, 8, 0, 0, 0, time.UTC)
+	if job == nil || !job.SendAt.Equal(expected) || job.State != StatePending {
+		t.Errorf("a message should be deferred until %s, got: %+v", expected, job)
+	}
+	if len(reasons) != 1 || reasons[0] != "quiet hours 22:00-08:00 UTC" {
+		t.Errorf("wrong reasons: %v", reasons)
+	}
+
+	// a provider can deliver it when quiet hours end
+	clk.now = expected.Add(-5 * time.Minute)
+	if n, _ := s.DispatchDue(context.Background()); n != 1 || len(*calls) != 1 || !(*calls)[0].early {
+		t.Errorf("a message should be scheduled by a provider after quiet hours, got: %+v", *calls)
+	}
+}
@@ -0,0 +1,289 @@
+// Package sns verifies and handles Amazon SNS HTTP notifications.
+package sns
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Message types
+const (
+	TypeNotification             = "Notification"
+	TypeSubscriptionConfirmation = "SubscriptionConfirmation"
+	TypeUnsubscribeConfirmation  = "UnsubscribeConfirmation"
+)
+
+// snsHost matches hosts SNS certificates and subscription URLs are served from
+var snsHost = regexp.MustCompile(`^sns\.[a-z0-9-]+\.amazonaws\.com(\.cn)?$`)
+
+// Message is an SNS HTTP message
+type Message struct {
+	Type             string `json:"Type"`
+	MessageID        string `json:"MessageId"`
+	Token            string `json:"Token,omitempty"`
+	TopicArn         string `json:"TopicArn"`
+	Subject          string `json:"Subject,omitempty"`
+	Message          string `json:"Message"`
+	Timestamp        string `json:"Timestamp"`
+	SignatureVersion string `json:"SignatureVersion"`
+	Signature        string `json:"Signature"`
+	SigningCertURL   string `json:"SigningCertURL"`
+	SubscribeURL     string `json:"SubscribeURL,omitempty"`
+	UnsubscribeURL   string `json:"UnsubscribeURL,omitempty"`
+}
+
+// Parse decodes an SNS message
+func Parse(data []byte) (*Message, error) {
+	var m Message
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("invalid SNS message: %s", err.Error())
+	}
+
+	return &m, nil
+}
+
+// StringToSign builds a text which is signed by SNS
+func (m *Message) StringToSign() (string, error) {
+	var fields [][2]string
+	switch m.Type {
+	case TypeNotification:
+		fields = [][2]string{
+			{"Message", m.Message},
+			{"MessageId", m.MessageID},
+			{"Subject", m.Subject},
+			{"Timestamp", m.Timestamp},
+			{"TopicArn", m.TopicArn},
+			{"Type", m.Type},
+		}
+	case TypeSubscriptionConfirmation, TypeUnsubscribeConfirmation:
+		fields = [][2]string{
+			{"Message", m.Message},
+			{"MessageId", m.MessageID},
+			{"SubscribeURL", m.SubscribeURL},
+			{"Timestamp", m.Timestamp},
+			{"Token", m.Token},
+			{"TopicArn", m.TopicArn},
+			{"Type", m.Type},
+		}
+	default:
+		return "", fmt.Errorf("unknown SNS message type: %s", m.Type)
+	}
+
+	var b strings.Builder
+	for _, f := range fields {
+		// subject is the only optional field
+		if f[0] == "Subject" && f[1] == "" {
+			continue
+		}
+		b.WriteString(f[0])
+		b.WriteString("\n")
+		b.WriteString(f[1])
+		b.WriteString("\n")
+	}
+
+	return b.String(), nil
+}
+
+// CertificateSource provides certificates used to sign SNS messages
+type CertificateSource interface {
+	Certificate(ctx context.Context, certURL string) (*x509.Certificate, error)
+}
+
+// StaticCertificateSource returns the same certificate for every URL
+// It is useful when certificates are pinned and for tests
+type StaticCertificateSource struct {
+	cert *x509.Certificate
+}
+
+// NewStaticCertificateSource parses a PEM encoded certificate
+func NewStaticCertificateSource(pemData []byte) (*StaticCertificateSource, error) {
+	cert, err := parseCertificate(pemData)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StaticCertificateSource{
+		cert: cert,
+	}, nil
+}
+
+// Certificate returns a configured certificate
+func (s *StaticCertificateSource) Certificate(ctx context.Context, certURL string) (*x509.Certificate, error) {
+	return s.cert, nil
+}
+
+// HTTPCertificateSource downloads certificates from SNS,
+// only HTTPS URLs on SNS hosts are accepted
+// Certificates are cached.
+type HTTPCertificateSource struct {
+	client *http.Client
+	mu     sync.Mutex
+	cache  map[string]*x509.Certificate
+}
+
+// NewHTTPCertificateSource returns a new HTTPCertificateSource
+func NewHTTPCertificateSource(client *http.Client) *HTTPCertificateSource {
+	return &HTTPCertificateSource{
+		client: client,
+		cache:  map[string]*x509.Certificate{},
+	}
+}
+
+// Certificate returns a certificate, it is downloaded when not cached
+func (s *HTTPCertificateSource) Certificate(ctx context.Context, certURL string) (*x509.Certificate, error) {
+	if err := ValidateURL(certURL); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	cert, ok := s.cache[certURL]
+	s.mu.Unlock()
+	if ok {
+		return cert, nil
+	}
+
+	req, err := http.NewRequest("GET", certURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("cannot download certificate: %s", err.Error())
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("cannot download certificate, status code: %d", res.StatusCode)
+	}
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("cannot download certificate: %s", err.Error())
+	}
+
+	cert, err = parseCertificate(data)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.cache[certURL] = cert
+	s.mu.Unlock()
+
+	return cert, nil
+}
+
+// ValidateURL checks if a URL points to SNS
+func ValidateURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid SNS URL: %s", err.Error())
+	}
+	if u.Scheme != "https" || !snsHost.MatchString(u.Host) {
+		return fmt.Errorf("URL does not point to SNS: %s", rawURL)
+	}
+
+	return nil
+}
+
+func parseCertificate(data []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM encoded certificate found")
+	}
+
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// Verifier verifies signatures of SNS messages
+type Verifier struct {
+	certificates CertificateSource
+}
+
+// NewVerifier returns a verifier using a given source of certificates
+func NewVerifier(certificates CertificateSource) *Verifier {
+	return &Verifier{
+		certificates: certificates,
+	}
+}
+
+// Verify checks a signature of a message
+func (v *Verifier) Verify(ctx context.Context, m *Message) error {
+	var hash crypto.Hash
+	switch m.SignatureVersion {
+	case "1":
+		hash = crypto.SHA1
+	case "2":
+		hash = crypto.SHA256
+	default:
+		return fmt.Errorf("unsupported signature version: %s", m.SignatureVersion)
+	}
+
+	stringToSign, err := m.StringToSign()
+	if err != nil {
+		return err
+	}
+	signature, err := base64.StdEncoding.DecodeString(m.Signature)
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding: %s", err.Error())
+	}
+
+	cert, err := v.certificates.Certificate(ctx, m.SigningCertURL)
+	if err != nil {
+		return err
+	}
+	publicKey, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return errors.New("certificate does not hold an RSA key")
+	}
+
+	var digest []byte
+	if hash == crypto.SHA1 {
+		sum := sha1.Sum([]byte(stringToSign))
+		digest = sum[:]
+	} else {
+		sum := sha256.Sum256([]byte(stringToSign))
+		digest = sum[:]
+	}
+
+	if err := rsa.VerifyPKCS1v15(publicKey, hash, digest, signature); err != nil {
+		return fmt.Errorf("invalid signature: %s", err.Error())
+	}
+
+	return nil
+}
+
+// ConfirmSubscription visits a subscribe URL of a SubscriptionConfirmation message
+func ConfirmSubscription(ctx context.Context, client *http.Client, m *Message) error {
+	if err := ValidateURL(m.SubscribeURL); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("GET", m.SubscribeURL, nil)
+	if err != nil {
+		return err
+	}
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("cannot confirm subscription: %s", err.Error())
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("cannot confirm subscription, status code: %d", res.StatusCode)
+	}
+
+	return nil
+}
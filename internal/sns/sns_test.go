@@ -0,0 +1,164 @@
+package sns
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+)
+
+// rewriteTransport sends all requests to a test server
+type rewriteTransport struct {
+	target *url.URL
+}
+
+func (rt rewriteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req.URL.Scheme = rt.target.Scheme
+	req.URL.Host = rt.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+
+	data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatalf("cannot read fixture: %s", err.Error())
+	}
+	return data
+}
+
+func TestVerifier_Verify(t *testing.T) {
+	source, err := NewStaticCertificateSource(readFixture(t, "cert.pem"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	verifier := NewVerifier(source)
+
+	cases := map[string]struct {
+		fixture string
+		modify  func(m *Message)
+		err     bool
+	}{
+		"notification-v1": {
+			fixture: "notification.json",
+		},
+		"subscription-v2": {
+			fixture: "subscription.json",
+		},
+		"modified-message": {
+			fixture: "notification.json",
+			modify: func(m *Message) {
+				m.Message = `{"notificationType": "Delivery"}`
+			},
+			err: true,
+		},
+		"modified-subscribe-url": {
+			fixture: "subscription.json",
+			modify: func(m *Message) {
+				m.SubscribeURL = "https://sns.eu-west-1.amazonaws.com/?Action=ConfirmSubscription&Token=other"
+			},
+			err: true,
+		},
+		"unknown-version": {
+			fixture: "notification.json",
+			modify: func(m *Message) {
+				m.SignatureVersion = "3"
+			},
+			err: true,
+		},
+		"unknown-type": {
+			fixture: "notification.json",
+			modify: func(m *Message) {
+				m.Type = "Other"
+			},
+			err: true,
+		},
+	}
+
+	for hint, c := range cases {
+		t.Run(hint, func(t *testing.T) {
+			m, err := Parse(readFixture(t, c.fixture))
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if c.modify != nil {
+				c.modify(m)
+			}
+
+			err = verifier.Verify(context.Background(), m)
+			if c.err && err == nil {
+				t.Errorf("expected an error")
+			}
+			if !c.err && err != nil {
+				t.Errorf("unexpected error: %s", err.Error())
+			}
+		})
+	}
+}
+
+func TestHTTPCertificateSource(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write(readFixture(t, "cert.pem"))
+	}))
+	defer server.Close()
+	target, _ := url.Parse(server.URL)
+
+	source := NewHTTPCertificateSource(&http.Client{Transport: rewriteTransport{target: target}})
+	verifier := NewVerifier(source)
+
+	m, err := Parse(readFixture(t, "notification.json"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	for i := 0; i < 2; i++ {
+		if err := verifier.Verify(context.Background(), m); err != nil {
+			t.Errorf("unexpected error: %s", err.Error())
+		}
+	}
+	if requests != 1 {
+		t.Errorf("expected a certificate to be downloaded once, got %d requests", requests)
+	}
+
+	for _, certURL := range []string{
+		"http://sns.eu-west-1.amazonaws.com/cert.pem",
+		"https://sns.eu-west-1.amazonaws.com.example.com/cert.pem",
+		"https://example.com/cert.pem",
+	} {
+		if _, err := source.Certificate(context.Background(), certURL); err == nil {
+			t.Errorf("expected an error for URL %s", certURL)
+		}
+	}
+}
+
+func TestConfirmSubscription(t *testing.T) {
+	var query url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+	}))
+	defer server.Close()
+	target, _ := url.Parse(server.URL)
+
+	m, err := Parse(readFixture(t, "subscription.json"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	client := &http.Client{Transport: rewriteTransport{target: target}}
+	if err := ConfirmSubscription(context.Background(), client, m); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if query.Get("Action") != "ConfirmSubscription" || query.Get("Token") == "" {
+		t.Errorf("unexpected confirmation request %v", query)
+	}
+
+	m.SubscribeURL = server.URL
+	if err := ConfirmSubscription(context.Background(), client, m); err == nil {
+		t.Errorf("expected an error for a URL outside of SNS")
+	}
+}
@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// BoltStore keeps documents in a bolt database file
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// NewBoltStore opens or creates a database file
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	return &BoltStore{
+		db: db,
+	}, nil
+}
+
+// Get decodes a document into v
+func (bs *BoltStore) Get(bucket, key string, v interface{}) error {
+	return bs.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return ErrNotFound
+		}
+		data := b.Get([]byte(key))
+		if data == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(data, v)
+	})
+}
+
+// Put encodes and stores a document
+func (bs *BoltStore) Put(bucket, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), data)
+	})
+}
+
+// Delete removes a document
+func (bs *BoltStore) Delete(bucket, key string) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return b.Delete([]byte(key))
+	})
+}
+
+// List calls fn for every document in a bucket, in key order
+func (bs *BoltStore) List(bucket string, fn func(key string, decode func(v interface{}) error) error) error {
+	return bs.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, data []byte) error {
+			return fn(string(k), func(v interface{}) error {
+				return json.Unmarshal(data, v)
+			})
+		})
+	})
+}
+
+// Update atomically modifies a document
+func (bs *BoltStore) Update(bucket, key string, v interface{}, fn func(found bool) error) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+
+		data := b.Get([]byte(key))
+		found := data != nil
+		if found {
+			if err := json.Unmarshal(data, v); err != nil {
+				return err
+			}
+		}
+
+		if err := fn(found); err != nil {
+			return err
+		}
+
+		data, err = json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), data)
+	})
+}
+
+// Close closes a database file
+func (bs *BoltStore) Close() error {
+	return bs.db.Close()
+}
@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+)
+
+// MemoryStore keeps documents in memory
+// It is useful for tests and development
+type MemoryStore struct {
+	mu      sync.Mutex
+	buckets map[string]map[string][]byte
+}
+
+// NewMemoryStore returns a new, empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets: map[string]map[string][]byte{},
+	}
+}
+
+// Get decodes a document into v
+func (ms *MemoryStore) Get(bucket, key string, v interface{}) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	data, ok := ms.buckets[bucket][key]
+	if !ok {
+		return ErrNotFound
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Put encodes and stores a document
+func (ms *MemoryStore) Put(bucket, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.put(bucket, key, data)
+	return nil
+}
+
+func (ms *MemoryStore) put(bucket, key string, data []byte) {
+	b, ok := ms.buckets[bucket]
+	if !ok {
+		b = map[string][]byte{}
+		ms.buckets[bucket] = b
+	}
+	b[key] = data
+}
+
+// Delete removes a document
+func (ms *MemoryStore) Delete(bucket, key string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	delete(ms.buckets[bucket], key)
+	return nil
+}
+
+// List calls fn for every document in a bucket, in key order
+func (ms *MemoryStore) List(bucket string, fn func(key string, decode func(v interface{}) error) error) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	b := ms.buckets[bucket]
+	keys := make([]string, 0, len(b))
+	for k := range b {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		data := b[k]
+		err := fn(k, func(v interface{}) error {
+			return json.Unmarshal(data, v)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Update atomically modifies a document
+func (ms *MemoryStore) Update(bucket, key string, v interface{}, fn func(found bool) error) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	data, found := ms.buckets[bucket][key]
+	if found {
+		if err := json.Unmarshal(data, v); err != nil {
+			return err
+		}
+	}
+
+	if err := fn(found); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	ms.put(bucket, key, data)
+
+	return nil
+}
+
+// Close does nothing
+func (ms *MemoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,33 @@
+// Package storage keeps service state as JSON documents grouped in buckets.
+package storage
+
+import "errors"
+
+// ErrNotFound is returned when a document does not exist
+var ErrNotFound = errors.New("document not found")
+
+// Store is a common interface of all stores
+//
+// Functions passed to List and Update run while a store is locked,
+// they must not call other methods of a store.
+type Store interface {
+	// Get decodes a document into v
+	Get(bucket, key string, v interface{}) error
+
+	// Put encodes and stores a document
+	Put(bucket, key string, v interface{}) error
+
+	// Delete removes a document, it is not an error if it does not exist
+	Delete(bucket, key string) error
+
+	// List calls fn for every document in a bucket, in key order
+	List(bucket string, fn func(key string, decode func(v interface{}) error) error) error
+
+	// Update atomically modifies a document,
+	// v is filled with a stored document before fn is called
+	// and stored after fn returns, unless fn returns an error
+	Update(bucket, key string, v interface{}, fn func(found bool) error) error
+
+	// Close releases resources held by a store
+	Close() error
+}
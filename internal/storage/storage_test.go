@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+type document struct {
+	Name  string
+	Count int
+}
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	boltStore, err := NewBoltStore(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	stores := map[string]Store{
+		"memory": NewMemoryStore(),
+		"bolt":   boltStore,
+	}
+
+	for hint, store := range stores {
+		t.Run(hint, func(t *testing.T) {
+			defer store.Close()
+
+			var d document
+			if err := store.Get("docs", "a", &d); err != ErrNotFound {
+				t.Errorf("expected ErrNotFound but got %v", err)
+			}
+
+			for _, key := range []string{"b", "a", "c"} {
+				if err := store.Put("docs", key, &document{Name: key}); err != nil {
+					t.Fatalf("unexpected error: %s", err.Error())
+				}
+			}
+
+			if err := store.Get("docs", "a", &d); err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if d.Name != "a" {
+				t.Errorf("expected document 'a' but got '%s'", d.Name)
+			}
+
+			if err := store.Delete("docs", "b"); err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if err := store.Delete("missing", "b"); err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+
+			var names []string
+			err := store.List("docs", func(key string, decode func(v interface{}) error) error {
+				var d document
+				if err := decode(&d); err != nil {
+					return err
+				}
+				names = append(names, d.Name)
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if !reflect.DeepEqual([]string{"a", "c"}, names) {
+				t.Errorf("expected documents [a c] but got %v", names)
+			}
+
+			for i := 0; i < 3; i++ {
+				var counter document
+				err := store.Update("counters", "x", &counter, func(found bool) error {
+					if found != (i > 0) {
+						t.Errorf("unexpected found value %t in iteration %d", found, i)
+					}
+					counter.Count++
+					return nil
+				})
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err.Error())
+				}
+			}
+
+			someError := errors.New("some error")
+			var counter document
+			err = store.Update("counters", "x", &counter, func(found bool) error {
+				counter.Count = 100
+				return someError
+			})
+			if err != someError {
+				t.Errorf("expected error '%v' but got '%v'", someError, err)
+			}
+
+			if err := store.Get("counters", "x", &counter); err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if counter.Count != 3 {
+				t.Errorf("expected count 3 but got %d", counter.Count)
+			}
+		})
+	}
+}
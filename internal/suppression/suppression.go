@@ -0,0 +1,122 @@
+// Package suppression keeps addresses which should not receive emails,
+// e.g. because they bounced or their owners complained.
+package suppression
+
+import (
+	"strings"
+	"time"
+
+	"github.com/mikolajb/emailserv/internal/storage"
+)
+
+const bucket = "suppressions"
+
+// Reasons of suppressing an address
+const (
+	ReasonBounce      = "bounce"
+	ReasonComplaint   = "complaint"
+	ReasonUnsubscribe = "unsubscribe"
+	ReasonManual      = "manual"
+)
+
+// Entry is a suppressed address
+type Entry struct {
+	// Address is a suppressed email address
+	Address string `json:"address"`
+
+	// Reason explains why an address is suppressed, e.g. "bounce"
+	Reason string `json:"reason"`
+
+	// Source is where a suppression comes from, e.g. "aws" or "admin"
+	Source string `json:"source"`
+
+	// CreatedAt is a time of adding an entry
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// List holds a state of a suppression list
+type List struct {
+	store storage.Store
+	now   func() time.Time
+}
+
+// NewList returns a suppression list kept in a given store
+func NewList(store storage.Store) *List {
+	return &List{
+		store: store,
+		now:   time.Now,
+	}
+}
+
+func normalize(address string) string {
+	return strings.ToLower(strings.TrimSpace(address))
+}
+
+// Add adds an address to a list, an existing entry is replaced
+func (l *List) Add(address, reason, source string) (*Entry, error) {
+	entry := &Entry{
+		Address:   normalize(address),
+		Reason:    reason,
+		Source:    source,
+		CreatedAt: l.now().UTC(),
+	}
+	if err := l.store.Put(bucket, entry.Address, entry); err != nil {
+		return nil, err
+	}
+
+	return entry, nil
+}
+
+// Remove removes an address from a list
+func (l *List) Remove(address string) error {
+	return l.store.Delete(bucket, normalize(address))
+}
+
+// Get returns an entry for an address or nil when it is not suppressed
+func (l *List) Get(address string) (*Entry, error) {
+	var entry Entry
+	err := l.store.Get(bucket, normalize(address), &entry)
+	if err == storage.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &entry, nil
+}
+
+// All returns all entries ordered by address
+func (l *List) All() ([]*Entry, error) {
+	entries := []*Entry{}
+	err := l.store.List(bucket, func(key string, decode func(v interface{}) error) error {
+		var entry Entry
+		if err := decode(&entry); err != nil {
+			return err
+		}
+		entries = append(entries, &entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// Filter splits addresses into allowed and suppressed ones
+func (l *List) Filter(addresses []string) (allowed, suppressed []string, err error) {
+	for _, a := range addresses {
+		entry, err := l.Get(a)
+		if err != nil {
+			return nil, nil, err
+		}
+		if entry != nil {
+			suppressed = append(suppressed, a)
+		} else {
+			allowed = append(allowed, a)
+		}
+	}
+
+	return allowed, suppressed, nil
+}
@@ -0,0 +1,49 @@
+package suppression
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mikolajb/emailserv/internal/storage"
+)
+
+func TestList(t *testing.T) {
+	list := NewList(storage.NewMemoryStore())
+
+	if _, err := list.Add("Bounced@Example.com ", ReasonBounce, "aws"); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if _, err := list.Add("complained@example.com", ReasonComplaint, "sendgrid"); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	entry, err := list.Get("bounced@example.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if entry == nil || entry.Reason != ReasonBounce || entry.Source != "aws" || entry.CreatedAt.IsZero() {
+		t.Errorf("unexpected entry %v", entry)
+	}
+
+	allowed, suppressed, err := list.Filter([]string{"ok@example.com", "BOUNCED@example.com", "complained@example.com"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if !reflect.DeepEqual([]string{"ok@example.com"}, allowed) {
+		t.Errorf("unexpected allowed addresses %v", allowed)
+	}
+	if !reflect.DeepEqual([]string{"BOUNCED@example.com", "complained@example.com"}, suppressed) {
+		t.Errorf("unexpected suppressed addresses %v", suppressed)
+	}
+
+	if err := list.Remove("Complained@example.com"); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	entries, err := list.All()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if len(entries) != 1 || entries[0].Address != "bounced@example.com" {
+		t.Errorf("unexpected entries %v", entries)
+	}
+}
@@ -0,0 +1,111 @@
+// Package tracing holds OpenTelemetry helpers shared by the handler, the email
+// manager and email clients.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	instrumentationName = "github.com/mikolajb/emailserv"
+
+	// ExporterNop drops all spans
+	ExporterNop = "nop"
+
+	// ExporterOTLP sends spans to an OTLP/HTTP collector
+	ExporterOTLP = "otlp"
+)
+
+// Propagator reads and writes W3C trace context and baggage
+var Propagator propagation.TextMapPropagator = propagation.NewCompositeTextMapPropagator(
+	propagation.TraceContext{},
+	propagation.Baggage{},
+)
+
+// Start starts a new span using the global tracer provider
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// RecordError marks a span as failed
+func RecordError(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// Extract returns a context holding a trace context read from HTTP headers
+func Extract(ctx context.Context, header http.Header) context.Context {
+	return Propagator.Extract(ctx, propagation.HeaderCarrier(header))
+}
+
+// Inject writes a trace context held by ctx into HTTP headers
+func Inject(ctx context.Context, header http.Header) {
+	Propagator.Inject(ctx, propagation.HeaderCarrier(header))
+}
+
+// NopExporter drops all spans
+type NopExporter struct{}
+
+// ExportSpans does nothing
+func (NopExporter) ExportSpans(context.Context, []sdktrace.ReadOnlySpan) error {
+	return nil
+}
+
+// Shutdown does nothing
+func (NopExporter) Shutdown(context.Context) error {
+	return nil
+}
+
+// NewInMemoryExporter returns an exporter keeping spans in memory
+// It is useful for tests
+func NewInMemoryExporter() *tracetest.InMemoryExporter {
+	return tracetest.NewInMemoryExporter()
+}
+
+// NewExporter creates an exporter of a given kind
+// endpoint is only used by the OTLP exporter, when empty
+// OTEL_EXPORTER_OTLP_ENDPOINT or a default is used
+func NewExporter(ctx context.Context, kind, endpoint string, insecure bool) (sdktrace.SpanExporter, error) {
+	switch kind {
+	case ExporterNop, "":
+		return NopExporter{}, nil
+	case ExporterOTLP:
+		var opts []otlptracehttp.Option
+		if endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(endpoint))
+		}
+		if insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		return otlptracehttp.New(ctx, opts...)
+	default:
+		return nil, fmt.Errorf("unknown trace exporter: %s", kind)
+	}
+}
+
+// Setup creates a tracer provider for a given exporter and installs it globally
+func Setup(exporter sdktrace.SpanExporter, serviceName, version string) *sdktrace.TracerProvider {
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", serviceName),
+			attribute.String("service.version", version),
+		)),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(Propagator)
+
+	return tp
+}
@@ -0,0 +1,57 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestInjectExtract(t *testing.T) {
+	traceparent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	in := http.Header{}
+	in.Set("traceparent", traceparent)
+
+	out := http.Header{}
+	Inject(Extract(context.Background(), in), out)
+
+	if out.Get("traceparent") != traceparent {
+		t.Errorf("expected traceparent '%s' but got '%s'", traceparent, out.Get("traceparent"))
+	}
+}
+
+func TestNewExporter(t *testing.T) {
+	cases := map[string]struct {
+		kind string
+		err  bool
+	}{
+		"default": {},
+		"nop": {
+			kind: ExporterNop,
+		},
+		"otlp": {
+			kind: ExporterOTLP,
+		},
+		"unknown": {
+			kind: "zipkin",
+			err:  true,
+		},
+	}
+
+	for hint, c := range cases {
+		t.Run(hint, func(t *testing.T) {
+			exporter, err := NewExporter(context.Background(), c.kind, "localhost:4318", true)
+			if c.err {
+				if err == nil {
+					t.Errorf("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if err := exporter.Shutdown(context.Background()); err != nil {
+				t.Errorf("unexpected error: %s", err.Error())
+			}
+		})
+	}
+}
@@ -0,0 +1,197 @@
+// Package usage records sent messages and aggregates them
+// into reports with costs of providers.
+package usage
+
+import (
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/mikolajb/emailserv/internal/storage"
+)
+
+const bucket = "usage"
+
+// Record is a single successfully sent message
+type Record struct {
+	Time      time.Time `json:"time"`
+	Key       string    `json:"key"`
+	Provider  string    `json:"provider"`
+	MessageID string    `json:"message_id"`
+
+	// Recipients is a number of all recipients, including cc and bcc
+	Recipients int `json:"recipients"`
+
+	// Size is a size of a message content in bytes
+	Size int `json:"size"`
+}
+
+// Price is a price list of a provider, e.g. SES charges
+// per recipient and per GB of data
+type Price struct {
+	PerMessage   float64 `json:"per_message,omitempty"`
+	PerRecipient float64 `json:"per_recipient,omitempty"`
+	PerGB        float64 `json:"per_gb,omitempty"`
+
+	// IncludedPerMonth is a number of recipients a plan includes in a month,
+	// e.g. emails of a SendGrid plan, they are only used by routing
+	IncludedPerMonth int64 `json:"included_per_month,omitempty"`
+}
+
+// Cost returns a cost of a given volume, size is in bytes
+func (p Price) Cost(messages, recipients, size int64) float64 {
+	return float64(messages)*p.PerMessage +
+		float64(recipients)*p.PerRecipient +
+		float64(size)/(1<<30)*p.PerGB
+}
+
+// Pricing maps provider names to their prices
+type Pricing map[string]Price
+
+// LoadPricing reads a JSON file with prices of providers, e.g.
+// {"aws": {"per_recipient": 0.0001, "per_gb": 0.12}, "sendgrid": {"per_message": 0.0006}}
+func LoadPricing(path string) (Pricing, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read pricing: %s", err.Error())
+	}
+
+	var pricing Pricing
+	if err := json.Unmarshal(data, &pricing); err != nil {
+		return nil, fmt.Errorf("invalid pricing file: %s", err.Error())
+	}
+
+	return pricing, nil
+}
+
+// Recorder keeps usage records in a store
+type Recorder struct {
+	store storage.Store
+	now   func() time.Time
+}
+
+// NewRecorder returns a recorder keeping records in a given store
+func NewRecorder(store storage.Store) *Recorder {
+	return &Recorder{
+		store: store,
+		now:   time.Now,
+	}
+}
+
+// Record stores a sent message, its time is set when it is zero
+func (r *Recorder) Record(record *Record) error {
+	if record.Time.IsZero() {
+		record.Time = r.now()
+	}
+	record.Time = record.Time.UTC()
+
+	// keys are ordered by time
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	key := fmt.Sprintf("%016x-%s", record.Time.UnixNano(), hex.EncodeToString(suffix))
+
+	return r.store.Put(bucket, key, record)
+}
+
+// Row is usage of a key and a provider in a day
+type Row struct {
+	// Day is a UTC day, e.g. "2018-05-10"
+	Day        string  `json:"day"`
+	Key        string  `json:"key"`
+	Provider   string  `json:"provider"`
+	Messages   int64   `json:"messages"`
+	Recipients int64   `json:"recipients"`
+	Size       int64   `json:"size"`
+	Cost       float64 `json:"cost"`
+}
+
+// Report aggregates records sent in [from, to) by day, key and provider,
+// costs are computed with pricing, providers without a price cost nothing
+func (r *Recorder) Report(from, to time.Time, pricing Pricing) ([]*Row, error) {
+	rows := map[[3]string]*Row{}
+	err := r.store.List(bucket, func(key string, decode func(v interface{}) error) error {
+		var record Record
+		if err := decode(&record); err != nil {
+			return err
+		}
+		if record.Time.Before(from) || !record.Time.Before(to) {
+			return nil
+		}
+
+		day := record.Time.UTC().Format("2006-01-02")
+		id := [3]string{day, record.Key, record.Provider}
+		row, ok := rows[id]
+		if !ok {
+			row = &Row{Day: day, Key: record.Key, Provider: record.Provider}
+			rows[id] = row
+		}
+		row.Messages++
+		row.Recipients += int64(record.Recipients)
+		row.Size += int64(record.Size)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*Row, 0, len(rows))
+	for _, row := range rows {
+		row.Cost = pricing[row.Provider].Cost(row.Messages, row.Recipients, row.Size)
+		result = append(result, row)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if a.Day != b.Day {
+			return a.Day < b.Day
+		}
+		if a.Key != b.Key {
+			return a.Key < b.Key
+		}
+		return a.Provider < b.Provider
+	})
+
+	return result, nil
+}
+
+// Formats of reports
+const (
+	FormatJSON = "json"
+	FormatCSV  = "csv"
+)
+
+// Write writes a report in a given format
+func Write(w io.Writer, format string, rows []*Row) error {
+	switch format {
+	case FormatJSON:
+		return json.NewEncoder(w).Encode(struct {
+			Rows []*Row `json:"rows"`
+		}{rows})
+	case FormatCSV:
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"day", "key", "provider", "messages", "recipients", "size", "cost"})
+		for _, row := range rows {
+			cw.Write([]string{
+				row.Day,
+				row.Key,
+				row.Provider,
+				strconv.FormatInt(row.Messages, 10),
+				strconv.FormatInt(row.Recipients, 10),
+				strconv.FormatInt(row.Size, 10),
+				strconv.FormatFloat(row.Cost, 'f', 6, 64),
+			})
+		}
+		cw.Flush()
+		return cw.Error()
+	default:
+		return fmt.Errorf("unknown format %q, expected json or csv", format)
+	}
+}
@@ -0,0 +1,101 @@
+package usage
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/mikolajb/emailserv/internal/storage"
+)
+
+func TestRecorder_Report(t *testing.T) {
+	r := NewRecorder(storage.NewMemoryStore())
+	day := time.Date(2018, 5, 10, 12, 0, 0, 0, time.UTC)
+	records := []*Record{
+		{Time: day, Key: "billing", Provider: "aws", Recipients: 2, Size: 1 << 29},
+		{Time: day.Add(time.Hour), Key: "billing", Provider: "aws", Recipients: 1, Size: 1 << 29},
+		{Time: day, Key: "billing", Provider: "sendgrid", Recipients: 3, Size: 100},
+		{Time: day, Key: "marketing", Provider: "aws", Recipients: 10, Size: 100},
+		{Time: day.Add(24 * time.Hour), Key: "billing", Provider: "aws", Recipients: 1, Size: 100},
+		// outside of a report
+		{Time: day.Add(-24 * time.Hour), Key: "billing", Provider: "aws", Recipients: 1, Size: 100},
+	}
+	for _, record := range records {
+		if err := r.Record(record); err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+	}
+
+	pricing := Pricing{
+		"aws":      {PerRecipient: 0.0001, PerGB: 0.12},
+		"sendgrid": {PerMessage: 0.001},
+	}
+	rows, err := r.Report(day.Truncate(24*time.Hour), day.Add(48*time.Hour), pricing)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	expected := []Row{
+		{Day: "2018-05-10", Key: "billing", Provider: "aws", Messages: 2, Recipients: 3, Size: 1 << 30, Cost: 0.1203},
+		{Day: "2018-05-10", Key: "billing", Provider: "sendgrid", Messages: 1, Recipients: 3, Size: 100, Cost: 0.001},
+		{Day: "2018-05-10", Key: "marketing", Provider: "aws", Messages: 1, Recipients: 10, Size: 100, Cost: 0.001 + 100.0/(1<<30)*0.12},
+		{Day: "2018-05-11", Key: "billing", Provider: "aws", Messages: 1, Recipients: 1, Size: 100, Cost: 0.0001 + 100.0/(1<<30)*0.12},
+	}
+	if len(rows) != len(expected) {
+		t.Fatalf("expected %d rows, got: %d", len(expected), len(rows))
+	}
+	for i := range expected {
+		got := *rows[i]
+		if math.Abs(got.Cost-expected[i].Cost) > 1e-9 {
+			t.Errorf("row %d: expected cost %f, got: %f", i, expected[i].Cost, got.Cost)
+		}
+		got.Cost, expected[i].Cost = 0, 0
+		if got != expected[i] {
+			t.Errorf("row %d: expected %+v, got: %+v", i, expected[i], got)
+		}
+	}
+}
+
+func TestWrite(t *testing.T) {
+	rows := []*Row{
+		{Day: "2018-05-10", Key: "billing", Provider: "aws", Messages: 2, Recipients: 3, Size: 100, Cost: 0.0003},
+	}
+	cases := map[string]struct {
+		format   string
+		expected string
+		err      bool
+	}{
+		"json": {
+			format:   FormatJSON,
+			expected: `{"rows":[{"day":"2018-05-10","key":"billing","provider":"aws","messages":2,"recipients":3,"size":100,"cost":0.0003}]}` + "\n",
+		},
+		"csv": {
+			format:   FormatCSV,
+			expected: "day,key,provider,messages,recipients,size,cost\n2018-05-10,billing,aws,2,3,100,0.000300\n",
+		},
+		"unknown": {
+			format: "xml",
+			err:    true,
+		},
+	}
+
+	for hint, c := range cases {
+		t.Run(hint, func(t *testing.T) {
+			var b bytes.Buffer
+			err := Write(&b, c.format, rows)
+			if c.err {
+				if err == nil {
+					t.Errorf("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if b.String() != c.expected {
+				t.Errorf("expected:\n%s\ngot:\n%s", c.expected, b.String())
+			}
+		})
+	}
+}